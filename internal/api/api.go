@@ -0,0 +1,271 @@
+// Package api holds the wire format shared by the upload server and its
+// client: header and form field names, response bodies and error codes.
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+const (
+	ChecksumFieldSHA256  = "checksum_sha256"
+	HeaderChecksumSHA256 = "X-Checksum-Sha256"
+	// HeaderUploadSize announces the size of the file payload, which the
+	// chunked multipart body does not reveal up front.
+	HeaderUploadSize = "X-Upload-Size"
+	// HeaderUploadTTL asks the server to delete the uploaded files after a
+	// Go duration such as "72h". The server may shorten it to its maximum.
+	HeaderUploadTTL = "X-Upload-Ttl"
+	// HeaderExpiresAt carries the RFC 3339 time a stored file expires at.
+	HeaderExpiresAt = "X-Upload-Expires-At"
+	// HeaderUploadExtract asks the server to extract the uploaded tar,
+	// tar.gz or zip archive under the prefix it carries instead of storing
+	// the archive itself.
+	HeaderUploadExtract = "X-Upload-Extract"
+)
+
+// Values of the status field of every JSON response.
+const (
+	StatusOK    = "ok"
+	StatusError = "error"
+)
+
+// Error codes carried in ErrorResponse.Code. Unlike the message they are
+// stable and meant to be matched by clients.
+const (
+	CodeBadRequest          = "bad_request"
+	CodeUnauthorized        = "unauthorized"
+	CodeForbidden           = "forbidden"
+	CodeNotFound            = "not_found"
+	CodeMethodNotAllowed    = "method_not_allowed"
+	CodeCancelled           = "cancelled"
+	CodeConflict            = "conflict"
+	CodeTooLarge            = "too_large"
+	CodePreflightFailed     = "preflight_failed"
+	CodeChecksumMismatch    = "checksum_mismatch"
+	CodeInvalidMetadata     = "invalid_metadata"
+	CodeTooManyUploads      = "too_many_uploads"
+	CodeShuttingDown        = "shutting_down"
+	CodeUnavailable         = "unavailable"
+	CodeInsufficientStorage = "insufficient_storage"
+	CodePreconditionFailed  = "precondition_failed"
+	// CodeUnsupportedMediaType answers a file whose content type the server
+	// does not accept or that does not match its declared type.
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	// CodeInvalidArchive answers an archive that is corrupt or has entries
+	// the server refuses to extract, such as paths leaving the prefix.
+	CodeInvalidArchive = "invalid_archive"
+	// CodeRejected and CodeQuarantined answer a file an upload hook of the
+	// server refused; a quarantined one is kept aside for inspection.
+	CodeRejected    = "rejected"
+	CodeQuarantined = "quarantined"
+	CodeInternal    = "internal"
+)
+
+// UploadResult is the body of a successful upload.
+type UploadResult struct {
+	Status   string `json:"status"`
+	Files    int    `json:"files"`
+	Size     string `json:"size"`
+	Duration string `json:"duration"`
+	Speed    string `json:"speed"`
+	SHA256   string `json:"sha256"`
+	// CompositeSHA256 is set for multipart uploads, see CompositeSHA256.
+	CompositeSHA256 string `json:"composite_sha256,omitempty"`
+	// Archive is set for extracted uploads; SHA256 is then the checksum of
+	// the archive.
+	Archive *ArchiveResult `json:"archive,omitempty"`
+}
+
+// MediaTypeUploadV2 is the Accept value that selects UploadResultV2 as the
+// body of a successful upload. Without it the server answers with
+// UploadResult.
+const MediaTypeUploadV2 = "application/vnd.upload.v2+json"
+
+// UploadResultV2 is the machine-readable body of a successful upload: sizes
+// are in bytes, the duration in nanoseconds and the speed in bytes per second.
+type UploadResultV2 struct {
+	Status         string         `json:"status"`
+	Version        int            `json:"version"`
+	Files          []UploadedFile `json:"files"`
+	Size           int64          `json:"size"`
+	DurationNS     int64          `json:"duration_ns"`
+	BytesPerSecond float64        `json:"bytes_per_second"`
+	SHA256         string         `json:"sha256"`
+	// CompositeSHA256 is set for multipart uploads, see CompositeSHA256.
+	CompositeSHA256 string `json:"composite_sha256,omitempty"`
+	// Archive is set for extracted uploads, whose entries are in Files.
+	Archive *ArchiveResult `json:"archive,omitempty"`
+}
+
+// Formats of ArchiveResult.
+const (
+	ArchiveTar     = "tar"
+	ArchiveTarGzip = "tar.gz"
+	ArchiveZip     = "zip"
+)
+
+// ArchiveResult describes an archive extracted with HeaderUploadExtract.
+type ArchiveResult struct {
+	Format string `json:"format"`
+	Prefix string `json:"prefix"`
+	// Size of the archive as uploaded.
+	Size int64 `json:"size"`
+	// Entries are the stored files, named by their path in the archive. In
+	// UploadResultV2 they are in Files instead.
+	Entries []UploadedFile `json:"entries,omitempty"`
+	// Skipped lists the entries that were not stored: links and hidden
+	// files.
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// UploadedFile is one file stored by an upload. Name is the file name sent by
+// the client and StorageID the name to use under /files.
+type UploadedFile struct {
+	Name      string `json:"name"`
+	StorageID string `json:"storage_id"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+	MD5       string `json:"md5,omitempty"`
+	// Metadata holds the key/value pairs sent with the file.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// ExpiresAt is set for files that expire, in RFC 3339.
+	ExpiresAt string `json:"expires_at,omitempty"`
+	// VersionID identifies the stored version, see HeaderVersionID.
+	VersionID string `json:"version_id,omitempty"`
+}
+
+// ErrorResponse is the body of every JSON error.
+type ErrorResponse struct {
+	Status           string `json:"status"`
+	Code             string `json:"code,omitempty"`
+	Error            string `json:"error"`
+	ExpectedChecksum string `json:"expected_checksum,omitempty"`
+	ActualChecksum   string `json:"actual_checksum,omitempty"`
+}
+
+// FileInfo describes a stored file.
+type FileInfo struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+	Modified string `json:"modified"`
+	// Metadata holds the key/value pairs attached to the upload.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// ExpiresAt is set for files that expire, in RFC 3339.
+	ExpiresAt string `json:"expires_at,omitempty"`
+	// VersionID identifies the version described, see HeaderVersionID.
+	VersionID string `json:"version_id,omitempty"`
+}
+
+// FileList is the body of GET /files.
+type FileList struct {
+	Status string     `json:"status"`
+	Files  []FileInfo `json:"files"`
+}
+
+// MultipartInit is the body of POST /uploads, which starts a multipart
+// upload of one file.
+type MultipartInit struct {
+	Name string `json:"name"`
+	// Size of the whole file, when known, for the size and free space checks.
+	Size int64 `json:"size,omitempty"`
+	// Metadata is stored with the assembled file, see ValidateMetadata.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// TTL of the assembled file, see HeaderUploadTTL.
+	TTL string `json:"ttl,omitempty"`
+}
+
+// MultipartSession is the answer to MultipartInit.
+type MultipartSession struct {
+	Status    string `json:"status"`
+	UploadID  string `json:"upload_id"`
+	Name      string `json:"name"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// PartResult is the answer to PUT /uploads/{id}/parts/{n}.
+type PartResult struct {
+	Status     string `json:"status"`
+	PartNumber int    `json:"part_number"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256"`
+}
+
+// CompletedPart names a part to include in the assembled file.
+type CompletedPart struct {
+	PartNumber int    `json:"part_number"`
+	SHA256     string `json:"sha256"`
+}
+
+// MultipartComplete is the body of POST /uploads/{id}/complete. Parts are
+// assembled in the order given, which must be ascending.
+type MultipartComplete struct {
+	Parts []CompletedPart `json:"parts"`
+	// SHA256 of the whole file.
+	SHA256          string `json:"sha256"`
+	CompositeSHA256 string `json:"composite_sha256"`
+}
+
+// Limits of multipart uploads.
+const (
+	MinPartNumber = 1
+	MaxPartNumber = 10000
+)
+
+// CompositeSHA256 is the S3-style checksum of a multipart upload: the SHA-256
+// of the concatenated binary part digests, followed by the part count.
+func CompositeSHA256(partSHA256 []string) (string, error) {
+	hasher := sha256.New()
+	for i, part := range partSHA256 {
+		digest, err := hex.DecodeString(part)
+		if err != nil || len(digest) != sha256.Size {
+			return "", fmt.Errorf("part %d: invalid sha256 %q", i+1, part)
+		}
+		hasher.Write(digest)
+	}
+
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(hasher.Sum(nil)), len(partSHA256)), nil
+}
+
+// CodeForStatus is the code used for an error answered with status when no
+// more specific one applies, e.g. for responses without a JSON body.
+func CodeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeCancelled
+	case http.StatusRequestEntityTooLarge:
+		return CodeTooLarge
+	case http.StatusExpectationFailed:
+		return CodePreflightFailed
+	case http.StatusUnprocessableEntity:
+		return CodeChecksumMismatch
+	case http.StatusTooManyRequests:
+		return CodeTooManyUploads
+	case http.StatusServiceUnavailable:
+		return CodeUnavailable
+	case http.StatusInsufficientStorage:
+		return CodeInsufficientStorage
+	case http.StatusPreconditionFailed:
+		return CodePreconditionFailed
+	case http.StatusUnsupportedMediaType:
+		return CodeUnsupportedMediaType
+	}
+	if status >= 500 {
+		return CodeInternal
+	}
+
+	return ""
+}
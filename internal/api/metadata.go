@@ -0,0 +1,72 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// MetadataFieldPrefix starts the name of a multipart field holding one
+	// metadata entry, e.g. "meta.build-id". The entry belongs to the file part
+	// before it.
+	MetadataFieldPrefix = "meta."
+	// HeaderMetadataPrefix starts the response headers that carry the
+	// metadata of a stored file, e.g. "X-Upload-Meta-Build-Id".
+	HeaderMetadataPrefix = "X-Upload-Meta-"
+	// LabelQueryParam filters GET /files by metadata: label=key=value matches
+	// files with that entry, label=key files with any value for key. Repeated
+	// parameters must all match.
+	LabelQueryParam = "label"
+)
+
+// Limits of the metadata of one file. MaxMetadataSize counts the bytes of
+// all keys and values.
+const (
+	MaxMetadataEntries   = 32
+	MaxMetadataKeyLength = 64
+	MaxMetadataSize      = 8 << 10
+)
+
+// ValidateMetadata checks metadata against the limits and the key and value
+// rules: keys are lowercase letters, digits and dashes, so that they survive
+// as header names; values are UTF-8 without control characters.
+func ValidateMetadata(metadata map[string]string) error {
+	if len(metadata) > MaxMetadataEntries {
+		return fmt.Errorf("metadata has %d entries, at most %d are allowed", len(metadata), MaxMetadataEntries)
+	}
+
+	size := 0
+	for key, value := range metadata {
+		if err := ValidateMetadataKey(key); err != nil {
+			return err
+		}
+		if !utf8.ValidString(value) || strings.IndexFunc(value, unicode.IsControl) >= 0 {
+			return fmt.Errorf("metadata value of %q must be UTF-8 without control characters", key)
+		}
+		size += len(key) + len(value)
+	}
+	if size > MaxMetadataSize {
+		return fmt.Errorf("metadata takes %d bytes, at most %d are allowed", size, MaxMetadataSize)
+	}
+
+	return nil
+}
+
+// ValidateMetadataKey checks a single metadata key, see ValidateMetadata.
+func ValidateMetadataKey(key string) error {
+	if key == "" || len(key) > MaxMetadataKeyLength {
+		return fmt.Errorf("metadata key %q must have 1 to %d characters", key, MaxMetadataKeyLength)
+	}
+	for _, c := range key {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return fmt.Errorf("metadata key %q may only contain lowercase letters, digits and dashes", key)
+		}
+	}
+	if strings.HasPrefix(key, "-") || strings.HasSuffix(key, "-") {
+		return fmt.Errorf("metadata key %q must not start or end with a dash", key)
+	}
+
+	return nil
+}
@@ -0,0 +1,38 @@
+package api
+
+// Query parameters of a pre-signed URL. The signature covers the method, the
+// path and every other parameter; a pre-signed URL carries no others.
+const (
+	// PresignExpiresParam is the unix time the URL stops working at.
+	PresignExpiresParam = "X-Upload-Expires"
+	// PresignNameParam is the name a pre-signed POST /upload stores its one
+	// file under. The file part must carry the base of it.
+	PresignNameParam = "X-Upload-Name"
+	// PresignMaxSizeParam caps the file size of a pre-signed upload in bytes.
+	PresignMaxSizeParam = "X-Upload-Max-Size"
+	// PresignSignatureParam is the hex HMAC-SHA256 of the grant.
+	PresignSignatureParam = "X-Upload-Signature"
+)
+
+// PresignRequest is the body of POST /admin/presign. Method POST grants one
+// upload of Name through POST /upload, method GET grants downloads of
+// /files/{Name} until the URL expires.
+type PresignRequest struct {
+	Method string `json:"method"`
+	Name   string `json:"name"`
+	// MaxSize caps the size of the uploaded file in bytes; zero leaves only
+	// the server limit. Only valid for uploads.
+	MaxSize int64 `json:"max_size,omitempty"`
+	// TTL is how long the URL works, as a Go duration such as "15m". The
+	// server may shorten it to its maximum.
+	TTL string `json:"ttl,omitempty"`
+}
+
+// PresignResult is the answer to PresignRequest. URL is relative to the
+// upload server, e.g. "/upload?X-Upload-Name=...".
+type PresignResult struct {
+	Status    string `json:"status"`
+	Method    string `json:"method"`
+	URL       string `json:"url"`
+	ExpiresAt string `json:"expires_at"`
+}
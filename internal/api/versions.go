@@ -0,0 +1,46 @@
+package api
+
+import "strings"
+
+const (
+	// HeaderVersionID carries the version of a stored file. The ETag of the
+	// file is the same id, quoted, so that If-Match can refer to it.
+	HeaderVersionID = "X-Upload-Version-Id"
+	// VersionQueryParam selects a version of a file in GET and HEAD
+	// /files/{name}?version={id}.
+	VersionQueryParam = "version"
+	// VersionsQueryParam makes GET /files/{name}?versions list the versions
+	// of the file instead of downloading it.
+	VersionsQueryParam = "versions"
+	// RestoreQueryParam names the version that POST
+	// /files/{name}?restore={id} makes current again.
+	RestoreQueryParam = "restore"
+)
+
+// FileVersionList is the body of GET /files/{name}?versions. The current
+// version comes first, followed by the versions it replaced, newest first.
+type FileVersionList struct {
+	Status   string     `json:"status"`
+	Name     string     `json:"name"`
+	Versions []FileInfo `json:"versions"`
+}
+
+// RestoreResult is the body of POST /files/{name}?restore={id}. File is the
+// new current version, a copy of the restored one.
+type RestoreResult struct {
+	Status string   `json:"status"`
+	File   FileInfo `json:"file"`
+}
+
+// ETag returns the entity tag of a file version.
+func ETag(versionID string) string {
+	return `"` + versionID + `"`
+}
+
+// ParseETag returns the version id an entity tag refers to. Weak tags are
+// accepted, as versions never change.
+func ParseETag(etag string) string {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+
+	return strings.Trim(etag, `"`)
+}
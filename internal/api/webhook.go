@@ -0,0 +1,43 @@
+package api
+
+// Headers of a webhook request. The signature is "sha256=" followed by the
+// hex HMAC-SHA256 of the timestamp, a dot and the body, keyed with the
+// webhook secret; receivers should also reject stale timestamps.
+const (
+	HeaderWebhookID        = "X-Upload-Webhook-Id"
+	HeaderWebhookEvent     = "X-Upload-Webhook-Event"
+	HeaderWebhookTimestamp = "X-Upload-Webhook-Timestamp"
+	HeaderWebhookSignature = "X-Upload-Webhook-Signature"
+)
+
+// Types of WebhookEvent.
+const (
+	EventUploadStarted   = "upload.started"
+	EventUploadCompleted = "upload.completed"
+	EventUploadFailed    = "upload.failed"
+	EventFileDeleted     = "file.deleted"
+	EventFileExpired     = "file.expired"
+)
+
+// WebhookEvent is the body of a webhook request. Deliveries are retried, so
+// receivers may see an event more than once and should deduplicate by ID.
+type WebhookEvent struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// Time the event happened at, in RFC 3339 with nanoseconds.
+	Time string `json:"time"`
+	// UploadID ties the events of one upload together: the in-flight upload
+	// id of POST /upload or the id of a multipart upload.
+	UploadID string `json:"upload_id,omitempty"`
+	Remote   string `json:"remote,omitempty"`
+	// Name is the file of multipart upload and file events.
+	Name string `json:"name,omitempty"`
+	// Files are the files stored by a completed upload.
+	Files  []UploadedFile `json:"files,omitempty"`
+	Size   int64          `json:"size,omitempty"`
+	SHA256 string         `json:"sha256,omitempty"`
+	// Code and Reason tell why an upload failed, as in ErrorResponse.
+	// Reason of file.expired is the retention reason, ttl or rule.
+	Code   string `json:"code,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
@@ -0,0 +1,433 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	clientconfig "client-server-fasthttp-test/internal/client/config"
+	"client-server-fasthttp-test/internal/client/uploader"
+
+	"github.com/bytedance/sonic"
+	"github.com/spf13/pflag"
+)
+
+const defaultCommand = "upload"
+
+var errFilesRequired = errors.New("invalid client config: files are required")
+
+type command struct {
+	name    string
+	usage   string
+	summary string
+	nargs   func(n int) bool
+	flags   func(flags *pflag.FlagSet)
+	run     func(ctx context.Context, env *commandEnv, args []string) error
+}
+
+type commandEnv struct {
+	cfg    clientconfig.AppConfig
+	client *uploader.Client
+	flags  *pflag.FlagSet
+	stdout io.Writer
+}
+
+type verifyResult struct {
+	File         string `json:"file"`
+	Name         string `json:"name"`
+	LocalSHA256  string `json:"local_sha256"`
+	RemoteSHA256 string `json:"remote_sha256"`
+	Match        bool   `json:"match"`
+}
+
+func commands() []command {
+	return []command{
+		{
+			name:    "upload",
+			usage:   "upload [flags] [file...]",
+			summary: "upload files, - for stdin (default: UPLOAD_CLIENT_FILES)",
+			nargs:   func(int) bool { return true },
+			run:     runUpload,
+		},
+		{
+			name:    "download",
+			usage:   "download [flags] <name>",
+			summary: "download a stored file",
+			nargs:   exactly(1),
+			flags: func(flags *pflag.FlagSet) {
+				flags.String("dest", "", "destination path, - for stdout (default: base name of <name>)")
+			},
+			run: runDownload,
+		},
+		{
+			name:    "list",
+			usage:   "list [flags]",
+			summary: "list stored files",
+			nargs:   exactly(0),
+			flags: func(flags *pflag.FlagSet) {
+				flags.String("prefix", "", "only list names starting with prefix")
+			},
+			run: runList,
+		},
+		{
+			name:    "stat",
+			usage:   "stat [flags] <name>",
+			summary: "show size and checksum of a stored file",
+			nargs:   exactly(1),
+			run:     runStat,
+		},
+		{
+			name:    "delete",
+			usage:   "delete [flags] <name>",
+			summary: "delete a stored file",
+			nargs:   exactly(1),
+			run:     runDelete,
+		},
+		{
+			name:    "verify",
+			usage:   "verify [flags] <file>",
+			summary: "compare a local file with its stored copy by SHA-256",
+			nargs:   exactly(1),
+			flags: func(flags *pflag.FlagSet) {
+				flags.String("name", "", "stored file name (default: base name of <file>)")
+			},
+			run: runVerify,
+		},
+	}
+}
+
+func exactly(n int) func(int) bool {
+	return func(got int) bool { return got == n }
+}
+
+// Run executes a client subcommand. Without a subcommand it uploads the files
+// from the configuration, which keeps the container entrypoint unchanged.
+func Run(ctx context.Context, args []string, stdout io.Writer) error {
+	name := defaultCommand
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	} else if len(args) > 0 && (args[0] == "-h" || args[0] == "--help") {
+		printUsage(stdout)
+		return nil
+	}
+
+	var cmd *command
+	for _, c := range commands() {
+		if c.name == name {
+			cmd = &c
+			break
+		}
+	}
+	if cmd == nil {
+		printUsage(os.Stderr)
+		return fmt.Errorf("unknown command %q", name)
+	}
+
+	flags := pflag.NewFlagSet(cmd.name, pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: client %s\n\n%s\n", cmd.usage, flags.FlagUsages())
+	}
+	clientconfig.RegisterFlags(flags)
+	if cmd.flags != nil {
+		cmd.flags(flags)
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if !cmd.nargs(flags.NArg()) {
+		flags.Usage()
+		return fmt.Errorf("%s: unexpected number of arguments", cmd.name)
+	}
+
+	cfg, err := clientconfig.Load(clientconfig.Options{Flags: flags})
+	if err != nil {
+		return err
+	}
+
+	client, err := uploader.New(nil, uploader.Config{
+		ChunkSize:      cfg.ChunkSize,
+		FormFieldName:  cfg.FieldName,
+		RequestTimeout: cfg.RequestTimeout,
+		ExpectContinue: cfg.ExpectContinue,
+		AuthToken:      cfg.AuthToken,
+	})
+	if err != nil {
+		return fmt.Errorf("create client: %w", err)
+	}
+
+	return cmd.run(ctx, &commandEnv{
+		cfg:    cfg,
+		client: client,
+		flags:  flags,
+		stdout: stdout,
+	}, flags.Args())
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: client <command> [flags] [args]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, c := range commands() {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.name, c.summary)
+	}
+	_ = tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Flags override UPLOAD_CLIENT_* environment variables and .env.client.")
+	fmt.Fprintln(w, "Run 'client <command> --help' for command flags.")
+}
+
+func runUpload(ctx context.Context, env *commandEnv, args []string) error {
+	cfg := env.cfg
+	if len(args) > 0 {
+		cfg.Files = args
+		if err := cfg.Validate(); err != nil {
+			return err
+		}
+	}
+	if len(cfg.Files) == 0 {
+		return errFilesRequired
+	}
+
+	handler, err := newUploadHandler(cfg)
+	if err != nil {
+		return err
+	}
+
+	results, err := handler.Handle(ctx)
+	if cfg.Output == clientconfig.OutputJSON {
+		if outErr := writeJSONOutput(env.stdout, results); outErr != nil && err == nil {
+			err = outErr
+		}
+	}
+
+	return err
+}
+
+func runDownload(ctx context.Context, env *commandEnv, args []string) error {
+	name := args[0]
+	dest, _ := env.flags.GetString("dest")
+	if dest == "" {
+		dest = path.Base(name)
+	}
+
+	fileURL, err := filesURL(env.cfg.URL, name)
+	if err != nil {
+		return err
+	}
+
+	var info *uploader.FileInfo
+	if dest == "-" {
+		info, err = env.client.DownloadContext(ctx, fileURL, env.stdout)
+		if err != nil {
+			return err
+		}
+	} else {
+		info, err = downloadToFile(ctx, env.client, fileURL, dest)
+		if err != nil {
+			return err
+		}
+	}
+	info.Name = name
+
+	switch {
+	case env.cfg.Output == clientconfig.OutputJSON && dest != "-":
+		return writeJSONOutput(env.stdout, info)
+	case dest != "-":
+		fmt.Fprintf(env.stdout, "%s -> %s (%d bytes, sha256 %s)\n", name, dest, info.Size, info.SHA256)
+	}
+
+	return nil
+}
+
+// downloadToFile writes into a temp file next to dest and renames it only after
+// the checksum has been verified, so a failed download never leaves a partial
+// file under the destination name.
+func downloadToFile(ctx context.Context, client *uploader.Client, fileURL, dest string) (*uploader.FileInfo, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*")
+	if err != nil {
+		return nil, fmt.Errorf("create destination: %w", err)
+	}
+
+	info, err := client.DownloadContext(ctx, fileURL, tmp)
+	closeErr := tmp.Close()
+	if err == nil && closeErr != nil {
+		err = fmt.Errorf("close destination: %w", closeErr)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dest)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	return info, nil
+}
+
+func runList(ctx context.Context, env *commandEnv, _ []string) error {
+	prefix, _ := env.flags.GetString("prefix")
+	listURL, err := filesListURL(env.cfg.URL, prefix)
+	if err != nil {
+		return err
+	}
+
+	files, err := env.client.ListContext(ctx, listURL)
+	if err != nil {
+		return err
+	}
+	if env.cfg.Output == clientconfig.OutputJSON {
+		return writeJSONOutput(env.stdout, files)
+	}
+
+	tw := tabwriter.NewWriter(env.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSIZE\tSHA256\tMODIFIED")
+	for _, f := range files {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", f.Name, f.Size, f.SHA256, f.Modified)
+	}
+
+	return tw.Flush()
+}
+
+func runStat(ctx context.Context, env *commandEnv, args []string) error {
+	info, err := statRemote(ctx, env, args[0])
+	if err != nil {
+		return err
+	}
+	if env.cfg.Output == clientconfig.OutputJSON {
+		return writeJSONOutput(env.stdout, info)
+	}
+
+	fmt.Fprintf(env.stdout, "name: %s\nsize: %d\nsha256: %s\nmodified: %s\n", info.Name, info.Size, info.SHA256, info.Modified)
+	return nil
+}
+
+func runDelete(ctx context.Context, env *commandEnv, args []string) error {
+	fileURL, err := filesURL(env.cfg.URL, args[0])
+	if err != nil {
+		return err
+	}
+	if err := env.client.DeleteContext(ctx, fileURL); err != nil {
+		return err
+	}
+	if env.cfg.Output == clientconfig.OutputJSON {
+		return writeJSONOutput(env.stdout, map[string]string{"name": args[0], "status": "deleted"})
+	}
+
+	fmt.Fprintf(env.stdout, "deleted %s\n", args[0])
+	return nil
+}
+
+func runVerify(ctx context.Context, env *commandEnv, args []string) error {
+	localPath := args[0]
+	name, _ := env.flags.GetString("name")
+	if name == "" {
+		name = filepath.Base(localPath)
+	}
+
+	localSHA256, err := fileSHA256(localPath)
+	if err != nil {
+		return err
+	}
+	info, err := statRemote(ctx, env, name)
+	if err != nil {
+		return err
+	}
+
+	result := verifyResult{
+		File:         localPath,
+		Name:         name,
+		LocalSHA256:  localSHA256,
+		RemoteSHA256: info.SHA256,
+		Match:        localSHA256 == info.SHA256,
+	}
+	if env.cfg.Output == clientconfig.OutputJSON {
+		if err := writeJSONOutput(env.stdout, result); err != nil {
+			return err
+		}
+	} else if result.Match {
+		fmt.Fprintf(env.stdout, "OK %s sha256 %s\n", name, localSHA256)
+	}
+	if !result.Match {
+		return fmt.Errorf("verify %q: checksum mismatch: local %s, remote %s", name, localSHA256, info.SHA256)
+	}
+
+	return nil
+}
+
+func statRemote(ctx context.Context, env *commandEnv, name string) (*uploader.FileInfo, error) {
+	fileURL, err := filesURL(env.cfg.URL, name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := env.client.StatContext(ctx, fileURL)
+	if err != nil {
+		return nil, fmt.Errorf("stat %q: %w", name, err)
+	}
+	info.Name = name
+
+	return info, nil
+}
+
+func fileSHA256(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("open file %q: %w", filePath, err)
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", fmt.Errorf("hash file %q: %w", filePath, err)
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// filesURL resolves the file endpoint relative to the upload URL, so
+// http://host/upload maps to http://host/files/<name>.
+func filesURL(uploadURL, name string) (string, error) {
+	return resolveFilesURL(uploadURL, &url.URL{Path: "files/" + name})
+}
+
+func filesListURL(uploadURL, prefix string) (string, error) {
+	ref := &url.URL{Path: "files"}
+	if prefix != "" {
+		ref.RawQuery = url.Values{"prefix": {prefix}}.Encode()
+	}
+
+	return resolveFilesURL(uploadURL, ref)
+}
+
+func resolveFilesURL(uploadURL string, ref *url.URL) (string, error) {
+	base, err := url.Parse(uploadURL)
+	if err != nil {
+		return "", fmt.Errorf("parse url %q: %w", uploadURL, err)
+	}
+
+	return base.ResolveReference(ref).String(), nil
+}
+
+func writeJSONOutput(w io.Writer, v any) error {
+	body, err := sonic.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encode output: %w", err)
+	}
+	body = append(body, '\n')
+
+	_, err = w.Write(body)
+	return err
+}
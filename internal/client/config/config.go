@@ -2,11 +2,15 @@ package config
 
 import (
 	"errors"
-	"log"
+	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
+	"client-server-fasthttp-test/internal/server/format"
+
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -15,6 +19,10 @@ const (
 	defaultChunkSize      = 256
 	defaultFormFieldName  = "file"
 	defaultRequestTimeout = 30 * time.Second
+	defaultStdinName      = "stdin"
+	defaultPartSize       = 8 << 20
+	defaultPartConcurrent = 4
+	defaultRetryDelay     = time.Second
 
 	keyURL            = "UPLOAD_CLIENT_URL"
 	keyFiles          = "UPLOAD_CLIENT_FILES"
@@ -23,9 +31,75 @@ const (
 	keyField          = "UPLOAD_CLIENT_FIELD"
 	keyRequestTimeout = "UPLOAD_CLIENT_REQUEST_TIMEOUT"
 	keyMaxConcurrent  = "UPLOAD_CLIENT_MAX_CONCURRENT_UPLOADS"
+	keyOutput         = "UPLOAD_CLIENT_OUTPUT"
+	keyConfigFile     = "UPLOAD_CLIENT_CONFIG_FILE"
+	keyExpectContinue = "UPLOAD_CLIENT_EXPECT_CONTINUE"
+	keyReportPath     = "UPLOAD_CLIENT_REPORT_PATH"
+	keyReportFormat   = "UPLOAD_CLIENT_REPORT_FORMAT"
+	keyContinueOnErr  = "UPLOAD_CLIENT_CONTINUE_ON_ERROR"
+	keyStdinName      = "UPLOAD_CLIENT_STDIN_NAME"
+	keyMultipartMin   = "UPLOAD_CLIENT_MULTIPART_THRESHOLD"
+	keyPartSize       = "UPLOAD_CLIENT_PART_SIZE"
+	keyPartConcurrent = "UPLOAD_CLIENT_PART_CONCURRENCY"
+	keyTTL            = "UPLOAD_CLIENT_TTL"
+	keyAuthToken      = "UPLOAD_CLIENT_AUTH_TOKEN"
+	keyAttempts       = "UPLOAD_CLIENT_ATTEMPTS"
+	keyRetryDelay     = "UPLOAD_CLIENT_RETRY_DELAY"
+
+	flagURL            = "url"
+	flagChunkSize      = "chunk-size"
+	flagField          = "field"
+	flagRequestTimeout = "request-timeout"
+	flagMaxConcurrent  = "max-concurrent"
+	flagOutput         = "output"
+	flagConfig         = "config"
+	flagExpectContinue = "expect-continue"
+	flagReport         = "report"
+	flagReportFormat   = "report-format"
+	flagContinueOnErr  = "continue-on-error"
+	flagStdinName      = "stdin-name"
+	flagMultipartMin   = "multipart-threshold"
+	flagPartSize       = "part-size"
+	flagPartConcurrent = "part-concurrency"
+	flagTTL            = "ttl"
+	flagAuthToken      = "auth-token"
+	flagAttempts       = "attempts"
+	flagRetryDelay     = "retry-delay"
+)
+
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+
+	ReportJSON  = "json"
+	ReportJUnit = "junit"
+
+	// StdinPath in Files uploads standard input.
+	StdinPath = "-"
 )
 
-var Cfg AppConfig
+// flagKeys maps every shared command-line flag to the configuration key it
+// overrides.
+var flagKeys = map[string]string{
+	flagURL:            keyURL,
+	flagChunkSize:      keyChunkSize,
+	flagField:          keyField,
+	flagRequestTimeout: keyRequestTimeout,
+	flagMaxConcurrent:  keyMaxConcurrent,
+	flagOutput:         keyOutput,
+	flagExpectContinue: keyExpectContinue,
+	flagReport:         keyReportPath,
+	flagReportFormat:   keyReportFormat,
+	flagContinueOnErr:  keyContinueOnErr,
+	flagStdinName:      keyStdinName,
+	flagMultipartMin:   keyMultipartMin,
+	flagPartSize:       keyPartSize,
+	flagPartConcurrent: keyPartConcurrent,
+	flagTTL:            keyTTL,
+	flagAuthToken:      keyAuthToken,
+	flagAttempts:       keyAttempts,
+	flagRetryDelay:     keyRetryDelay,
+}
 
 type AppConfig struct {
 	URL            string
@@ -34,9 +108,95 @@ type AppConfig struct {
 	FieldName      string
 	RequestTimeout time.Duration
 	MaxConcurrent  int
+	Output         string
+	ExpectContinue bool
+	// ReportPath is where the batch report is written; empty disables it.
+	ReportPath   string
+	ReportFormat string
+	// ContinueOnError keeps uploading the remaining files after a failure
+	// instead of aborting the batch.
+	ContinueOnError bool
+	// StdinName is the stored name of the upload read from StdinPath.
+	StdinName string
+	// MultipartThreshold is the file size in bytes from which a file is
+	// uploaded in parts of PartSize, PartConcurrency at a time; 0 disables
+	// multipart uploads.
+	MultipartThreshold int64
+	PartSize           int64
+	PartConcurrency    int
+	// TTL asks the server to delete the uploaded files after this long; 0
+	// keeps them until the server's retention rules apply.
+	TTL time.Duration
+	// AuthToken is sent as a bearer token to servers that protect their
+	// upload and file endpoints, see UPLOAD_SERVER_AUTH_TOKEN.
+	AuthToken string
+	// Attempts is how often a file is tried before it counts as failed;
+	// only connection failures and 429 and 5xx answers are retried.
+	Attempts int
+	// RetryDelay is the pause before the first retry, doubled before each
+	// further one.
+	RetryDelay time.Duration
+}
+
+// RegisterFlags defines the flags shared by all client subcommands. A flag
+// that is set explicitly takes precedence over the environment and the
+// config file.
+func RegisterFlags(flags *pflag.FlagSet) {
+	flags.String(flagURL, "", "upload endpoint URL ("+keyURL+")")
+	flags.String(flagChunkSize, "", "streaming chunk size, e.g. 64KiB ("+keyChunkSize+")")
+	flags.String(flagField, "", "multipart file field name ("+keyField+")")
+	flags.Duration(flagRequestTimeout, 0, "per-request timeout ("+keyRequestTimeout+")")
+	flags.Int(flagMaxConcurrent, 0, "number of parallel uploads ("+keyMaxConcurrent+")")
+	flags.StringP(flagOutput, "o", "", "output format: text or json ("+keyOutput+")")
+	flags.Bool(flagExpectContinue, false, "ask the server with Expect: 100-continue before sending the body ("+keyExpectContinue+")")
+	flags.String(flagReport, "", "write a batch report to this path ("+keyReportPath+")")
+	flags.String(flagReportFormat, "", "batch report format: json or junit, default by extension ("+keyReportFormat+")")
+	flags.Bool(flagContinueOnErr, false, "keep uploading remaining files after a failure ("+keyContinueOnErr+")")
+	flags.String(flagStdinName, "", "stored name of the upload read from - ("+keyStdinName+")")
+	flags.String(flagMultipartMin, "", "upload files of at least this size in parts, e.g. 100MiB, 0 disables ("+keyMultipartMin+")")
+	flags.String(flagPartSize, "", "multipart part size, e.g. 8MiB ("+keyPartSize+")")
+	flags.Int(flagPartConcurrent, 0, "number of parts of one file uploaded in parallel ("+keyPartConcurrent+")")
+	flags.Duration(flagTTL, 0, "ask the server to delete the uploads after this long, e.g. 72h ("+keyTTL+")")
+	flags.String(flagAuthToken, "", "bearer token of the server's upload and file endpoints ("+keyAuthToken+")")
+	flags.Int(flagAttempts, 0, "attempts per file, retrying connection failures and 429/5xx answers ("+keyAttempts+")")
+	flags.Duration(flagRetryDelay, 0, "pause before the first retry, doubled for each further one ("+keyRetryDelay+")")
+	flags.String(flagConfig, "", "config file: .env, .yaml, .toml or .json ("+keyConfigFile+")")
+}
+
+// Options controls where Load reads the configuration from.
+type Options struct {
+	// ConfigFile is read in addition to the process environment. The format
+	// is taken from the extension: .yaml, .yml, .toml, .json, anything else
+	// is parsed as a dotenv file. When empty, the --config flag and then
+	// UPLOAD_CLIENT_CONFIG_FILE are consulted, falling back to an optional
+	// .env.client.
+	ConfigFile string
+	// Flags registered with RegisterFlags override every other source. May be
+	// nil.
+	Flags *pflag.FlagSet
+}
+
+// configFile resolves the file to read and reports whether it must exist.
+func (o Options) configFile() (string, bool) {
+	if o.ConfigFile != "" {
+		return o.ConfigFile, true
+	}
+	if o.Flags != nil {
+		if path, err := o.Flags.GetString(flagConfig); err == nil && path != "" {
+			return path, true
+		}
+	}
+	if path := strings.TrimSpace(os.Getenv(keyConfigFile)); path != "" {
+		return path, true
+	}
+
+	return defaultConfigFile, false
 }
 
-func init() {
+// Load reads the configuration from the config file selected by opts, the
+// process environment and the flags in opts, in increasing order of
+// precedence. All validation problems are reported together.
+func Load(opts Options) (AppConfig, error) {
 	appViper := viper.New()
 
 	appViper.AutomaticEnv()
@@ -46,17 +206,32 @@ func init() {
 	appViper.SetDefault(keyField, defaultFormFieldName)
 	appViper.SetDefault(keyRequestTimeout, defaultRequestTimeout)
 	appViper.SetDefault(keyMaxConcurrent, 4)
+	appViper.SetDefault(keyOutput, OutputText)
+	appViper.SetDefault(keyExpectContinue, false)
+	appViper.SetDefault(keyContinueOnErr, false)
+	appViper.SetDefault(keyStdinName, defaultStdinName)
+	appViper.SetDefault(keyMultipartMin, 0)
+	appViper.SetDefault(keyPartSize, defaultPartSize)
+	appViper.SetDefault(keyPartConcurrent, defaultPartConcurrent)
+	appViper.SetDefault(keyTTL, time.Duration(0))
+	appViper.SetDefault(keyAttempts, 1)
+	appViper.SetDefault(keyRetryDelay, defaultRetryDelay)
 
-	appViper.SetConfigFile(defaultConfigFile)
-	appViper.SetConfigType("env")
-
-	if err := appViper.ReadInConfig(); err != nil {
-		var configNotFoundErr viper.ConfigFileNotFoundError
-		if !errors.As(err, &configNotFoundErr) && !os.IsNotExist(err) {
-			log.Panicf("read %s: %v", defaultConfigFile, err)
+	if opts.Flags != nil {
+		for name, key := range flagKeys {
+			if flag := opts.Flags.Lookup(name); flag != nil {
+				if err := appViper.BindPFlag(key, flag); err != nil {
+					return AppConfig{}, fmt.Errorf("bind flag %q: %w", name, err)
+				}
+			}
 		}
 	}
 
+	configFile, required := opts.configFile()
+	if err := readConfigFile(appViper, configFile, required); err != nil {
+		return AppConfig{}, err
+	}
+
 	files := normalizeFiles(appViper.GetStringSlice(keyFiles))
 	if len(files) == 0 {
 		files = parseCSV(appViper.GetString(keyFiles))
@@ -68,32 +243,146 @@ func init() {
 		}
 	}
 
-	Cfg = AppConfig{
-		URL:            appViper.GetString(keyURL),
-		Files:          files,
-		ChunkSize:      appViper.GetInt(keyChunkSize),
-		FieldName:      appViper.GetString(keyField),
-		RequestTimeout: appViper.GetDuration(keyRequestTimeout),
-		MaxConcurrent:  appViper.GetInt(keyMaxConcurrent),
+	var errs []error
+	sizes := make(map[string]int64, len(sizeKeys))
+	for _, key := range sizeKeys {
+		size, err := parseSize(appViper, key)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		sizes[key] = size
+	}
+
+	cfg := AppConfig{
+		URL:             appViper.GetString(keyURL),
+		Files:           files,
+		ChunkSize:       int(sizes[keyChunkSize]),
+		FieldName:       appViper.GetString(keyField),
+		RequestTimeout:  appViper.GetDuration(keyRequestTimeout),
+		MaxConcurrent:   appViper.GetInt(keyMaxConcurrent),
+		Output:          appViper.GetString(keyOutput),
+		ExpectContinue:  appViper.GetBool(keyExpectContinue),
+		ReportPath:      appViper.GetString(keyReportPath),
+		ReportFormat:    appViper.GetString(keyReportFormat),
+		ContinueOnError: appViper.GetBool(keyContinueOnErr),
+		StdinName:       appViper.GetString(keyStdinName),
+
+		MultipartThreshold: sizes[keyMultipartMin],
+		PartSize:           sizes[keyPartSize],
+		PartConcurrency:    appViper.GetInt(keyPartConcurrent),
+		TTL:                appViper.GetDuration(keyTTL),
+		AuthToken:          appViper.GetString(keyAuthToken),
+		Attempts:           appViper.GetInt(keyAttempts),
+		RetryDelay:         appViper.GetDuration(keyRetryDelay),
+	}
+	if cfg.ReportFormat == "" {
+		cfg.ReportFormat = ReportJSON
+		if strings.EqualFold(filepath.Ext(cfg.ReportPath), ".xml") {
+			cfg.ReportFormat = ReportJUnit
+		}
+	}
+
+	if len(errs) > 0 {
+		return AppConfig{}, fmt.Errorf("invalid client config: %w", errors.Join(errs...))
+	}
+	if err := cfg.Validate(); err != nil {
+		return AppConfig{}, err
 	}
 
-	if len(Cfg.Files) == 0 {
-		log.Panic("invalid client config: files are required")
+	return cfg, nil
+}
+
+// Validate checks a configuration that was built without Load, e.g. by a
+// program embedding the client.
+func (c AppConfig) Validate() error {
+	var errs []error
+	if c.URL == "" {
+		errs = append(errs, errors.New("url is required"))
+	}
+	if c.ChunkSize <= 0 {
+		errs = append(errs, errors.New("chunk_size must be positive"))
+	}
+	if c.FieldName == "" {
+		errs = append(errs, errors.New("field is required"))
+	}
+	if c.RequestTimeout <= 0 {
+		errs = append(errs, errors.New("request_timeout must be positive"))
+	}
+	if c.MaxConcurrent <= 0 {
+		errs = append(errs, errors.New("max_concurrent_uploads must be positive"))
+	}
+	if c.Output != OutputText && c.Output != OutputJSON {
+		errs = append(errs, fmt.Errorf("output must be %q or %q", OutputText, OutputJSON))
+	}
+	if c.ReportPath != "" && c.ReportFormat != ReportJSON && c.ReportFormat != ReportJUnit {
+		errs = append(errs, fmt.Errorf("report_format must be %q or %q", ReportJSON, ReportJUnit))
 	}
-	if Cfg.URL == "" {
-		log.Panic("invalid client config: url is required")
+	if c.MultipartThreshold < 0 {
+		errs = append(errs, errors.New("multipart_threshold must not be negative"))
 	}
-	if Cfg.ChunkSize <= 0 {
-		log.Panic("invalid client config: chunk_size must be positive")
+	if c.MultipartThreshold > 0 && c.PartSize <= 0 {
+		errs = append(errs, errors.New("part_size must be positive"))
 	}
-	if Cfg.FieldName == "" {
-		log.Panic("invalid client config: field is required")
+	if c.MultipartThreshold > 0 && c.PartConcurrency <= 0 {
+		errs = append(errs, errors.New("part_concurrency must be positive"))
+	}
+	if c.TTL < 0 {
+		errs = append(errs, errors.New("ttl must not be negative"))
+	}
+	if c.Attempts <= 0 {
+		errs = append(errs, errors.New("attempts must be positive"))
+	}
+	if c.RetryDelay < 0 {
+		errs = append(errs, errors.New("retry_delay must not be negative"))
+	}
+	if stdin := countStdin(c.Files); stdin > 1 {
+		errs = append(errs, fmt.Errorf("files may list standard input (%s) only once, got %d", StdinPath, stdin))
+	} else if stdin == 1 && c.StdinName == "" {
+		errs = append(errs, errors.New("stdin_name is required to upload standard input"))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid client config: %w", errors.Join(errs...))
+	}
+
+	return nil
+}
+
+// sizeKeys are read with parseSize and so accept units such as "64KiB".
+var sizeKeys = []string{keyChunkSize, keyMultipartMin, keyPartSize}
+
+// parseSize reads a byte count with an optional unit, see format.ParseBytes.
+func parseSize(v *viper.Viper, key string) (int64, error) {
+	size, err := format.ParseBytes(v.GetString(key))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", strings.ToLower(strings.TrimPrefix(key, "UPLOAD_CLIENT_")), err)
 	}
-	if Cfg.RequestTimeout <= 0 {
-		log.Panic("invalid client config: request_timeout must be positive")
+
+	return size, nil
+}
+
+// readConfigFile merges path into v. A missing file is only an error when it
+// was requested explicitly.
+func readConfigFile(v *viper.Viper, path string, required bool) error {
+	v.SetConfigFile(path)
+	v.SetConfigType(configType(path))
+
+	if err := v.ReadInConfig(); err != nil {
+		var configNotFoundErr viper.ConfigFileNotFoundError
+		if !required && (errors.As(err, &configNotFoundErr) || os.IsNotExist(err)) {
+			return nil
+		}
+		return fmt.Errorf("read %s: %w", path, err)
 	}
-	if Cfg.MaxConcurrent <= 0 {
-		log.Panic("invalid client config: max_concurrent_uploads must be positive")
+
+	return nil
+}
+
+func configType(path string) string {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml", ".toml", ".json":
+		return strings.TrimPrefix(ext, ".")
+	default:
+		return "env"
 	}
 }
 
@@ -110,6 +399,17 @@ func parseCSV(raw string) []string {
 	return out
 }
 
+func countStdin(files []string) int {
+	n := 0
+	for _, file := range files {
+		if file == StdinPath {
+			n++
+		}
+	}
+
+	return n
+}
+
 func normalizeFiles(raw []string) []string {
 	out := make([]string, 0, len(raw))
 	for _, item := range raw {
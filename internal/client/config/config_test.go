@@ -0,0 +1,75 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.yaml")
+	content := "UPLOAD_CLIENT_URL: http://file/upload\nUPLOAD_CLIENT_CHUNK_SIZE: 1024\nUPLOAD_CLIENT_FILES:\n  - a.bin\n  - b.bin\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	t.Setenv(keyChunkSize, "2048")
+
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	RegisterFlags(flags)
+	if err := flags.Parse([]string{"--config", path, "--url", "http://flag/upload"}); err != nil {
+		t.Fatalf("parse flags: %v", err)
+	}
+
+	cfg, err := Load(Options{Flags: flags})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if cfg.URL != "http://flag/upload" {
+		t.Fatalf("unexpected url: got %q want %q", cfg.URL, "http://flag/upload")
+	}
+	if cfg.ChunkSize != 2048 {
+		t.Fatalf("unexpected chunk size: got %d want %d", cfg.ChunkSize, 2048)
+	}
+	if want := []string{"a.bin", "b.bin"}; !slices.Equal(cfg.Files, want) {
+		t.Fatalf("unexpected files: got %v want %v", cfg.Files, want)
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	err := AppConfig{Output: "xml", Files: []string{StdinPath, "a.bin", StdinPath}, MultipartThreshold: 1}.Validate()
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+	for _, want := range []string{"url", "chunk_size", "field", "request_timeout", "max_concurrent_uploads", "output", "standard input", "part_size", "part_concurrency", "attempts"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("error does not mention %s: %v", want, err)
+		}
+	}
+}
+
+func TestLoadSizeUnits(t *testing.T) {
+	t.Setenv(keyPartSize, "16MiB")
+
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	RegisterFlags(flags)
+	if err := flags.Parse([]string{"--chunk-size", "64KiB", "--multipart-threshold", "1GB"}); err != nil {
+		t.Fatalf("parse flags: %v", err)
+	}
+
+	cfg, err := Load(Options{Flags: flags})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if cfg.ChunkSize != 64<<10 || cfg.MultipartThreshold != 1_000_000_000 || cfg.PartSize != 16<<20 {
+		t.Fatalf("unexpected sizes: chunk %d, threshold %d, part %d", cfg.ChunkSize, cfg.MultipartThreshold, cfg.PartSize)
+	}
+
+	t.Setenv(keyPartSize, "16 MiBs")
+	if _, err := Load(Options{Flags: flags}); err == nil || !strings.Contains(err.Error(), "part_size") {
+		t.Fatalf("expected part_size error, got %v", err)
+	}
+}
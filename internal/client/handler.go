@@ -2,32 +2,57 @@ package client
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"client-server-fasthttp-test/internal/api"
 	"client-server-fasthttp-test/internal/client/config"
 	"client-server-fasthttp-test/internal/client/uploader"
+	"client-server-fasthttp-test/internal/server/format"
+)
 
-	"github.com/bytedance/sonic"
+const (
+	outcomeOK      = "ok"
+	outcomeFailed  = "failed"
+	outcomeSkipped = "skipped"
 )
 
 type uploadHandler struct {
 	client *uploader.Client
 	cfg    config.AppConfig
+	// stdin is read for config.StdinPath.
+	stdin io.Reader
 }
 
-type uploadResultPayload struct {
-	Status           string `json:"status"`
-	Files            int    `json:"files"`
-	Size             string `json:"size"`
-	Duration         string `json:"duration"`
-	Speed            string `json:"speed"`
-	SHA256           string `json:"sha256"`
+type uploadResult struct {
+	File       string `json:"file"`
+	HTTPStatus int    `json:"http_status"`
+	// Outcome is ok, failed or skipped; skipped files were never uploaded
+	// because the batch was aborted.
+	Outcome        string `json:"outcome"`
+	Bytes          int64  `json:"bytes"`
+	Attempts       int    `json:"attempts"`
+	ClientDuration string `json:"client_duration"`
+	ClientSpeed    string `json:"client_speed"`
+	LocalSHA256    string `json:"local_sha256"`
+	// UploadResult holds the server's response; its SHA256 is the checksum
+	// reported by the server.
+	uploader.UploadResult
 	Error            string `json:"error"`
-	ExpectedChecksum string `json:"expected_checksum"`
-	ActualChecksum   string `json:"actual_checksum"`
+	ErrorCode        string `json:"error_code,omitempty"`
+	ExpectedChecksum string `json:"expected_checksum,omitempty"`
+	ActualChecksum   string `json:"actual_checksum,omitempty"`
+
+	elapsed time.Duration
 }
 
 func newUploadHandler(cfg config.AppConfig) (*uploadHandler, error) {
@@ -35,6 +60,8 @@ func newUploadHandler(cfg config.AppConfig) (*uploadHandler, error) {
 		ChunkSize:      cfg.ChunkSize,
 		FormFieldName:  cfg.FieldName,
 		RequestTimeout: cfg.RequestTimeout,
+		ExpectContinue: cfg.ExpectContinue,
+		AuthToken:      cfg.AuthToken,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("create client: %w", err)
@@ -43,16 +70,21 @@ func newUploadHandler(cfg config.AppConfig) (*uploadHandler, error) {
 	return &uploadHandler{
 		client: client,
 		cfg:    cfg,
+		stdin:  os.Stdin,
 	}, nil
 }
 
-func (h *uploadHandler) Handle(ctx context.Context) error {
+// Handle uploads every configured file and returns one result per file, in
+// configuration order, even when the batch fails. By default the first
+// failure cancels the remaining uploads; with ContinueOnError every file is
+// attempted. The batch report is written before returning.
+func (h *uploadHandler) Handle(ctx context.Context) ([]uploadResult, error) {
 	start := time.Now()
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	sem := make(chan struct{}, h.cfg.MaxConcurrent)
-	responses := make([]*uploader.UploadResponse, len(h.cfg.Files))
+	results := make([]uploadResult, len(h.cfg.Files))
 
 	var wg sync.WaitGroup
 	var firstErr error
@@ -66,68 +98,253 @@ func (h *uploadHandler) Handle(ctx context.Context) error {
 			select {
 			case sem <- struct{}{}:
 			case <-ctx.Done():
+				results[idx] = skippedResult(ctx, path)
 				return
 			}
 			defer func() { <-sem }()
 
-			resp, err := h.client.UploadFileContext(ctx, uploader.UploadRequest{
-				URL:      h.cfg.URL,
-				FilePath: path,
-			})
+			if ctx.Err() != nil {
+				results[idx] = skippedResult(ctx, path)
+				return
+			}
+
+			result, err := h.uploadFile(ctx, path)
 			if err != nil {
 				errMu.Lock()
-				if firstErr == nil {
-					firstErr = fmt.Errorf("upload file %q: %w", path, err)
-					cancel()
+				switch {
+				case firstErr == nil:
+					firstErr = err
+					if !h.cfg.ContinueOnError {
+						cancel()
+					}
+				case ctx.Err() != nil:
+					// Interrupted by the abort triggered by firstErr.
+					result.Outcome = outcomeSkipped
 				}
 				errMu.Unlock()
-				return
 			}
 
-			responses[idx] = resp
+			results[idx] = result
 		}(i, filePath)
 	}
 
 	wg.Wait()
 
-	if firstErr != nil {
-		return firstErr
+	failed := 0
+	for _, result := range results {
+		if result.Outcome == outcomeFailed {
+			failed++
+		}
+		logUploadResult(result)
 	}
+	slog.Info("upload batch complete",
+		"files", len(h.cfg.Files),
+		"failed", failed,
+		"total_duration", time.Since(start).Round(time.Millisecond).String(),
+	)
 
-	for i, resp := range responses {
-		if resp == nil {
-			return fmt.Errorf("upload file %q: empty response", h.cfg.Files[i])
+	var errs []error
+	if h.cfg.ReportPath != "" {
+		report := newBatchReport(start, time.Now(), h.cfg.ContinueOnError, results)
+		if err := writeReport(h.cfg.ReportPath, h.cfg.ReportFormat, report); err != nil {
+			errs = append(errs, err)
 		}
+	}
+	switch {
+	case firstErr != nil && h.cfg.ContinueOnError && failed > 1:
+		errs = append(errs, fmt.Errorf("%d of %d uploads failed, first: %w", failed, len(results), firstErr))
+	case firstErr != nil:
+		errs = append(errs, firstErr)
+	}
+
+	return results, errors.Join(errs...)
+}
 
-		var payload uploadResultPayload
-		if err := sonic.Unmarshal(resp.Body, &payload); err != nil {
-			slog.Info("upload result",
-				"file", h.cfg.Files[i],
-				"http_status", resp.StatusCode,
-				"response_parse_error", err.Error(),
-				"response_bytes", len(resp.Body),
-			)
-			continue
+// uploadFile uploads one file, trying up to cfg.Attempts times while the
+// failure is retryable. Standard input cannot be read twice and is tried
+// once. The result is that of the last attempt.
+func (h *uploadHandler) uploadFile(ctx context.Context, path string) (uploadResult, error) {
+	attempts := h.cfg.Attempts
+	if path == config.StdinPath {
+		attempts = 1
+	}
+
+	delay := h.cfg.RetryDelay
+	for attempt := 1; ; attempt++ {
+		result, err := h.uploadOnce(ctx, path)
+		result.Attempts = attempt
+		if err == nil || attempt >= attempts || !retryable(err) {
+			return result, err
 		}
 
-		slog.Info("upload result",
-			"file", h.cfg.Files[i],
-			"http_status", resp.StatusCode,
-			"status", payload.Status,
-			"files", payload.Files,
-			"size", payload.Size,
-			"duration", payload.Duration,
-			"speed", payload.Speed,
-			"sha256", payload.SHA256,
-			"error", payload.Error,
-			"expected_checksum", payload.ExpectedChecksum,
-			"actual_checksum", payload.ActualChecksum,
-		)
+		slog.Warn("upload failed, retrying", "file", path, "attempt", attempt, "delay", delay.String(), "error", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return result, err
+		}
+		delay *= 2
 	}
-	slog.Info("upload batch complete",
-		"files", len(h.cfg.Files),
-		"total_duration", time.Since(start).Round(time.Millisecond).String(),
-	)
+}
 
-	return nil
+// retryable reports whether a failed upload may succeed when repeated: the
+// request never got an answer, or the server was busy or failing.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	var httpErr *uploader.HTTPError
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var mismatch *uploader.ChecksumMismatchError
+
+	return !errors.As(err, &mismatch)
+}
+
+// uploadOnce makes a single attempt at uploading path. The returned error
+// mirrors a failed outcome: a transport failure, a non-2xx response or a
+// checksum mismatch.
+func (h *uploadHandler) uploadOnce(ctx context.Context, path string) (uploadResult, error) {
+	result := uploadResult{File: path, Outcome: outcomeFailed}
+
+	start := time.Now()
+	var resp *uploader.UploadResponse
+	var err error
+	if path == config.StdinPath {
+		stdin := &countingReader{r: h.stdin}
+		resp, err = h.client.UploadReaderContext(ctx, uploader.ReaderUploadRequest{
+			URL:      h.cfg.URL,
+			Reader:   stdin,
+			FileName: h.cfg.StdinName,
+			TTL:      h.cfg.TTL,
+		})
+		result.Bytes = stdin.n.Load()
+	} else {
+		if info, statErr := os.Stat(path); statErr == nil {
+			result.Bytes = info.Size()
+		}
+		if h.useMultipart(result.Bytes) {
+			resp, err = h.uploadMultipart(ctx, path)
+		} else {
+			resp, err = h.client.UploadFileContext(ctx, uploader.UploadRequest{
+				URL:      h.cfg.URL,
+				FilePath: path,
+				TTL:      h.cfg.TTL,
+			})
+		}
+	}
+	result.setElapsed(time.Since(start))
+	if resp != nil {
+		// A checksum mismatch comes with the response.
+		result.HTTPStatus = resp.StatusCode
+		result.LocalSHA256 = resp.SHA256
+		if resp.Result != nil {
+			result.UploadResult = *resp.Result
+		}
+	}
+	if err == nil {
+		result.Outcome = outcomeOK
+		return result, nil
+	}
+
+	result.Error = err.Error()
+	var httpErr *uploader.HTTPError
+	var mismatch *uploader.ChecksumMismatchError
+	switch {
+	case errors.As(err, &httpErr):
+		result.HTTPStatus = httpErr.StatusCode
+		result.Status = api.StatusError
+		result.ErrorCode = httpErr.Code()
+		result.ExpectedChecksum = httpErr.Response.ExpectedChecksum
+		result.ActualChecksum = httpErr.Response.ActualChecksum
+		if httpErr.Response.Error != "" {
+			result.Error = httpErr.Response.Error
+		}
+	case errors.As(err, &mismatch):
+		result.ErrorCode = api.CodeChecksumMismatch
+		result.ExpectedChecksum = mismatch.Local
+		result.ActualChecksum = mismatch.Server
+	}
+
+	return result, fmt.Errorf("upload file %q: %w", path, err)
+}
+
+// useMultipart reports whether a file of size bytes is uploaded in parts.
+func (h *uploadHandler) useMultipart(size int64) bool {
+	return h.cfg.MultipartThreshold > 0 && size >= h.cfg.MultipartThreshold
+}
+
+// uploadMultipart sends path in parts to the multipart endpoint next to the
+// upload URL.
+func (h *uploadHandler) uploadMultipart(ctx context.Context, path string) (*uploader.UploadResponse, error) {
+	uploadsURL, err := resolveFilesURL(h.cfg.URL, &url.URL{Path: "uploads"})
+	if err != nil {
+		return nil, err
+	}
+
+	return h.client.UploadMultipartContext(ctx, uploader.MultipartUploadRequest{
+		URL:         uploadsURL,
+		FilePath:    path,
+		PartSize:    h.cfg.PartSize,
+		Concurrency: h.cfg.PartConcurrency,
+		TTL:         h.cfg.TTL,
+	})
+}
+
+func (r *uploadResult) setElapsed(elapsed time.Duration) {
+	r.elapsed = elapsed
+	r.ClientDuration = elapsed.Round(time.Millisecond).String()
+	if elapsed > 0 {
+		r.ClientSpeed = format.BytesPerSecond(float64(r.Bytes) / elapsed.Seconds())
+	}
+}
+
+// countingReader counts the bytes of a source whose size is not known in
+// advance. The body may still be streaming when a failed upload returns.
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+
+	return n, err
+}
+
+func skippedResult(ctx context.Context, path string) uploadResult {
+	return uploadResult{
+		File:    path,
+		Outcome: outcomeSkipped,
+		Error:   fmt.Sprintf("not uploaded: %v", context.Cause(ctx)),
+	}
+}
+
+func logUploadResult(result uploadResult) {
+	slog.Info("upload result",
+		"file", result.File,
+		"outcome", result.Outcome,
+		"http_status", result.HTTPStatus,
+		"status", result.Status,
+		"files", result.Files,
+		"size", result.Size,
+		"duration", result.Duration,
+		"speed", result.Speed,
+		"sha256", result.SHA256,
+		"local_sha256", result.LocalSHA256,
+		"attempts", result.Attempts,
+		"error", result.Error,
+		"error_code", result.ErrorCode,
+		"expected_checksum", result.ExpectedChecksum,
+		"actual_checksum", result.ActualChecksum,
+	)
 }
@@ -0,0 +1,197 @@
+package client
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"client-server-fasthttp-test/internal/client/config"
+
+	"github.com/bytedance/sonic"
+	"github.com/valyala/fasthttp"
+)
+
+// payloadSHA256 is the SHA-256 of "payload", which the test server reports
+// for every upload.
+const payloadSHA256 = "239f59ed55e737c77147cf55ad0c1b030b6d7ee748a7426952f9b852d5a935e5"
+
+func newTestUploadServer(t *testing.T) string {
+	t.Helper()
+
+	return serveTestUploads(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(fasthttp.StatusCreated)
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(`{"status":"ok","files":1,"sha256":"` + payloadSHA256 + `"}`)
+	})
+}
+
+func serveTestUploads(t *testing.T, handler fasthttp.RequestHandler) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := &fasthttp.Server{Handler: handler}
+	go func() {
+		_ = server.Serve(ln)
+	}()
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+
+	return "http://" + ln.Addr().String() + "/upload"
+}
+
+func testHandlerConfig(t *testing.T, url string, files ...string) config.AppConfig {
+	t.Helper()
+
+	return config.AppConfig{
+		URL:            url,
+		Files:          files,
+		ChunkSize:      64,
+		FieldName:      "file",
+		RequestTimeout: 5 * time.Second,
+		MaxConcurrent:  2,
+		Output:         config.OutputText,
+		Attempts:       1,
+	}
+}
+
+func TestHandleContinueOnErrorWritesReport(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.bin")
+	if err := os.WriteFile(good, []byte("payload"), 0o600); err != nil {
+		t.Fatalf("write temp file: %v", err)
+	}
+	missing := filepath.Join(dir, "missing.bin")
+
+	cfg := testHandlerConfig(t, newTestUploadServer(t), missing, good)
+	cfg.ContinueOnError = true
+	cfg.ReportPath = filepath.Join(dir, "report.json")
+	cfg.ReportFormat = config.ReportJSON
+
+	handler, err := newUploadHandler(cfg)
+	if err != nil {
+		t.Fatalf("new upload handler: %v", err)
+	}
+	results, err := handler.Handle(context.Background())
+	if err == nil {
+		t.Fatal("expected batch error")
+	}
+	if len(results) != 2 || results[0].Outcome != outcomeFailed || results[1].Outcome != outcomeOK {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+
+	body, err := os.ReadFile(cfg.ReportPath)
+	if err != nil {
+		t.Fatalf("read report: %v", err)
+	}
+	var report batchReport
+	if err := sonic.Unmarshal(body, &report); err != nil {
+		t.Fatalf("decode report: %v", err)
+	}
+	if report.Total != 2 || report.Succeeded != 1 || report.Failed != 1 {
+		t.Fatalf("unexpected report totals: %+v", report)
+	}
+	ok := report.Files[1]
+	if ok.HTTPStatus != fasthttp.StatusCreated || ok.SHA256 != payloadSHA256 || ok.LocalSHA256 != payloadSHA256 || ok.Bytes != int64(len("payload")) || ok.Attempts != 1 {
+		t.Fatalf("unexpected report entry: %+v", ok)
+	}
+}
+
+func TestHandleRetriesTransientFailures(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.bin")
+	if err := os.WriteFile(path, []byte("payload"), 0o600); err != nil {
+		t.Fatalf("write temp file: %v", err)
+	}
+
+	var requests atomic.Int32
+	status := fasthttp.StatusServiceUnavailable
+	url := serveTestUploads(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetContentType("application/json")
+		if requests.Add(1) < 3 {
+			ctx.SetStatusCode(status)
+			ctx.SetBodyString(`{"status":"error","code":"too_many_uploads","error":"busy"}`)
+			return
+		}
+		ctx.SetStatusCode(fasthttp.StatusCreated)
+		ctx.SetBodyString(`{"status":"ok","files":1,"sha256":"` + payloadSHA256 + `"}`)
+	})
+	cfg := testHandlerConfig(t, url, path)
+	cfg.Attempts = 3
+	cfg.RetryDelay = time.Millisecond
+
+	handler, err := newUploadHandler(cfg)
+	if err != nil {
+		t.Fatalf("new upload handler: %v", err)
+	}
+	results, err := handler.Handle(context.Background())
+	if err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	if got := results[0]; got.Outcome != outcomeOK || got.Attempts != 3 || requests.Load() != 3 {
+		t.Fatalf("unexpected result after %d requests: %+v", requests.Load(), got)
+	}
+
+	// Client errors are not retried.
+	requests.Store(0)
+	status = fasthttp.StatusUnprocessableEntity
+	results, err = handler.Handle(context.Background())
+	if err == nil {
+		t.Fatal("expected upload error")
+	}
+	if got := results[0]; got.Outcome != outcomeFailed || got.Attempts != 1 || requests.Load() != 1 {
+		t.Fatalf("unexpected result after %d requests: %+v", requests.Load(), got)
+	}
+}
+
+func TestJUnitReport(t *testing.T) {
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	report := newBatchReport(start, start.Add(2*time.Second), false, []uploadResult{
+		{File: "a.bin", Outcome: outcomeOK, HTTPStatus: 201, Attempts: 1},
+		{File: "b.bin", Outcome: outcomeFailed, HTTPStatus: 422, Attempts: 1, Error: "checksum mismatch"},
+		{File: "c.bin", Outcome: outcomeSkipped, Error: "not uploaded: context canceled"},
+	})
+
+	body, err := report.junitXML()
+	if err != nil {
+		t.Fatalf("encode junit: %v", err)
+	}
+	for _, want := range []string{
+		`<testsuite name="upload" tests="3" failures="1" skipped="1" time="2.000" timestamp="2026-01-02T03:04:05Z">`,
+		`<failure message="checksum mismatch"></failure>`,
+		`<skipped message="not uploaded: context canceled"></skipped>`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Fatalf("junit report missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestHandleUploadsStdin(t *testing.T) {
+	cfg := testHandlerConfig(t, newTestUploadServer(t), config.StdinPath)
+	cfg.StdinName = "generated.bin"
+
+	handler, err := newUploadHandler(cfg)
+	if err != nil {
+		t.Fatalf("new upload handler: %v", err)
+	}
+	handler.stdin = strings.NewReader("payload")
+
+	results, err := handler.Handle(context.Background())
+	if err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	if len(results) != 1 || results[0].Outcome != outcomeOK {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	if got := results[0]; got.Bytes != int64(len("payload")) || got.LocalSHA256 != payloadSHA256 {
+		t.Fatalf("unexpected stdin result: bytes %d, sha256 %q", got.Bytes, got.LocalSHA256)
+	}
+}
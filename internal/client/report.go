@@ -0,0 +1,163 @@
+package client
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	clientconfig "client-server-fasthttp-test/internal/client/config"
+
+	"github.com/bytedance/sonic"
+)
+
+// batchReport is the machine-readable summary of one upload batch.
+type batchReport struct {
+	StartedAt       string         `json:"started_at"`
+	FinishedAt      string         `json:"finished_at"`
+	Duration        string         `json:"duration"`
+	ContinueOnError bool           `json:"continue_on_error"`
+	Total           int            `json:"total"`
+	Succeeded       int            `json:"succeeded"`
+	Failed          int            `json:"failed"`
+	Skipped         int            `json:"skipped"`
+	Files           []uploadResult `json:"files"`
+
+	elapsed time.Duration
+}
+
+func newBatchReport(start, end time.Time, continueOnError bool, results []uploadResult) batchReport {
+	report := batchReport{
+		StartedAt:       start.UTC().Format(time.RFC3339),
+		FinishedAt:      end.UTC().Format(time.RFC3339),
+		Duration:        end.Sub(start).Round(time.Millisecond).String(),
+		ContinueOnError: continueOnError,
+		Total:           len(results),
+		Files:           results,
+		elapsed:         end.Sub(start),
+	}
+	for _, result := range results {
+		switch result.Outcome {
+		case outcomeOK:
+			report.Succeeded++
+		case outcomeFailed:
+			report.Failed++
+		default:
+			report.Skipped++
+		}
+	}
+
+	return report
+}
+
+// writeReport writes the report through a temp file so that a crash never
+// leaves a truncated report for CI to pick up.
+func writeReport(path, format string, report batchReport) error {
+	var body []byte
+	var err error
+	switch format {
+	case clientconfig.ReportJUnit:
+		body, err = report.junitXML()
+	default:
+		body, err = sonic.ConfigStd.MarshalIndent(report, "", "  ")
+	}
+	if err != nil {
+		return fmt.Errorf("encode report: %w", err)
+	}
+	body = append(body, '\n')
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("create report: %w", err)
+	}
+	_, err = tmp.Write(body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("write report: %w", err)
+	}
+
+	return nil
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Skipped    int             `xml:"skipped,attr"`
+	Time       string          `xml:"time,attr"`
+	Timestamp  string          `xml:"timestamp,attr"`
+	Properties []junitProperty `xml:"properties>property,omitempty"`
+	Cases      []junitTestCase `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+}
+
+func (r batchReport) junitXML() ([]byte, error) {
+	suite := junitTestSuite{
+		Name:      "upload",
+		Tests:     r.Total,
+		Failures:  r.Failed,
+		Skipped:   r.Skipped,
+		Time:      seconds(r.elapsed),
+		Timestamp: r.StartedAt,
+		Properties: []junitProperty{
+			{Name: "continue_on_error", Value: strconv.FormatBool(r.ContinueOnError)},
+		},
+	}
+	for _, result := range r.Files {
+		testCase := junitTestCase{
+			Name:      result.File,
+			ClassName: "upload",
+			Time:      seconds(result.elapsed),
+			SystemOut: fmt.Sprintf("bytes=%d http_status=%d attempts=%d speed=%s sha256=%s",
+				result.Bytes, result.HTTPStatus, result.Attempts, result.ClientSpeed, result.SHA256),
+		}
+		switch result.Outcome {
+		case outcomeFailed:
+			testCase.Failure = &junitMessage{Message: result.Error}
+		case outcomeSkipped:
+			testCase.Skipped = &junitMessage{Message: result.Error}
+		}
+		suite.Cases = append(suite.Cases, testCase)
+	}
+
+	body, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), body...), nil
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
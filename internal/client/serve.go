@@ -6,13 +6,32 @@ import (
 	clientconfig "client-server-fasthttp-test/internal/client/config"
 )
 
+// Serve uploads the files listed in the configuration; it is the equivalent of
+// running the client without a subcommand.
 func Serve() error {
-	cfg := clientconfig.Cfg
+	cfg, err := clientconfig.Load(clientconfig.Options{})
+	if err != nil {
+		return err
+	}
+
+	return ServeWithConfig(context.Background(), cfg)
+}
+
+// ServeWithConfig uploads the files listed in cfg. It is meant for programs
+// embedding the client and stops early when ctx is cancelled.
+func ServeWithConfig(ctx context.Context, cfg clientconfig.AppConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if len(cfg.Files) == 0 {
+		return errFilesRequired
+	}
 
 	handler, err := newUploadHandler(cfg)
 	if err != nil {
 		return err
 	}
 
-	return handler.Handle(context.Background())
+	_, err = handler.Handle(ctx)
+	return err
 }
@@ -0,0 +1,142 @@
+package uploader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"client-server-fasthttp-test/internal/api"
+
+	"github.com/bytedance/sonic"
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	// ErrChecksumMismatch matches both a server that rejected the upload
+	// because the content did not match the client's checksum and a server
+	// that accepted it with a different checksum than the client computed.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrTooManyUploads matches a server that had no free upload slot.
+	ErrTooManyUploads = errors.New("too many concurrent uploads")
+	ErrUnauthorized   = errors.New("unauthorized")
+	// ErrForbidden matches a request the server refused, e.g. one made with
+	// a pre-signed URL that is invalid, expired or already used.
+	ErrForbidden = errors.New("forbidden")
+	ErrNotFound  = errors.New("not found")
+	// ErrTooLarge matches an upload over the size limit of the server or of
+	// a pre-signed URL.
+	ErrTooLarge = errors.New("upload too large")
+	// ErrUploadRejected matches a 417 answer to Expect: 100-continue; the
+	// server refused the upload before the body was sent and the reason is
+	// only in its log.
+	ErrUploadRejected = errors.New("server rejected the upload before the body was sent")
+	// ErrPreconditionFailed matches a write whose Condition did not hold.
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// ErrContentRejected matches an upload the server's upload hooks
+	// refused, including quarantined ones; the hook's message is in
+	// HTTPError.Response.Error.
+	ErrContentRejected = errors.New("upload rejected by the server's checks")
+	// ErrUnsupportedMediaType matches a file whose sniffed content type the
+	// server does not accept or that contradicts its name or Content-Type.
+	ErrUnsupportedMediaType = errors.New("unsupported media type")
+	// ErrInvalidArchive matches an archive the server could not extract,
+	// being corrupt or holding paths or links that leave the prefix.
+	ErrInvalidArchive = errors.New("invalid archive")
+)
+
+// HTTPError is returned for any response outside 2xx. Response is the
+// server's error body; it is zero when the server did not answer with JSON,
+// in which case Body holds the raw response.
+type HTTPError struct {
+	StatusCode int
+	Response   api.ErrorResponse
+	Body       []byte
+}
+
+// newHTTPError decodes body, which may be empty or not JSON at all.
+func newHTTPError(statusCode int, contentType, body []byte) *HTTPError {
+	httpErr := &HTTPError{
+		StatusCode: statusCode,
+		Body:       append([]byte(nil), body...),
+	}
+	if bytes.HasPrefix(contentType, []byte("application/json")) {
+		_ = sonic.Unmarshal(body, &httpErr.Response)
+	}
+
+	return httpErr
+}
+
+func newHTTPErrorFromResponse(resp *fasthttp.Response) *HTTPError {
+	return newHTTPError(resp.StatusCode(), resp.Header.ContentType(), resp.Body())
+}
+
+func (e *HTTPError) Error() string {
+	msg := e.Response.Error
+	switch {
+	case msg != "":
+	case e.StatusCode == http.StatusExpectationFailed:
+		msg = ErrUploadRejected.Error()
+	case len(e.Body) > 0 && len(e.Body) <= 256:
+		msg = strings.TrimSpace(string(e.Body))
+	default:
+		msg = http.StatusText(e.StatusCode)
+	}
+
+	return fmt.Sprintf("server returned %d: %s", e.StatusCode, msg)
+}
+
+// Code is the server's error code, or the one implied by the status when the
+// server sent none.
+func (e *HTTPError) Code() string {
+	if e.Response.Code != "" {
+		return e.Response.Code
+	}
+
+	return api.CodeForStatus(e.StatusCode)
+}
+
+func (e *HTTPError) Is(target error) bool {
+	switch target {
+	case ErrChecksumMismatch:
+		return e.Code() == api.CodeChecksumMismatch
+	case ErrTooManyUploads:
+		return e.Code() == api.CodeTooManyUploads
+	case ErrUnauthorized:
+		return e.Code() == api.CodeUnauthorized
+	case ErrForbidden:
+		return e.Code() == api.CodeForbidden
+	case ErrNotFound:
+		return e.Code() == api.CodeNotFound
+	case ErrTooLarge:
+		return e.Code() == api.CodeTooLarge
+	case ErrUploadRejected:
+		return e.StatusCode == http.StatusExpectationFailed
+	case ErrPreconditionFailed:
+		return e.Code() == api.CodePreconditionFailed
+	case ErrContentRejected:
+		return e.Code() == api.CodeRejected || e.Code() == api.CodeQuarantined
+	case ErrUnsupportedMediaType:
+		return e.Code() == api.CodeUnsupportedMediaType
+	case ErrInvalidArchive:
+		return e.Code() == api.CodeInvalidArchive
+	}
+
+	return false
+}
+
+// ChecksumMismatchError reports an upload the server accepted but with a
+// different checksum than the one computed while streaming it.
+type ChecksumMismatchError struct {
+	Local  string
+	Server string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("server checksum mismatch: local %s, server %q", e.Local, e.Server)
+}
+
+func (e *ChecksumMismatchError) Unwrap() error {
+	return ErrChecksumMismatch
+}
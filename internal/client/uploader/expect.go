@@ -0,0 +1,203 @@
+package uploader
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// doExpectContinue performs req on a dedicated connection: it sends the
+// headers with Expect: 100-continue, waits for the server's verdict and only
+// then streams the body produced by writeBody. fasthttp.Client always writes
+// the whole request before reading, so the exchange is done by hand.
+func (c *Client) doExpectContinue(ctx context.Context, req *fasthttp.Request, resp *fasthttp.Response, writeBody func(*bufio.Writer) error) error {
+	c.authorize(req)
+	conn, err := c.dialRequest(ctx, req.URI())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	deadline := time.Time{}
+	if d, ok := ctx.Deadline(); ok {
+		deadline = d
+	} else if c.cfg.RequestTimeout > 0 {
+		deadline = time.Now().Add(c.cfg.RequestTimeout)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return fmt.Errorf("set deadline: %w", err)
+	}
+
+	uri := req.URI()
+	req.Header.SetRequestURIBytes(uri.RequestURI())
+	req.Header.SetHostBytes(uri.Host())
+	req.Header.Set(fasthttp.HeaderExpect, "100-continue")
+	req.Header.SetContentLength(-1)
+	req.Header.SetConnectionClose()
+
+	br := bufio.NewReader(conn)
+	bw := bufio.NewWriter(conn)
+	if err := req.Header.Write(bw); err != nil {
+		return fmt.Errorf("write request headers: %w", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("write request headers: %w", err)
+	}
+
+	proceed, err := c.awaitContinue(conn, br, resp, deadline)
+	if err != nil {
+		return err
+	}
+	if !proceed {
+		// The server answered with its final status; the body is never sent.
+		if err := resp.ReadBody(br, 0); err != nil {
+			return fmt.Errorf("read response body: %w", err)
+		}
+		return nil
+	}
+
+	chunked := &chunkedWriter{w: bw}
+	body := bufio.NewWriterSize(chunked, max(c.cfg.ChunkSize, 4096))
+	if err := writeBody(body); err != nil {
+		return fmt.Errorf("stream multipart body: %w", err)
+	}
+	if err := body.Flush(); err != nil {
+		return fmt.Errorf("stream multipart body: %w", err)
+	}
+	if err := chunked.Close(); err != nil {
+		return fmt.Errorf("stream multipart body: %w", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("stream multipart body: %w", err)
+	}
+
+	if err := resp.Read(br); err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+
+	return nil
+}
+
+// awaitContinue waits up to ContinueTimeout for the first response line. It
+// returns true when the body should be sent: on 100 Continue or when the
+// server stays silent. Otherwise resp holds the final response headers.
+func (c *Client) awaitContinue(conn net.Conn, br *bufio.Reader, resp *fasthttp.Response, deadline time.Time) (bool, error) {
+	timeout := c.cfg.ContinueTimeout
+	if timeout <= 0 {
+		timeout = defaultContinueTimeout
+	}
+	waitUntil := time.Now().Add(timeout)
+	if !deadline.IsZero() && deadline.Before(waitUntil) {
+		waitUntil = deadline
+	}
+	if err := conn.SetReadDeadline(waitUntil); err != nil {
+		return false, fmt.Errorf("set read deadline: %w", err)
+	}
+
+	// Peek first so that a timeout never leaves a half-read status line.
+	if _, err := br.Peek(1); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) && (deadline.IsZero() || time.Now().Before(deadline)) {
+			return true, conn.SetReadDeadline(deadline)
+		}
+		return false, fmt.Errorf("wait for 100 continue: %w", err)
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return false, fmt.Errorf("set read deadline: %w", err)
+	}
+
+	resp.Reset()
+	if err := resp.Header.Read(br); err != nil {
+		return false, fmt.Errorf("read response headers: %w", err)
+	}
+	if resp.StatusCode() == fasthttp.StatusContinue {
+		resp.Reset()
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (c *Client) dialRequest(ctx context.Context, uri *fasthttp.URI) (net.Conn, error) {
+	host := string(uri.Host())
+	isTLS := string(uri.Scheme()) == "https"
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		port := "80"
+		if isTLS {
+			port = "443"
+		}
+		addr = net.JoinHostPort(host, port)
+	}
+
+	var conn net.Conn
+	var err error
+	if c.httpClient.Dial != nil {
+		conn, err = c.httpClient.Dial(addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", addr, err)
+	}
+	if !isTLS {
+		return conn, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if c.httpClient.TLSConfig != nil {
+		tlsConfig = c.httpClient.TLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("tls handshake with %s: %w", addr, err)
+	}
+
+	return tlsConn, nil
+}
+
+// chunkedWriter applies HTTP/1.1 chunked transfer encoding.
+type chunkedWriter struct {
+	w io.Writer
+}
+
+func (c *chunkedWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := fmt.Fprintf(c.w, "%x\r\n", len(p)); err != nil {
+		return 0, err
+	}
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if _, err := io.WriteString(c.w, "\r\n"); err != nil {
+		return n, err
+	}
+
+	return n, nil
+}
+
+// Close writes the terminating zero-length chunk.
+func (c *chunkedWriter) Close() error {
+	_, err := io.WriteString(c.w, "0\r\n\r\n")
+	return err
+}
@@ -0,0 +1,156 @@
+package uploader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"client-server-fasthttp-test/internal/api"
+
+	"github.com/bytedance/sonic"
+	"github.com/valyala/fasthttp"
+)
+
+type FileInfo = api.FileInfo
+
+// StatContext issues a HEAD request for a stored file. The returned FileInfo
+// has no Name; callers know which file they asked for.
+func (c *Client) StatContext(ctx context.Context, fileURL string) (*FileInfo, error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.Header.SetMethod(fasthttp.MethodHead)
+	req.SetRequestURI(fileURL)
+	resp.SkipBody = true
+
+	if err := c.send(ctx, req, resp); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return nil, fmt.Errorf("stat file: %w", newHTTPErrorFromResponse(resp))
+	}
+
+	return fileInfoFromHeaders(resp), nil
+}
+
+// DownloadContext streams a stored file into w in ChunkSize blocks and checks
+// the content against the checksum advertised by the server.
+func (c *Client) DownloadContext(ctx context.Context, fileURL string, w io.Writer) (*FileInfo, error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.Header.SetMethod(fasthttp.MethodGet)
+	req.SetRequestURI(fileURL)
+	resp.StreamBody = true
+
+	if err := c.send(ctx, req, resp); err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.CloseBodyStream() }()
+
+	if resp.StatusCode() != fasthttp.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.BodyStream(), 4096))
+		return nil, fmt.Errorf("download file: %w", newHTTPError(resp.StatusCode(), resp.Header.ContentType(), body))
+	}
+
+	info := fileInfoFromHeaders(resp)
+	hasher := sha256.New()
+	n, err := io.CopyBuffer(io.MultiWriter(w, hasher), resp.BodyStream(), make([]byte, c.cfg.ChunkSize))
+	if err != nil {
+		return nil, fmt.Errorf("download file: %w", err)
+	}
+	info.Size = n
+
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	if info.SHA256 != "" && actual != info.SHA256 {
+		return nil, fmt.Errorf("download file: checksum mismatch: expected %s, got %s", info.SHA256, actual)
+	}
+	info.SHA256 = actual
+
+	return info, nil
+}
+
+func (c *Client) ListContext(ctx context.Context, listURL string) ([]FileInfo, error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.Header.SetMethod(fasthttp.MethodGet)
+	req.SetRequestURI(listURL)
+
+	if err := c.send(ctx, req, resp); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return nil, fmt.Errorf("list files: %w", newHTTPErrorFromResponse(resp))
+	}
+
+	var payload api.FileList
+	if err := sonic.Unmarshal(resp.Body(), &payload); err != nil {
+		return nil, fmt.Errorf("decode file list: %w", err)
+	}
+
+	return payload.Files, nil
+}
+
+func (c *Client) DeleteContext(ctx context.Context, fileURL string) error {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.Header.SetMethod(fasthttp.MethodDelete)
+	req.SetRequestURI(fileURL)
+
+	if err := c.send(ctx, req, resp); err != nil {
+		return err
+	}
+	if resp.StatusCode() != fasthttp.StatusNoContent && resp.StatusCode() != fasthttp.StatusOK {
+		return fmt.Errorf("delete file: %w", newHTTPErrorFromResponse(resp))
+	}
+
+	return nil
+}
+
+func (c *Client) send(ctx context.Context, req *fasthttp.Request, resp *fasthttp.Response) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if err := c.doRequest(ctx, req, resp); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return fmt.Errorf("send request: %w", ctxErr)
+		}
+		return fmt.Errorf("send request: %w", err)
+	}
+
+	return nil
+}
+
+func fileInfoFromHeaders(resp *fasthttp.Response) *FileInfo {
+	info := &FileInfo{
+		Size:      int64(resp.Header.ContentLength()),
+		SHA256:    string(resp.Header.Peek(HeaderChecksumSHA256)),
+		Modified:  string(resp.Header.Peek(fasthttp.HeaderLastModified)),
+		ExpiresAt: string(resp.Header.Peek(api.HeaderExpiresAt)),
+		VersionID: string(resp.Header.Peek(api.HeaderVersionID)),
+	}
+	for key, value := range resp.Header.All() {
+		if len(key) > len(api.HeaderMetadataPrefix) && strings.EqualFold(string(key[:len(api.HeaderMetadataPrefix)]), api.HeaderMetadataPrefix) {
+			if info.Metadata == nil {
+				info.Metadata = make(map[string]string)
+			}
+			info.Metadata[strings.ToLower(string(key[len(api.HeaderMetadataPrefix):]))] = string(value)
+		}
+	}
+
+	return info
+}
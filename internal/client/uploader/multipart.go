@@ -0,0 +1,354 @@
+package uploader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"client-server-fasthttp-test/internal/api"
+
+	"github.com/bytedance/sonic"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	DefaultPartSize        = 8 << 20
+	DefaultPartConcurrency = 4
+
+	// abortTimeout bounds the cleanup request sent after a failed multipart
+	// upload, which may run after the caller's context is done.
+	abortTimeout = 10 * time.Second
+)
+
+// MultipartUploadRequest uploads one file in parts that are sent
+// concurrently and assembled by the server.
+type MultipartUploadRequest struct {
+	// URL of the multipart endpoint, e.g. http://host:8080/uploads.
+	URL      string
+	FilePath string
+	// FileName is the stored name; defaults to the base name of FilePath.
+	FileName string
+	// PartSize defaults to DefaultPartSize. It is raised when the file would
+	// otherwise need more than api.MaxPartNumber parts.
+	PartSize int64
+	// Concurrency is the number of parts in flight; defaults to
+	// DefaultPartConcurrency.
+	Concurrency int
+	// Metadata is stored with the file, see UploadRequest.
+	Metadata map[string]string
+	// TTL of the file, see UploadRequest.
+	TTL time.Duration
+	// Condition of the upload, see UploadRequest. It is checked when the
+	// upload is completed.
+	Condition Condition
+}
+
+type filePart struct {
+	number int
+	offset int64
+	size   int64
+	sha256 string
+}
+
+// UploadMultipartContext uploads uploadReq.FilePath as a multipart upload.
+// Every part is sent with its checksum, and the server verifies both the
+// composite checksum and the SHA-256 of the whole file before storing it.
+// On failure the upload is aborted so that the server drops the parts.
+func (c *Client) UploadMultipartContext(ctx context.Context, uploadReq MultipartUploadRequest) (*UploadResponse, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := validateMultipartUploadRequest(&uploadReq); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(uploadReq.FilePath)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat file: %w", err)
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("file path %q points to a directory", uploadReq.FilePath)
+	}
+	parts, fileSHA256, err := c.hashParts(file, info.Size(), uploadReq.PartSize)
+	if err != nil {
+		return nil, err
+	}
+	digests := make([]string, len(parts))
+	for i, part := range parts {
+		digests[i] = part.sha256
+	}
+	composite, err := api.CompositeSHA256(digests)
+	if err != nil {
+		return nil, err
+	}
+
+	init := api.MultipartInit{Name: uploadReq.FileName, Size: info.Size(), Metadata: uploadReq.Metadata}
+	if uploadReq.TTL > 0 {
+		init.TTL = uploadReq.TTL.String()
+	}
+	session, err := c.initMultipart(ctx, uploadReq.URL, init)
+	if err != nil {
+		return nil, err
+	}
+	uploadURL := strings.TrimSuffix(uploadReq.URL, "/") + "/" + url.PathEscape(session.UploadID)
+
+	if err := c.putParts(ctx, uploadURL, file, parts, uploadReq.Concurrency); err != nil {
+		return nil, c.abortMultipart(ctx, uploadURL, err)
+	}
+
+	complete := api.MultipartComplete{SHA256: fileSHA256, CompositeSHA256: composite}
+	for _, part := range parts {
+		complete.Parts = append(complete.Parts, api.CompletedPart{PartNumber: part.number, SHA256: part.sha256})
+	}
+	uploadResp, err := c.completeMultipart(ctx, uploadURL, complete, uploadReq.Condition, fileSHA256)
+	var mismatch *ChecksumMismatchError
+	switch {
+	case errors.As(err, &mismatch):
+		// The server stored the file; there is nothing left to abort.
+		return uploadResp, err
+	case err != nil:
+		return nil, c.abortMultipart(ctx, uploadURL, err)
+	}
+	if result := uploadResp.Result; result != nil && result.CompositeSHA256 != composite {
+		return uploadResp, &ChecksumMismatchError{Local: composite, Server: result.CompositeSHA256}
+	}
+
+	return uploadResp, nil
+}
+
+// hashParts reads the file once to split it into parts and compute the
+// checksum of every part and of the whole file.
+func (c *Client) hashParts(file *os.File, size, partSize int64) ([]filePart, string, error) {
+	partSize = max(partSize, (size+api.MaxPartNumber-1)/api.MaxPartNumber)
+	count := max(1, int((size+partSize-1)/partSize))
+
+	parts := make([]filePart, 0, count)
+	whole := sha256.New()
+	buf := make([]byte, max(c.cfg.ChunkSize, 32<<10))
+	for i := range count {
+		part := filePart{number: i + 1, offset: int64(i) * partSize}
+		part.size = min(partSize, size-part.offset)
+
+		hasher := sha256.New()
+		section := io.NewSectionReader(file, part.offset, part.size)
+		if _, err := io.CopyBuffer(io.MultiWriter(whole, hasher), section, buf); err != nil {
+			return nil, "", fmt.Errorf("read part %d: %w", part.number, err)
+		}
+		part.sha256 = hex.EncodeToString(hasher.Sum(nil))
+		parts = append(parts, part)
+	}
+
+	return parts, hex.EncodeToString(whole.Sum(nil)), nil
+}
+
+func (c *Client) initMultipart(ctx context.Context, uploadsURL string, init api.MultipartInit) (*api.MultipartSession, error) {
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	if err := c.sendJSON(ctx, fasthttp.MethodPost, uploadsURL, init, resp); err != nil {
+		return nil, fmt.Errorf("start multipart upload: %w", err)
+	}
+	if resp.StatusCode() != fasthttp.StatusCreated {
+		return nil, fmt.Errorf("start multipart upload: %w", newHTTPErrorFromResponse(resp))
+	}
+
+	var session api.MultipartSession
+	if err := sonic.Unmarshal(resp.Body(), &session); err != nil {
+		return nil, fmt.Errorf("decode multipart session: %w", err)
+	}
+	if session.UploadID == "" {
+		return nil, errors.New("start multipart upload: no upload id in response")
+	}
+
+	return &session, nil
+}
+
+// putParts uploads parts with up to concurrency requests in flight and stops
+// at the first failure.
+func (c *Client) putParts(ctx context.Context, uploadURL string, file *os.File, parts []filePart, concurrency int) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	queue := make(chan filePart)
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	for range min(concurrency, len(parts)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range queue {
+				if err := c.putPart(ctx, uploadURL, file, part); err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel(err)
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, part := range parts {
+		select {
+		case queue <- part:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	return context.Cause(ctx)
+}
+
+func (c *Client) putPart(ctx context.Context, uploadURL string, file *os.File, part filePart) error {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.Header.SetMethod(fasthttp.MethodPut)
+	req.SetRequestURI(uploadURL + "/parts/" + strconv.Itoa(part.number))
+	req.Header.SetContentType("application/octet-stream")
+	req.Header.Set(HeaderChecksumSHA256, part.sha256)
+	req.SetBodyStream(io.NewSectionReader(file, part.offset, part.size), int(part.size))
+
+	if err := c.send(ctx, req, resp); err != nil {
+		return fmt.Errorf("upload part %d: %w", part.number, err)
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return fmt.Errorf("upload part %d: %w", part.number, newHTTPErrorFromResponse(resp))
+	}
+
+	var result api.PartResult
+	if err := sonic.Unmarshal(resp.Body(), &result); err != nil {
+		return fmt.Errorf("decode part %d response: %w", part.number, err)
+	}
+	if result.SHA256 != part.sha256 {
+		return fmt.Errorf("upload part %d: %w", part.number, &ChecksumMismatchError{Local: part.sha256, Server: result.SHA256})
+	}
+
+	return nil
+}
+
+func (c *Client) completeMultipart(ctx context.Context, uploadURL string, complete api.MultipartComplete, condition Condition, localSHA256 string) (*UploadResponse, error) {
+	req, err := newJSONRequest(fasthttp.MethodPost, uploadURL+"/complete", complete)
+	if err != nil {
+		return nil, err
+	}
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	condition.setHeaders(&req.Header)
+	if err := c.send(ctx, req, resp); err != nil {
+		return nil, fmt.Errorf("complete multipart upload: %w", err)
+	}
+
+	return newUploadResponse(resp, localSHA256)
+}
+
+// abortMultipart asks the server to drop the parts of a failed upload and
+// returns cause, joined with the abort failure if any.
+func (c *Client) abortMultipart(ctx context.Context, uploadURL string, cause error) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), abortTimeout)
+	defer cancel()
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.Header.SetMethod(fasthttp.MethodDelete)
+	req.SetRequestURI(uploadURL)
+
+	err := c.send(ctx, req, resp)
+	if err == nil && resp.StatusCode() != fasthttp.StatusNoContent && resp.StatusCode() != fasthttp.StatusNotFound {
+		err = newHTTPErrorFromResponse(resp)
+	}
+	if err != nil {
+		return errors.Join(cause, fmt.Errorf("abort multipart upload: %w", err))
+	}
+
+	return cause
+}
+
+func (c *Client) sendJSON(ctx context.Context, method, uri string, body any, resp *fasthttp.Response) error {
+	req, err := newJSONRequest(method, uri, body)
+	if err != nil {
+		return err
+	}
+	defer fasthttp.ReleaseRequest(req)
+
+	return c.send(ctx, req, resp)
+}
+
+// newJSONRequest returns a request with body encoded as JSON; the caller
+// releases it.
+func newJSONRequest(method, uri string, body any) (*fasthttp.Request, error) {
+	payload, err := sonic.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("encode request: %w", err)
+	}
+
+	req := fasthttp.AcquireRequest()
+	req.Header.SetMethod(method)
+	req.SetRequestURI(uri)
+	req.Header.SetContentType("application/json")
+	req.SetBody(payload)
+
+	return req, nil
+}
+
+func validateMultipartUploadRequest(uploadReq *MultipartUploadRequest) error {
+	if uploadReq.URL == "" {
+		return errors.New("url is required")
+	}
+	if uploadReq.FilePath == "" {
+		return errors.New("file path is required")
+	}
+	if uploadReq.FileName == "" {
+		uploadReq.FileName = filepath.Base(uploadReq.FilePath)
+	}
+	if uploadReq.PartSize < 0 {
+		return errors.New("part size must not be negative")
+	}
+	if uploadReq.PartSize == 0 {
+		uploadReq.PartSize = DefaultPartSize
+	}
+	if uploadReq.Concurrency < 0 {
+		return errors.New("concurrency must not be negative")
+	}
+	if uploadReq.Concurrency == 0 {
+		uploadReq.Concurrency = DefaultPartConcurrency
+	}
+	if uploadReq.TTL < 0 {
+		return errors.New("ttl must not be negative")
+	}
+	if err := uploadReq.Condition.validate(); err != nil {
+		return err
+	}
+
+	return api.ValidateMetadata(uploadReq.Metadata)
+}
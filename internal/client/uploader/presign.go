@@ -0,0 +1,126 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"client-server-fasthttp-test/internal/api"
+
+	"github.com/bytedance/sonic"
+	"github.com/valyala/fasthttp"
+)
+
+// ErrPresignedURLExpired is returned by UploadPresignedContext for a URL
+// that has expired, without contacting the server.
+var ErrPresignedURLExpired = errors.New("pre-signed URL expired")
+
+// PresignRequest asks for a pre-signed URL, see api.PresignRequest.
+type PresignRequest = api.PresignRequest
+
+// PresignResult is the answer of the admin API; URL is relative to the
+// upload server.
+type PresignResult = api.PresignResult
+
+// PresignedURL is what a pre-signed URL grants, as read by
+// ParsePresignedURL.
+type PresignedURL struct {
+	// Name is the file name a pre-signed upload must use; empty for
+	// downloads.
+	Name string
+	// MaxSize caps the file size of an upload; zero means only the server
+	// limit applies.
+	MaxSize   int64
+	ExpiresAt time.Time
+}
+
+// PresignContext asks the admin API at presignURL, e.g.
+// "http://host:6061/admin/presign", for a pre-signed URL. It is meant for a
+// coordinator holding the admin token, which hands the URL to a worker that
+// holds no credentials.
+func (c *Client) PresignContext(ctx context.Context, presignURL, adminToken string, presignReq PresignRequest) (*PresignResult, error) {
+	req, err := newJSONRequest(fasthttp.MethodPost, presignURL, presignReq)
+	if err != nil {
+		return nil, err
+	}
+	defer fasthttp.ReleaseRequest(req)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+adminToken)
+	if err := c.send(ctx, req, resp); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return nil, fmt.Errorf("presign: %w", newHTTPErrorFromResponse(resp))
+	}
+
+	var result PresignResult
+	if err := sonic.Unmarshal(resp.Body(), &result); err != nil {
+		return nil, fmt.Errorf("decode presign result: %w", err)
+	}
+
+	return &result, nil
+}
+
+// ParsePresignedURL reads the grant of a pre-signed URL so that it can be
+// checked before use. Only the server can verify the signature.
+func ParsePresignedURL(rawURL string) (PresignedURL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return PresignedURL{}, fmt.Errorf("parse pre-signed URL: %w", err)
+	}
+	query := u.Query()
+	if !query.Has(api.PresignSignatureParam) {
+		return PresignedURL{}, errors.New("not a pre-signed URL: no signature")
+	}
+
+	expires, err := strconv.ParseInt(query.Get(api.PresignExpiresParam), 10, 64)
+	if err != nil {
+		return PresignedURL{}, fmt.Errorf("invalid %s in pre-signed URL", api.PresignExpiresParam)
+	}
+	presigned := PresignedURL{
+		Name:      query.Get(api.PresignNameParam),
+		ExpiresAt: time.Unix(expires, 0),
+	}
+	if raw := query.Get(api.PresignMaxSizeParam); raw != "" {
+		presigned.MaxSize, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || presigned.MaxSize <= 0 {
+			return PresignedURL{}, fmt.Errorf("invalid %s in pre-signed URL", api.PresignMaxSizeParam)
+		}
+	}
+
+	return presigned, nil
+}
+
+// UploadPresignedContext uploads the file at filePath through a pre-signed
+// upload URL, under the name the URL grants. Expiry and size are checked
+// before anything is sent. The URL works once: after a successful upload the
+// server rejects it with ErrForbidden, while a failed upload may be retried.
+func (c *Client) UploadPresignedContext(ctx context.Context, presignedURL, filePath string) (*UploadResponse, error) {
+	presigned, err := ParsePresignedURL(presignedURL)
+	if err != nil {
+		return nil, err
+	}
+	if presigned.Name == "" {
+		return nil, errors.New("not a pre-signed upload URL: no file name")
+	}
+	if !time.Now().Before(presigned.ExpiresAt) {
+		return nil, fmt.Errorf("%w at %s", ErrPresignedURLExpired, presigned.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+	if presigned.MaxSize > 0 {
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("stat file %q: %w", filePath, err)
+		}
+		if info.Size() > presigned.MaxSize {
+			return nil, fmt.Errorf("%w: file %q has %d bytes, the pre-signed URL allows %d", ErrTooLarge, filePath, info.Size(), presigned.MaxSize)
+		}
+	}
+
+	return c.UploadFileContext(ctx, UploadRequest{URL: presignedURL, FilePath: filePath, FileName: presigned.Name})
+}
@@ -2,27 +2,50 @@ package uploader
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"maps"
 	"mime/multipart"
+	"net/textproto"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"client-server-fasthttp-test/internal/api"
+
+	"github.com/bytedance/sonic"
 	"github.com/valyala/fasthttp"
 )
 
 const (
-	ChecksumFieldSHA256 = "checksum_sha256"
+	ChecksumFieldSHA256  = api.ChecksumFieldSHA256
+	HeaderChecksumSHA256 = api.HeaderChecksumSHA256
+	HeaderUploadSize     = api.HeaderUploadSize
+
+	defaultContinueTimeout = time.Second
 )
 
 type Config struct {
 	ChunkSize      int
 	FormFieldName  string
 	RequestTimeout time.Duration
+	// ExpectContinue sends the headers, including the declared size and
+	// checksum, with Expect: 100-continue and streams the body only after the
+	// server agrees. The checksum costs an extra read of the file.
+	ExpectContinue bool
+	// ContinueTimeout is how long to wait for 100 Continue before sending
+	// the body anyway, for servers that ignore Expect. Defaults to 1s.
+	ContinueTimeout time.Duration
+	// AuthToken is sent as a bearer token with every request that does not
+	// carry credentials of its own.
+	AuthToken string
 }
 
 type Client struct {
@@ -30,22 +53,79 @@ type Client struct {
 	cfg        Config
 }
 
-type uploadFile struct {
-	path string
-	name string
+// uploadSource is the payload of one upload. Files are opened lazily so that
+// the checksum can be computed before the body is streamed; a reader can
+// only be consumed once.
+type uploadSource struct {
+	path        string
+	reader      io.Reader
+	name        string
+	size        int64
+	contentType string
+	metadata    map[string]string
+	ttl         time.Duration
+	condition   Condition
+	extractTo   string
 }
 
 type UploadRequest struct {
 	URL      string
 	FilePath string
 	FileName string
+	// Metadata is stored with the file and returned by Stat, Download and
+	// List, see api.ValidateMetadata for the rules.
+	Metadata map[string]string
+	// TTL asks the server to delete the file after this long. The server
+	// may shorten it; FileInfo.ExpiresAt has the outcome. Zero keeps the
+	// file until a retention rule of the server applies.
+	TTL time.Duration
+	// Condition guards against replacing a version of the file the caller
+	// has not seen.
+	Condition Condition
+	// ExtractTo asks the server to extract the file, a tar, tar.gz or zip
+	// archive, under this prefix instead of storing it. The result then has
+	// the checksum of the archive and UploadResponse.Result.Archive lists
+	// the extracted files.
+	ExtractTo string
+}
+
+// ReaderUploadRequest uploads the content of Reader, e.g. an artifact built
+// in memory or the output of a subprocess, until EOF.
+type ReaderUploadRequest struct {
+	URL    string
+	Reader io.Reader
+	// FileName is the name the server stores the upload under.
+	FileName string
+	// Size is the payload length, sent as HeaderUploadSize so the server can
+	// reject an oversized upload early. Zero means unknown.
+	Size int64
+	// ContentType of the file part; defaults to application/octet-stream.
+	ContentType string
+	// Metadata is stored with the file, see UploadRequest.
+	Metadata map[string]string
+	// TTL of the file, see UploadRequest.
+	TTL time.Duration
+	// Condition of the upload, see UploadRequest.
+	Condition Condition
+	// ExtractTo of the archive, see UploadRequest.
+	ExtractTo string
 }
 
+// UploadResponse is a successful upload. Responses outside 2xx are returned
+// as *HTTPError instead.
 type UploadResponse struct {
 	StatusCode int
 	Body       []byte
+	// SHA256 is the digest computed locally while streaming the file.
+	SHA256 string
+	// Result is the decoded server response, or nil when the server did not
+	// answer with JSON.
+	Result *UploadResult
 }
 
+// UploadResult is the JSON body returned by the upload endpoint.
+type UploadResult = api.UploadResult
+
 func New(httpClient *fasthttp.Client, cfg Config) (*Client, error) {
 	if httpClient == nil {
 		httpClient = &fasthttp.Client{}
@@ -58,15 +138,31 @@ func New(httpClient *fasthttp.Client, cfg Config) (*Client, error) {
 }
 
 func (c *Client) UploadFileContext(ctx context.Context, uploadReq UploadRequest) (*UploadResponse, error) {
-	if ctx == nil {
-		ctx = context.Background()
+	url, source, err := validateUploadRequest(uploadReq)
+	if err != nil {
+		return nil, err
 	}
 
-	url, fileMeta, err := validateUploadRequest(uploadReq)
+	return c.upload(ctx, url, source)
+}
+
+// UploadReaderContext streams uploadReq.Reader with the same chunking and
+// checksumming as UploadFileContext. With ExpectContinue the checksum cannot
+// be announced up front, so the server verifies the multipart field only.
+func (c *Client) UploadReaderContext(ctx context.Context, uploadReq ReaderUploadRequest) (*UploadResponse, error) {
+	url, source, err := validateReaderUploadRequest(uploadReq)
 	if err != nil {
 		return nil, err
 	}
 
+	return c.upload(ctx, url, source)
+}
+
+func (c *Client) upload(ctx context.Context, url string, source uploadSource) (*UploadResponse, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
 	req := fasthttp.AcquireRequest()
 	resp := fasthttp.AcquireResponse()
 	defer fasthttp.ReleaseRequest(req)
@@ -77,17 +173,61 @@ func (c *Client) UploadFileContext(ctx context.Context, uploadReq UploadRequest)
 
 	boundary := multipart.NewWriter(io.Discard).Boundary()
 	req.Header.SetContentType("multipart/form-data; boundary=" + boundary)
+	if source.size > 0 {
+		req.Header.Set(HeaderUploadSize, strconv.FormatInt(source.size, 10))
+	}
+	if source.ttl > 0 {
+		req.Header.Set(api.HeaderUploadTTL, source.ttl.String())
+	}
+	if source.extractTo != "" {
+		req.Header.Set(api.HeaderUploadExtract, source.extractTo)
+	}
+	source.condition.setHeaders(&req.Header)
+
+	if c.cfg.ExpectContinue {
+		var localSHA256 string
+		if source.path != "" {
+			checksum, err := fileSHA256(source.path)
+			if err != nil {
+				return nil, err
+			}
+			localSHA256 = checksum
+			req.Header.Set(HeaderChecksumSHA256, localSHA256)
+		}
 
-	streamErrCh := make(chan error, 1)
+		err := c.doExpectContinue(ctx, req, resp, func(w *bufio.Writer) error {
+			streamedSHA256, err := c.writeMultipartBody(w, boundary, source)
+			if err == nil {
+				localSHA256 = streamedSHA256
+			}
+			return err
+		})
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, fmt.Errorf("send request: %w", ctxErr)
+			}
+			return nil, fmt.Errorf("send request: %w", err)
+		}
+
+		return newUploadResponse(resp, localSHA256)
+	}
+
+	type streamResult struct {
+		sha256 string
+		err    error
+	}
+	streamCh := make(chan streamResult, 1)
 	req.SetBodyStreamWriter(func(w *bufio.Writer) {
-		streamErrCh <- c.writeMultipartBody(w, boundary, fileMeta)
+		sha256, err := c.writeMultipartBody(w, boundary, source)
+		streamCh <- streamResult{sha256: sha256, err: err}
 	})
 
 	doErr := c.doRequest(ctx, req, resp)
 	if doErr != nil {
 		var streamErr error
 		select {
-		case streamErr = <-streamErrCh:
+		case result := <-streamCh:
+			streamErr = result.err
 		default:
 		}
 
@@ -100,18 +240,56 @@ func (c *Client) UploadFileContext(ctx context.Context, uploadReq UploadRequest)
 		return nil, fmt.Errorf("send request: %w", doErr)
 	}
 
-	streamErr := <-streamErrCh
-	if streamErr != nil {
-		return nil, fmt.Errorf("stream multipart body: %w", streamErr)
+	stream := <-streamCh
+	if stream.err != nil {
+		return nil, fmt.Errorf("stream multipart body: %w", stream.err)
 	}
 
-	return &UploadResponse{
+	return newUploadResponse(resp, stream.sha256)
+}
+
+// newUploadResponse turns a response outside 2xx into an *HTTPError,
+// decodes a successful one and cross-checks the checksum the server reports
+// against the local one. On a mismatch the response is returned together with
+// a *ChecksumMismatchError, since the server did store the file.
+func newUploadResponse(resp *fasthttp.Response, localSHA256 string) (*UploadResponse, error) {
+	if resp.StatusCode() < 200 || resp.StatusCode() >= 300 {
+		return nil, newHTTPErrorFromResponse(resp)
+	}
+
+	uploadResp := &UploadResponse{
 		StatusCode: resp.StatusCode(),
 		Body:       append([]byte(nil), resp.Body()...),
-	}, nil
+		SHA256:     localSHA256,
+	}
+	if !bytes.HasPrefix(resp.Header.ContentType(), []byte("application/json")) {
+		return uploadResp, nil
+	}
+
+	var result UploadResult
+	if err := sonic.Unmarshal(uploadResp.Body, &result); err != nil {
+		return nil, fmt.Errorf("decode upload response: %w", err)
+	}
+	uploadResp.Result = &result
+
+	if result.SHA256 != localSHA256 {
+		return uploadResp, &ChecksumMismatchError{Local: localSHA256, Server: result.SHA256}
+	}
+
+	return uploadResp, nil
+}
+
+// authorize adds the configured bearer token unless req already carries an
+// Authorization header, e.g. the admin token of a presign request.
+func (c *Client) authorize(req *fasthttp.Request) {
+	if c.cfg.AuthToken == "" || len(req.Header.Peek(fasthttp.HeaderAuthorization)) > 0 {
+		return
+	}
+	req.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+c.cfg.AuthToken)
 }
 
 func (c *Client) doRequest(ctx context.Context, req *fasthttp.Request, resp *fasthttp.Response) error {
+	c.authorize(req)
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
@@ -129,60 +307,116 @@ func (c *Client) doRequest(ctx context.Context, req *fasthttp.Request, resp *fas
 	return c.httpClient.Do(req, resp)
 }
 
-func (c *Client) writeMultipartBody(w *bufio.Writer, boundary string, fileMeta uploadFile) error {
+// writeMultipartBody streams the source, its checksum field and its metadata
+// fields and returns the checksum.
+func (c *Client) writeMultipartBody(w *bufio.Writer, boundary string, source uploadSource) (string, error) {
 	mw := multipart.NewWriter(w)
 	if err := mw.SetBoundary(boundary); err != nil {
-		return fmt.Errorf("set multipart boundary: %w", err)
+		return "", fmt.Errorf("set multipart boundary: %w", err)
 	}
 
 	buf := make([]byte, c.cfg.ChunkSize)
-	partWriter, err := mw.CreateFormFile(c.cfg.FormFieldName, fileMeta.name)
+	partWriter, err := mw.CreatePart(filePartHeader(c.cfg.FormFieldName, source))
 	if err != nil {
-		return fmt.Errorf("create form file part: %w", err)
+		return "", fmt.Errorf("create form file part: %w", err)
 	}
 
-	file, err := os.Open(fileMeta.path)
+	body, err := source.open()
 	if err != nil {
-		return fmt.Errorf("open file %q: %w", fileMeta.path, err)
+		return "", err
 	}
 
 	hasher := sha256.New()
-	if _, err := io.CopyBuffer(io.MultiWriter(partWriter, hasher), file, buf); err != nil {
-		_ = file.Close()
-		return fmt.Errorf("copy file to multipart body: %w", err)
+	if _, err := io.CopyBuffer(io.MultiWriter(partWriter, hasher), body, buf); err != nil {
+		_ = body.Close()
+		return "", fmt.Errorf("copy %s to multipart body: %w", source, err)
 	}
-	fileSHA256 := hex.EncodeToString(hasher.Sum(nil))
+	checksum := hex.EncodeToString(hasher.Sum(nil))
 
-	if err := file.Close(); err != nil {
-		return fmt.Errorf("close file %q: %w", fileMeta.path, err)
+	if err := body.Close(); err != nil {
+		return "", fmt.Errorf("close %s: %w", source, err)
 	}
 
-	if err := mw.WriteField(ChecksumFieldSHA256, fileSHA256); err != nil {
-		return fmt.Errorf("write checksum form field: %w", err)
+	if err := mw.WriteField(ChecksumFieldSHA256, checksum); err != nil {
+		return "", fmt.Errorf("write checksum form field: %w", err)
+	}
+	for _, key := range slices.Sorted(maps.Keys(source.metadata)) {
+		if err := mw.WriteField(api.MetadataFieldPrefix+key, source.metadata[key]); err != nil {
+			return "", fmt.Errorf("write metadata form field: %w", err)
+		}
 	}
 
 	if err := mw.Close(); err != nil {
-		return fmt.Errorf("close multipart writer: %w", err)
+		return "", fmt.Errorf("close multipart writer: %w", err)
 	}
 
-	return nil
+	return checksum, nil
 }
 
-func validateUploadRequest(uploadReq UploadRequest) (string, uploadFile, error) {
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// filePartHeader mirrors multipart.Writer.CreateFormFile with a configurable
+// content type.
+func filePartHeader(fieldName string, source uploadSource) textproto.MIMEHeader {
+	contentType := source.contentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+		quoteEscaper.Replace(fieldName), quoteEscaper.Replace(source.name)))
+	header.Set("Content-Type", contentType)
+
+	return header
+}
+
+func (s uploadSource) open() (io.ReadCloser, error) {
+	if s.reader != nil {
+		return io.NopCloser(s.reader), nil
+	}
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("open file %q: %w", s.path, err)
+	}
+
+	return file, nil
+}
+
+func (s uploadSource) String() string {
+	if s.reader != nil {
+		return fmt.Sprintf("reader %q", s.name)
+	}
+
+	return fmt.Sprintf("file %q", s.path)
+}
+
+func validateUploadRequest(uploadReq UploadRequest) (string, uploadSource, error) {
 	if uploadReq.URL == "" {
-		return "", uploadFile{}, fmt.Errorf("url is required")
+		return "", uploadSource{}, fmt.Errorf("url is required")
 	}
 
 	if uploadReq.FilePath == "" {
-		return "", uploadFile{}, fmt.Errorf("file path is required")
+		return "", uploadSource{}, fmt.Errorf("file path is required")
 	}
 
 	fileInfo, err := os.Stat(uploadReq.FilePath)
 	if err != nil {
-		return "", uploadFile{}, fmt.Errorf("stat file %q: %w", uploadReq.FilePath, err)
+		return "", uploadSource{}, fmt.Errorf("stat file %q: %w", uploadReq.FilePath, err)
 	}
 	if fileInfo.IsDir() {
-		return "", uploadFile{}, fmt.Errorf("file path %q points to a directory", uploadReq.FilePath)
+		return "", uploadSource{}, fmt.Errorf("file path %q points to a directory", uploadReq.FilePath)
+	}
+
+	if err := api.ValidateMetadata(uploadReq.Metadata); err != nil {
+		return "", uploadSource{}, err
+	}
+	if uploadReq.TTL < 0 {
+		return "", uploadSource{}, fmt.Errorf("ttl must not be negative")
+	}
+	if err := uploadReq.Condition.validate(); err != nil {
+		return "", uploadSource{}, err
 	}
 
 	fileName := uploadReq.FileName
@@ -190,8 +424,63 @@ func validateUploadRequest(uploadReq UploadRequest) (string, uploadFile, error)
 		fileName = filepath.Base(uploadReq.FilePath)
 	}
 
-	return uploadReq.URL, uploadFile{
-		path: uploadReq.FilePath,
-		name: fileName,
+	return uploadReq.URL, uploadSource{
+		path:      uploadReq.FilePath,
+		name:      fileName,
+		size:      fileInfo.Size(),
+		metadata:  uploadReq.Metadata,
+		ttl:       uploadReq.TTL,
+		condition: uploadReq.Condition,
+		extractTo: uploadReq.ExtractTo,
 	}, nil
 }
+
+func validateReaderUploadRequest(uploadReq ReaderUploadRequest) (string, uploadSource, error) {
+	if uploadReq.URL == "" {
+		return "", uploadSource{}, fmt.Errorf("url is required")
+	}
+	if uploadReq.Reader == nil {
+		return "", uploadSource{}, fmt.Errorf("reader is required")
+	}
+	if uploadReq.FileName == "" {
+		return "", uploadSource{}, fmt.Errorf("file name is required")
+	}
+	if uploadReq.Size < 0 {
+		return "", uploadSource{}, fmt.Errorf("size must not be negative")
+	}
+	if err := api.ValidateMetadata(uploadReq.Metadata); err != nil {
+		return "", uploadSource{}, err
+	}
+	if uploadReq.TTL < 0 {
+		return "", uploadSource{}, fmt.Errorf("ttl must not be negative")
+	}
+	if err := uploadReq.Condition.validate(); err != nil {
+		return "", uploadSource{}, err
+	}
+
+	return uploadReq.URL, uploadSource{
+		reader:      uploadReq.Reader,
+		name:        uploadReq.FileName,
+		size:        uploadReq.Size,
+		contentType: uploadReq.ContentType,
+		metadata:    uploadReq.Metadata,
+		ttl:         uploadReq.TTL,
+		condition:   uploadReq.Condition,
+		extractTo:   uploadReq.ExtractTo,
+	}, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("open file %q: %w", path, err)
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", fmt.Errorf("hash file %q: %w", path, err)
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
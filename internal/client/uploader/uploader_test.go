@@ -5,16 +5,20 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"client-server-fasthttp-test/internal/api"
+
 	"github.com/valyala/fasthttp"
 	"github.com/valyala/fasthttp/fasthttputil"
 )
@@ -154,12 +158,254 @@ func TestUploadFile(t *testing.T) {
 	if receivedChecksum != expectedChecksum {
 		t.Fatalf("unexpected checksum header: got %q want %q", receivedChecksum, expectedChecksum)
 	}
+	if resp.SHA256 != expectedChecksum {
+		t.Fatalf("unexpected local checksum: got %q want %q", resp.SHA256, expectedChecksum)
+	}
 
 	if !strings.HasPrefix(receivedContentType, "multipart/form-data; boundary=") {
 		t.Fatalf("unexpected content type: %q", receivedContentType)
 	}
 }
 
+func TestUploadFileVerifiesServerChecksum(t *testing.T) {
+	tempFilePath := filepath.Join(t.TempDir(), "payload.bin")
+	if err := os.WriteFile(tempFilePath, []byte("payload"), 0o600); err != nil {
+		t.Fatalf("write temp file: %v", err)
+	}
+
+	reported := "239f59ed55e737c77147cf55ad0c1b030b6d7ee748a7426952f9b852d5a935e5"
+	server := &fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			ctx.SetStatusCode(fasthttp.StatusCreated)
+			ctx.SetContentType("application/json")
+			ctx.SetBodyString(`{"status":"ok","files":1,"sha256":"` + reported + `"}`)
+		},
+	}
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+	go func() {
+		_ = server.Serve(ln)
+	}()
+	defer server.Shutdown()
+
+	client, err := New(&fasthttp.Client{
+		Dial: func(_ string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}, validUploaderConfig(64))
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	upload := func() (*UploadResponse, error) {
+		return client.UploadFileContext(context.Background(), UploadRequest{
+			URL:      "http://inmemory/upload",
+			FilePath: tempFilePath,
+		})
+	}
+
+	resp, err := upload()
+	if err != nil {
+		t.Fatalf("upload file: %v", err)
+	}
+	if resp.Result == nil || resp.Result.SHA256 != resp.SHA256 {
+		t.Fatalf("unexpected typed result: %+v", resp.Result)
+	}
+
+	reported = strings.Repeat("0", 64)
+	resp, err = upload()
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	if resp == nil || resp.StatusCode != fasthttp.StatusCreated {
+		t.Fatalf("mismatch must return the response: %+v", resp)
+	}
+}
+
+func TestUploadReader(t *testing.T) {
+	content := bytes.Repeat([]byte("streamed"), 300)
+	sum := sha256.Sum256(content)
+	wantSHA256 := hex.EncodeToString(sum[:])
+
+	type received struct {
+		name, contentType, declaredSize, checksum string
+		content                                   []byte
+	}
+	receivedCh := make(chan received, 1)
+	server := &fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			form, err := ctx.MultipartForm()
+			if err != nil || len(form.File["file"]) != 1 || len(form.Value[ChecksumFieldSHA256]) != 1 {
+				ctx.SetStatusCode(fasthttp.StatusBadRequest)
+				return
+			}
+			header := form.File["file"][0]
+			file, err := header.Open()
+			if err != nil {
+				ctx.SetStatusCode(fasthttp.StatusBadRequest)
+				return
+			}
+			body, _ := io.ReadAll(file)
+			_ = file.Close()
+			receivedCh <- received{
+				name:         header.Filename,
+				contentType:  header.Header.Get("Content-Type"),
+				declaredSize: string(ctx.Request.Header.Peek(HeaderUploadSize)),
+				checksum:     form.Value[ChecksumFieldSHA256][0],
+				content:      body,
+			}
+			ctx.SetStatusCode(fasthttp.StatusCreated)
+			ctx.SetContentType("application/json")
+			ctx.SetBodyString(`{"status":"ok","files":1,"sha256":"` + wantSHA256 + `"}`)
+		},
+	}
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+	go func() {
+		_ = server.Serve(ln)
+	}()
+	defer server.Shutdown()
+
+	client, err := New(&fasthttp.Client{
+		Dial: func(_ string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}, validUploaderConfig(64))
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+
+	// A bare io.Reader hides its length, as a pipe from a subprocess would.
+	resp, err := client.UploadReaderContext(context.Background(), ReaderUploadRequest{
+		URL:         "http://inmemory/upload",
+		Reader:      io.MultiReader(bytes.NewReader(content)),
+		FileName:    "report.json",
+		ContentType: "application/json",
+	})
+	if err != nil {
+		t.Fatalf("upload reader: %v", err)
+	}
+	if resp.SHA256 != wantSHA256 {
+		t.Fatalf("unexpected local checksum: got %q want %q", resp.SHA256, wantSHA256)
+	}
+
+	got := <-receivedCh
+	if !bytes.Equal(got.content, content) || got.checksum != wantSHA256 {
+		t.Fatal("uploaded content or checksum mismatch")
+	}
+	if got.name != "report.json" || got.contentType != "application/json" || got.declaredSize != "" {
+		t.Fatalf("unexpected part: name %q, content type %q, declared size %q", got.name, got.contentType, got.declaredSize)
+	}
+
+	if _, err := client.UploadReaderContext(context.Background(), ReaderUploadRequest{
+		URL:      "http://inmemory/upload",
+		Reader:   bytes.NewReader(content),
+		FileName: "sized.bin",
+		Size:     int64(len(content)),
+	}); err != nil {
+		t.Fatalf("upload sized reader: %v", err)
+	}
+	got = <-receivedCh
+	if got.declaredSize != strconv.Itoa(len(content)) || got.contentType != "application/octet-stream" {
+		t.Fatalf("unexpected part: content type %q, declared size %q", got.contentType, got.declaredSize)
+	}
+
+	if _, err := client.UploadReaderContext(context.Background(), ReaderUploadRequest{
+		URL:    "http://inmemory/upload",
+		Reader: bytes.NewReader(content),
+	}); err == nil {
+		t.Fatal("expected an error for a reader without a file name")
+	}
+}
+
+func TestUploadFileTypedErrors(t *testing.T) {
+	tempFilePath := filepath.Join(t.TempDir(), "payload.bin")
+	if err := os.WriteFile(tempFilePath, []byte("payload"), 0o600); err != nil {
+		t.Fatalf("write temp file: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		want        error
+		wantCode    string
+	}{
+		{
+			name:        "checksum mismatch",
+			status:      fasthttp.StatusUnprocessableEntity,
+			contentType: "application/json",
+			body:        `{"status":"error","code":"checksum_mismatch","error":"checksum mismatch","expected_checksum":"aa","actual_checksum":"bb"}`,
+			want:        ErrChecksumMismatch,
+			wantCode:    api.CodeChecksumMismatch,
+		},
+		{
+			name:        "no upload slot",
+			status:      fasthttp.StatusServiceUnavailable,
+			contentType: "application/json",
+			body:        `{"status":"error","code":"too_many_uploads","error":"too many concurrent uploads"}`,
+			want:        ErrTooManyUploads,
+			wantCode:    api.CodeTooManyUploads,
+		},
+		{
+			name:        "unauthorized without json",
+			status:      fasthttp.StatusUnauthorized,
+			contentType: "text/plain",
+			body:        "go away",
+			want:        ErrUnauthorized,
+			wantCode:    api.CodeUnauthorized,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			server := &fasthttp.Server{
+				Handler: func(ctx *fasthttp.RequestCtx) {
+					ctx.SetStatusCode(tc.status)
+					ctx.SetContentType(tc.contentType)
+					ctx.SetBodyString(tc.body)
+				},
+			}
+			ln := fasthttputil.NewInmemoryListener()
+			defer ln.Close()
+			go func() {
+				_ = server.Serve(ln)
+			}()
+			defer server.Shutdown()
+
+			client, err := New(&fasthttp.Client{
+				Dial: func(_ string) (net.Conn, error) {
+					return ln.Dial()
+				},
+			}, validUploaderConfig(64))
+			if err != nil {
+				t.Fatalf("new client: %v", err)
+			}
+
+			resp, err := client.UploadFileContext(context.Background(), UploadRequest{
+				URL:      "http://inmemory/upload",
+				FilePath: tempFilePath,
+			})
+			if resp != nil {
+				t.Fatalf("unexpected response for status %d: %+v", tc.status, resp)
+			}
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("unexpected error: got %v want %v", err, tc.want)
+			}
+			var httpErr *HTTPError
+			if !errors.As(err, &httpErr) {
+				t.Fatalf("expected *HTTPError, got %T", err)
+			}
+			if httpErr.StatusCode != tc.status || httpErr.Code() != tc.wantCode {
+				t.Fatalf("unexpected http error: got %d %q want %d %q", httpErr.StatusCode, httpErr.Code(), tc.status, tc.wantCode)
+			}
+			if tc.want == ErrChecksumMismatch && (httpErr.Response.ExpectedChecksum != "aa" || httpErr.Response.ActualChecksum != "bb") {
+				t.Fatalf("unexpected error response: %+v", httpErr.Response)
+			}
+		})
+	}
+}
+
 func TestUploadFileMultipleFiles(t *testing.T) {
 	payloads := map[string][]byte{
 		"payload-1.bin": bytes.Repeat([]byte("a1b2c3"), 512),
@@ -0,0 +1,117 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"client-server-fasthttp-test/internal/api"
+
+	"github.com/bytedance/sonic"
+	"github.com/valyala/fasthttp"
+)
+
+// Condition makes a write fail with ErrPreconditionFailed unless the file is
+// in the expected state, which prevents lost updates. The zero value always
+// holds.
+type Condition struct {
+	// IfNoneMatch only creates the file; it never replaces an existing one.
+	IfNoneMatch bool
+	// IfMatch only replaces the version with this id, see
+	// FileInfo.VersionID; "*" replaces any version but does not create the
+	// file.
+	IfMatch string
+}
+
+func (c Condition) validate() error {
+	if c.IfNoneMatch && c.IfMatch != "" {
+		return errors.New("if-match and if-none-match cannot be combined")
+	}
+
+	return nil
+}
+
+func (c Condition) setHeaders(header *fasthttp.RequestHeader) {
+	switch {
+	case c.IfNoneMatch:
+		header.Set(fasthttp.HeaderIfNoneMatch, "*")
+	case c.IfMatch == "*":
+		header.Set(fasthttp.HeaderIfMatch, "*")
+	case c.IfMatch != "":
+		header.Set(fasthttp.HeaderIfMatch, api.ETag(c.IfMatch))
+	}
+}
+
+// VersionURL returns the URL of one version of the file at fileURL, for
+// StatContext and DownloadContext.
+func VersionURL(fileURL, versionID string) string {
+	return withQuery(fileURL, api.VersionQueryParam+"="+url.QueryEscape(versionID))
+}
+
+// ListVersionsContext returns the versions of the file at fileURL: the
+// current one first, then the versions it replaced, newest first.
+func (c *Client) ListVersionsContext(ctx context.Context, fileURL string) ([]FileInfo, error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.Header.SetMethod(fasthttp.MethodGet)
+	req.SetRequestURI(withQuery(fileURL, api.VersionsQueryParam))
+
+	if err := c.send(ctx, req, resp); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return nil, fmt.Errorf("list versions: %w", newHTTPErrorFromResponse(resp))
+	}
+
+	var payload api.FileVersionList
+	if err := sonic.Unmarshal(resp.Body(), &payload); err != nil {
+		return nil, fmt.Errorf("decode version list: %w", err)
+	}
+
+	return payload.Versions, nil
+}
+
+// RestoreContext makes versionID the current version of the file at fileURL
+// again. The server stores it as a new version, so the one it replaces is
+// kept; condition applies to that one.
+func (c *Client) RestoreContext(ctx context.Context, fileURL, versionID string, condition Condition) (*FileInfo, error) {
+	if err := condition.validate(); err != nil {
+		return nil, err
+	}
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.SetRequestURI(withQuery(fileURL, api.RestoreQueryParam+"="+url.QueryEscape(versionID)))
+	condition.setHeaders(&req.Header)
+
+	if err := c.send(ctx, req, resp); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return nil, fmt.Errorf("restore version: %w", newHTTPErrorFromResponse(resp))
+	}
+
+	var payload api.RestoreResult
+	if err := sonic.Unmarshal(resp.Body(), &payload); err != nil {
+		return nil, fmt.Errorf("decode restored file: %w", err)
+	}
+
+	return &payload.File, nil
+}
+
+func withQuery(rawURL, query string) string {
+	if strings.Contains(rawURL, "?") {
+		return rawURL + "&" + query
+	}
+
+	return rawURL + "?" + query
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/server/metrics"
+
+	"github.com/valyala/fasthttp"
+)
+
+const adminUploadsPath = "/admin/uploads"
+
+type adminHandler struct {
+	live          *liveConfig
+	uploadHandler *handlerConfig
+	routes        fasthttp.RequestHandler
+}
+
+type slotUsageResponse struct {
+	InUse    int `json:"in_use"`
+	Capacity int `json:"capacity"`
+}
+
+type inflightUploadsResponse struct {
+	Uploads []inflightUploadSnapshot `json:"uploads"`
+}
+
+func newAdminHandler(live *liveConfig, uploadHandler *handlerConfig, reg *metrics.Registry) *adminHandler {
+	a := &adminHandler{
+		live:          live,
+		uploadHandler: uploadHandler,
+	}
+
+	routes := NewRouter()
+	routes.Use(Recovery(reg), BearerAuth("admin", func() string { return live.snapshot().AdminToken }))
+	routes.Handle(fasthttp.MethodGet, adminUploadsPath, func(ctx *fasthttp.RequestCtx) {
+		writeJSON(ctx, fasthttp.StatusOK, inflightUploadsResponse{Uploads: uploadHandler.uploads.snapshot()})
+	})
+	routes.HandlePrefix(fasthttp.MethodDelete, adminUploadsPath+"/", func(ctx *fasthttp.RequestCtx) {
+		a.cancelUpload(ctx, strings.TrimPrefix(string(ctx.Path()), adminUploadsPath+"/"))
+	})
+	routes.Handle(fasthttp.MethodGet, "/admin/slots", func(ctx *fasthttp.RequestCtx) {
+		inUse, capacity := uploadHandler.uploadSlotUsage()
+		writeJSON(ctx, fasthttp.StatusOK, slotUsageResponse{InUse: inUse, Capacity: capacity})
+	})
+	routes.Handle(fasthttp.MethodGet, "/admin/config", func(ctx *fasthttp.RequestCtx) {
+		writeJSON(ctx, fasthttp.StatusOK, live.snapshot().Redacted())
+	})
+	routes.Handle(fasthttp.MethodGet, "/admin/config/reload", func(ctx *fasthttp.RequestCtx) {
+		writeJSON(ctx, fasthttp.StatusOK, live.lastReloadReport())
+	})
+	routes.Handle(fasthttp.MethodPost, adminPresignPath, a.presign)
+	routes.Handle(fasthttp.MethodGet, adminWebhooksPath, func(ctx *fasthttp.RequestCtx) {
+		webhooks := uploadHandler.webhooks
+		writeJSON(ctx, fasthttp.StatusOK, webhooksResponse{Pending: webhooks.Pending(), Deliveries: webhooks.Recent()})
+	})
+	a.routes = routes.Handler()
+
+	return a
+}
+
+func (a *adminHandler) handler(ctx *fasthttp.RequestCtx) {
+	a.routes(ctx)
+}
+
+// presign issues a pre-signed URL, see api.PresignRequest.
+func (a *adminHandler) presign(ctx *fasthttp.RequestCtx) {
+	var req api.PresignRequest
+	if err := decodeJSONBody(ctx, &req); err != nil {
+		writeJSONError(ctx, fasthttp.StatusBadRequest, err.Error())
+		return
+	}
+	grant, url, err := a.uploadHandler.presign.issue(req)
+	if err != nil {
+		writePreflightError(ctx, err)
+		return
+	}
+	slog.Info("pre-signed URL issued", "method", grant.Method, "path", grant.Path, "name", grant.Name, "max_size", grant.MaxSize, "expires_at", grant.ExpiresAt)
+
+	writeJSON(ctx, fasthttp.StatusOK, api.PresignResult{
+		Status:    api.StatusOK,
+		Method:    grant.Method,
+		URL:       url,
+		ExpiresAt: grant.ExpiresAt.UTC().Format(time.RFC3339),
+	})
+}
+
+func (a *adminHandler) cancelUpload(ctx *fasthttp.RequestCtx, rawID string) {
+	id, err := strconv.ParseUint(rawID, 10, 64)
+	if err != nil {
+		writeJSONError(ctx, fasthttp.StatusBadRequest, "invalid upload id")
+		return
+	}
+	if !a.uploadHandler.uploads.cancel(id) {
+		writeJSONError(ctx, fasthttp.StatusNotFound, "upload not found")
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusAccepted)
+}
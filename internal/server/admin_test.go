@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"mime/multipart"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	serverconfig "client-server-fasthttp-test/internal/server/config"
+	"client-server-fasthttp-test/internal/server/storage"
+
+	"github.com/bytedance/sonic"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+const testAdminToken = "secret-token"
+
+func newTestAdmin(t *testing.T) (*handlerConfig, *fasthttp.Client) {
+	t.Helper()
+
+	store, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("new storage: %v", err)
+	}
+	uploadHandler := newHandlerConfig("file", 2, store, 0)
+
+	server := &fasthttp.Server{
+		Handler:                      uploadHandler.handler,
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+	}
+	ln := fasthttputil.NewInmemoryListener()
+	go func() {
+		_ = server.Serve(ln)
+	}()
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+		_ = ln.Close()
+	})
+
+	return uploadHandler, &fasthttp.Client{
+		Dial: func(_ string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}
+}
+
+func adminRequest(admin *adminHandler, method, path, token string) *fasthttp.RequestCtx {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(path)
+	if token != "" {
+		ctx.Request.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+token)
+	}
+	admin.handler(&ctx)
+
+	return &ctx
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	uploadHandler := newHandlerConfig("file", 1, nil, 0)
+	admin := newAdminHandler(newLiveConfig(serverconfig.AppConfig{AdminToken: testAdminToken}, uploadHandler), uploadHandler, nil)
+
+	for _, token := range []string{"", "wrong"} {
+		ctx := adminRequest(admin, fasthttp.MethodGet, "/admin/slots", token)
+		if ctx.Response.StatusCode() != fasthttp.StatusUnauthorized {
+			t.Fatalf("token %q: unexpected status: got %d want %d", token, ctx.Response.StatusCode(), fasthttp.StatusUnauthorized)
+		}
+	}
+
+	ctx := adminRequest(admin, fasthttp.MethodGet, "/admin/slots", testAdminToken)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("unexpected status: got %d want %d", ctx.Response.StatusCode(), fasthttp.StatusOK)
+	}
+}
+
+func TestAdminConfigRedactsSecrets(t *testing.T) {
+	uploadHandler := newHandlerConfig("file", 1, nil, 0)
+	admin := newAdminHandler(newLiveConfig(serverconfig.AppConfig{AdminToken: testAdminToken}, uploadHandler), uploadHandler, nil)
+
+	ctx := adminRequest(admin, fasthttp.MethodGet, "/admin/config", testAdminToken)
+	if strings.Contains(string(ctx.Response.Body()), testAdminToken) {
+		t.Fatalf("admin token leaked in config response: %s", ctx.Response.Body())
+	}
+}
+
+func TestAdminCancelInflightUpload(t *testing.T) {
+	uploadHandler, client := newTestAdmin(t)
+	admin := newAdminHandler(newLiveConfig(serverconfig.AppConfig{AdminToken: testAdminToken}, uploadHandler), uploadHandler, nil)
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	release := make(chan struct{})
+	defer close(release)
+
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.SetRequestURI("http://inmemory/upload")
+	req.Header.SetContentType("multipart/form-data; boundary=" + boundary)
+	req.SetBodyStreamWriter(func(w *bufio.Writer) {
+		mw := multipart.NewWriter(w)
+		_ = mw.SetBoundary(boundary)
+		part, err := mw.CreateFormFile("file", "slow.bin")
+		if err != nil {
+			return
+		}
+		_, _ = part.Write([]byte(strings.Repeat("x", 4096)))
+		_ = w.Flush()
+		<-release
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Do(req, resp)
+	}()
+
+	var uploads inflightUploadsResponse
+	deadline := time.Now().Add(5 * time.Second)
+	for len(uploads.Uploads) == 0 || uploads.Uploads[0].BytesReceived == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("upload did not become visible in admin api")
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		ctx := adminRequest(admin, fasthttp.MethodGet, adminUploadsPath, testAdminToken)
+		if err := sonic.Unmarshal(ctx.Response.Body(), &uploads); err != nil {
+			t.Fatalf("decode uploads: %v", err)
+		}
+	}
+	if uploads.Uploads[0].Filename != "slow.bin" {
+		t.Fatalf("unexpected filename: got %q want %q", uploads.Uploads[0].Filename, "slow.bin")
+	}
+
+	slots := adminRequest(admin, fasthttp.MethodGet, "/admin/slots", testAdminToken)
+	if got := string(slots.Response.Body()); got != `{"in_use":1,"capacity":2}` {
+		t.Fatalf("unexpected slot usage: %s", got)
+	}
+
+	id := uploads.Uploads[0].ID
+	cancelCtx := adminRequest(admin, fasthttp.MethodDelete, adminUploadsPath+"/"+strconv.FormatUint(id, 10), testAdminToken)
+	if cancelCtx.Response.StatusCode() != fasthttp.StatusAccepted {
+		t.Fatalf("unexpected cancel status: got %d want %d", cancelCtx.Response.StatusCode(), fasthttp.StatusAccepted)
+	}
+
+	release <- struct{}{}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("upload request: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled upload did not finish")
+	}
+	if resp.StatusCode() != fasthttp.StatusConflict {
+		t.Fatalf("unexpected upload status: got %d want %d", resp.StatusCode(), fasthttp.StatusConflict)
+	}
+}
@@ -0,0 +1,429 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+
+	"client-server-fasthttp-test/internal/api"
+	serverconfig "client-server-fasthttp-test/internal/server/config"
+	"client-server-fasthttp-test/internal/server/format"
+	"client-server-fasthttp-test/internal/server/sniff"
+	"client-server-fasthttp-test/internal/server/storage"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// minRatioCheckSize is how much an archive may extract to before the
+	// compression ratio is checked; tiny archives compress oddly well.
+	minRatioCheckSize = 1024 * 1024
+	// maxLinkTargetSize bounds the target of a symlink read from a zip
+	// entry.
+	maxLinkTargetSize = 4096
+)
+
+// extractLimits bound what an uploaded archive may extract to.
+type extractLimits struct {
+	enabled    bool
+	maxEntries int
+	maxSize    int64
+	maxRatio   int64
+}
+
+func newExtractLimits(cfg serverconfig.AppConfig) extractLimits {
+	return extractLimits{
+		enabled:    cfg.ExtractEnabled,
+		maxEntries: cfg.ExtractMaxEntries,
+		maxSize:    cfg.ExtractMaxSize,
+		maxRatio:   int64(cfg.ExtractMaxRatio),
+	}
+}
+
+// extractPrefix returns the prefix of api.HeaderUploadExtract, or "" for an
+// upload that is stored as is.
+func (h *handlerConfig) extractPrefix(header *fasthttp.RequestHeader) (string, error) {
+	raw := header.Peek(api.HeaderUploadExtract)
+	if len(raw) == 0 {
+		return "", nil
+	}
+	if !h.extract.enabled {
+		return "", &PreflightError{StatusCode: fasthttp.StatusForbidden, Message: "archive extraction is disabled"}
+	}
+	prefix := strings.Trim(string(raw), "/")
+	if storage.ValidateName(prefix) != nil {
+		return "", &PreflightError{StatusCode: fasthttp.StatusBadRequest, Message: fmt.Sprintf("invalid %s header", api.HeaderUploadExtract)}
+	}
+
+	return prefix, nil
+}
+
+// extractedArchive is an uploaded archive unpacked into staged files.
+type extractedArchive struct {
+	result api.ArchiveResult
+	sha256 string
+	files  []*storage.Staged
+	// names are the paths of files in the archive.
+	names []string
+	// metadata is sent after the archive and stored with every file.
+	metadata map[string]string
+}
+
+// archiveStream counts and hashes the archive as it is read.
+type archiveStream struct {
+	r    io.Reader
+	hash hash.Hash
+	n    int64
+}
+
+func (s *archiveStream) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.hash.Write(p[:n])
+	s.n += int64(n)
+
+	return n, err
+}
+
+// extraction is the state of one archive being extracted.
+type extraction struct {
+	h       *handlerConfig
+	prefix  string
+	archive *extractedArchive
+	seen    map[string]bool
+	entries int
+	size    int64
+	// compressed returns the archive bytes read so far, for the ratio
+	// check; nil skips it.
+	compressed func() int64
+}
+
+// extractArchive stages the files of the tar, tar.gz or zip archive read
+// from r under prefix. A tar is extracted while it streams in; a zip is
+// buffered in the storage temp area first, as its index is at the end. Archives the
+// server refuses are answered with a *PreflightError, read errors of r are
+// returned as is. On error nothing stays staged.
+func (h *handlerConfig) extractArchive(r io.Reader, prefix string) (*extractedArchive, error) {
+	src := &archiveStream{r: r, hash: sha256.New()}
+	br := bufio.NewReaderSize(src, sniff.Len)
+	head, err := br.Peek(sniff.Len)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	x := &extraction{
+		h:       h,
+		prefix:  prefix,
+		archive: &extractedArchive{result: api.ArchiveResult{Prefix: prefix}},
+		seen:    make(map[string]bool),
+	}
+	switch detected := sniff.Detect(head); detected {
+	case "application/gzip":
+		x.archive.result.Format = api.ArchiveTarGzip
+		x.compressed = func() int64 { return src.n }
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(br); err != nil {
+			err = invalidArchive("%v", err)
+			break
+		}
+		err = x.tar(zr)
+	case "application/x-tar":
+		x.archive.result.Format = api.ArchiveTar
+		err = x.tar(br)
+	case "application/zip":
+		x.archive.result.Format = api.ArchiveZip
+		err = x.zip(br)
+	default:
+		err = &PreflightError{
+			StatusCode: fasthttp.StatusUnsupportedMediaType,
+			Code:       api.CodeUnsupportedMediaType,
+			Message:    fmt.Sprintf("content is %s, not a tar, tar.gz or zip archive", detected),
+		}
+	}
+	if err == nil {
+		// The checksum covers the archive to its last byte.
+		_, err = io.Copy(io.Discard, br)
+	}
+	if err != nil {
+		for _, staged := range x.archive.files {
+			if discardErr := staged.Discard(); discardErr != nil {
+				slog.Warn("discard staged upload", "error", discardErr)
+			}
+		}
+		return nil, err
+	}
+
+	x.archive.result.Size = src.n
+	x.archive.sha256 = hex.EncodeToString(src.hash.Sum(nil))
+	slog.Info("archive extracted",
+		"prefix", prefix,
+		"format", x.archive.result.Format,
+		"files", len(x.archive.files),
+		"skipped", len(x.archive.result.Skipped),
+		"size", format.Bytes(x.size),
+	)
+
+	return x.archive, nil
+}
+
+func (x *extraction) tar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		// The insecure paths Next reports are checked by entryName.
+		if err != nil && !errors.Is(err, tar.ErrInsecurePath) {
+			return invalidArchive("%v", err)
+		}
+		if err := x.count(); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name, err := entryName(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+		case tar.TypeReg:
+			err = x.stage(name, tr)
+		case tar.TypeSymlink:
+			err = x.link(name, hdr.Linkname, true)
+		case tar.TypeLink:
+			err = x.link(name, hdr.Linkname, false)
+		default:
+			err = invalidArchive("entry %q has the unsupported type %q", hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (x *extraction) zip(r io.Reader) error {
+	tmp, err := x.h.storage.CreateTemp("archive-*.zip")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	// No legitimate archive is much larger than what it extracts to, and
+	// none is larger than a request may be.
+	limit, what := x.h.extract.maxSize, "archive"
+	if x.h.maxRequestBodySize > 0 && x.h.maxRequestBodySize < limit {
+		limit, what = x.h.maxRequestBodySize, "upload"
+	}
+	size, err := io.Copy(tmp, io.LimitReader(r, limit+1))
+	if err != nil {
+		return err
+	}
+	if size > limit {
+		return archiveTooLarge(fmt.Sprintf("%s exceeds the limit of %s", what, format.Bytes(limit)))
+	}
+	x.compressed = func() int64 { return size }
+
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil && !errors.Is(err, zip.ErrInsecurePath) {
+		return invalidArchive("%v", err)
+	}
+	if len(zr.File) > x.h.extract.maxEntries {
+		return archiveTooLarge(fmt.Sprintf("archive has more than %d entries", x.h.extract.maxEntries))
+	}
+	for _, f := range zr.File {
+		if err := x.count(); err != nil {
+			return err
+		}
+		name, err := entryName(f.Name)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+		case mode&fs.ModeSymlink != 0:
+			err = x.zipLink(name, f)
+		case mode.IsRegular():
+			err = x.zipFile(name, f)
+		default:
+			err = invalidArchive("entry %q has the unsupported mode %v", f.Name, mode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (x *extraction) zipFile(name string, f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return invalidArchive("entry %q: %v", f.Name, err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	return x.stage(name, rc)
+}
+
+func (x *extraction) zipLink(name string, f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return invalidArchive("entry %q: %v", f.Name, err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	target, err := io.ReadAll(io.LimitReader(rc, maxLinkTargetSize))
+	if err != nil {
+		return invalidArchive("entry %q: %v", f.Name, err)
+	}
+
+	return x.link(name, string(target), true)
+}
+
+func (x *extraction) count() error {
+	x.entries++
+	if x.entries > x.h.extract.maxEntries {
+		return archiveTooLarge(fmt.Sprintf("archive has more than %d entries", x.h.extract.maxEntries))
+	}
+
+	return nil
+}
+
+// entryName returns the cleaned path of an archive entry, or "" for the
+// root directory. Paths that would leave the prefix reject the archive.
+func entryName(raw string) (string, error) {
+	if strings.ContainsAny(raw, "\\\x00") {
+		return "", invalidArchive("entry %q has an invalid name", raw)
+	}
+	if path.IsAbs(raw) {
+		return "", invalidArchive("entry %q has an absolute path", raw)
+	}
+	name := path.Clean(raw)
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", invalidArchive("entry %q leaves the target prefix", raw)
+	}
+	if name == "." {
+		return "", nil
+	}
+
+	return name, nil
+}
+
+// claim reserves name for one entry; archives listing a path twice are
+// refused rather than resolved by order.
+func (x *extraction) claim(name string) error {
+	if x.seen[name] {
+		return invalidArchive("entry %q appears twice", name)
+	}
+	x.seen[name] = true
+
+	return nil
+}
+
+// link skips a link, as the storage has none. A symlink is relative to its
+// directory, a hard link to the archive root; one that points out of the
+// archive rejects it.
+func (x *extraction) link(name, target string, symlink bool) error {
+	if err := x.claim(name); err != nil {
+		return err
+	}
+	resolved := path.Clean(target)
+	if symlink {
+		resolved = path.Join(path.Dir(name), target)
+	}
+	if path.IsAbs(target) || resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return invalidArchive("link %q points out of the archive to %q", name, target)
+	}
+	x.archive.result.Skipped = append(x.archive.result.Skipped, name)
+
+	return nil
+}
+
+// stage stages the file name of the archive, read from r. Hidden files are
+// skipped, the storage does not take them.
+func (x *extraction) stage(name string, r io.Reader) error {
+	if err := x.claim(name); err != nil {
+		return err
+	}
+	storageName := x.prefix + "/" + name
+	if storage.ValidateName(storageName) != nil {
+		x.archive.result.Skipped = append(x.archive.result.Skipped, name)
+		return nil
+	}
+
+	src := &readErrRecorder{r: x.h.content.reader(&entryReader{r: r, x: x}, name, "")}
+	staged, err := x.h.storage.Stage(storageName, src)
+	if err != nil {
+		var preflightErr *PreflightError
+		switch {
+		case errors.As(src.err, &preflightErr):
+			return preflightErr
+		case src.err != nil:
+			return invalidArchive("entry %q: %v", name, src.err)
+		}
+		return fmt.Errorf("store entry %q: %w", name, err)
+	}
+	x.archive.files = append(x.archive.files, staged)
+	x.archive.names = append(x.archive.names, name)
+
+	return nil
+}
+
+// entryReader fails as soon as the archive extracts to more than the limits
+// allow, so a decompression bomb is not read on.
+type entryReader struct {
+	r io.Reader
+	x *extraction
+}
+
+func (r *entryReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	x := r.x
+	x.size += int64(n)
+	if x.size > x.h.extract.maxSize {
+		return n, archiveTooLarge(fmt.Sprintf("archive extracts to more than %s", format.Bytes(x.h.extract.maxSize)))
+	}
+	if x.compressed != nil && x.size > minRatioCheckSize && x.size > x.compressed()*x.h.extract.maxRatio {
+		return n, archiveTooLarge(fmt.Sprintf("archive extracts to more than %d times its size", x.h.extract.maxRatio))
+	}
+
+	return n, err
+}
+
+func archiveTooLarge(msg string) error {
+	return &PreflightError{StatusCode: fasthttp.StatusRequestEntityTooLarge, Code: api.CodeTooLarge, Message: msg}
+}
+
+func invalidArchive(msgFormat string, args ...any) error {
+	return &PreflightError{
+		StatusCode: fasthttp.StatusUnprocessableEntity,
+		Code:       api.CodeInvalidArchive,
+		Message:    "invalid archive: " + fmt.Sprintf(msgFormat, args...),
+	}
+}
@@ -0,0 +1,312 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/client/uploader"
+
+	"github.com/bytedance/sonic"
+	"github.com/valyala/fasthttp"
+)
+
+// archiveEntry is one entry of a test archive; a regular file unless
+// typeflag says otherwise.
+type archiveEntry struct {
+	name     string
+	body     string
+	typeflag byte
+	linkname string
+}
+
+func tarGzArchive(t *testing.T, entries ...archiveEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, entry := range entries {
+		hdr := &tar.Header{Name: entry.name, Typeflag: entry.typeflag, Linkname: entry.linkname, Mode: 0o644}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(entry.body))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("write tar header: %v", err)
+		}
+		if _, err := tw.Write([]byte(entry.body)); err != nil {
+			t.Fatalf("write tar entry: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("close gzip: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func zipArchive(t *testing.T, entries ...archiveEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		w, err := zw.Create(entry.name)
+		if err != nil {
+			t.Fatalf("create zip entry: %v", err)
+		}
+		if _, err := w.Write([]byte(entry.body)); err != nil {
+			t.Fatalf("write zip entry: %v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("close zip: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func testExtractLimits() extractLimits {
+	return extractLimits{enabled: true, maxEntries: 100, maxSize: 16 << 20, maxRatio: 100}
+}
+
+func TestUploadExtractArchive(t *testing.T) {
+	uploadHandler, client := newTestServer(t)
+	uploadHandler.extract = testExtractLimits()
+
+	archive := tarGzArchive(t,
+		archiveEntry{name: "./", typeflag: tar.TypeDir},
+		archiveEntry{name: "bin/", typeflag: tar.TypeDir},
+		archiveEntry{name: "bin/app", body: "#!/bin/sh\necho app\n"},
+		archiveEntry{name: "bin/latest", typeflag: tar.TypeSymlink, linkname: "app"},
+		archiveEntry{name: "docs/readme.txt", body: "read me"},
+		archiveEntry{name: ".env", body: "SECRET=1"},
+	)
+	resp, err := client.UploadReaderContext(context.Background(), uploader.ReaderUploadRequest{
+		URL:       "http://inmemory/upload",
+		Reader:    bytes.NewReader(archive),
+		FileName:  "build.tar.gz",
+		Metadata:  map[string]string{"build": "42"},
+		ExtractTo: "/builds/42/",
+	})
+	if err != nil {
+		t.Fatalf("upload archive: %v", err)
+	}
+
+	result := resp.Result.Archive
+	if result == nil {
+		t.Fatalf("archive result is missing: %s", resp.Body)
+	}
+	if result.Format != api.ArchiveTarGzip || result.Prefix != "builds/42" || result.Size != int64(len(archive)) {
+		t.Fatalf("unexpected archive result: %+v", result)
+	}
+	if resp.Result.SHA256 != sha256Hex(archive) {
+		t.Fatalf("unexpected checksum: got %s want the archive's", resp.Result.SHA256)
+	}
+	if len(result.Skipped) != 2 || result.Skipped[0] != "bin/latest" || result.Skipped[1] != ".env" {
+		t.Fatalf("unexpected skipped entries: %v", result.Skipped)
+	}
+	want := map[string]string{"bin/app": "#!/bin/sh\necho app\n", "docs/readme.txt": "read me"}
+	if len(result.Entries) != len(want) {
+		t.Fatalf("unexpected entries: %+v", result.Entries)
+	}
+	for _, entry := range result.Entries {
+		if entry.SHA256 != sha256Hex([]byte(want[entry.Name])) || entry.StorageID != "builds/42/"+entry.Name {
+			t.Fatalf("unexpected entry: %+v", entry)
+		}
+	}
+
+	if got := storedNames(t, uploadHandler.storage); len(got) != 2 || got[0] != "builds/42/bin/app" || got[1] != "builds/42/docs/readme.txt" {
+		t.Fatalf("unexpected stored files: %v", got)
+	}
+	obj, err := uploadHandler.storage.Stat("builds/42/docs/readme.txt")
+	if err != nil {
+		t.Fatalf("stat extracted file: %v", err)
+	}
+	if obj.Metadata["build"] != "42" {
+		t.Fatalf("unexpected metadata: got %v want build=42", obj.Metadata)
+	}
+}
+
+func TestUploadExtractZip(t *testing.T) {
+	uploadHandler, client := newTestServer(t)
+	uploadHandler.extract = testExtractLimits()
+
+	resp, err := client.UploadReaderContext(context.Background(), uploader.ReaderUploadRequest{
+		URL:       "http://inmemory/upload",
+		Reader:    bytes.NewReader(zipArchive(t, archiveEntry{name: "a.txt", body: "a"}, archiveEntry{name: "dir/b.txt", body: "b"})),
+		FileName:  "site.zip",
+		ExtractTo: "site",
+	})
+	if err != nil {
+		t.Fatalf("upload archive: %v", err)
+	}
+	if resp.Result.Archive == nil || resp.Result.Archive.Format != api.ArchiveZip || len(resp.Result.Archive.Entries) != 2 {
+		t.Fatalf("unexpected archive result: %s", resp.Body)
+	}
+	if got := storedNames(t, uploadHandler.storage); len(got) != 2 || got[0] != "site/a.txt" || got[1] != "site/dir/b.txt" {
+		t.Fatalf("unexpected stored files: %v", got)
+	}
+}
+
+func TestUploadExtractRejectsArchive(t *testing.T) {
+	zeros := strings.Repeat("\x00", 8<<20)
+
+	tests := []struct {
+		name    string
+		limits  func(*extractLimits)
+		maxBody int64
+		archive func(t *testing.T) []byte
+		status  int
+		code    string
+		message string
+	}{
+		{
+			name:    "path-traversal",
+			archive: func(t *testing.T) []byte { return tarGzArchive(t, archiveEntry{name: "../evil", body: "x"}) },
+			status:  fasthttp.StatusUnprocessableEntity,
+			code:    api.CodeInvalidArchive,
+			message: "leaves the target prefix",
+		},
+		{
+			name:    "zip-absolute-path",
+			archive: func(t *testing.T) []byte { return zipArchive(t, archiveEntry{name: "/etc/passwd", body: "x"}) },
+			status:  fasthttp.StatusUnprocessableEntity,
+			code:    api.CodeInvalidArchive,
+			message: "absolute path",
+		},
+		{
+			name: "symlink-escape",
+			archive: func(t *testing.T) []byte {
+				return tarGzArchive(t,
+					archiveEntry{name: "a.txt", body: "a"},
+					archiveEntry{name: "dir/link", typeflag: tar.TypeSymlink, linkname: "../../secret"},
+				)
+			},
+			status:  fasthttp.StatusUnprocessableEntity,
+			code:    api.CodeInvalidArchive,
+			message: "points out of the archive",
+		},
+		{
+			name: "duplicate-entry",
+			archive: func(t *testing.T) []byte {
+				return tarGzArchive(t, archiveEntry{name: "a.txt", body: "a"}, archiveEntry{name: "./a.txt", body: "b"})
+			},
+			status:  fasthttp.StatusUnprocessableEntity,
+			code:    api.CodeInvalidArchive,
+			message: "appears twice",
+		},
+		{
+			name:   "too-many-entries",
+			limits: func(l *extractLimits) { l.maxEntries = 2 },
+			archive: func(t *testing.T) []byte {
+				return tarGzArchive(t, archiveEntry{name: "a", body: "a"}, archiveEntry{name: "b", body: "b"}, archiveEntry{name: "c", body: "c"})
+			},
+			status:  fasthttp.StatusRequestEntityTooLarge,
+			code:    api.CodeTooLarge,
+			message: "more than 2 entries",
+		},
+		{
+			name:    "compression-ratio",
+			archive: func(t *testing.T) []byte { return tarGzArchive(t, archiveEntry{name: "bomb", body: zeros}) },
+			status:  fasthttp.StatusRequestEntityTooLarge,
+			code:    api.CodeTooLarge,
+			message: "100 times its size",
+		},
+		{
+			name:    "extracted-size",
+			limits:  func(l *extractLimits) { l.maxSize = 1 << 20 },
+			archive: func(t *testing.T) []byte { return zipArchive(t, archiveEntry{name: "bomb", body: zeros}) },
+			status:  fasthttp.StatusRequestEntityTooLarge,
+			code:    api.CodeTooLarge,
+			message: "extracts to more than",
+		},
+		{
+			name:    "zip-over-request-limit",
+			maxBody: 1024,
+			archive: func(t *testing.T) []byte { return zipArchive(t, archiveEntry{name: "bomb", body: zeros}) },
+			status:  fasthttp.StatusRequestEntityTooLarge,
+			code:    api.CodeTooLarge,
+			message: "upload exceeds the limit of",
+		},
+		{
+			name:    "not-an-archive",
+			archive: func(*testing.T) []byte { return testPNG },
+			status:  fasthttp.StatusUnsupportedMediaType,
+			code:    api.CodeUnsupportedMediaType,
+			message: "not a tar, tar.gz or zip archive",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			uploadHandler, _ := newTestServer(t)
+			uploadHandler.extract = testExtractLimits()
+			if tc.limits != nil {
+				tc.limits(&uploadHandler.extract)
+			}
+			uploadHandler.maxRequestBodySize = tc.maxBody
+
+			// The handler is called directly: it answers without reading the
+			// rest of a rejected archive, which a streaming client may still
+			// be sending.
+			var ctx fasthttp.RequestCtx
+			ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+			ctx.Request.SetRequestURI("/upload")
+			ctx.Request.Header.Set(api.HeaderUploadExtract, "out")
+			ctx.Request.Header.SetContentType("multipart/form-data; boundary=b")
+			ctx.Request.SetBodyStream(io.MultiReader(
+				strings.NewReader("--b\r\nContent-Disposition: form-data; name=\"file\"; filename=\"upload\"\r\n\r\n"),
+				bytes.NewReader(tc.archive(t)),
+				strings.NewReader("\r\n--b--\r\n"),
+			), -1)
+			ctx.Request.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+testAuthToken)
+			uploadHandler.handler(&ctx)
+
+			var resp api.ErrorResponse
+			if err := sonic.Unmarshal(ctx.Response.Body(), &resp); err != nil {
+				t.Fatalf("decode response %q: %v", ctx.Response.Body(), err)
+			}
+			if ctx.Response.StatusCode() != tc.status || resp.Code != tc.code || !strings.Contains(resp.Error, tc.message) {
+				t.Fatalf("unexpected rejection: %d %s %q does not mention %q", ctx.Response.StatusCode(), resp.Code, resp.Error, tc.message)
+			}
+			if got := storedNames(t, uploadHandler.storage); len(got) != 0 {
+				t.Fatalf("rejected archive left files: %v", got)
+			}
+			if temp, err := uploadHandler.storage.ListTemp(); err != nil || len(temp) != 0 {
+				t.Fatalf("rejected archive left temp files: %v, %v", temp, err)
+			}
+		})
+	}
+}
+
+func TestUploadExtractClientErrors(t *testing.T) {
+	uploadHandler, client := newTestServer(t)
+	upload := func(archive []byte) error {
+		_, err := client.UploadReaderContext(context.Background(), uploader.ReaderUploadRequest{
+			URL:       "http://inmemory/upload",
+			Reader:    bytes.NewReader(archive),
+			FileName:  "site.zip",
+			ExtractTo: "site",
+		})
+		return err
+	}
+
+	if err := upload(zipArchive(t, archiveEntry{name: "a.txt", body: "a"})); !errors.Is(err, uploader.ErrForbidden) {
+		t.Fatalf("extraction was not refused: got %v want %v", err, uploader.ErrForbidden)
+	}
+	uploadHandler.extract = testExtractLimits()
+	if err := upload(zipArchive(t, archiveEntry{name: "../a.txt", body: "a"})); !errors.Is(err, uploader.ErrInvalidArchive) {
+		t.Fatalf("unexpected error: got %v want %v", err, uploader.ErrInvalidArchive)
+	}
+}
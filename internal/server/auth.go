@@ -0,0 +1,84 @@
+package server
+
+import (
+	"net/url"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/server/presign"
+
+	"github.com/valyala/fasthttp"
+)
+
+// authRealm is announced in the WWW-Authenticate header of the upload and
+// file endpoints.
+const authRealm = "upload"
+
+func (h *handlerConfig) setAuthToken(token string) {
+	h.authToken.Store(&token)
+}
+
+// token returns the bearer token of the upload and file endpoints, or an
+// empty string when none is configured.
+func (h *handlerConfig) token() string {
+	if token := h.authToken.Load(); token != nil {
+		return *token
+	}
+
+	return ""
+}
+
+// authenticated wraps the upload and file endpoints with BearerAuth once a
+// token is configured. A request made with a pre-signed URL is authorized by
+// its signature instead, which the endpoints verify themselves.
+func (h *handlerConfig) authenticated(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	authed := BearerAuth(authRealm, h.token)(next)
+
+	return func(ctx *fasthttp.RequestCtx) {
+		if h.token() == "" || isPresignedRequest(ctx) {
+			next(ctx)
+			return
+		}
+
+		authed(ctx)
+	}
+}
+
+// restricted wraps the file endpoints with BearerAuth unconditionally: they
+// expose and delete stored files, so they stay closed until a token is
+// configured. Pre-signed URLs remain usable either way.
+func (h *handlerConfig) restricted(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	authed := BearerAuth(authRealm, h.token)(next)
+
+	return func(ctx *fasthttp.RequestCtx) {
+		if isPresignedRequest(ctx) {
+			next(ctx)
+			return
+		}
+
+		authed(ctx)
+	}
+}
+
+// checkToken is the check of authenticated for an upload whose body has not
+// been read yet, so that Expect: 100-continue rejects it before the body.
+func (h *handlerConfig) checkToken(header *fasthttp.RequestHeader) error {
+	token := h.token()
+	if token == "" || bearerTokenValid(header, token) {
+		return nil
+	}
+	var uri fasthttp.URI
+	if err := uri.Parse(nil, header.RequestURI()); err == nil && isPresigned(uri.QueryString()) {
+		return nil
+	}
+
+	return &PreflightError{StatusCode: fasthttp.StatusUnauthorized, Code: api.CodeUnauthorized, Message: "unauthorized"}
+}
+
+func isPresignedRequest(ctx *fasthttp.RequestCtx) bool {
+	return isPresigned(ctx.URI().QueryString())
+}
+
+func isPresigned(queryString []byte) bool {
+	query, err := url.ParseQuery(string(queryString))
+	return err == nil && presign.IsPresigned(query)
+}
@@ -2,11 +2,18 @@ package config
 
 import (
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
+	"client-server-fasthttp-test/internal/server/format"
+	"client-server-fasthttp-test/internal/server/sniff"
+
 	"github.com/spf13/viper"
 )
 
@@ -21,6 +28,39 @@ const (
 	defaultWriteTimeout         = 30 * time.Second
 	defaultIdleTimeout          = 60 * time.Second
 	defaultMaxConcurrentUploads = 4
+	defaultAdminAddr            = ":6061"
+	defaultStorageDir           = "data"
+	defaultReadyMinFreeSpace    = 512 * 1024 * 1024 // 512 MiB
+	defaultShutdownDrainDelay   = 5 * time.Second
+	defaultShutdownTimeout      = 30 * time.Second
+	defaultMultipartTTL         = 24 * time.Hour
+	defaultS3Addr               = ":9000"
+	defaultS3Bucket             = "uploads"
+	defaultS3Region             = "us-east-1"
+	defaultStorageS3PartSize    = 8 * 1024 * 1024 // 8 MiB
+	// minStorageS3PartSize is the smallest part S3 accepts but for the last.
+	minStorageS3PartSize     = 5 * 1024 * 1024
+	defaultRetentionInterval = 10 * time.Minute
+	defaultRetentionTempTTL  = 24 * time.Hour
+	defaultPresignMaxTTL     = 24 * time.Hour
+	// minPresignSecretSize keeps the HMAC key of pre-signed URLs at the
+	// strength of its SHA-256.
+	minPresignSecretSize = 32
+	// defaultWebhookOutboxDir is relative to StorageDir; the local storage
+	// skips dot directories.
+	defaultWebhookOutboxDir   = ".webhooks"
+	defaultWebhookMaxAttempts = 10
+	defaultWebhookTimeout     = 10 * time.Second
+	defaultWebhookBackoff     = time.Second
+	defaultWebhookMaxBackoff  = 10 * time.Minute
+	defaultHookTimeout        = time.Minute
+	defaultHookConcurrency    = 2
+	// defaultHookQuarantineDir is relative to StorageDir, like
+	// defaultWebhookOutboxDir.
+	defaultHookQuarantineDir = ".quarantine"
+	defaultExtractMaxEntries = 10000
+	defaultExtractMaxSize    = 10 * 1024 * 1024 * 1024 // 10 GiB
+	defaultExtractMaxRatio   = 100
 
 	keyAddr                 = "UPLOAD_SERVER_ADDR"
 	keyName                 = "UPLOAD_SERVER_NAME"
@@ -33,9 +73,65 @@ const (
 	keyWriteTimeout         = "UPLOAD_SERVER_WRITE_TIMEOUT"
 	keyIdleTimeout          = "UPLOAD_SERVER_IDLE_TIMEOUT"
 	keyMaxConcurrentUploads = "UPLOAD_SERVER_MAX_CONCURRENT_UPLOADS"
-)
+	keyAdminEnabled         = "UPLOAD_SERVER_ADMIN_ENABLED"
+	keyAdminAddr            = "UPLOAD_SERVER_ADMIN_ADDR"
+	keyAdminToken           = "UPLOAD_SERVER_ADMIN_TOKEN"
+	keyAuthToken            = "UPLOAD_SERVER_AUTH_TOKEN"
+	keyStorageDir           = "UPLOAD_SERVER_STORAGE_DIR"
+	keyStoragePersist       = "UPLOAD_SERVER_STORAGE_PERSIST"
+	keyReadyMinFreeSpace    = "UPLOAD_SERVER_READY_MIN_FREE_SPACE"
+	keyShutdownDrainDelay   = "UPLOAD_SERVER_SHUTDOWN_DRAIN_DELAY"
+	keyShutdownTimeout      = "UPLOAD_SERVER_SHUTDOWN_TIMEOUT"
+	keyLogLevel             = "UPLOAD_SERVER_LOG_LEVEL"
+	keyConfigFile           = "UPLOAD_SERVER_CONFIG_FILE"
+	keyCORSAllowedOrigins   = "UPLOAD_SERVER_CORS_ALLOWED_ORIGINS"
+	keyMultipartTTL         = "UPLOAD_SERVER_MULTIPART_TTL"
+	keyS3Enabled            = "UPLOAD_SERVER_S3_ENABLED"
+	keyS3Addr               = "UPLOAD_SERVER_S3_ADDR"
+	keyS3Bucket             = "UPLOAD_SERVER_S3_BUCKET"
+	keyS3Region             = "UPLOAD_SERVER_S3_REGION"
+	keyS3Credentials        = "UPLOAD_SERVER_S3_CREDENTIALS"
+	keyStorageS3Enabled     = "UPLOAD_SERVER_STORAGE_S3_ENABLED"
+	keyStorageS3Endpoint    = "UPLOAD_SERVER_STORAGE_S3_ENDPOINT"
+	keyStorageS3Bucket      = "UPLOAD_SERVER_STORAGE_S3_BUCKET"
+	keyStorageS3Region      = "UPLOAD_SERVER_STORAGE_S3_REGION"
+	keyStorageS3AccessKey   = "UPLOAD_SERVER_STORAGE_S3_ACCESS_KEY"
+	keyStorageS3SecretKey   = "UPLOAD_SERVER_STORAGE_S3_SECRET_KEY"
+	keyStorageS3Prefix      = "UPLOAD_SERVER_STORAGE_S3_PREFIX"
+	keyStorageS3PartSize    = "UPLOAD_SERVER_STORAGE_S3_PART_SIZE"
+	keyRetentionMaxTTL      = "UPLOAD_SERVER_RETENTION_MAX_TTL"
+	keyRetentionRules       = "UPLOAD_SERVER_RETENTION_RULES"
+	keyRetentionInterval    = "UPLOAD_SERVER_RETENTION_INTERVAL"
+	keyRetentionTempTTL     = "UPLOAD_SERVER_RETENTION_TEMP_TTL"
+	keyRetentionDryRun      = "UPLOAD_SERVER_RETENTION_DRY_RUN"
+	keyPresignSecret        = "UPLOAD_SERVER_PRESIGN_SECRET"
+	keyPresignRequired      = "UPLOAD_SERVER_PRESIGN_REQUIRED"
+	keyPresignMaxTTL        = "UPLOAD_SERVER_PRESIGN_MAX_TTL"
+	keyWebhookURLs          = "UPLOAD_SERVER_WEBHOOK_URLS"
+	keyWebhookSecret        = "UPLOAD_SERVER_WEBHOOK_SECRET"
+	keyWebhookOutboxDir     = "UPLOAD_SERVER_WEBHOOK_OUTBOX_DIR"
+	keyWebhookMaxAttempts   = "UPLOAD_SERVER_WEBHOOK_MAX_ATTEMPTS"
+	keyWebhookTimeout       = "UPLOAD_SERVER_WEBHOOK_TIMEOUT"
+	keyWebhookBackoff       = "UPLOAD_SERVER_WEBHOOK_BACKOFF"
+	keyWebhookMaxBackoff    = "UPLOAD_SERVER_WEBHOOK_MAX_BACKOFF"
+	keyHookCommand          = "UPLOAD_SERVER_HOOK_COMMAND"
+	keyHookTimeout          = "UPLOAD_SERVER_HOOK_TIMEOUT"
+	keyHookConcurrency      = "UPLOAD_SERVER_HOOK_CONCURRENCY"
+	keyHookQuarantineDir    = "UPLOAD_SERVER_HOOK_QUARANTINE_DIR"
+	keyContentAllowedTypes  = "UPLOAD_SERVER_CONTENT_ALLOWED_TYPES"
+	keyContentDeniedTypes   = "UPLOAD_SERVER_CONTENT_DENIED_TYPES"
+	keyContentMaxSizes      = "UPLOAD_SERVER_CONTENT_MAX_SIZES"
+	keyContentCheckMismatch = "UPLOAD_SERVER_CONTENT_CHECK_MISMATCH"
+	keyExtractEnabled       = "UPLOAD_SERVER_EXTRACT_ENABLED"
+	keyExtractMaxEntries    = "UPLOAD_SERVER_EXTRACT_MAX_ENTRIES"
+	keyExtractMaxSize       = "UPLOAD_SERVER_EXTRACT_MAX_SIZE"
+	keyExtractMaxRatio      = "UPLOAD_SERVER_EXTRACT_MAX_RATIO"
+	keyRateLimitRequests    = "UPLOAD_SERVER_RATE_LIMIT_REQUESTS"
+	keyRateLimitBurst       = "UPLOAD_SERVER_RATE_LIMIT_BURST"
+	keyRateLimitBandwidth   = "UPLOAD_SERVER_RATE_LIMIT_BANDWIDTH"
 
-var Cfg AppConfig
+	redactedValue = "[REDACTED]"
+)
 
 type AppConfig struct {
 	Addr                 string
@@ -49,9 +145,175 @@ type AppConfig struct {
 	WriteTimeout         time.Duration
 	IdleTimeout          time.Duration
 	MaxConcurrentUploads int
+	AdminEnabled         bool
+	AdminAddr            string
+	AdminToken           string
+	// AuthToken is the bearer token the upload and file endpoints require.
+	// Empty leaves the upload endpoints open.
+	AuthToken  string
+	StorageDir string
+	// StoragePersist keeps uploaded files in StorageDir. Without it they
+	// are only staged there for hashing and dropped once the upload is
+	// complete. The S3 storage always keeps them.
+	StoragePersist     bool
+	ReadyMinFreeSpace  uint64
+	ShutdownDrainDelay time.Duration
+	ShutdownTimeout    time.Duration
+	LogLevel           slog.Level
+	CORSAllowedOrigins []string
+	// MultipartTTL is how long an idle multipart upload is kept before its
+	// parts are removed.
+	MultipartTTL time.Duration
+	// S3Enabled serves the S3-compatible API on S3Addr, exposing the storage
+	// as the single bucket S3Bucket.
+	S3Enabled bool
+	S3Addr    string
+	S3Bucket  string
+	S3Region  string
+	// S3Credentials maps access key ids to secret keys, configured as
+	// comma-separated access_key:secret_key pairs.
+	S3Credentials map[string]string
+	// StorageS3Enabled keeps uploaded files in an S3 bucket instead of
+	// StorageDir.
+	StorageS3Enabled   bool
+	StorageS3Endpoint  string
+	StorageS3Bucket    string
+	StorageS3Region    string
+	StorageS3AccessKey string
+	StorageS3SecretKey string
+	// StorageS3Prefix is prepended to every key.
+	StorageS3Prefix string
+	// StorageS3PartSize is the size of the parts files are streamed to S3
+	// in, and so the memory held per upload.
+	StorageS3PartSize int64
+	// RetentionMaxTTL caps the time to live a client may request for an
+	// upload; zero leaves it uncapped.
+	RetentionMaxTTL time.Duration
+	// RetentionRules expire files by name prefix, configured as
+	// comma-separated prefix=ttl pairs. The longest matching prefix applies.
+	RetentionRules []RetentionRule
+	// RetentionInterval is how often the janitor looks for expired files.
+	RetentionInterval time.Duration
+	// RetentionTempTTL is how long a temp file may go unmodified before it
+	// is considered left over from an interrupted upload.
+	RetentionTempTTL time.Duration
+	// RetentionDryRun only logs and counts what the janitor would delete.
+	RetentionDryRun bool
+	// PresignSecret is the HMAC key of pre-signed URLs, which are issued
+	// through the admin API. Empty disables them.
+	PresignSecret string
+	// PresignRequired makes the upload and file endpoints accept nothing
+	// but pre-signed URLs.
+	PresignRequired bool
+	// PresignMaxTTL caps how long a pre-signed URL works.
+	PresignMaxTTL time.Duration
+	// WebhookURLs receive the upload lifecycle events; none disables
+	// webhooks.
+	WebhookURLs []string
+	// WebhookSecret signs the webhook requests. Empty sends them unsigned.
+	WebhookSecret string
+	// WebhookOutboxDir keeps the pending deliveries and the delivery log.
+	// It defaults to .webhooks in StorageDir.
+	WebhookOutboxDir string
+	// WebhookMaxAttempts is how often a delivery is tried before it is
+	// given up.
+	WebhookMaxAttempts int
+	// WebhookTimeout limits one delivery attempt.
+	WebhookTimeout time.Duration
+	// WebhookBackoff is the wait after the first failed attempt; it doubles
+	// with every further one up to WebhookMaxBackoff.
+	WebhookBackoff    time.Duration
+	WebhookMaxBackoff time.Duration
+	// HookCommand is run on every uploaded file before it is committed, as
+	// a program followed by its arguments separated by spaces. Empty runs
+	// no command.
+	HookCommand string
+	// HookTimeout limits the upload hooks of one file, including the wait
+	// for a free slot; zero means no limit.
+	HookTimeout time.Duration
+	// HookConcurrency is how many files the upload hooks inspect at once;
+	// zero means no limit.
+	HookConcurrency int
+	// HookQuarantineDir keeps the files a hook quarantined. It defaults to
+	// .quarantine in StorageDir.
+	HookQuarantineDir string
+	// ContentAllowedTypes, when set, are the only media types an uploaded
+	// file may have, as patterns such as "image/*". The type is sniffed
+	// from the first bytes of the file.
+	ContentAllowedTypes []string
+	// ContentDeniedTypes are media type patterns no uploaded file may have,
+	// whether sniffed or declared by the client.
+	ContentDeniedTypes []string
+	// ContentMaxSizes limit the size of files by media type, configured as
+	// comma-separated pattern=size pairs. The most specific pattern applies.
+	ContentMaxSizes []ContentSizeLimit
+	// ContentCheckMismatch rejects files whose sniffed type contradicts
+	// the Content-Type of their part or their extension.
+	ContentCheckMismatch bool
+	// ExtractEnabled lets clients have an uploaded archive extracted, see
+	// api.HeaderUploadExtract. Off by default: extraction writes many files
+	// from one request and is bounded only by the ExtractMax limits.
+	ExtractEnabled bool
+	// ExtractMaxEntries caps the entries of an archive, directories and
+	// links included.
+	ExtractMaxEntries int
+	// ExtractMaxSize caps the total size of the files extracted from an
+	// archive.
+	ExtractMaxSize int64
+	// ExtractMaxRatio caps how many times larger the extracted files may
+	// get than the compressed archive read so far.
+	ExtractMaxRatio int
+	// RateLimitRequests caps the upload requests per second across the
+	// server: POST /upload, part uploads and S3 PUTs. Zero means no limit.
+	RateLimitRequests float64
+	// RateLimitBurst is how many upload requests may arrive at once above
+	// RateLimitRequests. Zero allows one second's worth.
+	RateLimitBurst int
+	// RateLimitBandwidth caps the bytes per second read from all upload
+	// bodies together, configured as a rate such as "100MiB/s". Zero means
+	// no limit.
+	RateLimitBandwidth int64
+}
+
+// ContentSizeLimit caps files whose media type matches Type at MaxSize bytes.
+type ContentSizeLimit struct {
+	Type    string
+	MaxSize int64
+}
+
+// RetentionRule expires files whose name starts with Prefix once they are
+// older than TTL. An empty prefix matches every file.
+type RetentionRule struct {
+	Prefix string
+	TTL    time.Duration
+}
+
+// Options controls where Load reads the configuration from.
+type Options struct {
+	// ConfigFile is read in addition to the process environment. The format
+	// is taken from the extension: .yaml, .yml, .toml, .json, anything else
+	// is parsed as a dotenv file. When empty, UPLOAD_SERVER_CONFIG_FILE is
+	// used, falling back to an optional .env.server.
+	ConfigFile string
+}
+
+// configFile resolves the file to read and reports whether it must exist.
+func (o Options) configFile() (string, bool) {
+	if o.ConfigFile != "" {
+		return o.ConfigFile, true
+	}
+	if path := strings.TrimSpace(os.Getenv(keyConfigFile)); path != "" {
+		return path, true
+	}
+
+	return defaultConfigFile, false
 }
 
-func init() {
+// Load reads the configuration from the process environment and the config
+// file selected by opts. Environment variables take precedence over the file.
+// All validation problems are reported together. Load has no side effects and
+// may be called again to pick up changes, see Watch.
+func Load(opts Options) (AppConfig, error) {
 	appViper := viper.New()
 
 	appViper.AutomaticEnv()
@@ -67,21 +329,83 @@ func init() {
 	appViper.SetDefault(keyWriteTimeout, defaultWriteTimeout)
 	appViper.SetDefault(keyIdleTimeout, defaultIdleTimeout)
 	appViper.SetDefault(keyMaxConcurrentUploads, defaultMaxConcurrentUploads)
+	appViper.SetDefault(keyAdminEnabled, false)
+	appViper.SetDefault(keyAdminAddr, defaultAdminAddr)
+	appViper.SetDefault(keyStorageDir, defaultStorageDir)
+	appViper.SetDefault(keyStoragePersist, false)
+	appViper.SetDefault(keyReadyMinFreeSpace, defaultReadyMinFreeSpace)
+	appViper.SetDefault(keyShutdownDrainDelay, defaultShutdownDrainDelay)
+	appViper.SetDefault(keyShutdownTimeout, defaultShutdownTimeout)
+	appViper.SetDefault(keyLogLevel, slog.LevelInfo.String())
+	appViper.SetDefault(keyMultipartTTL, defaultMultipartTTL)
+	appViper.SetDefault(keyS3Enabled, false)
+	appViper.SetDefault(keyS3Addr, defaultS3Addr)
+	appViper.SetDefault(keyS3Bucket, defaultS3Bucket)
+	appViper.SetDefault(keyS3Region, defaultS3Region)
+	appViper.SetDefault(keyStorageS3Enabled, false)
+	appViper.SetDefault(keyStorageS3Region, defaultS3Region)
+	appViper.SetDefault(keyStorageS3PartSize, defaultStorageS3PartSize)
+	appViper.SetDefault(keyRetentionMaxTTL, time.Duration(0))
+	appViper.SetDefault(keyRetentionInterval, defaultRetentionInterval)
+	appViper.SetDefault(keyRetentionTempTTL, defaultRetentionTempTTL)
+	appViper.SetDefault(keyRetentionDryRun, false)
+	appViper.SetDefault(keyPresignRequired, false)
+	appViper.SetDefault(keyPresignMaxTTL, defaultPresignMaxTTL)
+	appViper.SetDefault(keyWebhookMaxAttempts, defaultWebhookMaxAttempts)
+	appViper.SetDefault(keyWebhookTimeout, defaultWebhookTimeout)
+	appViper.SetDefault(keyWebhookBackoff, defaultWebhookBackoff)
+	appViper.SetDefault(keyWebhookMaxBackoff, defaultWebhookMaxBackoff)
+	appViper.SetDefault(keyHookTimeout, defaultHookTimeout)
+	appViper.SetDefault(keyHookConcurrency, defaultHookConcurrency)
+	appViper.SetDefault(keyContentCheckMismatch, false)
+	appViper.SetDefault(keyExtractEnabled, false)
+	appViper.SetDefault(keyExtractMaxEntries, defaultExtractMaxEntries)
+	appViper.SetDefault(keyExtractMaxSize, defaultExtractMaxSize)
+	appViper.SetDefault(keyExtractMaxRatio, defaultExtractMaxRatio)
+	appViper.SetDefault(keyRateLimitRequests, 0)
+	appViper.SetDefault(keyRateLimitBurst, 0)
+	appViper.SetDefault(keyRateLimitBandwidth, 0)
 
-	appViper.SetConfigFile(defaultConfigFile)
-	appViper.SetConfigType("env")
+	configFile, required := opts.configFile()
+	if err := readConfigFile(appViper, configFile, required); err != nil {
+		return AppConfig{}, err
+	}
 
-	if err := appViper.ReadInConfig(); err != nil {
-		var configNotFoundErr viper.ConfigFileNotFoundError
-		if !errors.As(err, &configNotFoundErr) && !os.IsNotExist(err) {
-			log.Panicf("read %s: %v", defaultConfigFile, err)
+	var errs []error
+	logLevel, err := parseLogLevel(appViper.GetString(keyLogLevel))
+	if err != nil {
+		errs = append(errs, err)
+	}
+	s3Credentials, err := parseS3Credentials(parseCSV(appViper.GetStringSlice(keyS3Credentials)))
+	if err != nil {
+		errs = append(errs, err)
+	}
+	retentionRules, err := parseRetentionRules(parseCSV(appViper.GetStringSlice(keyRetentionRules)))
+	if err != nil {
+		errs = append(errs, err)
+	}
+	contentMaxSizes, err := parseContentMaxSizes(parseCSV(appViper.GetStringSlice(keyContentMaxSizes)))
+	if err != nil {
+		errs = append(errs, err)
+	}
+	rateLimitBandwidth, err := parseRate(appViper, keyRateLimitBandwidth)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	sizes := make(map[string]int64, len(sizeKeys))
+	for _, key := range sizeKeys {
+		size, err := parseSize(appViper, key)
+		if err != nil {
+			errs = append(errs, err)
 		}
+		sizes[key] = size
 	}
-	Cfg = AppConfig{
+
+	cfg := AppConfig{
 		Addr:                 appViper.GetString(keyAddr),
 		Name:                 appViper.GetString(keyName),
 		StreamRequestBody:    appViper.GetBool(keyStreamRequestBody),
-		MaxRequestBodySize:   appViper.GetInt(keyMaxRequestBodySize),
+		MaxRequestBodySize:   int(sizes[keyMaxRequestBodySize]),
 		FileField:            appViper.GetString(keyFileField),
 		PprofEnabled:         appViper.GetBool(keyPprofEnabled),
 		PprofAddr:            appViper.GetString(keyPprofAddr),
@@ -89,33 +413,601 @@ func init() {
 		WriteTimeout:         appViper.GetDuration(keyWriteTimeout),
 		IdleTimeout:          appViper.GetDuration(keyIdleTimeout),
 		MaxConcurrentUploads: appViper.GetInt(keyMaxConcurrentUploads),
+		AdminEnabled:         appViper.GetBool(keyAdminEnabled),
+		AdminAddr:            appViper.GetString(keyAdminAddr),
+		AdminToken:           appViper.GetString(keyAdminToken),
+		AuthToken:            appViper.GetString(keyAuthToken),
+		StorageDir:           appViper.GetString(keyStorageDir),
+		StoragePersist:       appViper.GetBool(keyStoragePersist),
+		ReadyMinFreeSpace:    uint64(sizes[keyReadyMinFreeSpace]),
+		ShutdownDrainDelay:   appViper.GetDuration(keyShutdownDrainDelay),
+		ShutdownTimeout:      appViper.GetDuration(keyShutdownTimeout),
+		LogLevel:             logLevel,
+		CORSAllowedOrigins:   parseCSV(appViper.GetStringSlice(keyCORSAllowedOrigins)),
+		MultipartTTL:         appViper.GetDuration(keyMultipartTTL),
+		S3Enabled:            appViper.GetBool(keyS3Enabled),
+		S3Addr:               appViper.GetString(keyS3Addr),
+		S3Bucket:             appViper.GetString(keyS3Bucket),
+		S3Region:             appViper.GetString(keyS3Region),
+		S3Credentials:        s3Credentials,
+		StorageS3Enabled:     appViper.GetBool(keyStorageS3Enabled),
+		StorageS3Endpoint:    appViper.GetString(keyStorageS3Endpoint),
+		StorageS3Bucket:      appViper.GetString(keyStorageS3Bucket),
+		StorageS3Region:      appViper.GetString(keyStorageS3Region),
+		StorageS3AccessKey:   appViper.GetString(keyStorageS3AccessKey),
+		StorageS3SecretKey:   appViper.GetString(keyStorageS3SecretKey),
+		StorageS3Prefix:      appViper.GetString(keyStorageS3Prefix),
+		StorageS3PartSize:    sizes[keyStorageS3PartSize],
+		RetentionMaxTTL:      appViper.GetDuration(keyRetentionMaxTTL),
+		RetentionRules:       retentionRules,
+		RetentionInterval:    appViper.GetDuration(keyRetentionInterval),
+		RetentionTempTTL:     appViper.GetDuration(keyRetentionTempTTL),
+		RetentionDryRun:      appViper.GetBool(keyRetentionDryRun),
+		PresignSecret:        appViper.GetString(keyPresignSecret),
+		PresignRequired:      appViper.GetBool(keyPresignRequired),
+		PresignMaxTTL:        appViper.GetDuration(keyPresignMaxTTL),
+		WebhookURLs:          parseCSV(appViper.GetStringSlice(keyWebhookURLs)),
+		WebhookSecret:        appViper.GetString(keyWebhookSecret),
+		WebhookOutboxDir:     appViper.GetString(keyWebhookOutboxDir),
+		WebhookMaxAttempts:   appViper.GetInt(keyWebhookMaxAttempts),
+		WebhookTimeout:       appViper.GetDuration(keyWebhookTimeout),
+		WebhookBackoff:       appViper.GetDuration(keyWebhookBackoff),
+		WebhookMaxBackoff:    appViper.GetDuration(keyWebhookMaxBackoff),
+		HookCommand:          strings.TrimSpace(appViper.GetString(keyHookCommand)),
+		HookTimeout:          appViper.GetDuration(keyHookTimeout),
+		HookConcurrency:      appViper.GetInt(keyHookConcurrency),
+		HookQuarantineDir:    appViper.GetString(keyHookQuarantineDir),
+		ContentAllowedTypes:  parseCSV(appViper.GetStringSlice(keyContentAllowedTypes)),
+		ContentDeniedTypes:   parseCSV(appViper.GetStringSlice(keyContentDeniedTypes)),
+		ContentMaxSizes:      contentMaxSizes,
+		ContentCheckMismatch: appViper.GetBool(keyContentCheckMismatch),
+		ExtractEnabled:       appViper.GetBool(keyExtractEnabled),
+		ExtractMaxEntries:    appViper.GetInt(keyExtractMaxEntries),
+		ExtractMaxSize:       sizes[keyExtractMaxSize],
+		ExtractMaxRatio:      appViper.GetInt(keyExtractMaxRatio),
+		RateLimitRequests:    appViper.GetFloat64(keyRateLimitRequests),
+		RateLimitBurst:       appViper.GetInt(keyRateLimitBurst),
+		RateLimitBandwidth:   rateLimitBandwidth,
 	}
+	if !cfg.StorageS3Enabled && cfg.StorageDir != "" {
+		if cfg.WebhookOutboxDir == "" {
+			cfg.WebhookOutboxDir = filepath.Join(cfg.StorageDir, defaultWebhookOutboxDir)
+		}
+		if cfg.HookQuarantineDir == "" {
+			cfg.HookQuarantineDir = filepath.Join(cfg.StorageDir, defaultHookQuarantineDir)
+		}
+	}
+
+	errs = append(errs, cfg.validate()...)
+	if len(errs) > 0 {
+		return AppConfig{}, fmt.Errorf("invalid server config: %w", errors.Join(errs...))
+	}
+
+	return cfg, nil
+}
+
+// Validate checks a configuration that was built without Load, e.g. by a
+// program embedding the server.
+func (c AppConfig) Validate() error {
+	if errs := c.validate(); len(errs) > 0 {
+		return fmt.Errorf("invalid server config: %w", errors.Join(errs...))
+	}
+
+	return nil
+}
 
-	if strings.TrimSpace(Cfg.Addr) == "" {
-		log.Panic("invalid server config: addr is required")
+func (c AppConfig) validate() []error {
+	var errs []error
+	if strings.TrimSpace(c.Addr) == "" {
+		errs = append(errs, errors.New("addr is required"))
+	}
+	if strings.TrimSpace(c.Name) == "" {
+		errs = append(errs, errors.New("name is required"))
+	}
+	if strings.TrimSpace(c.FileField) == "" {
+		errs = append(errs, errors.New("file_field is required"))
+	}
+	if c.MaxRequestBodySize <= 0 {
+		errs = append(errs, errors.New("max_request_body_size must be positive"))
+	}
+	if c.PprofEnabled && strings.TrimSpace(c.PprofAddr) == "" {
+		errs = append(errs, errors.New("pprof_addr is required when pprof_enabled=true"))
+	}
+	if c.ReadTimeout <= 0 {
+		errs = append(errs, errors.New("read_timeout must be positive"))
+	}
+	if c.WriteTimeout <= 0 {
+		errs = append(errs, errors.New("write_timeout must be positive"))
+	}
+	if c.IdleTimeout <= 0 {
+		errs = append(errs, errors.New("idle_timeout must be positive"))
+	}
+	if c.MaxConcurrentUploads <= 0 {
+		errs = append(errs, errors.New("max_concurrent_uploads must be positive"))
+	}
+	if c.AdminEnabled && strings.TrimSpace(c.AdminAddr) == "" {
+		errs = append(errs, errors.New("admin_addr is required when admin_enabled=true"))
+	}
+	if c.AdminEnabled && strings.TrimSpace(c.AdminToken) == "" {
+		errs = append(errs, errors.New("admin_token is required when admin_enabled=true"))
+	}
+	if !c.StorageS3Enabled && strings.TrimSpace(c.StorageDir) == "" {
+		errs = append(errs, errors.New("storage_dir is required"))
 	}
-	if strings.TrimSpace(Cfg.Name) == "" {
-		log.Panic("invalid server config: name is required")
+	if c.StorageS3Enabled {
+		if endpoint, err := url.Parse(c.StorageS3Endpoint); err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			errs = append(errs, fmt.Errorf("storage_s3_endpoint %q must be an http(s) URL", c.StorageS3Endpoint))
+		}
+		if !validBucketName(c.StorageS3Bucket) {
+			errs = append(errs, fmt.Errorf("storage_s3_bucket %q is not a valid bucket name", c.StorageS3Bucket))
+		}
+		if strings.TrimSpace(c.StorageS3Region) == "" {
+			errs = append(errs, errors.New("storage_s3_region is required when storage_s3_enabled=true"))
+		}
+		if c.StorageS3AccessKey == "" || c.StorageS3SecretKey == "" {
+			errs = append(errs, errors.New("storage_s3_access_key and storage_s3_secret_key are required when storage_s3_enabled=true"))
+		}
+		if c.StorageS3PartSize < minStorageS3PartSize {
+			errs = append(errs, fmt.Errorf("storage_s3_part_size must be at least %d", minStorageS3PartSize))
+		}
+	}
+	if c.ShutdownDrainDelay < 0 {
+		errs = append(errs, errors.New("shutdown_drain_delay must not be negative"))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown_timeout must be positive"))
+	}
+	if c.MultipartTTL <= 0 {
+		errs = append(errs, errors.New("multipart_ttl must be positive"))
+	}
+	if c.RetentionMaxTTL < 0 {
+		errs = append(errs, errors.New("retention_max_ttl must not be negative"))
+	}
+	for _, rule := range c.RetentionRules {
+		if rule.TTL <= 0 {
+			errs = append(errs, fmt.Errorf("retention_rules: ttl of prefix %q must be positive", rule.Prefix))
+		}
+	}
+	if c.RetentionInterval <= 0 {
+		errs = append(errs, errors.New("retention_interval must be positive"))
+	}
+	if c.RetentionTempTTL <= 0 {
+		errs = append(errs, errors.New("retention_temp_ttl must be positive"))
+	}
+	if c.PresignSecret != "" && len(c.PresignSecret) < minPresignSecretSize {
+		errs = append(errs, fmt.Errorf("presign_secret must be at least %d bytes", minPresignSecretSize))
+	}
+	if c.PresignRequired && c.PresignSecret == "" {
+		errs = append(errs, errors.New("presign_secret is required when presign_required=true"))
+	}
+	if c.PresignMaxTTL <= 0 {
+		errs = append(errs, errors.New("presign_max_ttl must be positive"))
+	}
+	for _, raw := range c.WebhookURLs {
+		if endpoint, err := url.Parse(raw); err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			errs = append(errs, fmt.Errorf("webhook_urls: %q must be an http(s) URL", raw))
+		}
+	}
+	if len(c.WebhookURLs) > 0 {
+		if strings.TrimSpace(c.WebhookOutboxDir) == "" {
+			errs = append(errs, errors.New("webhook_outbox_dir is required when webhook_urls are set"))
+		}
+		if c.WebhookMaxAttempts <= 0 {
+			errs = append(errs, errors.New("webhook_max_attempts must be positive"))
+		}
+		if c.WebhookTimeout <= 0 {
+			errs = append(errs, errors.New("webhook_timeout must be positive"))
+		}
+		if c.WebhookBackoff <= 0 {
+			errs = append(errs, errors.New("webhook_backoff must be positive"))
+		}
+		if c.WebhookMaxBackoff < c.WebhookBackoff {
+			errs = append(errs, errors.New("webhook_max_backoff must not be less than webhook_backoff"))
+		}
+	}
+	if c.HookCommand != "" && c.StorageS3Enabled {
+		errs = append(errs, errors.New("hook_command needs the local storage, the hook gets the path of the uploaded file"))
 	}
-	if strings.TrimSpace(Cfg.FileField) == "" {
-		log.Panic("invalid server config: file_field is required")
+	if c.HookQuarantineDir != "" && c.StorageS3Enabled {
+		errs = append(errs, errors.New("hook_quarantine_dir needs the local storage, quarantine moves the uploaded file"))
 	}
-	if Cfg.MaxRequestBodySize <= 0 {
-		log.Panic("invalid server config: max_request_body_size must be positive")
+	if c.HookTimeout < 0 {
+		errs = append(errs, errors.New("hook_timeout must not be negative"))
+	}
+	if c.HookConcurrency < 0 {
+		errs = append(errs, errors.New("hook_concurrency must not be negative"))
+	}
+	for _, pattern := range c.ContentAllowedTypes {
+		if !sniff.ValidPattern(pattern) {
+			errs = append(errs, fmt.Errorf("content_allowed_types: %q is not a media type pattern", pattern))
+		}
+	}
+	for _, pattern := range c.ContentDeniedTypes {
+		if !sniff.ValidPattern(pattern) {
+			errs = append(errs, fmt.Errorf("content_denied_types: %q is not a media type pattern", pattern))
+		}
+	}
+	for _, limit := range c.ContentMaxSizes {
+		if !sniff.ValidPattern(limit.Type) {
+			errs = append(errs, fmt.Errorf("content_max_sizes: %q is not a media type pattern", limit.Type))
+		}
+		if limit.MaxSize <= 0 {
+			errs = append(errs, fmt.Errorf("content_max_sizes: size of %q must be positive", limit.Type))
+		}
 	}
-	if Cfg.PprofEnabled && strings.TrimSpace(Cfg.PprofAddr) == "" {
-		log.Panic("invalid server config: pprof_addr is required when pprof_enabled=true")
+	if c.ExtractEnabled {
+		if c.ExtractMaxEntries <= 0 {
+			errs = append(errs, errors.New("extract_max_entries must be positive"))
+		}
+		if c.ExtractMaxSize <= 0 {
+			errs = append(errs, errors.New("extract_max_size must be positive"))
+		}
+		if c.ExtractMaxRatio <= 0 {
+			errs = append(errs, errors.New("extract_max_ratio must be positive"))
+		}
 	}
-	if Cfg.ReadTimeout <= 0 {
-		log.Panic("invalid server config: read_timeout must be positive")
+	if c.RateLimitRequests < 0 {
+		errs = append(errs, errors.New("rate_limit_requests must not be negative"))
 	}
-	if Cfg.WriteTimeout <= 0 {
-		log.Panic("invalid server config: write_timeout must be positive")
+	if c.RateLimitBurst < 0 {
+		errs = append(errs, errors.New("rate_limit_burst must not be negative"))
 	}
-	if Cfg.IdleTimeout <= 0 {
-		log.Panic("invalid server config: idle_timeout must be positive")
+	if c.RateLimitBandwidth < 0 {
+		errs = append(errs, errors.New("rate_limit_bandwidth must not be negative"))
 	}
-	if Cfg.MaxConcurrentUploads <= 0 {
-		log.Panic("invalid server config: max_concurrent_uploads must be positive")
+	if c.S3Enabled {
+		if strings.TrimSpace(c.S3Addr) == "" {
+			errs = append(errs, errors.New("s3_addr is required when s3_enabled=true"))
+		}
+		if !validBucketName(c.S3Bucket) {
+			errs = append(errs, fmt.Errorf("s3_bucket %q is not a valid bucket name", c.S3Bucket))
+		}
+		if strings.TrimSpace(c.S3Region) == "" {
+			errs = append(errs, errors.New("s3_region is required when s3_enabled=true"))
+		}
+		if len(c.S3Credentials) == 0 {
+			errs = append(errs, errors.New("s3_credentials are required when s3_enabled=true"))
+		}
 	}
+
+	return errs
+}
+
+// readConfigFile merges path into v. A missing file is only an error when it
+// was requested explicitly.
+func readConfigFile(v *viper.Viper, path string, required bool) error {
+	v.SetConfigFile(path)
+	v.SetConfigType(configType(path))
+
+	if err := v.ReadInConfig(); err != nil {
+		var configNotFoundErr viper.ConfigFileNotFoundError
+		if !required && (errors.As(err, &configNotFoundErr) || os.IsNotExist(err)) {
+			return nil
+		}
+		return fmt.Errorf("read %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func configType(path string) string {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml", ".toml", ".json":
+		return strings.TrimPrefix(ext, ".")
+	default:
+		return "env"
+	}
+}
+
+// liveKeys lists the settings that a running server applies on reload; any
+// other change is reported as requiring a restart.
+var liveKeys = map[string]bool{
+	keyMaxConcurrentUploads: true,
+	keyAdminToken:           true,
+	keyAuthToken:            true,
+	keyReadyMinFreeSpace:    true,
+	keyLogLevel:             true,
+	keyS3Credentials:        true,
+	keyPresignSecret:        true,
+	keyWebhookSecret:        true,
+	keyRateLimitRequests:    true,
+	keyRateLimitBurst:       true,
+	keyRateLimitBandwidth:   true,
+}
+
+var secretKeys = map[string]bool{
+	keyAdminToken:         true,
+	keyAuthToken:          true,
+	keyS3Credentials:      true,
+	keyStorageS3SecretKey: true,
+	keyPresignSecret:      true,
+	keyWebhookSecret:      true,
+}
+
+// Redacted returns the effective configuration keyed by environment variable
+// name, with secrets replaced so it can be exposed over the admin API.
+func (c AppConfig) Redacted() map[string]any {
+	values := c.values()
+	for key := range secretKeys {
+		values[key] = redact(fmt.Sprint(values[key]))
+	}
+
+	return values
+}
+
+// Changes compares c with next and splits the changed keys into those that
+// can be applied live and those that only take effect after a restart.
+func (c AppConfig) Changes(next AppConfig) (live, restart []string) {
+	current, updated := c.values(), next.values()
+	for key, value := range current {
+		if fmt.Sprint(value) == fmt.Sprint(updated[key]) {
+			continue
+		}
+		if liveKeys[key] {
+			live = append(live, key)
+		} else {
+			restart = append(restart, key)
+		}
+	}
+	sort.Strings(live)
+	sort.Strings(restart)
+
+	return live, restart
+}
+
+// WithLive returns c with every live-reloadable setting taken from next.
+func (c AppConfig) WithLive(next AppConfig) AppConfig {
+	c.MaxConcurrentUploads = next.MaxConcurrentUploads
+	c.AdminToken = next.AdminToken
+	c.AuthToken = next.AuthToken
+	c.ReadyMinFreeSpace = next.ReadyMinFreeSpace
+	c.LogLevel = next.LogLevel
+	c.S3Credentials = next.S3Credentials
+	c.PresignSecret = next.PresignSecret
+	c.WebhookSecret = next.WebhookSecret
+	c.RateLimitRequests = next.RateLimitRequests
+	c.RateLimitBurst = next.RateLimitBurst
+	c.RateLimitBandwidth = next.RateLimitBandwidth
+
+	return c
+}
+
+func (c AppConfig) values() map[string]any {
+	return map[string]any{
+		keyAddr:                 c.Addr,
+		keyName:                 c.Name,
+		keyStreamRequestBody:    c.StreamRequestBody,
+		keyMaxRequestBodySize:   c.MaxRequestBodySize,
+		keyFileField:            c.FileField,
+		keyPprofEnabled:         c.PprofEnabled,
+		keyPprofAddr:            c.PprofAddr,
+		keyReadTimeout:          c.ReadTimeout.String(),
+		keyWriteTimeout:         c.WriteTimeout.String(),
+		keyIdleTimeout:          c.IdleTimeout.String(),
+		keyMaxConcurrentUploads: c.MaxConcurrentUploads,
+		keyAdminEnabled:         c.AdminEnabled,
+		keyAdminAddr:            c.AdminAddr,
+		keyAdminToken:           c.AdminToken,
+		keyAuthToken:            c.AuthToken,
+		keyStorageDir:           c.StorageDir,
+		keyStoragePersist:       c.StoragePersist,
+		keyReadyMinFreeSpace:    c.ReadyMinFreeSpace,
+		keyShutdownDrainDelay:   c.ShutdownDrainDelay.String(),
+		keyShutdownTimeout:      c.ShutdownTimeout.String(),
+		keyLogLevel:             c.LogLevel.String(),
+		keyCORSAllowedOrigins:   strings.Join(c.CORSAllowedOrigins, ","),
+		keyMultipartTTL:         c.MultipartTTL.String(),
+		keyS3Enabled:            c.S3Enabled,
+		keyS3Addr:               c.S3Addr,
+		keyS3Bucket:             c.S3Bucket,
+		keyS3Region:             c.S3Region,
+		keyS3Credentials:        formatS3Credentials(c.S3Credentials),
+		keyStorageS3Enabled:     c.StorageS3Enabled,
+		keyStorageS3Endpoint:    c.StorageS3Endpoint,
+		keyStorageS3Bucket:      c.StorageS3Bucket,
+		keyStorageS3Region:      c.StorageS3Region,
+		keyStorageS3AccessKey:   c.StorageS3AccessKey,
+		keyStorageS3SecretKey:   c.StorageS3SecretKey,
+		keyStorageS3Prefix:      c.StorageS3Prefix,
+		keyStorageS3PartSize:    c.StorageS3PartSize,
+		keyRetentionMaxTTL:      c.RetentionMaxTTL.String(),
+		keyRetentionRules:       formatRetentionRules(c.RetentionRules),
+		keyRetentionInterval:    c.RetentionInterval.String(),
+		keyRetentionTempTTL:     c.RetentionTempTTL.String(),
+		keyRetentionDryRun:      c.RetentionDryRun,
+		keyPresignSecret:        c.PresignSecret,
+		keyPresignRequired:      c.PresignRequired,
+		keyPresignMaxTTL:        c.PresignMaxTTL.String(),
+		keyWebhookURLs:          strings.Join(c.WebhookURLs, ","),
+		keyWebhookSecret:        c.WebhookSecret,
+		keyWebhookOutboxDir:     c.WebhookOutboxDir,
+		keyWebhookMaxAttempts:   c.WebhookMaxAttempts,
+		keyWebhookTimeout:       c.WebhookTimeout.String(),
+		keyWebhookBackoff:       c.WebhookBackoff.String(),
+		keyWebhookMaxBackoff:    c.WebhookMaxBackoff.String(),
+		keyHookCommand:          c.HookCommand,
+		keyHookTimeout:          c.HookTimeout.String(),
+		keyHookConcurrency:      c.HookConcurrency,
+		keyHookQuarantineDir:    c.HookQuarantineDir,
+		keyContentAllowedTypes:  strings.Join(c.ContentAllowedTypes, ","),
+		keyContentDeniedTypes:   strings.Join(c.ContentDeniedTypes, ","),
+		keyContentMaxSizes:      formatContentMaxSizes(c.ContentMaxSizes),
+		keyContentCheckMismatch: c.ContentCheckMismatch,
+		keyExtractEnabled:       c.ExtractEnabled,
+		keyExtractMaxEntries:    c.ExtractMaxEntries,
+		keyExtractMaxSize:       c.ExtractMaxSize,
+		keyExtractMaxRatio:      c.ExtractMaxRatio,
+		keyRateLimitRequests:    c.RateLimitRequests,
+		keyRateLimitBurst:       c.RateLimitBurst,
+		keyRateLimitBandwidth:   c.RateLimitBandwidth,
+	}
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+
+	return redactedValue
+}
+
+// parseCSV accepts both list values from YAML/TOML/JSON files and
+// comma-separated strings from the environment.
+func parseCSV(raw []string) []string {
+	var out []string
+	for _, item := range raw {
+		for _, part := range strings.Split(item, ",") {
+			if p := strings.TrimSpace(part); p != "" {
+				out = append(out, p)
+			}
+		}
+	}
+
+	return out
+}
+
+// parseS3Credentials reads access_key:secret_key pairs.
+func parseS3Credentials(pairs []string) (map[string]string, error) {
+	credentials := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		accessKey, secretKey, ok := strings.Cut(pair, ":")
+		accessKey, secretKey = strings.TrimSpace(accessKey), strings.TrimSpace(secretKey)
+		if !ok || accessKey == "" || secretKey == "" {
+			return nil, errors.New("s3_credentials: expected access_key:secret_key pairs")
+		}
+		if _, dup := credentials[accessKey]; dup {
+			return nil, fmt.Errorf("s3_credentials: duplicate access key %q", accessKey)
+		}
+		credentials[accessKey] = secretKey
+	}
+
+	return credentials, nil
+}
+
+func formatS3Credentials(credentials map[string]string) string {
+	pairs := make([]string, 0, len(credentials))
+	for accessKey, secretKey := range credentials {
+		pairs = append(pairs, accessKey+":"+secretKey)
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+// parseRetentionRules reads prefix=ttl pairs. The prefix ends at the last
+// "=", so it may contain one itself.
+func parseRetentionRules(pairs []string) ([]RetentionRule, error) {
+	rules := make([]RetentionRule, 0, len(pairs))
+	seen := make(map[string]bool, len(pairs))
+	for _, pair := range pairs {
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("retention_rules: expected prefix=ttl pairs, got %q", pair)
+		}
+		prefix := strings.TrimSpace(pair[:i])
+		ttl, err := time.ParseDuration(strings.TrimSpace(pair[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("retention_rules: prefix %q: %w", prefix, err)
+		}
+		if seen[prefix] {
+			return nil, fmt.Errorf("retention_rules: duplicate prefix %q", prefix)
+		}
+		seen[prefix] = true
+		rules = append(rules, RetentionRule{Prefix: prefix, TTL: ttl})
+	}
+
+	return rules, nil
+}
+
+func formatRetentionRules(rules []RetentionRule) string {
+	pairs := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		pairs = append(pairs, rule.Prefix+"="+rule.TTL.String())
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+// parseContentMaxSizes reads pattern=size pairs, see format.ParseBytes.
+func parseContentMaxSizes(pairs []string) ([]ContentSizeLimit, error) {
+	limits := make([]ContentSizeLimit, 0, len(pairs))
+	seen := make(map[string]bool, len(pairs))
+	for _, pair := range pairs {
+		pattern, rawSize, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("content_max_sizes: expected pattern=size pairs, got %q", pair)
+		}
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		size, err := format.ParseBytes(strings.TrimSpace(rawSize))
+		if err != nil {
+			return nil, fmt.Errorf("content_max_sizes: pattern %q: %w", pattern, err)
+		}
+		if seen[pattern] {
+			return nil, fmt.Errorf("content_max_sizes: duplicate pattern %q", pattern)
+		}
+		seen[pattern] = true
+		limits = append(limits, ContentSizeLimit{Type: pattern, MaxSize: size})
+	}
+
+	return limits, nil
+}
+
+func formatContentMaxSizes(limits []ContentSizeLimit) string {
+	pairs := make([]string, 0, len(limits))
+	for _, limit := range limits {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", limit.Type, limit.MaxSize))
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+// validBucketName applies the S3 naming rules that matter for path-style
+// requests: 3-63 lowercase letters, digits, dots and hyphens, starting and
+// ending with a letter or digit.
+func validBucketName(name string) bool {
+	if len(name) < 3 || len(name) > 63 {
+		return false
+	}
+	for i, c := range name {
+		alnum := ('a' <= c && c <= 'z') || ('0' <= c && c <= '9')
+		if !alnum && (c != '.' && c != '-' || i == 0 || i == len(name)-1) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sizeKeys are read with parseSize and so accept units such as "1GiB".
+var sizeKeys = []string{keyMaxRequestBodySize, keyReadyMinFreeSpace, keyStorageS3PartSize, keyExtractMaxSize}
+
+// parseSize reads a byte count with an optional unit, see format.ParseBytes.
+func parseSize(v *viper.Viper, key string) (int64, error) {
+	size, err := format.ParseBytes(v.GetString(key))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", strings.ToLower(strings.TrimPrefix(key, "UPLOAD_SERVER_")), err)
+	}
+
+	return size, nil
+}
+
+// parseRate reads a rate in bytes per second, see format.ParseRate.
+func parseRate(v *viper.Viper, key string) (int64, error) {
+	rate, err := format.ParseRate(v.GetString(key))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", strings.ToLower(strings.TrimPrefix(key, "UPLOAD_SERVER_")), err)
+	}
+
+	return rate, nil
+}
+
+func parseLogLevel(raw string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(raw))); err != nil {
+		return 0, fmt.Errorf("log_level: %w", err)
+	}
+
+	return level, nil
 }
@@ -0,0 +1,416 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := Load(Options{})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if cfg.Addr != defaultServerAddr {
+		t.Fatalf("unexpected addr: got %q want %q", cfg.Addr, defaultServerAddr)
+	}
+	if cfg.LogLevel != slog.LevelInfo {
+		t.Fatalf("unexpected log level: got %s want %s", cfg.LogLevel, slog.LevelInfo)
+	}
+}
+
+func TestLoadRejectsInvalidConfig(t *testing.T) {
+	t.Setenv(keyMaxConcurrentUploads, "0")
+
+	if _, err := Load(Options{}); err == nil {
+		t.Fatal("expected error for non-positive max_concurrent_uploads")
+	}
+}
+
+func TestLoadReportsAllProblems(t *testing.T) {
+	t.Setenv(keyMaxConcurrentUploads, "0")
+	t.Setenv(keyReadTimeout, "0s")
+	t.Setenv(keyLogLevel, "loud")
+
+	_, err := Load(Options{})
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+	for _, want := range []string{"max_concurrent_uploads", "read_timeout", "log_level"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("error does not mention %s: %v", want, err)
+		}
+	}
+}
+
+func TestLoadS3Config(t *testing.T) {
+	t.Setenv(keyS3Enabled, "true")
+	t.Setenv(keyS3Credentials, "AKIDONE:secret1, AKIDTWO:secret2")
+
+	cfg, err := Load(Options{})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if len(cfg.S3Credentials) != 2 || cfg.S3Credentials["AKIDTWO"] != "secret2" {
+		t.Fatalf("unexpected credentials: %v", cfg.S3Credentials)
+	}
+
+	t.Setenv(keyS3Credentials, "")
+	if _, err := Load(Options{}); err == nil || !strings.Contains(err.Error(), "s3_credentials") {
+		t.Fatalf("expected missing credentials error, got %v", err)
+	}
+
+	t.Setenv(keyS3Credentials, "AKIDONE")
+	t.Setenv(keyS3Bucket, "Bad_Bucket")
+	_, err = Load(Options{})
+	if err == nil || !strings.Contains(err.Error(), "s3_credentials") || !strings.Contains(err.Error(), "s3_bucket") {
+		t.Fatalf("expected credentials and bucket errors, got %v", err)
+	}
+}
+
+func TestLoadStorageS3Config(t *testing.T) {
+	t.Setenv(keyStorageS3Enabled, "true")
+	t.Setenv(keyStorageDir, "")
+	t.Setenv(keyStorageS3Endpoint, "https://s3.eu-west-1.amazonaws.com")
+	t.Setenv(keyStorageS3Bucket, "uploads")
+	t.Setenv(keyStorageS3AccessKey, "AKIDEXAMPLE")
+	t.Setenv(keyStorageS3SecretKey, "secret")
+
+	cfg, err := Load(Options{})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if cfg.StorageS3PartSize != defaultStorageS3PartSize || cfg.StorageS3Region != defaultS3Region {
+		t.Fatalf("unexpected defaults: part size %d region %q", cfg.StorageS3PartSize, cfg.StorageS3Region)
+	}
+	if got := cfg.Redacted()[keyStorageS3SecretKey]; got != redactedValue {
+		t.Fatalf("secret key is not redacted: %v", got)
+	}
+
+	t.Setenv(keyStorageS3Endpoint, "s3.amazonaws.com")
+	t.Setenv(keyStorageS3PartSize, "1024")
+	_, err = Load(Options{})
+	if err == nil || !strings.Contains(err.Error(), "storage_s3_endpoint") || !strings.Contains(err.Error(), "storage_s3_part_size") {
+		t.Fatalf("expected endpoint and part size errors, got %v", err)
+	}
+}
+
+func TestLoadSizeUnits(t *testing.T) {
+	t.Setenv(keyMaxRequestBodySize, "2GiB")
+	t.Setenv(keyReadyMinFreeSpace, "500 MB")
+
+	cfg, err := Load(Options{})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if cfg.MaxRequestBodySize != 2<<30 || cfg.ReadyMinFreeSpace != 500_000_000 {
+		t.Fatalf("unexpected sizes: max request body %d, min free space %d", cfg.MaxRequestBodySize, cfg.ReadyMinFreeSpace)
+	}
+
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	if err := os.WriteFile(path, []byte("UPLOAD_SERVER_STORAGE_S3_PART_SIZE: 6291456\n"), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	cfg, err = Load(Options{ConfigFile: path})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if cfg.StorageS3PartSize != 6<<20 {
+		t.Fatalf("unexpected part size: got %d want %d", cfg.StorageS3PartSize, 6<<20)
+	}
+
+	t.Setenv(keyMaxRequestBodySize, "lots")
+	if _, err := Load(Options{}); err == nil || !strings.Contains(err.Error(), "max_request_body_size") {
+		t.Fatalf("expected max_request_body_size error, got %v", err)
+	}
+}
+
+func TestLoadRetentionConfig(t *testing.T) {
+	cfg, err := Load(Options{})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if cfg.RetentionInterval != defaultRetentionInterval || cfg.RetentionTempTTL != defaultRetentionTempTTL || cfg.RetentionMaxTTL != 0 {
+		t.Fatalf("unexpected defaults: interval %s temp ttl %s max ttl %s", cfg.RetentionInterval, cfg.RetentionTempTTL, cfg.RetentionMaxTTL)
+	}
+
+	t.Setenv(keyRetentionMaxTTL, "720h")
+	t.Setenv(keyRetentionRules, "tmp/=24h, logs/a=b/=1h30m, =2160h")
+	cfg, err = Load(Options{})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	want := []RetentionRule{{Prefix: "tmp/", TTL: 24 * time.Hour}, {Prefix: "logs/a=b/", TTL: 90 * time.Minute}, {Prefix: "", TTL: 2160 * time.Hour}}
+	if !slices.Equal(cfg.RetentionRules, want) {
+		t.Fatalf("unexpected rules: got %v want %v", cfg.RetentionRules, want)
+	}
+	if got := cfg.Redacted()[keyRetentionRules]; got != "=2160h0m0s,logs/a=b/=1h30m0s,tmp/=24h0m0s" {
+		t.Fatalf("unexpected formatted rules: %v", got)
+	}
+
+	for _, rules := range []string{"tmp/", "tmp/=soon", "tmp/=0s", "tmp/=1h,tmp/=2h"} {
+		t.Setenv(keyRetentionRules, rules)
+		if _, err := Load(Options{}); err == nil || !strings.Contains(err.Error(), "retention_rules") {
+			t.Fatalf("rules %q: expected retention_rules error, got %v", rules, err)
+		}
+	}
+}
+
+func TestLoadPresignConfig(t *testing.T) {
+	cfg, err := Load(Options{})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if cfg.PresignSecret != "" || cfg.PresignRequired || cfg.PresignMaxTTL != defaultPresignMaxTTL {
+		t.Fatalf("unexpected defaults: %+v", cfg)
+	}
+
+	t.Setenv(keyPresignRequired, "true")
+	if _, err := Load(Options{}); err == nil || !strings.Contains(err.Error(), "presign_secret is required") {
+		t.Fatalf("expected presign_secret error, got %v", err)
+	}
+	t.Setenv(keyPresignSecret, "short")
+	if _, err := Load(Options{}); err == nil || !strings.Contains(err.Error(), "at least 32 bytes") {
+		t.Fatalf("expected secret length error, got %v", err)
+	}
+
+	secret := strings.Repeat("s", minPresignSecretSize)
+	t.Setenv(keyPresignSecret, secret)
+	cfg, err = Load(Options{})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if got := cfg.Redacted()[keyPresignSecret]; got != redactedValue {
+		t.Fatalf("secret not redacted: %v", got)
+	}
+	next := cfg
+	next.PresignSecret = strings.Repeat("t", minPresignSecretSize)
+	if live, restart := cfg.Changes(next); !slices.Equal(live, []string{keyPresignSecret}) || len(restart) != 0 {
+		t.Fatalf("unexpected changes: live %v restart %v", live, restart)
+	}
+}
+
+func TestLoadWebhookConfig(t *testing.T) {
+	t.Setenv(keyStorageDir, "/srv/uploads")
+	t.Setenv(keyWebhookURLs, "https://hooks.example.com/upload, http://10.0.0.5:8080/events")
+	cfg, err := Load(Options{})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if !slices.Equal(cfg.WebhookURLs, []string{"https://hooks.example.com/upload", "http://10.0.0.5:8080/events"}) {
+		t.Fatalf("unexpected webhook urls: %v", cfg.WebhookURLs)
+	}
+	if want := filepath.Join("/srv/uploads", defaultWebhookOutboxDir); cfg.WebhookOutboxDir != want {
+		t.Fatalf("unexpected outbox dir: got %q want %q", cfg.WebhookOutboxDir, want)
+	}
+	if cfg.WebhookMaxAttempts != defaultWebhookMaxAttempts || cfg.WebhookBackoff != defaultWebhookBackoff || cfg.WebhookMaxBackoff != defaultWebhookMaxBackoff {
+		t.Fatalf("unexpected retry defaults: %+v", cfg)
+	}
+
+	t.Setenv(keyWebhookSecret, "hook-secret")
+	cfg, err = Load(Options{})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if got := cfg.Redacted()[keyWebhookSecret]; got != redactedValue {
+		t.Fatalf("secret not redacted: %v", got)
+	}
+	next := cfg
+	next.WebhookSecret = "rotated"
+	if live, restart := cfg.Changes(next); !slices.Equal(live, []string{keyWebhookSecret}) || len(restart) != 0 {
+		t.Fatalf("unexpected changes: live %v restart %v", live, restart)
+	}
+
+	t.Setenv(keyWebhookURLs, "ftp://hooks.example.com")
+	t.Setenv(keyWebhookMaxBackoff, "100ms")
+	_, err = Load(Options{})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{"must be an http(s) URL", "webhook_max_backoff"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestLoadHookConfig(t *testing.T) {
+	t.Setenv(keyStorageDir, "/srv/uploads")
+	t.Setenv(keyHookCommand, " /usr/local/bin/scan --quick ")
+	cfg, err := Load(Options{})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if cfg.HookCommand != "/usr/local/bin/scan --quick" || cfg.HookTimeout != defaultHookTimeout || cfg.HookConcurrency != defaultHookConcurrency {
+		t.Fatalf("unexpected hook config: %+v", cfg)
+	}
+	if want := filepath.Join("/srv/uploads", defaultHookQuarantineDir); cfg.HookQuarantineDir != want {
+		t.Fatalf("unexpected quarantine dir: got %q want %q", cfg.HookQuarantineDir, want)
+	}
+
+	t.Setenv(keyStorageS3Enabled, "true")
+	t.Setenv(keyStorageS3Endpoint, "http://minio:9000")
+	t.Setenv(keyStorageS3Bucket, "uploads")
+	t.Setenv(keyStorageS3AccessKey, "access")
+	t.Setenv(keyStorageS3SecretKey, "secret")
+	t.Setenv(keyHookConcurrency, "-1")
+	t.Setenv(keyHookQuarantineDir, "/srv/quarantine")
+	_, err = Load(Options{})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{"hook_command needs the local storage", "hook_concurrency must not be negative", "hook_quarantine_dir needs the local storage"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestLoadContentConfig(t *testing.T) {
+	t.Setenv(keyContentAllowedTypes, "image/*, application/pdf")
+	t.Setenv(keyContentMaxSizes, "image/*=10MiB,Image/PNG=1MiB")
+	t.Setenv(keyContentCheckMismatch, "true")
+	cfg, err := Load(Options{})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if len(cfg.ContentAllowedTypes) != 2 || cfg.ContentAllowedTypes[1] != "application/pdf" || !cfg.ContentCheckMismatch {
+		t.Fatalf("unexpected content config: %+v", cfg)
+	}
+	want := []ContentSizeLimit{{Type: "image/*", MaxSize: 10 << 20}, {Type: "image/png", MaxSize: 1 << 20}}
+	if len(cfg.ContentMaxSizes) != len(want) || cfg.ContentMaxSizes[0] != want[0] || cfg.ContentMaxSizes[1] != want[1] {
+		t.Fatalf("unexpected max sizes: got %+v want %+v", cfg.ContentMaxSizes, want)
+	}
+
+	t.Setenv(keyContentDeniedTypes, "*/exe")
+	t.Setenv(keyContentMaxSizes, "image/*=0")
+	_, err = Load(Options{})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{`content_denied_types: "*/exe"`, `content_max_sizes: size of "image/*" must be positive`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestLoadExtractConfig(t *testing.T) {
+	cfg, err := Load(Options{})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if cfg.ExtractEnabled || cfg.ExtractMaxEntries != defaultExtractMaxEntries || cfg.ExtractMaxSize != defaultExtractMaxSize || cfg.ExtractMaxRatio != defaultExtractMaxRatio {
+		t.Fatalf("unexpected extract defaults: %+v", cfg)
+	}
+
+	t.Setenv(keyExtractEnabled, "true")
+	t.Setenv(keyExtractMaxSize, "512MiB")
+	t.Setenv(keyExtractMaxRatio, "0")
+	_, err = Load(Options{})
+	if err == nil || !strings.Contains(err.Error(), "extract_max_ratio must be positive") {
+		t.Fatalf("unexpected error: got %v want extract_max_ratio must be positive", err)
+	}
+
+	t.Setenv(keyExtractEnabled, "false")
+	cfg, err = Load(Options{})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if cfg.ExtractEnabled || cfg.ExtractMaxSize != 512<<20 {
+		t.Fatalf("unexpected extract config: %+v", cfg)
+	}
+}
+
+func TestLoadConfigFileFormats(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"server.yaml": "UPLOAD_SERVER_ADDR: \":9001\"\nupload_server_read_timeout: 5s\n",
+		"server.toml": "UPLOAD_SERVER_ADDR = \":9001\"\nUPLOAD_SERVER_READ_TIMEOUT = \"5s\"\n",
+		"server.json": `{"UPLOAD_SERVER_ADDR": ":9001", "UPLOAD_SERVER_READ_TIMEOUT": "5s"}`,
+		"server.env":  "UPLOAD_SERVER_ADDR=:9001\nUPLOAD_SERVER_READ_TIMEOUT=5s\n",
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatalf("write config: %v", err)
+			}
+
+			cfg, err := Load(Options{ConfigFile: path})
+			if err != nil {
+				t.Fatalf("load config: %v", err)
+			}
+			if cfg.Addr != ":9001" {
+				t.Fatalf("unexpected addr: got %q want %q", cfg.Addr, ":9001")
+			}
+			if cfg.ReadTimeout != 5*time.Second {
+				t.Fatalf("unexpected read timeout: got %s want %s", cfg.ReadTimeout, 5*time.Second)
+			}
+		})
+	}
+}
+
+func TestLoadRateLimits(t *testing.T) {
+	t.Setenv(keyRateLimitRequests, "2.5")
+	t.Setenv(keyRateLimitBurst, "5")
+	t.Setenv(keyRateLimitBandwidth, "10MiB/s")
+
+	cfg, err := Load(Options{})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if cfg.RateLimitRequests != 2.5 || cfg.RateLimitBurst != 5 || cfg.RateLimitBandwidth != 10<<20 {
+		t.Fatalf("unexpected rate limits: %v %v %v", cfg.RateLimitRequests, cfg.RateLimitBurst, cfg.RateLimitBandwidth)
+	}
+
+	next := cfg
+	next.RateLimitRequests = 0
+	next.RateLimitBandwidth = 1 << 20
+	if live, restart := cfg.Changes(next); !slices.Equal(live, []string{keyRateLimitBandwidth, keyRateLimitRequests}) || len(restart) != 0 {
+		t.Fatalf("unexpected changes: live %v restart %v", live, restart)
+	}
+
+	t.Setenv(keyRateLimitBandwidth, "fast")
+	if _, err := Load(Options{}); err == nil || !strings.Contains(err.Error(), "rate_limit_bandwidth") {
+		t.Fatalf("expected a rate_limit_bandwidth error, got %v", err)
+	}
+}
+
+func TestLoadRequiresExplicitConfigFile(t *testing.T) {
+	if _, err := Load(Options{ConfigFile: filepath.Join(t.TempDir(), "missing.yaml")}); err == nil {
+		t.Fatal("expected error for missing config file")
+	}
+}
+
+func TestChanges(t *testing.T) {
+	current, err := Load(Options{})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	next := current
+	next.MaxConcurrentUploads++
+	next.AdminToken = "rotated"
+	next.Addr = ":9090"
+
+	live, restart := current.Changes(next)
+	if want := []string{keyAdminToken, keyMaxConcurrentUploads}; !slices.Equal(live, want) {
+		t.Fatalf("unexpected live keys: got %v want %v", live, want)
+	}
+	if want := []string{keyAddr}; !slices.Equal(restart, want) {
+		t.Fatalf("unexpected restart keys: got %v want %v", restart, want)
+	}
+
+	applied := current.WithLive(next)
+	if applied.Addr != current.Addr {
+		t.Fatalf("restart-only key was applied: got %q want %q", applied.Addr, current.Addr)
+	}
+	if applied.MaxConcurrentUploads != next.MaxConcurrentUploads || applied.AdminToken != next.AdminToken {
+		t.Fatalf("live keys were not applied: %+v", applied)
+	}
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const reloadDebounce = 250 * time.Millisecond
+
+// Watch reloads the configuration whenever the config file selected by opts
+// changes and passes the result to onChange. The parent directory is watched
+// rather than the file so that editors replacing the file atomically are
+// picked up as well. Watch blocks until ctx is done.
+func Watch(ctx context.Context, opts Options, onChange func(AppConfig, error)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("create config watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	configFile, _ := opts.configFile()
+	configPath, err := filepath.Abs(configFile)
+	if err != nil {
+		return fmt.Errorf("resolve %s: %w", configFile, err)
+	}
+	if err := watcher.Add(filepath.Dir(configPath)); err != nil {
+		return fmt.Errorf("watch %s: %w", configFile, err)
+	}
+
+	debounce := time.NewTimer(0)
+	if !debounce.Stop() {
+		<-debounce.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(event.Name) != configPath {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			debounce.Reset(reloadDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			onChange(AppConfig{}, fmt.Errorf("watch %s: %w", configFile, err))
+		case <-debounce.C:
+			onChange(Load(opts))
+		}
+	}
+}
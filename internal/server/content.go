@@ -0,0 +1,192 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"client-server-fasthttp-test/internal/api"
+	serverconfig "client-server-fasthttp-test/internal/server/config"
+	"client-server-fasthttp-test/internal/server/format"
+	"client-server-fasthttp-test/internal/server/metrics"
+	"client-server-fasthttp-test/internal/server/sniff"
+
+	"github.com/valyala/fasthttp"
+)
+
+// contentPolicy decides from the first bytes of an uploaded file whether it
+// may be stored, and up to which size.
+type contentPolicy struct {
+	allowed       []string
+	denied        []string
+	maxSizes      []serverconfig.ContentSizeLimit
+	checkMismatch bool
+
+	rejections *metrics.Counter
+}
+
+// newContentPolicy returns the configured policy, or nil when it would let
+// every file through.
+func newContentPolicy(cfg serverconfig.AppConfig, reg *metrics.Registry) *contentPolicy {
+	if len(cfg.ContentAllowedTypes) == 0 && len(cfg.ContentDeniedTypes) == 0 && len(cfg.ContentMaxSizes) == 0 && !cfg.ContentCheckMismatch {
+		return nil
+	}
+
+	return &contentPolicy{
+		allowed:       cfg.ContentAllowedTypes,
+		denied:        cfg.ContentDeniedTypes,
+		maxSizes:      cfg.ContentMaxSizes,
+		checkMismatch: cfg.ContentCheckMismatch,
+		rejections: reg.Counter("upload_server_content_rejections_total",
+			"Uploaded files rejected by the content type policy, by reason.", "reason"),
+	}
+}
+
+// reader wraps the content of the file name sent with the part Content-Type
+// declared. It is r itself without a policy.
+func (p *contentPolicy) reader(r io.Reader, name, declared string) io.Reader {
+	if p == nil {
+		return r
+	}
+
+	return &contentReader{r: r, policy: p, name: name, declared: declared}
+}
+
+// check returns the media type of the file starting with head and its size
+// limit, zero meaning none. A rejected file is answered with a 415
+// *PreflightError.
+func (p *contentPolicy) check(name, declared string, head []byte) (string, int64, error) {
+	detected := sniff.Detect(head)
+	byExtension := sniff.ByExtension(name)
+	mediaType := sniff.Refine(detected, declared, byExtension)
+
+	reject := func(reason, msg string) error {
+		p.rejections.Inc(reason)
+		slog.Info("upload rejected by content policy",
+			"name", name,
+			"detected", detected,
+			"declared", declared,
+			"reason", reason,
+		)
+		return &PreflightError{StatusCode: fasthttp.StatusUnsupportedMediaType, Code: api.CodeUnsupportedMediaType, Message: fmt.Sprintf("file %q: %s", name, msg)}
+	}
+
+	if p.checkMismatch {
+		if !sniff.Compatible(detected, declared) {
+			return "", 0, reject("mismatch", fmt.Sprintf("content is %s, declared as %s", detected, sniff.Normalize(declared)))
+		}
+		if !sniff.Compatible(detected, byExtension) {
+			return "", 0, reject("mismatch", fmt.Sprintf("content is %s, extension says %s", detected, byExtension))
+		}
+	}
+	// The declarations are checked too, so that denying a type is not
+	// bypassed by content the sniffer does not recognize.
+	for _, candidate := range []string{mediaType, detected, sniff.Normalize(declared), byExtension} {
+		if candidate != "" && matchesAny(p.denied, candidate) {
+			return "", 0, reject("denied", fmt.Sprintf("content type %s is not allowed", candidate))
+		}
+	}
+	if len(p.allowed) > 0 && !matchesAny(p.allowed, mediaType) {
+		return "", 0, reject("not_allowed", fmt.Sprintf("content type %s is not allowed", mediaType))
+	}
+
+	return mediaType, p.maxSize(mediaType), nil
+}
+
+// maxSize returns the limit of the most specific pattern matching mediaType:
+// a media type before "type/*" before "*/*".
+func (p *contentPolicy) maxSize(mediaType string) int64 {
+	var limit int64
+	best := -1
+	for _, l := range p.maxSizes {
+		if !sniff.Match(l.Type, mediaType) {
+			continue
+		}
+		specificity := 2
+		switch {
+		case l.Type == "*/*":
+			specificity = 0
+		case strings.HasSuffix(l.Type, "/*"):
+			specificity = 1
+		}
+		if specificity > best {
+			best, limit = specificity, l.MaxSize
+		}
+	}
+
+	return limit
+}
+
+func (p *contentPolicy) tooLarge(name, mediaType string, limit int64) error {
+	p.rejections.Inc("too_large")
+
+	return &PreflightError{
+		StatusCode: fasthttp.StatusRequestEntityTooLarge,
+		Code:       api.CodeTooLarge,
+		Message:    fmt.Sprintf("file %q: %s files are limited to %s", name, mediaType, format.Bytes(limit)),
+	}
+}
+
+func matchesAny(patterns []string, mediaType string) bool {
+	for _, pattern := range patterns {
+		if sniff.Match(pattern, mediaType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// contentReader holds back the first bytes of a file until the policy has
+// seen them, then fails as soon as the file outgrows the limit of its type,
+// so a rejected file is not read any further.
+type contentReader struct {
+	r        io.Reader
+	policy   *contentPolicy
+	name     string
+	declared string
+
+	checked   bool
+	head      []byte
+	mediaType string
+	limit     int64
+	read      int64
+	err       error
+}
+
+func (r *contentReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if !r.checked {
+		r.checked = true
+		head := make([]byte, sniff.Len)
+		n, err := io.ReadFull(r.r, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			r.err = err
+			return 0, err
+		}
+		r.head = head[:n]
+		r.mediaType, r.limit, r.err = r.policy.check(r.name, r.declared, r.head)
+		if r.err != nil {
+			return 0, r.err
+		}
+	}
+
+	var n int
+	var err error
+	if len(r.head) > 0 {
+		n = copy(p, r.head)
+		r.head = r.head[n:]
+	} else {
+		n, err = r.r.Read(p)
+	}
+	r.read += int64(n)
+	if r.limit > 0 && r.read > r.limit {
+		r.err = r.policy.tooLarge(r.name, r.mediaType, r.limit)
+		return n, r.err
+	}
+
+	return n, err
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/client/uploader"
+	serverconfig "client-server-fasthttp-test/internal/server/config"
+	"client-server-fasthttp-test/internal/server/metrics"
+
+	"github.com/valyala/fasthttp"
+)
+
+var testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00")
+
+func TestUploadContentPolicy(t *testing.T) {
+	uploadHandler, client := newTestServer(t)
+	reg := metrics.NewRegistry()
+	uploadHandler.content = newContentPolicy(serverconfig.AppConfig{
+		ContentAllowedTypes:  []string{"image/*", "text/plain"},
+		ContentDeniedTypes:   []string{"application/x-elf"},
+		ContentCheckMismatch: true,
+	}, reg)
+	ctx := context.Background()
+
+	upload := func(name, contentType string, content []byte) error {
+		_, err := client.UploadReaderContext(ctx, uploader.ReaderUploadRequest{
+			URL:         "http://inmemory/upload",
+			Reader:      bytes.NewReader(content),
+			FileName:    name,
+			ContentType: contentType,
+		})
+		return err
+	}
+
+	if err := upload("a.png", "", testPNG); err != nil {
+		t.Fatalf("png upload: %v", err)
+	}
+	if err := upload("notes.txt", "text/plain; charset=utf-8", []byte("hello world")); err != nil {
+		t.Fatalf("text upload: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		fileName    string
+		contentType string
+		content     []byte
+		want        string
+	}{
+		{name: "extension-mismatch", fileName: "a.jpg", content: testPNG, want: "content is image/png, extension says image/jpeg"},
+		{name: "declared-mismatch", fileName: "b", contentType: "image/png", content: []byte("hello world"), want: "content is text/plain, declared as image/png"},
+		{name: "denied", fileName: "tool", content: []byte("\x7fELF\x02\x01\x01\x00"), want: "content type application/x-elf is not allowed"},
+		{name: "not-allowed", fileName: "data.bin", content: []byte{0x00, 0x01, 0x02, 0xff}, want: "content type application/octet-stream is not allowed"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := upload(tc.fileName, tc.contentType, tc.content)
+			var httpErr *uploader.HTTPError
+			if !errors.Is(err, uploader.ErrUnsupportedMediaType) || !errors.As(err, &httpErr) {
+				t.Fatalf("unexpected error: got %v want %v", err, uploader.ErrUnsupportedMediaType)
+			}
+			if httpErr.StatusCode != fasthttp.StatusUnsupportedMediaType || !strings.Contains(httpErr.Response.Error, tc.want) {
+				t.Fatalf("unexpected rejection: %d %q does not mention %q", httpErr.StatusCode, httpErr.Response.Error, tc.want)
+			}
+		})
+	}
+
+	if got := storedNames(t, uploadHandler.storage); len(got) != 2 || got[0] != "a.png" || got[1] != "notes.txt" {
+		t.Fatalf("unexpected stored files: %v", got)
+	}
+	rejections := reg.Counter("upload_server_content_rejections_total", "", "reason")
+	if got := rejections.Value("mismatch"); got != 2 {
+		t.Fatalf("unexpected mismatch rejections: got %v want %v", got, 2)
+	}
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+
+	return n, err
+}
+
+func TestUploadContentSizeLimitStopsEarly(t *testing.T) {
+	uploadHandler, _ := newTestServer(t)
+	uploadHandler.content = newContentPolicy(serverconfig.AppConfig{
+		ContentMaxSizes: []serverconfig.ContentSizeLimit{{Type: "*/*", MaxSize: 1 << 30}, {Type: "image/*", MaxSize: 1024}},
+	}, metrics.NewRegistry())
+
+	const size = 8 << 20
+	body := &countingReader{r: io.MultiReader(
+		strings.NewReader("--b\r\nContent-Disposition: form-data; name=\"file\"; filename=\"big.png\"\r\n\r\n"),
+		bytes.NewReader(testPNG),
+		io.LimitReader(zeroReader{}, size),
+		strings.NewReader("\r\n--b--\r\n"),
+	)}
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+	ctx.Request.SetRequestURI("/upload")
+	ctx.Request.Header.SetContentType("multipart/form-data; boundary=b")
+	ctx.Request.SetBodyStream(body, -1)
+	ctx.Request.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+testAuthToken)
+	uploadHandler.handler(&ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusRequestEntityTooLarge || !strings.Contains(string(ctx.Response.Body()), api.CodeTooLarge) {
+		t.Fatalf("unexpected response: %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if body.n >= size/2 {
+		t.Fatalf("oversized file was read on: got %d bytes of %d", body.n, size)
+	}
+	if got := storedNames(t, uploadHandler.storage); len(got) != 0 {
+		t.Fatalf("oversized file was stored: %v", got)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+
+	return len(p), nil
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/server/storage"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	filesPath      = "/files"
+	filesPathSlash = filesPath + "/"
+)
+
+func newFileInfo(obj storage.Object) api.FileInfo {
+	return api.FileInfo{
+		Name:      obj.Name,
+		Size:      obj.Size,
+		SHA256:    obj.SHA256,
+		Modified:  obj.ModTime.UTC().Format(time.RFC3339),
+		Metadata:  obj.Metadata,
+		ExpiresAt: formatExpiresAt(obj.ExpiresAt),
+		VersionID: obj.VersionID,
+	}
+}
+
+// formatExpiresAt renders an object expiry; objects without one get an empty
+// string.
+func formatExpiresAt(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(time.RFC3339)
+}
+
+func (h *handlerConfig) handleFiles(ctx *fasthttp.RequestCtx) {
+	name := strings.TrimPrefix(string(ctx.Path()), filesPathSlash)
+	switch {
+	case ctx.IsGet() && ctx.QueryArgs().Has(api.VersionsQueryParam):
+		h.handleListVersions(ctx, name)
+	case ctx.IsGet():
+		h.handleDownloadFile(ctx, name)
+	case ctx.IsHead():
+		h.handleStatFile(ctx, name)
+	case ctx.IsPost():
+		h.handleRestoreFile(ctx, name)
+	case ctx.IsDelete():
+		h.handleDeleteFile(ctx, name)
+	default:
+		writeJSONError(ctx, fasthttp.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (h *handlerConfig) handleListFiles(ctx *fasthttp.RequestCtx) {
+	var labels []label
+	for _, raw := range ctx.QueryArgs().PeekMulti(api.LabelQueryParam) {
+		l, err := parseLabel(string(raw))
+		if err != nil {
+			writeJSONError(ctx, fasthttp.StatusBadRequest, err.Error())
+			return
+		}
+		labels = append(labels, l)
+	}
+
+	objects, err := h.storage.List(string(ctx.QueryArgs().Peek("prefix")))
+	if err != nil {
+		writeJSONError(ctx, fasthttp.StatusInternalServerError, err.Error())
+		return
+	}
+
+	files := make([]api.FileInfo, 0, len(objects))
+	for _, obj := range objects {
+		if len(labels) > 0 && obj.SHA256 == "" {
+			// The listing did not include the sidecar, see storage.Backend.
+			if obj, err = h.storage.Stat(obj.Name); errors.Is(err, storage.ErrNotFound) {
+				continue
+			} else if err != nil {
+				writeJSONError(ctx, fasthttp.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		if matchLabels(obj.Metadata, labels) {
+			files = append(files, newFileInfo(obj))
+		}
+	}
+
+	writeJSON(ctx, fasthttp.StatusOK, api.FileList{Status: api.StatusOK, Files: files})
+}
+
+func (h *handlerConfig) handleStatFile(ctx *fasthttp.RequestCtx, name string) {
+	var obj storage.Object
+	var err error
+	if versionID := string(ctx.QueryArgs().Peek(api.VersionQueryParam)); versionID != "" {
+		obj, err = h.storage.StatVersion(name, versionID)
+	} else {
+		obj, err = h.storage.Stat(name)
+	}
+	if err != nil {
+		writeStorageError(ctx, err)
+		return
+	}
+
+	setObjectHeaders(ctx, obj)
+	ctx.Response.Header.SetContentLength(int(obj.Size))
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+func (h *handlerConfig) handleDownloadFile(ctx *fasthttp.RequestCtx, name string) {
+	// The file is being deleted by the retention janitor.
+	done, ok := h.downloads.begin(name)
+	if !ok {
+		writeStorageError(ctx, fmt.Errorf("%w: %q", storage.ErrNotFound, name))
+		return
+	}
+
+	var body io.ReadCloser
+	var obj storage.Object
+	var err error
+	if versionID := string(ctx.QueryArgs().Peek(api.VersionQueryParam)); versionID != "" {
+		body, obj, err = h.storage.OpenVersion(name, versionID)
+	} else {
+		body, obj, err = h.storage.Open(name)
+	}
+	if err != nil {
+		done()
+		writeStorageError(ctx, err)
+		return
+	}
+
+	setObjectHeaders(ctx, obj)
+	ctx.SetContentType("application/octet-stream")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	// fasthttp closes the body once it has been sent, which ends the
+	// download.
+	ctx.SetBodyStream(&trackedBody{ReadCloser: body, done: done}, int(obj.Size))
+}
+
+func (h *handlerConfig) handleDeleteFile(ctx *fasthttp.RequestCtx, name string) {
+	if err := h.storage.Delete(name); err != nil {
+		writeStorageError(ctx, err)
+		return
+	}
+	h.webhooks.Publish(api.WebhookEvent{Type: api.EventFileDeleted, Remote: ctx.RemoteAddr().String(), Name: name})
+
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+func setObjectHeaders(ctx *fasthttp.RequestCtx, obj storage.Object) {
+	if obj.SHA256 != "" {
+		ctx.Response.Header.Set(api.HeaderChecksumSHA256, obj.SHA256)
+	}
+	ctx.Response.Header.Set(fasthttp.HeaderLastModified, obj.ModTime.UTC().Format(http.TimeFormat))
+	if expiresAt := formatExpiresAt(obj.ExpiresAt); expiresAt != "" {
+		ctx.Response.Header.Set(api.HeaderExpiresAt, expiresAt)
+	}
+	if obj.VersionID != "" {
+		ctx.Response.Header.Set(api.HeaderVersionID, obj.VersionID)
+		ctx.Response.Header.Set(fasthttp.HeaderETag, api.ETag(obj.VersionID))
+	}
+	for key, value := range obj.Metadata {
+		ctx.Response.Header.Set(api.HeaderMetadataPrefix+key, value)
+	}
+}
+
+// label is a filter of GET /files, see api.LabelQueryParam.
+type label struct {
+	key, value string
+	anyValue   bool
+}
+
+func parseLabel(raw string) (label, error) {
+	key, value, hasValue := strings.Cut(raw, "=")
+	key = strings.ToLower(key)
+	if err := api.ValidateMetadataKey(key); err != nil {
+		return label{}, fmt.Errorf("%s: %w", api.LabelQueryParam, err)
+	}
+
+	return label{key: key, value: value, anyValue: !hasValue}, nil
+}
+
+func matchLabels(metadata map[string]string, labels []label) bool {
+	for _, l := range labels {
+		value, ok := metadata[l.key]
+		if !ok || (!l.anyValue && value != l.value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func writeStorageError(ctx *fasthttp.RequestCtx, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		writeJSONError(ctx, fasthttp.StatusNotFound, err.Error())
+	case errors.Is(err, storage.ErrInvalidName), errors.Is(err, storage.ErrInvalidVersionID):
+		writeJSONError(ctx, fasthttp.StatusBadRequest, err.Error())
+	case errors.Is(err, storage.ErrPreconditionFailed):
+		writeJSONErrorCode(ctx, fasthttp.StatusPreconditionFailed, api.CodePreconditionFailed, err.Error())
+	default:
+		writeJSONError(ctx, fasthttp.StatusInternalServerError, fmt.Sprintf("storage: %v", err))
+	}
+}
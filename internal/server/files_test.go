@@ -0,0 +1,373 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/client/uploader"
+	"client-server-fasthttp-test/internal/server/storage"
+
+	"github.com/bytedance/sonic"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// testAuthToken opens the file endpoints, which stay closed without a token.
+const testAuthToken = "test-token"
+
+func newTestServer(t *testing.T) (*handlerConfig, *uploader.Client) {
+	t.Helper()
+
+	store, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("new storage: %v", err)
+	}
+	uploadHandler := newHandlerConfig("file", 4, store, 0)
+	uploadHandler.setAuthToken(testAuthToken)
+
+	server := &fasthttp.Server{
+		Handler:                      uploadHandler.handler,
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+	}
+	ln := fasthttputil.NewInmemoryListener()
+	go func() {
+		_ = server.Serve(ln)
+	}()
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+		_ = ln.Close()
+	})
+
+	client, err := uploader.New(&fasthttp.Client{
+		Dial: func(_ string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}, uploader.Config{
+		ChunkSize:      64,
+		FormFieldName:  "file",
+		RequestTimeout: 5 * time.Second,
+		AuthToken:      testAuthToken,
+	})
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+
+	return uploadHandler, client
+}
+
+func TestFilesLifecycle(t *testing.T) {
+	_, client := newTestServer(t)
+	ctx := context.Background()
+
+	content := bytes.Repeat([]byte("stored-content"), 512)
+	sum := sha256.Sum256(content)
+	wantSHA256 := hex.EncodeToString(sum[:])
+
+	localPath := filepath.Join(t.TempDir(), "report.bin")
+	if err := os.WriteFile(localPath, content, 0o600); err != nil {
+		t.Fatalf("write temp file: %v", err)
+	}
+
+	resp, err := client.UploadFileContext(ctx, uploader.UploadRequest{URL: "http://inmemory/upload", FilePath: localPath})
+	if err != nil {
+		t.Fatalf("upload file: %v", err)
+	}
+	if resp.StatusCode != fasthttp.StatusCreated {
+		t.Fatalf("unexpected upload status: got %d want %d: %s", resp.StatusCode, fasthttp.StatusCreated, resp.Body)
+	}
+
+	info, err := client.StatContext(ctx, "http://inmemory/files/report.bin")
+	if err != nil {
+		t.Fatalf("stat file: %v", err)
+	}
+	if info.Size != int64(len(content)) || info.SHA256 != wantSHA256 {
+		t.Fatalf("unexpected stat result: %+v", info)
+	}
+
+	files, err := client.ListContext(ctx, "http://inmemory/files?prefix=rep")
+	if err != nil {
+		t.Fatalf("list files: %v", err)
+	}
+	if len(files) != 1 || files[0].Name != "report.bin" {
+		t.Fatalf("unexpected listing: %+v", files)
+	}
+
+	var downloaded bytes.Buffer
+	if _, err := client.DownloadContext(ctx, "http://inmemory/files/report.bin", &downloaded); err != nil {
+		t.Fatalf("download file: %v", err)
+	}
+	if !bytes.Equal(downloaded.Bytes(), content) {
+		t.Fatal("downloaded content mismatch")
+	}
+
+	if err := client.DeleteContext(ctx, "http://inmemory/files/report.bin"); err != nil {
+		t.Fatalf("delete file: %v", err)
+	}
+	if _, err := client.StatContext(ctx, "http://inmemory/files/report.bin"); !errors.Is(err, uploader.ErrNotFound) {
+		t.Fatalf("expected not found after delete, got %v", err)
+	}
+}
+
+func TestFilesRejectUnauthenticatedDelete(t *testing.T) {
+	uploadHandler, _ := newTestServer(t)
+
+	staged, err := uploadHandler.storage.Stage("a.bin", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatalf("stage: %v", err)
+	}
+	if _, err := staged.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	for _, authorization := range []string{"", "Bearer wrong-token"} {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.SetMethod(fasthttp.MethodDelete)
+		ctx.Request.SetRequestURI("/files/a.bin")
+		if authorization != "" {
+			ctx.Request.Header.Set(fasthttp.HeaderAuthorization, authorization)
+		}
+		uploadHandler.handler(&ctx)
+
+		if ctx.Response.StatusCode() != fasthttp.StatusUnauthorized {
+			t.Fatalf("%q: unexpected status: got %d want %d", authorization, ctx.Response.StatusCode(), fasthttp.StatusUnauthorized)
+		}
+	}
+	if _, err := uploadHandler.storage.Stat("a.bin"); err != nil {
+		t.Fatalf("file was deleted without a token: %v", err)
+	}
+}
+
+func TestUploadRejectsChecksumMismatchWithoutStoring(t *testing.T) {
+	uploadHandler, _ := newTestServer(t)
+
+	var ctx fasthttp.RequestCtx
+	body := "--b\r\n" +
+		"Content-Disposition: form-data; name=\"file\"; filename=\"a.bin\"\r\n\r\n" +
+		"payload\r\n" +
+		"--b\r\n" +
+		"Content-Disposition: form-data; name=\"" + api.ChecksumFieldSHA256 + "\"\r\n\r\n" +
+		"deadbeef\r\n" +
+		"--b--\r\n"
+	ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+	ctx.Request.SetRequestURI("/upload")
+	ctx.Request.Header.SetContentType("multipart/form-data; boundary=b")
+	ctx.Request.SetBodyString(body)
+	ctx.Request.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+testAuthToken)
+	uploadHandler.handler(&ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusUnprocessableEntity {
+		t.Fatalf("unexpected status: got %d want %d: %s", ctx.Response.StatusCode(), fasthttp.StatusUnprocessableEntity, ctx.Response.Body())
+	}
+	objects, err := uploadHandler.storage.List("")
+	if err != nil {
+		t.Fatalf("list storage: %v", err)
+	}
+	if len(objects) != 0 {
+		t.Fatalf("rejected upload was stored: %+v", objects)
+	}
+}
+
+func TestUploadResponseSchemas(t *testing.T) {
+	uploadHandler, _ := newTestServer(t)
+	body := "--b\r\n" +
+		"Content-Disposition: form-data; name=\"file\"; filename=\"a.txt\"\r\n\r\n" +
+		"first\r\n" +
+		"--b\r\n" +
+		"Content-Disposition: form-data; name=\"file\"; filename=\"b.txt\"\r\n\r\n" +
+		"second file\r\n" +
+		"--b--\r\n"
+	upload := func(accept string) *fasthttp.RequestCtx {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+		ctx.Request.SetRequestURI("/upload")
+		ctx.Request.Header.SetContentType("multipart/form-data; boundary=b")
+		if accept != "" {
+			ctx.Request.Header.Set(fasthttp.HeaderAccept, accept)
+		}
+		ctx.Request.SetBodyString(body)
+		ctx.Request.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+testAuthToken)
+		uploadHandler.handler(&ctx)
+		if ctx.Response.StatusCode() != fasthttp.StatusCreated {
+			t.Fatalf("unexpected status: got %d want %d: %s", ctx.Response.StatusCode(), fasthttp.StatusCreated, ctx.Response.Body())
+		}
+		return &ctx
+	}
+
+	v1 := upload("")
+	var legacy api.UploadResult
+	if err := sonic.Unmarshal(v1.Response.Body(), &legacy); err != nil {
+		t.Fatalf("decode v1 response: %v", err)
+	}
+	if legacy.Files != 2 || legacy.Size != "16 B" {
+		t.Fatalf("unexpected v1 response: %s", v1.Response.Body())
+	}
+
+	v2 := upload("application/json;q=0.5, " + api.MediaTypeUploadV2)
+	if got := string(v2.Response.Header.ContentType()); got != api.MediaTypeUploadV2 {
+		t.Fatalf("unexpected content type: got %q want %q", got, api.MediaTypeUploadV2)
+	}
+	var result api.UploadResultV2
+	if err := sonic.Unmarshal(v2.Response.Body(), &result); err != nil {
+		t.Fatalf("decode v2 response: %v", err)
+	}
+	if result.Version != 2 || result.Size != 16 || result.DurationNS <= 0 || result.BytesPerSecond <= 0 || result.SHA256 != legacy.SHA256 {
+		t.Fatalf("unexpected v2 response: %s", v2.Response.Body())
+	}
+	want := []api.UploadedFile{
+		{Name: "a.txt", StorageID: "a.txt", Size: 5, SHA256: sha256Hex([]byte("first"))},
+		{Name: "b.txt", StorageID: "b.txt", Size: 11, SHA256: sha256Hex([]byte("second file"))},
+	}
+	if len(result.Files) != len(want) {
+		t.Fatalf("unexpected files: %+v", result.Files)
+	}
+	for i, file := range result.Files {
+		if file.MD5 == "" || file.VersionID == "" {
+			t.Fatalf("file %d has no md5 or version: %+v", i, file)
+		}
+		file.MD5, file.VersionID = "", ""
+		if !reflect.DeepEqual(file, want[i]) {
+			t.Fatalf("unexpected file %d: got %+v want %+v", i, file, want[i])
+		}
+	}
+}
+
+func TestAcceptsMediaType(t *testing.T) {
+	for _, tc := range []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/json", false},
+		{api.MediaTypeUploadV2, true},
+		{"application/json, Application/Vnd.Upload.V2+JSON; q=0.9", true},
+		{api.MediaTypeUploadV2 + ";q=0", false},
+		{api.MediaTypeUploadV2 + "; charset=utf-8", true},
+	} {
+		if got := acceptsMediaType([]byte(tc.accept), api.MediaTypeUploadV2); got != tc.want {
+			t.Fatalf("accepts %q: got %v want %v", tc.accept, got, tc.want)
+		}
+	}
+}
+
+func TestFilesMetadata(t *testing.T) {
+	_, client := newTestServer(t)
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	for name, env := range map[string]string{"prod.bin": "prod", "dev.bin": "dev"} {
+		localPath := filepath.Join(dir, name)
+		if err := os.WriteFile(localPath, []byte(name), 0o600); err != nil {
+			t.Fatalf("write temp file: %v", err)
+		}
+		_, err := client.UploadFileContext(ctx, uploader.UploadRequest{
+			URL:      "http://inmemory/upload",
+			FilePath: localPath,
+			Metadata: map[string]string{"env": env, "owner": "Jörg Müller"},
+		})
+		if err != nil {
+			t.Fatalf("upload %s: %v", name, err)
+		}
+	}
+
+	want := map[string]string{"env": "prod", "owner": "Jörg Müller"}
+	info, err := client.StatContext(ctx, "http://inmemory/files/prod.bin")
+	if err != nil {
+		t.Fatalf("stat file: %v", err)
+	}
+	if !reflect.DeepEqual(info.Metadata, want) {
+		t.Fatalf("unexpected stat metadata: got %v want %v", info.Metadata, want)
+	}
+	var downloaded bytes.Buffer
+	info, err = client.DownloadContext(ctx, "http://inmemory/files/prod.bin", &downloaded)
+	if err != nil {
+		t.Fatalf("download file: %v", err)
+	}
+	if !reflect.DeepEqual(info.Metadata, want) {
+		t.Fatalf("unexpected download metadata: got %v want %v", info.Metadata, want)
+	}
+
+	for query, names := range map[string][]string{
+		"":                              {"dev.bin", "prod.bin"},
+		"?label=env=prod":               {"prod.bin"},
+		"?label=owner":                  {"dev.bin", "prod.bin"},
+		"?label=owner&label=env=dev":    {"dev.bin"},
+		"?label=Env=prod&label=team":    nil,
+		"?label=env%3Dprod&prefix=dev.": nil,
+	} {
+		files, err := client.ListContext(ctx, "http://inmemory/files"+query)
+		if err != nil {
+			t.Fatalf("list %q: %v", query, err)
+		}
+		var got []string
+		for _, file := range files {
+			got = append(got, file.Name)
+		}
+		if !reflect.DeepEqual(got, names) {
+			t.Fatalf("list %q: got %v want %v", query, got, names)
+		}
+	}
+	if _, err := client.ListContext(ctx, "http://inmemory/files?label=bad_key"); err == nil {
+		t.Fatal("expected an error for an invalid label")
+	}
+
+	_, err = client.UploadFileContext(ctx, uploader.UploadRequest{
+		URL:      "http://inmemory/upload",
+		FilePath: filepath.Join(dir, "prod.bin"),
+		Metadata: map[string]string{"Build ID": "1"},
+	})
+	if err == nil {
+		t.Fatal("expected the client to reject an invalid metadata key")
+	}
+}
+
+func TestUploadRejectsInvalidMetadata(t *testing.T) {
+	uploadHandler, _ := newTestServer(t)
+
+	tooMany := ""
+	for i := 0; i <= api.MaxMetadataEntries; i++ {
+		tooMany += fmt.Sprintf("--b\r\nContent-Disposition: form-data; name=\"%sk%d\"\r\n\r\nv\r\n", api.MetadataFieldPrefix, i)
+	}
+	filePart := "--b\r\nContent-Disposition: form-data; name=\"file\"; filename=\"a.bin\"\r\n\r\npayload\r\n"
+	metaPart := func(key, value string) string {
+		return "--b\r\nContent-Disposition: form-data; name=\"" + api.MetadataFieldPrefix + key + "\"\r\n\r\n" + value + "\r\n"
+	}
+	for name, body := range map[string]string{
+		"before-file": metaPart("env", "prod") + filePart,
+		"bad-key":     filePart + metaPart("build_id", "1"),
+		"duplicate":   filePart + metaPart("env", "prod") + metaPart("ENV", "dev"),
+		"too-many":    filePart + tooMany,
+		"too-large":   filePart + metaPart("notes", strings.Repeat("x", api.MaxMetadataSize)),
+	} {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+		ctx.Request.SetRequestURI("/upload")
+		ctx.Request.Header.SetContentType("multipart/form-data; boundary=b")
+		ctx.Request.SetBodyString(body + "--b--\r\n")
+		ctx.Request.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+testAuthToken)
+		uploadHandler.handler(&ctx)
+
+		if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+			t.Fatalf("%s: unexpected status: got %d want %d: %s", name, ctx.Response.StatusCode(), fasthttp.StatusBadRequest, ctx.Response.Body())
+		}
+		if !bytes.Contains(ctx.Response.Body(), []byte(api.CodeInvalidMetadata)) {
+			t.Fatalf("%s: unexpected body: %s", name, ctx.Response.Body())
+		}
+	}
+	if objects, err := uploadHandler.storage.List(""); err != nil || len(objects) != 0 {
+		t.Fatalf("rejected uploads were stored: %+v %v", objects, err)
+	}
+}
@@ -0,0 +1,86 @@
+package format
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// byteUnits maps lower-cased unit suffixes to their multipliers. IEC units
+// (Ki, KiB, ...) are powers of 1024, SI units (k, kB, ...) powers of 1000.
+var byteUnits = map[string]int64{
+	"": 1, "b": 1,
+	"k": 1e3, "kb": 1e3, "ki": 1 << 10, "kib": 1 << 10,
+	"m": 1e6, "mb": 1e6, "mi": 1 << 20, "mib": 1 << 20,
+	"g": 1e9, "gb": 1e9, "gi": 1 << 30, "gib": 1 << 30,
+	"t": 1e12, "tb": 1e12, "ti": 1 << 40, "tib": 1 << 40,
+	"p": 1e15, "pb": 1e15, "pi": 1 << 50, "pib": 1 << 50,
+	"e": 1e18, "eb": 1e18, "ei": 1 << 60, "eib": 1 << 60,
+}
+
+// ErrOutOfRange is returned for sizes that do not fit in an int64.
+var ErrOutOfRange = errors.New("value out of range")
+
+// ParseBytes parses a size such as "512", "1.5GiB", "500 MB" or "64k", the
+// inverse of Bytes. Units are case-insensitive; a plain number is in bytes.
+// Fractions are rounded to the nearest byte.
+func ParseBytes(s string) (int64, error) {
+	size, err := parseBytes(s)
+	if err != nil {
+		return 0, fmt.Errorf("parse size %q: %w", s, err)
+	}
+
+	return size, nil
+}
+
+// ParseRate parses a rate in bytes per second such as "10MiB/s" or "500 kB/s",
+// the inverse of BytesPerSecond. The "/s" suffix may be omitted.
+func ParseRate(s string) (int64, error) {
+	raw := strings.TrimSpace(s)
+	if len(raw) >= 2 && strings.EqualFold(raw[len(raw)-2:], "/s") {
+		raw = raw[:len(raw)-2]
+	}
+	rate, err := parseBytes(raw)
+	if err != nil {
+		return 0, fmt.Errorf("parse rate %q: %w", s, err)
+	}
+
+	return rate, nil
+}
+
+func parseBytes(s string) (int64, error) {
+	raw := strings.TrimSpace(s)
+	end := strings.IndexFunc(raw, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if end < 0 {
+		end = len(raw)
+	}
+	number, unit := raw[:end], strings.ToLower(strings.TrimSpace(raw[end:]))
+	multiplier, ok := byteUnits[unit]
+	if number == "" || !ok {
+		return 0, errors.New("expected a number with an optional unit such as KiB or MB")
+	}
+
+	if !strings.Contains(number, ".") {
+		n, err := strconv.ParseInt(number, 10, 64)
+		if err != nil || n > math.MaxInt64/multiplier {
+			return 0, ErrOutOfRange
+		}
+		return n * multiplier, nil
+	}
+
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, errors.New("invalid number")
+	}
+	size := math.Round(f * float64(multiplier))
+	// float64(math.MaxInt64) rounds up to 2^63, which no longer fits.
+	if size >= math.MaxInt64 {
+		return 0, ErrOutOfRange
+	}
+
+	return int64(size), nil
+}
@@ -0,0 +1,103 @@
+package format
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{in: "0", want: 0},
+		{in: "512", want: 512},
+		{in: "512 B", want: 512},
+		{in: "64k", want: 64_000},
+		{in: "500MB", want: 500_000_000},
+		{in: "1GiB", want: 1 << 30},
+		{in: " 1.50 GiB ", want: 1536 << 20},
+		{in: "10mib", want: 10 << 20},
+		{in: "2Ki", want: 2048},
+		{in: "1.5", want: 2},
+		{in: "7EiB", want: 7 << 60},
+		{in: "9223372036854775807", want: math.MaxInt64},
+	}
+	for _, tc := range tests {
+		got, err := ParseBytes(tc.in)
+		if err != nil || got != tc.want {
+			t.Fatalf("parse %q: got %d, %v want %d", tc.in, got, err, tc.want)
+		}
+	}
+
+	for _, in := range []string{"", "MiB", "-1", "1.2.3", "10 MiBs", "1 bit", "0x10"} {
+		if _, err := ParseBytes(in); err == nil {
+			t.Fatalf("parse %q: expected an error", in)
+		}
+	}
+	for _, in := range []string{"8EiB", "9223372036854775808", "8192PiB", "9.3EB"} {
+		if _, err := ParseBytes(in); !errors.Is(err, ErrOutOfRange) {
+			t.Fatalf("parse %q: got %v want %v", in, err, ErrOutOfRange)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{in: "10MiB/s", want: 10 << 20},
+		{in: "500 kB/s", want: 500_000},
+		{in: "2.00 KiB/s", want: 2048},
+		{in: "1G", want: 1_000_000_000},
+	}
+	for _, tc := range tests {
+		got, err := ParseRate(tc.in)
+		if err != nil || got != tc.want {
+			t.Fatalf("parse %q: got %d, %v want %d", tc.in, got, err, tc.want)
+		}
+	}
+	if _, err := ParseRate("fast/s"); err == nil {
+		t.Fatal("expected an error for an invalid rate")
+	}
+}
+
+// sizeValues generates sizes spread over all units. Bytes rounds to two
+// decimals, so sizes close to math.MaxInt64 render as a value that overflows.
+func sizeValues(args []reflect.Value, r *rand.Rand) {
+	args[0] = reflect.ValueOf(r.Int63n(1<<62) >> r.Intn(62))
+}
+
+// roughlyEqual allows for the rounding of Bytes to two decimals, at most
+// 0.005 of the unit, which is at least the value itself.
+func roughlyEqual(got, want int64) bool {
+	return math.Abs(float64(got-want)) <= 0.005*float64(want)+0.5
+}
+
+func TestParseBytesRoundTrip(t *testing.T) {
+	roundTrip := func(size int64) bool {
+		got, err := ParseBytes(Bytes(size))
+		if size < 1024 {
+			return err == nil && got == size
+		}
+		return err == nil && roughlyEqual(got, size)
+	}
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 5000, Values: sizeValues}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseRateRoundTrip(t *testing.T) {
+	roundTrip := func(rate int64) bool {
+		got, err := ParseRate(BytesPerSecond(float64(rate)))
+		return err == nil && roughlyEqual(got, rate)
+	}
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 5000, Values: sizeValues}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,205 +1,718 @@
 package server
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"mime/multipart"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"client-server-fasthttp-test/internal/client/uploader"
+	"client-server-fasthttp-test/internal/api"
 	"client-server-fasthttp-test/internal/server/format"
+	"client-server-fasthttp-test/internal/server/storage"
+	"client-server-fasthttp-test/internal/server/webhook"
 
 	"github.com/bytedance/sonic"
 	"github.com/valyala/fasthttp"
 )
 
+const (
+	uploadPath           = "/upload"
+	maxChecksumFieldSize = 1024
+)
+
 type handlerConfig struct {
 	fileFieldName string
-	uploadSlots   chan struct{}
+	uploadSlots   *uploadLimiter
+	uploads       *uploadTracker
+	storage       storage.Backend
+	minFreeSpace  atomic.Uint64
+	draining      atomic.Bool
+	routes        fasthttp.RequestHandler
+	// maxRequestBodySize bounds the declared upload size; zero disables the
+	// check.
+	maxRequestBodySize int64
+	preflightChecks    []PreflightCheck
+	multipart          *multipartSessions
+	// maxTTL caps the time to live requested for an upload; zero leaves it
+	// uncapped.
+	maxTTL    time.Duration
+	downloads *downloadTracker
+	presign   *presigner
+	// webhooks is nil without configured webhooks.
+	webhooks *webhook.Dispatcher
+	// hooks is nil without upload hooks.
+	hooks *uploadHooks
+	// content is nil without a content type policy.
+	content *contentPolicy
+	extract extractLimits
+	// requestRate limits how often uploads start, bandwidth how fast their
+	// bodies are read.
+	requestRate *rateLimiter
+	bandwidth   *rateLimiter
+	// authToken is the bearer token the upload and file endpoints require,
+	// see WithAuth.
+	authToken atomic.Pointer[string]
 }
 
-type uploadSuccessResponse struct {
-	Status   string `json:"status"`
-	Files    int    `json:"files"`
-	Size     string `json:"size"`
-	Duration string `json:"duration"`
-	Speed    string `json:"speed"`
-	SHA256   string `json:"sha256"`
+func newHandlerConfig(fileFieldName string, maxConcurrentUploads int, store storage.Backend, minFreeSpace uint64) *handlerConfig {
+	h := &handlerConfig{
+		fileFieldName: fileFieldName,
+		uploadSlots:   newUploadLimiter(maxConcurrentUploads),
+		uploads:       newUploadTracker(),
+		storage:       store,
+		multipart:     newMultipartSessions(defaultMultipartTTL),
+		downloads:     newDownloadTracker(),
+		presign:       newPresigner(),
+		requestRate:   newRateLimiter(0, 0),
+		bandwidth:     newRateLimiter(0, 0),
+	}
+	h.minFreeSpace.Store(minFreeSpace)
+
+	routes := NewRouter()
+	h.register(routes)
+	h.routes = routes.Handler()
+
+	return h
 }
 
-type errorResponse struct {
-	Status           string `json:"status"`
-	Error            string `json:"error"`
-	ExpectedChecksum string `json:"expected_checksum,omitempty"`
-	ActualChecksum   string `json:"actual_checksum,omitempty"`
+func (h *handlerConfig) uploadSlotUsage() (inUse, capacity int) {
+	return h.uploadSlots.usage()
 }
 
-func newHandlerConfig(fileFieldName string, maxConcurrentUploads int) *handlerConfig {
-	h := &handlerConfig{fileFieldName: fileFieldName}
-	if maxConcurrentUploads > 0 {
-		h.uploadSlots = make(chan struct{}, maxConcurrentUploads)
+func (h *handlerConfig) tryAcquireUploadSlot() (func(), bool) {
+	if !h.uploadSlots.tryAcquire() {
+		return nil, false
 	}
 
-	return h
+	return h.uploadSlots.release, true
 }
 
-func (h *handlerConfig) tryAcquireUploadSlot() (func(), bool) {
-	if h.uploadSlots == nil {
-		return func() {}, true
+// uploadLimiter bounds concurrent uploads. Unlike a buffered channel its limit
+// can be changed at runtime; lowering it never interrupts uploads already
+// holding a slot, it only delays new ones until usage drops below the limit.
+type uploadLimiter struct {
+	mu    sync.Mutex
+	limit int
+	inUse int
+}
+
+func newUploadLimiter(limit int) *uploadLimiter {
+	return &uploadLimiter{limit: limit}
+}
+
+func (l *uploadLimiter) tryAcquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limit > 0 && l.inUse >= l.limit {
+		return false
 	}
+	l.inUse++
 
-	select {
-	case h.uploadSlots <- struct{}{}:
-		return func() { <-h.uploadSlots }, true
-	default:
-		return nil, false
+	return true
+}
+
+// available reports whether tryAcquire would currently succeed.
+func (l *uploadLimiter) available() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.limit <= 0 || l.inUse < l.limit
+}
+
+func (l *uploadLimiter) release() {
+	l.mu.Lock()
+	l.inUse--
+	l.mu.Unlock()
+}
+
+func (l *uploadLimiter) resize(limit int) {
+	l.mu.Lock()
+	l.limit = limit
+	l.mu.Unlock()
+}
+
+// usage reports a zero capacity when uploads are unlimited.
+func (l *uploadLimiter) usage() (inUse, capacity int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limit <= 0 {
+		return 0, 0
 	}
+
+	return l.inUse, l.limit
 }
 
 func writeJSON(ctx *fasthttp.RequestCtx, statusCode int, payload any) {
+	writeJSONAs(ctx, statusCode, "application/json; charset=utf-8", payload)
+}
+
+// writeJSONAs is writeJSON with another content type for the payload.
+func writeJSONAs(ctx *fasthttp.RequestCtx, statusCode int, contentType string, payload any) {
 	body, err := sonic.Marshal(payload)
 	if err != nil {
 		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
 		ctx.SetContentType("application/json; charset=utf-8")
-		ctx.SetBodyString(`{"status":"error","error":"internal server error"}`)
+		ctx.SetBodyString(`{"status":"error","code":"internal","error":"internal server error"}`)
 		return
 	}
 
 	ctx.SetStatusCode(statusCode)
-	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.SetContentType(contentType)
 	ctx.SetBody(body)
 }
 
+// writeJSONError answers with the default error code for statusCode.
 func writeJSONError(ctx *fasthttp.RequestCtx, statusCode int, msg string) {
-	writeJSON(ctx, statusCode, errorResponse{
-		Status: "error",
+	writeJSONErrorCode(ctx, statusCode, api.CodeForStatus(statusCode), msg)
+}
+
+func writeJSONErrorCode(ctx *fasthttp.RequestCtx, statusCode int, code, msg string) {
+	writeJSON(ctx, statusCode, api.ErrorResponse{
+		Status: api.StatusError,
+		Code:   code,
 		Error:  msg,
 	})
 }
 
-func (h *handlerConfig) handler(ctx *fasthttp.RequestCtx) {
-	switch {
-	case ctx.IsGet() && string(ctx.Path()) == "/healthz":
+// register adds the health, upload, multipart upload and file endpoints to r.
+// The upload endpoints require the bearer token once one is configured; the
+// file endpoints always do.
+func (h *handlerConfig) register(r *Router) {
+	r.Handle(fasthttp.MethodGet, "/healthz", func(ctx *fasthttp.RequestCtx) {
 		ctx.SetStatusCode(fasthttp.StatusOK)
 		ctx.SetBodyString("ok")
-	case ctx.IsPost() && string(ctx.Path()) == "/upload":
-		h.handleUpload(ctx)
-	default:
-		writeJSONError(ctx, fasthttp.StatusNotFound, "not found")
-	}
+	})
+	r.Handle(fasthttp.MethodGet, "/livez", h.handleLivez)
+	r.Handle(fasthttp.MethodGet, "/readyz", h.handleReadyz)
+	r.Handle(fasthttp.MethodPost, uploadPath, h.authenticated(h.handleUpload))
+	r.Handle(fasthttp.MethodPost, uploadsPath, h.authenticated(h.presigned(h.handleMultipartInit)))
+	r.HandlePrefix(fasthttp.MethodPut, uploadsPathSlash, h.authenticated(h.presigned(h.handleMultipart)))
+	r.HandlePrefix(fasthttp.MethodPost, uploadsPathSlash, h.authenticated(h.presigned(h.handleMultipart)))
+	r.HandlePrefix(fasthttp.MethodDelete, uploadsPathSlash, h.authenticated(h.presigned(h.handleMultipart)))
+	r.Handle(fasthttp.MethodGet, filesPath, h.restricted(h.presigned(h.handleListFiles)))
+	r.HandlePrefix(fasthttp.MethodGet, filesPathSlash, h.restricted(h.presigned(h.handleFiles)))
+	r.HandlePrefix(fasthttp.MethodHead, filesPathSlash, h.restricted(h.presigned(h.handleFiles)))
+	r.HandlePrefix(fasthttp.MethodPost, filesPathSlash, h.restricted(h.presigned(h.handleFiles)))
+	r.HandlePrefix(fasthttp.MethodDelete, filesPathSlash, h.restricted(h.presigned(h.handleFiles)))
+}
+
+// handler serves the endpoints from register without any middleware.
+func (h *handlerConfig) handler(ctx *fasthttp.RequestCtx) {
+	h.routes(ctx)
 }
 
 func (h *handlerConfig) handleUpload(ctx *fasthttp.RequestCtx) {
 	start := time.Now()
 	releaseUploadSlot, ok := h.tryAcquireUploadSlot()
 	if !ok {
-		writeJSONError(ctx, fasthttp.StatusServiceUnavailable, "too many concurrent uploads")
+		writeJSONErrorCode(ctx, fasthttp.StatusServiceUnavailable, api.CodeTooManyUploads, "too many concurrent uploads")
 		return
 	}
 	defer releaseUploadSlot()
 
-	form, err := ctx.MultipartForm()
+	upload := h.uploads.begin(ctx.RemoteAddr().String(), ctx.Conn())
+	defer h.uploads.finish(upload)
+	ctx.SetUserValue(uploadIDUserValue, upload.id)
+
+	// A response sent before the body has been read to the end leaves
+	// unread bytes on the connection, so it must not be reused.
+	bodyConsumed := false
+	defer func() {
+		if !bodyConsumed {
+			ctx.SetConnectionClose()
+		}
+	}()
+
+	// Clients that did not ask for 100-continue still get the header checks
+	// before their body is read.
+	grant, err := h.checkPresignedUpload(&ctx.Request.Header)
+	if err == nil {
+		err = h.preflight(&ctx.Request.Header, false)
+	}
 	if err != nil {
-		writeJSONError(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("read multipart form: %v", err))
+		writePreflightError(ctx, err)
 		return
 	}
+	// A pre-signed upload URL is used up by a stored upload only.
+	committed := false
+	if grant != nil {
+		release, err := h.presign.reserve(*grant)
+		if err != nil {
+			writePreflightError(ctx, err)
+			return
+		}
+		defer func() {
+			if !committed {
+				release()
+			}
+		}()
+	}
 
-	files := form.File[h.fileFieldName]
-	if len(files) == 0 {
-		writeJSONError(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("multipart field %q is required", h.fileFieldName))
-		return
+	event := uploadEvent(api.EventUploadStarted, upload.id, ctx.RemoteAddr().String())
+	if size, err := declaredUploadSize(&ctx.Request.Header); err == nil {
+		event.Size = size
 	}
+	h.webhooks.Publish(event)
+	defer func() {
+		if !committed {
+			h.webhooks.Publish(failedUploadEvent(ctx, event))
+		}
+	}()
 
-	var totalBytes int64
-	actualChecksum := "n/a"
-	aggregateHasher := sha256.New()
-	expectedChecksums, checksumErr := expectedChecksumsForRequest(ctx, form.Value[uploader.ChecksumFieldSHA256], len(files))
-	if checksumErr != nil {
-		writeJSONError(ctx, fasthttp.StatusBadRequest, checksumErr.Error())
+	// Already validated by preflight.
+	ttl, _ := h.uploadTTL(string(ctx.Request.Header.Peek(api.HeaderUploadTTL)))
+	condition, _ := uploadCondition(&ctx.Request.Header)
+	extractTo, _ := h.extractPrefix(&ctx.Request.Header)
+
+	boundary := string(ctx.Request.Header.MultipartFormBoundary())
+	if boundary == "" {
+		writeJSONError(ctx, fasthttp.StatusBadRequest, "read multipart form: request is not multipart/form-data")
 		return
 	}
 
-	for idx, fileHeader := range files {
-		f, err := fileHeader.Open()
+	var files []*storage.Staged
+	var names []string
+	var metadata []map[string]string
+	// archive is set once the archive of an extracted upload is read.
+	var archive *extractedArchive
+	defer func() {
+		// Discarding is a no-op for committed objects.
+		for _, staged := range files {
+			if err := staged.Discard(); err != nil {
+				slog.Warn("discard staged upload", "error", err)
+			}
+		}
+	}()
+
+	var multipartChecksums []string
+	body := upload.reader(requestBody(ctx), h.bandwidth)
+	mr := multipart.NewReader(body, boundary)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			// Skip the epilogue, including the terminating chunk of a
+			// chunked request.
+			if _, err := io.Copy(io.Discard, body); err != nil {
+				h.writeReadError(ctx, upload, fmt.Sprintf("read multipart form: %v", err))
+				return
+			}
+			bodyConsumed = true
+			break
+		}
 		if err != nil {
-			writeJSONError(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("open uploaded file %q: %v", fileHeader.Filename, err))
+			h.writeReadError(ctx, upload, fmt.Sprintf("read multipart form: %v", err))
 			return
 		}
 
-		hash, n, hashErr := hashSHA256HexAndCount(f)
-		closeErr := f.Close()
-		if hashErr != nil {
-			writeJSONError(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("read uploaded file %q: %v", fileHeader.Filename, hashErr))
-			return
+		switch {
+		case part.FormName() == h.fileFieldName && part.FileName() != "" && extractTo != "":
+			if grant != nil || archive != nil {
+				writeJSONError(ctx, fasthttp.StatusBadRequest, "an extracted upload takes a single archive and no pre-signed URL")
+				return
+			}
+			upload.setFilename(part.FileName())
+			src := &readErrRecorder{r: part}
+			extracted, extractErr := h.extractArchive(src, extractTo)
+			if extractErr != nil {
+				var preflightErr *PreflightError
+				switch {
+				case src.err != nil || upload.cancelled():
+					h.writeReadError(ctx, upload, fmt.Sprintf("read uploaded archive %q: %v", part.FileName(), src.err))
+				case errors.As(extractErr, &preflightErr):
+					writePreflightError(ctx, preflightErr)
+				default:
+					writeJSONError(ctx, fasthttp.StatusInternalServerError, fmt.Sprintf("extract uploaded archive %q: %v", part.FileName(), extractErr))
+				}
+				return
+			}
+			archive = extracted
+			files = append(files, extracted.files...)
+			names = append(names, extracted.names...)
+			metadata = append(metadata, make([]map[string]string, len(extracted.files))...)
+		case part.FormName() == h.fileFieldName && part.FileName() != "":
+			upload.setFilename(part.FileName())
+			src := &readErrRecorder{r: part}
+			storageName := part.FileName()
+			if grant != nil {
+				// The part only carries the base name; the grant pins the
+				// full one.
+				if part.FileName() != path.Base(grant.Name) || len(files) > 0 {
+					_ = part.Close()
+					writeJSONError(ctx, fasthttp.StatusForbidden, fmt.Sprintf("the pre-signed URL only allows one file named %q", grant.Name))
+					return
+				}
+				storageName = grant.Name
+				if grant.MaxSize > 0 {
+					src.r = &maxSizeReader{r: part, remaining: grant.MaxSize}
+				}
+			}
+			src.r = h.content.reader(src.r, part.FileName(), part.Header.Get("Content-Type"))
+			staged, stageErr := h.storage.Stage(storageName, src)
+			if stageErr != nil {
+				var policyErr *PreflightError
+				if errors.As(src.err, &policyErr) {
+					// Closing the part would read the rejected file to its
+					// end; the connection is closed instead.
+					writePreflightError(ctx, policyErr)
+					return
+				}
+				_ = part.Close()
+				switch {
+				case errors.Is(stageErr, storage.ErrInvalidName):
+					writeJSONError(ctx, fasthttp.StatusBadRequest, stageErr.Error())
+				case errors.Is(src.err, errPresignedSizeExceeded):
+					writeJSONError(ctx, fasthttp.StatusRequestEntityTooLarge, src.err.Error())
+				case src.err != nil || upload.cancelled():
+					h.writeReadError(ctx, upload, fmt.Sprintf("read uploaded file %q: %v", part.FileName(), src.err))
+				default:
+					writeJSONError(ctx, fasthttp.StatusInternalServerError, fmt.Sprintf("store uploaded file %q: %v", part.FileName(), stageErr))
+				}
+				return
+			}
+			files = append(files, staged)
+			names = append(names, part.FileName())
+			metadata = append(metadata, nil)
+		case strings.HasPrefix(part.FormName(), api.MetadataFieldPrefix):
+			if len(files) == 0 && archive == nil {
+				_ = part.Close()
+				writeJSONErrorCode(ctx, fasthttp.StatusBadRequest, api.CodeInvalidMetadata, fmt.Sprintf("metadata field %q must follow a file part", part.FormName()))
+				return
+			}
+			value, readErr := io.ReadAll(io.LimitReader(part, api.MaxMetadataSize+1))
+			if readErr != nil {
+				_ = part.Close()
+				h.writeReadError(ctx, upload, fmt.Sprintf("read multipart form: %v", readErr))
+				return
+			}
+			key := strings.TrimPrefix(part.FormName(), api.MetadataFieldPrefix)
+			if archive != nil {
+				// The metadata of an archive goes to every file in it.
+				archiveMetadata, metaErr := addMetadata(archive.metadata, key, string(value))
+				if metaErr != nil {
+					_ = part.Close()
+					writeJSONErrorCode(ctx, fasthttp.StatusBadRequest, api.CodeInvalidMetadata, fmt.Sprintf("archive %q: %v", extractTo, metaErr))
+					return
+				}
+				archive.metadata = archiveMetadata
+				break
+			}
+			fileMetadata, metaErr := addMetadata(metadata[len(files)-1], key, string(value))
+			if metaErr != nil {
+				_ = part.Close()
+				writeJSONErrorCode(ctx, fasthttp.StatusBadRequest, api.CodeInvalidMetadata, fmt.Sprintf("file %q: %v", names[len(files)-1], metaErr))
+				return
+			}
+			metadata[len(files)-1] = fileMetadata
+		case part.FormName() == api.ChecksumFieldSHA256:
+			value, readErr := io.ReadAll(io.LimitReader(part, maxChecksumFieldSize))
+			if readErr != nil {
+				_ = part.Close()
+				h.writeReadError(ctx, upload, fmt.Sprintf("read multipart form: %v", readErr))
+				return
+			}
+			multipartChecksums = append(multipartChecksums, string(value))
 		}
-		if closeErr != nil {
-			writeJSONError(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("close uploaded file %q: %v", fileHeader.Filename, closeErr))
+
+		if err := part.Close(); err != nil {
+			h.writeReadError(ctx, upload, fmt.Sprintf("read multipart form: %v", err))
 			return
 		}
+	}
+
+	if len(files) == 0 && archive == nil {
+		writeJSONError(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("multipart field %q is required", h.fileFieldName))
+		return
+	}
+
+	var totalBytes int64
+	actualChecksum := "n/a"
+	aggregateHasher := sha256.New()
+	// The checksum of an extracted upload is the one of the archive.
+	checksumCount := len(files)
+	if archive != nil {
+		checksumCount = 1
+	}
+	expectedChecksums, checksumErr := expectedChecksumsForRequest(ctx, multipartChecksums, checksumCount)
+	if checksumErr != nil {
+		writeJSONError(ctx, fasthttp.StatusBadRequest, checksumErr.Error())
+		return
+	}
 
-		totalBytes += n
+	for idx, staged := range files {
+		file := staged.Object()
+		totalBytes += file.Size
+		if archive != nil {
+			metadata[idx] = archive.metadata
+			continue
+		}
 		if len(files) == 1 {
-			actualChecksum = hash
+			actualChecksum = file.SHA256
 		} else {
-			if _, err := fmt.Fprintf(aggregateHasher, "%s:%s\n", fileHeader.Filename, hash); err != nil {
+			if _, err := fmt.Fprintf(aggregateHasher, "%s:%s\n", file.Name, file.SHA256); err != nil {
 				writeJSONError(ctx, fasthttp.StatusInternalServerError, fmt.Sprintf("aggregate checksum: %v", err))
 				return
 			}
 		}
-		if len(expectedChecksums) > 0 && hash != expectedChecksums[idx] {
-			writeJSON(ctx, fasthttp.StatusUnprocessableEntity, errorResponse{
-				Status:           "error",
-				Error:            "checksum mismatch",
-				ExpectedChecksum: expectedChecksums[idx],
-				ActualChecksum:   hash,
-			})
+		if len(expectedChecksums) > 0 && file.SHA256 != expectedChecksums[idx] {
+			writeChecksumMismatch(ctx, expectedChecksums[idx], file.SHA256)
 			return
 		}
 	}
-	if len(files) > 1 {
+	switch {
+	case archive != nil:
+		actualChecksum = archive.sha256
+		if len(expectedChecksums) > 0 && archive.sha256 != expectedChecksums[0] {
+			writeChecksumMismatch(ctx, expectedChecksums[0], archive.sha256)
+			return
+		}
+	case len(files) > 1:
 		actualChecksum = hex.EncodeToString(aggregateHasher.Sum(nil))
 	}
 
-	elapsed := time.Since(start)
-	throughput := 0.0
-	if elapsed > 0 {
-		throughput = float64(totalBytes) / elapsed.Seconds()
+	summary := uploadSummary{
+		files:   make([]api.UploadedFile, 0, len(files)),
+		size:    totalBytes,
+		elapsed: time.Since(start),
+		sha256:  actualChecksum,
+	}
+	if archive != nil {
+		summary.archive = &archive.result
+	}
+	if err := h.checkConditions(files, condition); err != nil {
+		writeStorageError(ctx, err)
+		return
+	}
+	// The hooks run last, as they may be slow or quarantine a file.
+	for idx, staged := range files {
+		if err := h.hooks.check(staged, metadata[idx], ctx.RemoteAddr().String()); err != nil {
+			writePreflightError(ctx, err)
+			return
+		}
+	}
+	for idx, staged := range files {
+		staged.SetMetadata(metadata[idx])
+		staged.SetExpiresAt(expiresAt(ttl))
+		staged.SetCondition(condition)
+		stored, err := staged.Commit()
+		if errors.Is(err, storage.ErrPreconditionFailed) {
+			writeStorageError(ctx, err)
+			return
+		}
+		if err != nil {
+			writeJSONError(ctx, fasthttp.StatusInternalServerError, fmt.Sprintf("store uploaded file %q: %v", staged.Object().Name, err))
+			return
+		}
+		summary.files = append(summary.files, uploadedFile(names[idx], stored))
 	}
-	speed := format.BytesPerSecond(throughput)
+	committed = true
+	summary.elapsed = time.Since(start)
 
-	log.Printf(
-		"upload complete: files=%d size=%s duration=%s speed=%s sha256=%s",
-		len(files),
-		format.Bytes(totalBytes),
-		elapsed.Round(time.Millisecond),
-		speed,
-		actualChecksum,
+	slog.Info("upload complete",
+		"files", len(files),
+		"size", format.Bytes(totalBytes),
+		"duration", summary.elapsed.Round(time.Millisecond).String(),
+		"speed", format.BytesPerSecond(summary.throughput()),
+		"sha256", actualChecksum,
 	)
 
-	writeJSON(ctx, fasthttp.StatusCreated, uploadSuccessResponse{
-		Status:   "ok",
-		Files:    len(files),
-		Size:     format.Bytes(totalBytes),
-		Duration: elapsed.Round(time.Millisecond).String(),
-		Speed:    speed,
-		SHA256:   actualChecksum,
+	event.Type = api.EventUploadCompleted
+	event.Files = summary.files
+	event.Size = totalBytes
+	event.SHA256 = actualChecksum
+	h.webhooks.Publish(event)
+
+	writeUploadResult(ctx, summary)
+}
+
+// uploadSummary is a finished upload, rendered by writeUploadResult in the
+// schema the client asked for.
+type uploadSummary struct {
+	files           []api.UploadedFile
+	size            int64
+	elapsed         time.Duration
+	sha256          string
+	compositeSHA256 string
+	// archive is set for extracted uploads.
+	archive *api.ArchiveResult
+}
+
+// throughput returns the upload speed in bytes per second.
+func (s uploadSummary) throughput() float64 {
+	if s.elapsed <= 0 {
+		return 0
+	}
+
+	return float64(s.size) / s.elapsed.Seconds()
+}
+
+func uploadedFile(name string, obj storage.Object) api.UploadedFile {
+	return api.UploadedFile{
+		Name:      name,
+		StorageID: obj.Name,
+		Size:      obj.Size,
+		SHA256:    obj.SHA256,
+		MD5:       obj.MD5,
+		Metadata:  obj.Metadata,
+		ExpiresAt: formatExpiresAt(obj.ExpiresAt),
+		VersionID: obj.VersionID,
+	}
+}
+
+// addMetadata adds one entry sent as a multipart field to metadata, which may
+// be nil, and checks the result against the limits of api.ValidateMetadata.
+// Keys are matched case-insensitively, like the headers they are returned in.
+func addMetadata(metadata map[string]string, key, value string) (map[string]string, error) {
+	key = strings.ToLower(key)
+	if _, dup := metadata[key]; dup {
+		return nil, fmt.Errorf("duplicate metadata key %q", key)
+	}
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	metadata[key] = value
+	if err := api.ValidateMetadata(metadata); err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+func writeChecksumMismatch(ctx *fasthttp.RequestCtx, expected, actual string) {
+	writeJSON(ctx, fasthttp.StatusUnprocessableEntity, api.ErrorResponse{
+		Status:           api.StatusError,
+		Code:             api.CodeChecksumMismatch,
+		Error:            "checksum mismatch",
+		ExpectedChecksum: expected,
+		ActualChecksum:   actual,
 	})
 }
 
-func hashSHA256HexAndCount(r io.Reader) (string, int64, error) {
-	hasher := sha256.New()
-	n, err := io.Copy(io.MultiWriter(io.Discard, hasher), r)
-	if err != nil {
-		return "", n, fmt.Errorf("hash stream: %w", err)
+// writeUploadResult answers a successful upload with api.UploadResultV2 when
+// the client accepts it and with the human-readable api.UploadResult
+// otherwise.
+func writeUploadResult(ctx *fasthttp.RequestCtx, s uploadSummary) {
+	ctx.Response.Header.Add(fasthttp.HeaderVary, fasthttp.HeaderAccept)
+	if acceptsMediaType(ctx.Request.Header.Peek(fasthttp.HeaderAccept), api.MediaTypeUploadV2) {
+		writeJSONAs(ctx, fasthttp.StatusCreated, api.MediaTypeUploadV2, api.UploadResultV2{
+			Status:          api.StatusOK,
+			Version:         2,
+			Files:           s.files,
+			Size:            s.size,
+			DurationNS:      s.elapsed.Nanoseconds(),
+			BytesPerSecond:  s.throughput(),
+			SHA256:          s.sha256,
+			CompositeSHA256: s.compositeSHA256,
+			Archive:         archiveResult(s.archive, nil),
+		})
+		return
 	}
 
-	return hex.EncodeToString(hasher.Sum(nil)), n, nil
+	writeJSON(ctx, fasthttp.StatusCreated, api.UploadResult{
+		Status:          api.StatusOK,
+		Files:           len(s.files),
+		Size:            format.Bytes(s.size),
+		Duration:        s.elapsed.Round(time.Millisecond).String(),
+		Speed:           format.BytesPerSecond(s.throughput()),
+		SHA256:          s.sha256,
+		CompositeSHA256: s.compositeSHA256,
+		Archive:         archiveResult(s.archive, s.files),
+	})
+}
+
+// archiveResult returns archive, if any, with entries.
+func archiveResult(archive *api.ArchiveResult, entries []api.UploadedFile) *api.ArchiveResult {
+	if archive == nil {
+		return nil
+	}
+	result := *archive
+	result.Entries = entries
+
+	return &result
 }
 
-func expectedChecksumsForRequest(_ *fasthttp.RequestCtx, multipartChecksums []string, fileCount int) ([]string, error) {
+// acceptsMediaType reports whether the Accept header lists mediaType, ignoring
+// wildcards and entries with q=0.
+func acceptsMediaType(accept []byte, mediaType string) bool {
+	for _, entry := range strings.Split(string(accept), ",") {
+		name, params, _ := strings.Cut(entry, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), mediaType) {
+			continue
+		}
+		rejected := false
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(key), "q") {
+				if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && q == 0 {
+					rejected = true
+				}
+			}
+		}
+		if !rejected {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeReadError reports a failure to consume the request body, telling an
+// admin cancellation apart from a malformed or interrupted upload.
+func (h *handlerConfig) writeReadError(ctx *fasthttp.RequestCtx, upload *inflightUpload, msg string) {
+	if upload.cancelled() {
+		slog.Warn("upload cancelled",
+			"id", upload.id,
+			"remote", upload.remoteAddr,
+			"file", upload.currentFilename(),
+			"received", upload.received.Load(),
+		)
+		writeJSONError(ctx, fasthttp.StatusConflict, errUploadCancelled.Error())
+		return
+	}
+
+	writeJSONError(ctx, fasthttp.StatusBadRequest, msg)
+}
+
+// requestBody returns the streamed request body when the server runs with
+// StreamRequestBody and the buffered one otherwise.
+func requestBody(ctx *fasthttp.RequestCtx) io.Reader {
+	if body := ctx.RequestBodyStream(); body != nil {
+		return body
+	}
+
+	return bytes.NewReader(ctx.PostBody())
+}
+
+// readErrRecorder remembers the last error returned by the underlying reader
+// so that client-side read failures can be told apart from storage failures.
+type readErrRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrRecorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+
+	return n, err
+}
+
+// expectedChecksumsForRequest prefers the per-file multipart checksum fields
+// and falls back to the checksum header sent along with Expect: 100-continue.
+func expectedChecksumsForRequest(ctx *fasthttp.RequestCtx, multipartChecksums []string, fileCount int) ([]string, error) {
 	checksums := make([]string, 0, len(multipartChecksums))
 	for _, checksum := range multipartChecksums {
 		clean := strings.TrimSpace(checksum)
@@ -207,6 +720,9 @@ func expectedChecksumsForRequest(_ *fasthttp.RequestCtx, multipartChecksums []st
 			checksums = append(checksums, clean)
 		}
 	}
+	if header := strings.TrimSpace(string(ctx.Request.Header.Peek(api.HeaderChecksumSHA256))); len(checksums) == 0 && header != "" {
+		checksums = append(checksums, header)
+	}
 	if len(checksums) > 0 && len(checksums) != fileCount {
 		return nil, fmt.Errorf("checksum count mismatch: got %d for %d file(s)", len(checksums), fileCount)
 	}
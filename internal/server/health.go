@@ -0,0 +1,103 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"client-server-fasthttp-test/internal/server/format"
+	"client-server-fasthttp-test/internal/server/storage"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	checkStatusOK      = "ok"
+	checkStatusFail    = "fail"
+	checkStatusSkipped = "skipped"
+)
+
+type healthCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type healthResponse struct {
+	Status string        `json:"status"`
+	Checks []healthCheck `json:"checks,omitempty"`
+}
+
+func (h *handlerConfig) handleLivez(ctx *fasthttp.RequestCtx) {
+	writeJSON(ctx, fasthttp.StatusOK, healthResponse{Status: checkStatusOK})
+}
+
+// handleReadyz reports whether the server should receive new uploads. Every
+// check is always evaluated so the response shows the full picture.
+func (h *handlerConfig) handleReadyz(ctx *fasthttp.RequestCtx) {
+	checks := []healthCheck{
+		h.checkDraining(),
+		h.checkStorageWritable(),
+		h.checkFreeSpace(),
+		h.checkUploadSlots(),
+	}
+
+	resp := healthResponse{Status: checkStatusOK, Checks: checks}
+	statusCode := fasthttp.StatusOK
+	for _, check := range checks {
+		if check.Status == checkStatusFail {
+			resp.Status = checkStatusFail
+			statusCode = fasthttp.StatusServiceUnavailable
+			break
+		}
+	}
+
+	writeJSON(ctx, statusCode, resp)
+}
+
+func (h *handlerConfig) checkDraining() healthCheck {
+	if h.draining.Load() {
+		return healthCheck{Name: "draining", Status: checkStatusFail, Detail: "server is shutting down"}
+	}
+
+	return healthCheck{Name: "draining", Status: checkStatusOK}
+}
+
+func (h *handlerConfig) checkStorageWritable() healthCheck {
+	if err := h.storage.CheckWritable(); err != nil {
+		return healthCheck{Name: "storage", Status: checkStatusFail, Detail: err.Error()}
+	}
+
+	return healthCheck{Name: "storage", Status: checkStatusOK}
+}
+
+func (h *handlerConfig) checkFreeSpace() healthCheck {
+	free, err := h.storage.FreeSpace()
+	if errors.Is(err, storage.ErrUnsupported) {
+		return healthCheck{Name: "disk_space", Status: checkStatusSkipped, Detail: err.Error()}
+	}
+	if err != nil {
+		return healthCheck{Name: "disk_space", Status: checkStatusFail, Detail: err.Error()}
+	}
+
+	minFreeSpace := h.minFreeSpace.Load()
+	detail := fmt.Sprintf("free %s, threshold %s", format.Bytes(int64(free)), format.Bytes(int64(minFreeSpace)))
+	if free < minFreeSpace {
+		return healthCheck{Name: "disk_space", Status: checkStatusFail, Detail: detail}
+	}
+
+	return healthCheck{Name: "disk_space", Status: checkStatusOK, Detail: detail}
+}
+
+func (h *handlerConfig) checkUploadSlots() healthCheck {
+	inUse, capacity := h.uploadSlotUsage()
+	if capacity == 0 {
+		return healthCheck{Name: "upload_slots", Status: checkStatusSkipped, Detail: "unlimited"}
+	}
+
+	detail := fmt.Sprintf("%d/%d in use", inUse, capacity)
+	if inUse >= capacity {
+		return healthCheck{Name: "upload_slots", Status: checkStatusFail, Detail: detail}
+	}
+
+	return healthCheck{Name: "upload_slots", Status: checkStatusOK, Detail: detail}
+}
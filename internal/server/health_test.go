@@ -0,0 +1,70 @@
+package server
+
+import (
+	"math"
+	"testing"
+
+	"client-server-fasthttp-test/internal/server/storage"
+
+	"github.com/bytedance/sonic"
+	"github.com/valyala/fasthttp"
+)
+
+func readyzChecks(t *testing.T, h *handlerConfig) (int, map[string]string) {
+	t.Helper()
+
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod(fasthttp.MethodGet)
+	ctx.Request.SetRequestURI("/readyz")
+	h.handler(&ctx)
+
+	var resp healthResponse
+	if err := sonic.Unmarshal(ctx.Response.Body(), &resp); err != nil {
+		t.Fatalf("decode readyz response: %v", err)
+	}
+
+	checks := make(map[string]string, len(resp.Checks))
+	for _, check := range resp.Checks {
+		checks[check.Name] = check.Status
+	}
+
+	return ctx.Response.StatusCode(), checks
+}
+
+func TestReadyz(t *testing.T) {
+	store, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("new storage: %v", err)
+	}
+
+	h := newHandlerConfig("file", 1, store, 0)
+	if status, checks := readyzChecks(t, h); status != fasthttp.StatusOK {
+		t.Fatalf("unexpected status: got %d want %d (checks: %v)", status, fasthttp.StatusOK, checks)
+	}
+
+	release, ok := h.tryAcquireUploadSlot()
+	if !ok {
+		t.Fatal("acquire upload slot")
+	}
+	status, checks := readyzChecks(t, h)
+	release()
+	if status != fasthttp.StatusServiceUnavailable || checks["upload_slots"] != checkStatusFail {
+		t.Fatalf("expected saturated slots to fail readiness: status=%d checks=%v", status, checks)
+	}
+
+	h.draining.Store(true)
+	status, checks = readyzChecks(t, h)
+	h.draining.Store(false)
+	if status != fasthttp.StatusServiceUnavailable || checks["draining"] != checkStatusFail {
+		t.Fatalf("expected draining to fail readiness: status=%d checks=%v", status, checks)
+	}
+
+	h.minFreeSpace.Store(math.MaxInt64)
+	status, checks = readyzChecks(t, h)
+	if checks["disk_space"] == checkStatusSkipped {
+		t.Skip("free space check is not supported on this platform")
+	}
+	if status != fasthttp.StatusServiceUnavailable || checks["disk_space"] != checkStatusFail {
+		t.Fatalf("expected low disk space to fail readiness: status=%d checks=%v", status, checks)
+	}
+}
@@ -0,0 +1,390 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"client-server-fasthttp-test/internal/api"
+	serverconfig "client-server-fasthttp-test/internal/server/config"
+	"client-server-fasthttp-test/internal/server/metrics"
+	"client-server-fasthttp-test/internal/server/storage"
+
+	"github.com/bytedance/sonic"
+	"github.com/valyala/fasthttp"
+)
+
+// HookVerdict is what an UploadHook decided about a file.
+type HookVerdict int
+
+const (
+	HookAccept HookVerdict = iota
+	// HookReject answers the upload with 422 and drops the file.
+	HookReject
+	// HookQuarantine answers like HookReject but keeps the file in the
+	// quarantine directory for inspection.
+	HookQuarantine
+)
+
+func (v HookVerdict) String() string {
+	switch v {
+	case HookAccept:
+		return "accept"
+	case HookReject:
+		return "reject"
+	case HookQuarantine:
+		return "quarantine"
+	}
+
+	return "unknown"
+}
+
+// HookUpload is a file an UploadHook inspects: stored and hashed, but not
+// visible under its name yet.
+type HookUpload struct {
+	// Path is the local file with the contents; hooks must not change it.
+	// It is empty with the S3 storage backend.
+	Path     string
+	Name     string
+	Size     int64
+	SHA256   string
+	Metadata map[string]string
+	Remote   string
+}
+
+// HookResult is the outcome of an UploadHook. Message is sent to the client
+// of a rejected or quarantined upload.
+type HookResult struct {
+	Verdict HookVerdict
+	Message string
+}
+
+// UploadHook inspects every uploaded file before it is committed, e.g. to
+// run a virus scanner. An error fails the upload with 503 and drops the
+// file; ctx ends at the hook timeout.
+type UploadHook func(ctx context.Context, upload HookUpload) (HookResult, error)
+
+// Exit codes of the hook command, see CommandHook.
+const (
+	hookExitReject     = 1
+	hookExitQuarantine = 2
+	// maxHookMessageSize caps the message read from the hook command.
+	maxHookMessageSize = 1024
+)
+
+// CommandHook returns an UploadHook running the program args[0] with the
+// file in its environment:
+//
+//	UPLOAD_HOOK_PATH, UPLOAD_HOOK_NAME, UPLOAD_HOOK_SIZE, UPLOAD_HOOK_SHA256,
+//	UPLOAD_HOOK_REMOTE, UPLOAD_HOOK_METADATA (JSON) and UPLOAD_HOOK_META_<KEY>
+//
+// Exit status 0 accepts the file, 1 rejects and 2 quarantines it; the
+// standard output is the message. Any other outcome is an error. Of the
+// server's own environment only PATH, HOME and TMPDIR are passed on.
+// Metadata keys that map to the same UPLOAD_HOOK_META_<KEY> are an error.
+func CommandHook(args ...string) UploadHook {
+	return func(ctx context.Context, upload HookUpload) (HookResult, error) {
+		var stdout, stderr bytes.Buffer
+		env, err := hookEnv(upload)
+		if err != nil {
+			return HookResult{}, fmt.Errorf("hook %s: %w", args[0], err)
+		}
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Env = env
+		cmd.Stdout = &limitedBuffer{buf: &stdout, remaining: maxHookMessageSize}
+		cmd.Stderr = &limitedBuffer{buf: &stderr, remaining: maxHookMessageSize}
+		// Children the command started may hold its output open.
+		cmd.WaitDelay = time.Second
+
+		err = cmd.Run()
+		message := strings.TrimSpace(stdout.String())
+		var exitErr *exec.ExitError
+		switch {
+		case err == nil:
+			return HookResult{Verdict: HookAccept, Message: message}, nil
+		case ctx.Err() != nil:
+			return HookResult{}, fmt.Errorf("hook %s: %w", args[0], ctx.Err())
+		case errors.As(err, &exitErr) && exitErr.ExitCode() == hookExitReject:
+			return HookResult{Verdict: HookReject, Message: message}, nil
+		case errors.As(err, &exitErr) && exitErr.ExitCode() == hookExitQuarantine:
+			return HookResult{Verdict: HookQuarantine, Message: message}, nil
+		}
+
+		return HookResult{}, fmt.Errorf("hook %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+}
+
+// hookInheritedEnv lists the variables of the server's environment a hook
+// command inherits; anything else may hold secrets of the server.
+var hookInheritedEnv = []string{"PATH", "HOME", "TMPDIR"}
+
+func hookEnv(upload HookUpload) ([]string, error) {
+	var env []string
+	for _, name := range hookInheritedEnv {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	metadata, _ := sonic.MarshalString(upload.Metadata)
+	env = append(env,
+		"UPLOAD_HOOK_PATH="+upload.Path,
+		"UPLOAD_HOOK_NAME="+upload.Name,
+		"UPLOAD_HOOK_SIZE="+strconv.FormatInt(upload.Size, 10),
+		"UPLOAD_HOOK_SHA256="+upload.SHA256,
+		"UPLOAD_HOOK_REMOTE="+upload.Remote,
+		"UPLOAD_HOOK_METADATA="+metadata,
+	)
+	keys := make(map[string]string, len(upload.Metadata))
+	for _, key := range slices.Sorted(maps.Keys(upload.Metadata)) {
+		envKey := hookEnvKey(key)
+		if other, dup := keys[envKey]; dup {
+			return nil, fmt.Errorf("metadata keys %q and %q both map to UPLOAD_HOOK_META_%s", other, key, envKey)
+		}
+		keys[envKey] = key
+		env = append(env, "UPLOAD_HOOK_META_"+envKey+"="+upload.Metadata[key])
+	}
+
+	return env, nil
+}
+
+// hookEnvKey turns a metadata key into the suffix of an environment
+// variable: upper case, with anything but letters and digits replaced by _.
+func hookEnvKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, key)
+}
+
+// limitedBuffer keeps the first bytes written to it and discards the rest,
+// so that a chatty hook cannot exhaust memory.
+type limitedBuffer struct {
+	buf       *bytes.Buffer
+	remaining int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.remaining > 0 {
+		n := min(len(p), b.remaining)
+		b.buf.Write(p[:n])
+		b.remaining -= n
+	}
+
+	return len(p), nil
+}
+
+// uploadHooks runs the upload hooks on every file before it is committed.
+type uploadHooks struct {
+	hooks   []UploadHook
+	timeout time.Duration
+	// slots bounds the files inspected at once; nil means no limit.
+	slots         chan struct{}
+	quarantineDir string
+
+	runs *metrics.Counter
+}
+
+// newUploadHooks returns the configured command followed by the hooks from
+// WithUploadHook, or nil when there are none. Quarantine moves the staged
+// file, so a quarantine directory needs the local storage.
+func newUploadHooks(cfg serverconfig.AppConfig, hooks []UploadHook, store storage.Backend, reg *metrics.Registry) (*uploadHooks, error) {
+	if args := strings.Fields(cfg.HookCommand); len(args) > 0 {
+		hooks = append([]UploadHook{CommandHook(args...)}, hooks...)
+	}
+	if len(hooks) == 0 {
+		return nil, nil
+	}
+	if _, local := store.(*storage.Local); cfg.HookQuarantineDir != "" && !local {
+		return nil, errors.New("hook_quarantine_dir needs the local storage; leave it empty to answer quarantine verdicts with 503")
+	}
+
+	u := &uploadHooks{
+		hooks:         hooks,
+		timeout:       cfg.HookTimeout,
+		quarantineDir: cfg.HookQuarantineDir,
+		runs: reg.Counter("upload_server_upload_hook_files_total",
+			"Uploaded files inspected by the upload hooks, by verdict.", "verdict"),
+	}
+	if cfg.HookConcurrency > 0 {
+		u.slots = make(chan struct{}, cfg.HookConcurrency)
+	}
+
+	return u, nil
+}
+
+// check runs the hooks on staged until one does not accept it. A rejected
+// or quarantined file is answered with a 422 *PreflightError, a failed hook
+// or a file that could not be quarantined with 503.
+func (u *uploadHooks) check(staged *storage.Staged, metadata map[string]string, remote string) error {
+	if u == nil {
+		return nil
+	}
+
+	obj := staged.Object()
+	upload := HookUpload{
+		Path:     staged.Path(),
+		Name:     obj.Name,
+		Size:     obj.Size,
+		SHA256:   obj.SHA256,
+		Metadata: metadata,
+		Remote:   remote,
+	}
+	start := time.Now()
+	result, err := u.run(upload)
+	if err != nil {
+		u.runs.Inc("error")
+		slog.Error("upload hook failed", "name", upload.Name, "sha256", upload.SHA256, "error", err)
+		return &PreflightError{StatusCode: fasthttp.StatusServiceUnavailable, Code: api.CodeUnavailable, Message: "upload hook failed"}
+	}
+	u.runs.Inc(result.Verdict.String())
+	attrs := []any{"name", upload.Name, "sha256", upload.SHA256, "remote", remote, "duration", time.Since(start).Round(time.Millisecond).String()}
+
+	switch result.Verdict {
+	case HookAccept:
+		slog.Debug("upload hooks accepted file", attrs...)
+		return nil
+	case HookQuarantine:
+		where, err := u.quarantine(upload, result.Message)
+		if where == "" {
+			// The staged file is still in place and is discarded by the
+			// caller, so the client must not be told it was kept.
+			slog.Error("quarantine uploaded file", append(attrs, "message", result.Message, "error", err)...)
+			return &PreflightError{StatusCode: fasthttp.StatusServiceUnavailable, Code: api.CodeUnavailable, Message: "upload could not be quarantined"}
+		}
+		if err != nil {
+			slog.Error("quarantine uploaded file", append(attrs, "quarantine", where, "error", err)...)
+		}
+		slog.Warn("upload hook quarantined file", append(attrs, "message", result.Message, "quarantine", where)...)
+		return &PreflightError{StatusCode: fasthttp.StatusUnprocessableEntity, Code: api.CodeQuarantined, Message: hookMessage(result)}
+	default:
+		slog.Warn("upload hook rejected file", append(attrs, "message", result.Message)...)
+		return &PreflightError{StatusCode: fasthttp.StatusUnprocessableEntity, Code: api.CodeRejected, Message: hookMessage(result)}
+	}
+}
+
+func hookMessage(result HookResult) string {
+	switch {
+	case result.Message != "":
+		return result.Message
+	case result.Verdict == HookQuarantine:
+		return "upload quarantined by an upload hook"
+	}
+
+	return "upload rejected by an upload hook"
+}
+
+func (u *uploadHooks) run(upload HookUpload) (HookResult, error) {
+	ctx := context.Background()
+	if u.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, u.timeout)
+		defer cancel()
+	}
+	if u.slots != nil {
+		select {
+		case u.slots <- struct{}{}:
+			defer func() { <-u.slots }()
+		case <-ctx.Done():
+			return HookResult{}, fmt.Errorf("wait for a free hook slot: %w", ctx.Err())
+		}
+	}
+
+	for _, hook := range u.hooks {
+		result, err := hook(ctx, upload)
+		if err != nil || result.Verdict != HookAccept {
+			return result, err
+		}
+	}
+
+	return HookResult{Verdict: HookAccept}, nil
+}
+
+// quarantineRecord is written next to a quarantined file.
+type quarantineRecord struct {
+	Name          string            `json:"name"`
+	Size          int64             `json:"size"`
+	SHA256        string            `json:"sha256"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	Remote        string            `json:"remote,omitempty"`
+	Message       string            `json:"message,omitempty"`
+	QuarantinedAt string            `json:"quarantined_at"`
+}
+
+// quarantine moves the staged file of upload to the quarantine directory,
+// next to a JSON record of the upload, and returns its new path. The path is
+// returned with the error when only the record could not be written.
+func (u *uploadHooks) quarantine(upload HookUpload, message string) (string, error) {
+	if upload.Path == "" || u.quarantineDir == "" {
+		return "", errors.New("quarantine needs the local storage and a quarantine directory")
+	}
+	if err := os.MkdirAll(u.quarantineDir, 0o750); err != nil {
+		return "", fmt.Errorf("create quarantine dir: %w", err)
+	}
+
+	now := time.Now().UTC()
+	target := filepath.Join(u.quarantineDir, fmt.Sprintf("%s-%.12s-%s", now.Format("20060102T150405Z"), upload.SHA256, path.Base(upload.Name)))
+	if err := moveFile(upload.Path, target); err != nil {
+		return "", err
+	}
+	record, err := sonic.Marshal(quarantineRecord{
+		Name:          upload.Name,
+		Size:          upload.Size,
+		SHA256:        upload.SHA256,
+		Metadata:      upload.Metadata,
+		Remote:        upload.Remote,
+		Message:       message,
+		QuarantinedAt: now.Format(time.RFC3339),
+	})
+	if err == nil {
+		err = os.WriteFile(target+".json", record, 0o640)
+	}
+	if err != nil {
+		return target, fmt.Errorf("write quarantine record: %w", err)
+	}
+
+	return target, nil
+}
+
+// moveFile renames src to dst, copying when they are on different file
+// systems.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", src, err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", dst, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		_ = os.Remove(dst)
+		return fmt.Errorf("copy to %s: %w", dst, err)
+	}
+	if err := out.Close(); err != nil {
+		_ = os.Remove(dst)
+		return fmt.Errorf("close %s: %w", dst, err)
+	}
+
+	return os.Remove(src)
+}
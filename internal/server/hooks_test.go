@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/client/uploader"
+	serverconfig "client-server-fasthttp-test/internal/server/config"
+	"client-server-fasthttp-test/internal/server/metrics"
+
+	"github.com/valyala/fasthttp"
+)
+
+const testHookScript = `#!/bin/sh
+case "$UPLOAD_HOOK_NAME" in
+*virus*) echo "EICAR test signature found"; exit 2 ;;
+*bad*) echo "files named bad are not allowed"; exit 1 ;;
+esac
+[ "$(cat "$UPLOAD_HOOK_PATH")" = "payload" ] || { echo "unexpected content" >&2; exit 3; }
+[ "$UPLOAD_HOOK_META_BUILD_ID" = "42" ] || { echo "missing metadata" >&2; exit 3; }
+[ "$UPLOAD_HOOK_SIZE" = "7" ] || { echo "unexpected size" >&2; exit 3; }
+[ -z "$UPLOAD_SERVER_ADMIN_TOKEN" ] || { echo "server secrets leaked" >&2; exit 3; }
+[ -z "$AWS_SECRET_ACCESS_KEY" ] || { echo "server environment leaked" >&2; exit 3; }
+`
+
+func TestUploadCommandHook(t *testing.T) {
+	t.Setenv("UPLOAD_SERVER_ADMIN_TOKEN", "secret")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	dir := t.TempDir()
+	script := filepath.Join(dir, "hook.sh")
+	if err := os.WriteFile(script, []byte(testHookScript), 0o700); err != nil {
+		t.Fatalf("write hook: %v", err)
+	}
+	quarantineDir := filepath.Join(dir, "quarantine")
+
+	uploadHandler, client := newTestServer(t)
+	hooks, err := newUploadHooks(serverconfig.AppConfig{
+		HookCommand:       script,
+		HookTimeout:       5 * time.Second,
+		HookConcurrency:   1,
+		HookQuarantineDir: quarantineDir,
+	}, nil, uploadHandler.storage, metrics.NewRegistry())
+	if err != nil {
+		t.Fatalf("new upload hooks: %v", err)
+	}
+	uploadHandler.hooks = hooks
+	ctx := context.Background()
+
+	localPath := filepath.Join(dir, "payload.bin")
+	if err := os.WriteFile(localPath, []byte("payload"), 0o600); err != nil {
+		t.Fatalf("write temp file: %v", err)
+	}
+	upload := func(name string) error {
+		_, err := client.UploadFileContext(ctx, uploader.UploadRequest{
+			URL:      "http://inmemory/upload",
+			FilePath: localPath,
+			FileName: name,
+			Metadata: map[string]string{"build-id": "42"},
+		})
+		return err
+	}
+
+	if err := upload("good.bin"); err != nil {
+		t.Fatalf("accepted upload: %v", err)
+	}
+
+	err = upload("bad.bin")
+	var httpErr *uploader.HTTPError
+	if !errors.Is(err, uploader.ErrContentRejected) || !errors.As(err, &httpErr) {
+		t.Fatalf("rejected upload: got %v want %v", err, uploader.ErrContentRejected)
+	}
+	if httpErr.StatusCode != fasthttp.StatusUnprocessableEntity || httpErr.Code() != api.CodeRejected || httpErr.Response.Error != "files named bad are not allowed" {
+		t.Fatalf("unexpected rejection: %d %+v", httpErr.StatusCode, httpErr.Response)
+	}
+
+	err = upload("virus.bin")
+	if !errors.As(err, &httpErr) || httpErr.Code() != api.CodeQuarantined || httpErr.Response.Error != "EICAR test signature found" {
+		t.Fatalf("quarantined upload: got %v", err)
+	}
+	quarantined, err := filepath.Glob(filepath.Join(quarantineDir, "*-virus.bin"))
+	if err != nil || len(quarantined) != 1 {
+		t.Fatalf("unexpected quarantine: %v %v", quarantined, err)
+	}
+	if content, err := os.ReadFile(quarantined[0]); err != nil || string(content) != "payload" {
+		t.Fatalf("unexpected quarantined content: %q %v", content, err)
+	}
+	if _, err := os.Stat(quarantined[0] + ".json"); err != nil {
+		t.Fatalf("quarantine record: %v", err)
+	}
+
+	// A file that cannot be quarantined is not reported as kept.
+	hooks.quarantineDir = localPath
+	err = upload("virus2.bin")
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != fasthttp.StatusServiceUnavailable || httpErr.Code() != api.CodeUnavailable {
+		t.Fatalf("failed quarantine: got %v", err)
+	}
+
+	if got := storedNames(t, uploadHandler.storage); len(got) != 1 || got[0] != "good.bin" {
+		t.Fatalf("unexpected stored files: %v", got)
+	}
+}
+
+func TestHookEnv(t *testing.T) {
+	t.Setenv("HOME", "/home/upload")
+	t.Setenv("DATABASE_URL", "postgres://secret")
+
+	env, err := hookEnv(HookUpload{Name: "a.bin", Metadata: map[string]string{"build-id": "42"}})
+	if err != nil {
+		t.Fatalf("hook env: %v", err)
+	}
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, "UPLOAD_HOOK_") && !slices.Contains(hookInheritedEnv, name) {
+			t.Fatalf("unexpected variable %s in %v", name, env)
+		}
+	}
+	for _, want := range []string{"HOME=/home/upload", "UPLOAD_HOOK_NAME=a.bin", "UPLOAD_HOOK_META_BUILD_ID=42"} {
+		if !slices.Contains(env, want) {
+			t.Fatalf("missing %s in %v", want, env)
+		}
+	}
+
+	_, err = hookEnv(HookUpload{Metadata: map[string]string{"a-b": "1", "a_b": "2"}})
+	if err == nil || !strings.Contains(err.Error(), "UPLOAD_HOOK_META_A_B") {
+		t.Fatalf("colliding keys: got %v", err)
+	}
+}
+
+func TestUploadHookFailuresAndConcurrency(t *testing.T) {
+	var running, peak atomic.Int32
+	block := make(chan struct{})
+	uploadHandler, _ := newTestServer(t)
+	hooks, err := newUploadHooks(serverconfig.AppConfig{HookTimeout: 200 * time.Millisecond, HookConcurrency: 1}, []UploadHook{
+		func(ctx context.Context, upload HookUpload) (HookResult, error) {
+			n := running.Add(1)
+			defer running.Add(-1)
+			if n > peak.Load() {
+				peak.Store(n)
+			}
+			if upload.Name == "slow.bin" {
+				<-ctx.Done()
+				return HookResult{}, ctx.Err()
+			}
+			<-block
+			return HookResult{Verdict: HookAccept}, nil
+		},
+	}, uploadHandler.storage, metrics.NewRegistry())
+	if err != nil {
+		t.Fatalf("new upload hooks: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := hooks.run(HookUpload{Name: "a.bin"})
+		done <- err
+	}()
+	for running.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The only slot is taken, so the second file times out waiting.
+	if _, err := hooks.run(HookUpload{Name: "b.bin"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("waiting for a slot: got %v want %v", err, context.DeadlineExceeded)
+	}
+	close(block)
+	if err := <-done; err != nil {
+		t.Fatalf("first hook: %v", err)
+	}
+	if peak.Load() != 1 {
+		t.Fatalf("unexpected concurrency: got %v want %v", peak.Load(), 1)
+	}
+
+	uploadHandler.hooks = hooks
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+	ctx.Request.SetRequestURI("/upload")
+	ctx.Request.Header.SetContentType("multipart/form-data; boundary=b")
+	ctx.Request.SetBodyString("--b\r\nContent-Disposition: form-data; name=\"file\"; filename=\"slow.bin\"\r\n\r\npayload\r\n--b--\r\n")
+	ctx.Request.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+testAuthToken)
+	uploadHandler.handler(&ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusServiceUnavailable || !strings.Contains(string(ctx.Response.Body()), "upload hook failed") {
+		t.Fatalf("unexpected response: %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if got := storedNames(t, uploadHandler.storage); len(got) != 0 {
+		t.Fatalf("failed upload was stored: %v", got)
+	}
+}
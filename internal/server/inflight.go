@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errUploadCancelled = errors.New("upload cancelled")
+
+type inflightUpload struct {
+	id         uint64
+	remoteAddr string
+	startedAt  time.Time
+	received   atomic.Int64
+	filename   atomic.Pointer[string]
+
+	conn   net.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type inflightUploadSnapshot struct {
+	ID            uint64 `json:"id"`
+	RemoteAddr    string `json:"remote_addr"`
+	Filename      string `json:"filename"`
+	BytesReceived int64  `json:"bytes_received"`
+	Elapsed       string `json:"elapsed"`
+}
+
+type uploadTracker struct {
+	mu      sync.Mutex
+	nextID  uint64
+	uploads map[uint64]*inflightUpload
+}
+
+func newUploadTracker() *uploadTracker {
+	return &uploadTracker{uploads: make(map[uint64]*inflightUpload)}
+}
+
+// begin registers a new upload. conn may be nil when the request is not
+// served from a network connection, e.g. in tests.
+func (t *uploadTracker) begin(remoteAddr string, conn net.Conn) *inflightUpload {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nextID++
+	upload := &inflightUpload{
+		id:         t.nextID,
+		remoteAddr: remoteAddr,
+		startedAt:  time.Now(),
+		conn:       conn,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	t.uploads[upload.id] = upload
+
+	return upload
+}
+
+func (t *uploadTracker) finish(upload *inflightUpload) {
+	upload.cancel()
+
+	t.mu.Lock()
+	delete(t.uploads, upload.id)
+	t.mu.Unlock()
+}
+
+func (t *uploadTracker) cancel(id uint64) bool {
+	t.mu.Lock()
+	upload, ok := t.uploads[id]
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	upload.cancel()
+	if upload.conn != nil {
+		// Unblock a read that is waiting on a stalled client.
+		_ = upload.conn.SetReadDeadline(time.Now())
+	}
+
+	return true
+}
+
+func (t *uploadTracker) snapshot() []inflightUploadSnapshot {
+	t.mu.Lock()
+	uploads := make([]*inflightUpload, 0, len(t.uploads))
+	for _, upload := range t.uploads {
+		uploads = append(uploads, upload)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].id < uploads[j].id })
+
+	out := make([]inflightUploadSnapshot, 0, len(uploads))
+	for _, upload := range uploads {
+		out = append(out, inflightUploadSnapshot{
+			ID:            upload.id,
+			RemoteAddr:    upload.remoteAddr,
+			Filename:      upload.currentFilename(),
+			BytesReceived: upload.received.Load(),
+			Elapsed:       time.Since(upload.startedAt).Round(time.Millisecond).String(),
+		})
+	}
+
+	return out
+}
+
+func (u *inflightUpload) setFilename(name string) {
+	u.filename.Store(&name)
+}
+
+func (u *inflightUpload) currentFilename() string {
+	if name := u.filename.Load(); name != nil {
+		return *name
+	}
+
+	return ""
+}
+
+func (u *inflightUpload) cancelled() bool {
+	return u.ctx.Err() != nil
+}
+
+// reader wraps the request body so that received bytes are accounted for,
+// the body is read no faster than limit allows and an admin cancellation
+// aborts the upload on the next read.
+func (u *inflightUpload) reader(r io.Reader, limit *rateLimiter) io.Reader {
+	return &progressReader{r: &throttledReader{r: r, limit: limit, ctx: u.ctx}, upload: u}
+}
+
+type progressReader struct {
+	r      io.Reader
+	upload *inflightUpload
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	if p.upload.cancelled() {
+		return 0, errUploadCancelled
+	}
+
+	n, err := p.r.Read(b)
+	p.upload.received.Add(int64(n))
+
+	return n, err
+}
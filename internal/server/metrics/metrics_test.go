@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	reg := NewRegistry()
+	requests := reg.Counter("requests_total", "Requests.", "code")
+	requests.Inc("200")
+	requests.Add(2, "500")
+	requests.Add(-1, "500")
+	reg.Gauge("in_flight", "In flight.").Set(3)
+	latency := reg.Histogram("latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+	latency.Observe(0.05, `/a"b`)
+	latency.Observe(0.5, `/a"b`)
+	latency.Observe(5, `/a"b`)
+
+	var buf bytes.Buffer
+	if err := reg.WriteText(&buf); err != nil {
+		t.Fatalf("write text: %v", err)
+	}
+
+	want := strings.Join([]string{
+		"# HELP in_flight In flight.",
+		"# TYPE in_flight gauge",
+		"in_flight 3",
+		"# HELP latency_seconds Latency.",
+		"# TYPE latency_seconds histogram",
+		`latency_seconds_bucket{route="/a\"b",le="0.1"} 1`,
+		`latency_seconds_bucket{route="/a\"b",le="1"} 2`,
+		`latency_seconds_bucket{route="/a\"b",le="+Inf"} 3`,
+		`latency_seconds_sum{route="/a\"b"} 5.55`,
+		`latency_seconds_count{route="/a\"b"} 3`,
+		"# HELP requests_total Requests.",
+		"# TYPE requests_total counter",
+		`requests_total{code="200"} 1`,
+		`requests_total{code="500"} 2`,
+		"",
+	}, "\n")
+	if got := buf.String(); got != want {
+		t.Fatalf("unexpected output:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRegisterReturnsExistingFamily(t *testing.T) {
+	reg := NewRegistry()
+	reg.Counter("panics_total", "Panics.").Inc()
+	reg.Counter("panics_total", "Panics.").Inc()
+
+	if got := reg.Counter("panics_total", "Panics.").Value(); got != 2 {
+		t.Fatalf("unexpected counter value: got %v want %v", got, 2)
+	}
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/server/metrics"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Middleware wraps a handler with behaviour that runs around it.
+type Middleware func(fasthttp.RequestHandler) fasthttp.RequestHandler
+
+// Chain wraps handler so that the first middleware runs outermost.
+func Chain(handler fasthttp.RequestHandler, middleware ...Middleware) fasthttp.RequestHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+
+	return handler
+}
+
+// uploadIDUserValue carries the in-flight upload id so that request-scoped
+// logs, such as a recovered panic, can be matched with the admin API.
+const uploadIDUserValue = "server.upload_id"
+
+// Recovery turns a panic in next into a 500 api.ErrorResponse so that a single
+// faulty request does not take down the process and every other upload with
+// it. The stack trace is logged with the request context and, when reg is not
+// nil, counted in upload_server_panics_total. Deferred cleanup in the handler,
+// such as releasing the upload slot, runs while the panic unwinds.
+func Recovery(reg *metrics.Registry) Middleware {
+	var panics *metrics.Counter
+	if reg != nil {
+		panics = reg.Counter("upload_server_panics_total", "Panics recovered in request handlers, by route.", "route")
+	}
+
+	return func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+			defer func() {
+				recovered := recover()
+				if recovered == nil {
+					return
+				}
+
+				route := RouteName(ctx)
+				attrs := []any{
+					"panic", fmt.Sprint(recovered),
+					"method", string(ctx.Method()),
+					"path", string(ctx.Path()),
+					"route", route,
+					"remote", ctx.RemoteAddr().String(),
+					"request_id", ctx.ID(),
+				}
+				if uploadID, ok := ctx.UserValue(uploadIDUserValue).(uint64); ok {
+					attrs = append(attrs, "upload_id", uploadID)
+				}
+				attrs = append(attrs, "stack", string(debug.Stack()))
+				slog.Error("panic in request handler", attrs...)
+				if panics != nil {
+					panics.Inc(route)
+				}
+
+				// Drop whatever the handler had prepared; the request body
+				// may be partially read, so the connection cannot be reused.
+				ctx.Response.Reset()
+				ctx.SetConnectionClose()
+				writeJSONError(ctx, fasthttp.StatusInternalServerError, "internal server error")
+			}()
+
+			next(ctx)
+		}
+	}
+}
+
+// Logging logs every request at debug level; raise UPLOAD_SERVER_LOG_LEVEL to
+// silence it.
+func Logging() Middleware {
+	return func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+			start := time.Now()
+			next(ctx)
+
+			slog.Debug("request",
+				"method", string(ctx.Method()),
+				"path", string(ctx.Path()),
+				"status", ctx.Response.StatusCode(),
+				"duration", time.Since(start).Round(time.Microsecond).String(),
+				"remote", ctx.RemoteAddr().String(),
+			)
+		}
+	}
+}
+
+// Metrics records request counts, latencies and requests in flight in reg,
+// labelled by route pattern rather than raw path.
+func Metrics(reg *metrics.Registry) Middleware {
+	requests := reg.Counter("upload_server_http_requests_total", "HTTP requests by route, method and status code.", "route", "method", "code")
+	duration := reg.Histogram("upload_server_http_request_duration_seconds", "HTTP request latency by route.", metrics.DefaultDurationBuckets, "route", "method")
+	inFlight := reg.Gauge("upload_server_http_requests_in_flight", "HTTP requests currently being served.")
+
+	return func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+			start := time.Now()
+			inFlight.Add(1)
+			defer inFlight.Add(-1)
+
+			next(ctx)
+
+			route := RouteName(ctx)
+			if route == "" {
+				route = "unmatched"
+			}
+			method := string(ctx.Method())
+			requests.Inc(route, method, strconv.Itoa(ctx.Response.StatusCode()))
+			duration.Observe(time.Since(start).Seconds(), route, method)
+		}
+	}
+}
+
+// BearerAuth rejects requests that do not carry the token returned by token.
+// token is called per request so that it can be rotated at runtime; an empty
+// token rejects everything.
+func BearerAuth(realm string, token func() string) Middleware {
+	return func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+			if !bearerTokenValid(&ctx.Request.Header, token()) {
+				ctx.Response.Header.Set(fasthttp.HeaderWWWAuthenticate, fmt.Sprintf("Bearer realm=%q", realm))
+				writeJSONError(ctx, fasthttp.StatusUnauthorized, "unauthorized")
+				return
+			}
+
+			next(ctx)
+		}
+	}
+}
+
+func bearerTokenValid(header *fasthttp.RequestHeader, expected string) bool {
+	token, ok := strings.CutPrefix(string(header.Peek(fasthttp.HeaderAuthorization)), "Bearer ")
+	if !ok || expected == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+type CORSConfig struct {
+	// AllowedOrigins lists the permitted origins; "*" allows any.
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+	MaxAge         time.Duration
+}
+
+// CORS answers preflight requests and adds CORS headers for allowed origins.
+// Requests from other origins are passed through without CORS headers, which
+// makes browsers reject them.
+func CORS(cfg CORSConfig) Middleware {
+	if len(cfg.AllowedMethods) == 0 {
+		cfg.AllowedMethods = []string{fasthttp.MethodGet, fasthttp.MethodHead, fasthttp.MethodPost, fasthttp.MethodDelete}
+	}
+	if len(cfg.AllowedHeaders) == 0 {
+		cfg.AllowedHeaders = []string{
+			fasthttp.HeaderAuthorization, fasthttp.HeaderContentType, api.HeaderChecksumSHA256, api.HeaderUploadTTL,
+			api.HeaderUploadExtract, fasthttp.HeaderIfMatch, fasthttp.HeaderIfNoneMatch,
+		}
+	}
+	allowAny := slices.Contains(cfg.AllowedOrigins, "*")
+	methods := strings.Join(cfg.AllowedMethods, ", ")
+	headers := strings.Join(cfg.AllowedHeaders, ", ")
+
+	return func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+			origin := string(ctx.Request.Header.Peek(fasthttp.HeaderOrigin))
+			if origin == "" || (!allowAny && !slices.Contains(cfg.AllowedOrigins, origin)) {
+				next(ctx)
+				return
+			}
+
+			ctx.Response.Header.Set(fasthttp.HeaderAccessControlAllowOrigin, origin)
+			ctx.Response.Header.Add(fasthttp.HeaderVary, fasthttp.HeaderOrigin)
+
+			preflight := ctx.IsOptions() && len(ctx.Request.Header.Peek(fasthttp.HeaderAccessControlRequestMethod)) > 0
+			if !preflight {
+				next(ctx)
+				// Metadata headers have per-file names, which a prefix
+				// cannot expose.
+				exposed := []string{api.HeaderChecksumSHA256}
+				if len(ctx.Response.Header.Peek(api.HeaderExpiresAt)) > 0 {
+					exposed = append(exposed, api.HeaderExpiresAt)
+				}
+				if len(ctx.Response.Header.Peek(api.HeaderVersionID)) > 0 {
+					exposed = append(exposed, api.HeaderVersionID, fasthttp.HeaderETag)
+				}
+				for key := range ctx.Response.Header.All() {
+					if len(key) > len(api.HeaderMetadataPrefix) && strings.EqualFold(string(key[:len(api.HeaderMetadataPrefix)]), api.HeaderMetadataPrefix) {
+						exposed = append(exposed, string(key))
+					}
+				}
+				ctx.Response.Header.Set(fasthttp.HeaderAccessControlExposeHeaders, strings.Join(exposed, ", "))
+				return
+			}
+
+			ctx.Response.Header.Set(fasthttp.HeaderAccessControlAllowMethods, methods)
+			ctx.Response.Header.Set(fasthttp.HeaderAccessControlAllowHeaders, headers)
+			if cfg.MaxAge > 0 {
+				ctx.Response.Header.Set(fasthttp.HeaderAccessControlMaxAge, strconv.Itoa(int(cfg.MaxAge.Seconds())))
+			}
+			ctx.SetStatusCode(fasthttp.StatusNoContent)
+		}
+	}
+}
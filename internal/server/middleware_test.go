@@ -0,0 +1,56 @@
+package server
+
+import (
+	"testing"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/server/metrics"
+
+	"github.com/bytedance/sonic"
+	"github.com/valyala/fasthttp"
+)
+
+func TestRecoveryReleasesUploadSlot(t *testing.T) {
+	// Without storage the handler panics once it reaches the file part, after
+	// the upload slot has been acquired.
+	uploadHandler := newHandlerConfig("file", 1, nil, 0)
+	reg := metrics.NewRegistry()
+	handler := Chain(uploadHandler.handler, Recovery(reg))
+
+	for i := 0; i < 2; i++ {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+		ctx.Request.SetRequestURI("/upload")
+		ctx.Request.Header.SetContentType("multipart/form-data; boundary=b")
+		ctx.Request.SetBodyString("--b\r\n" +
+			"Content-Disposition: form-data; name=\"file\"; filename=\"a.bin\"\r\n\r\n" +
+			"payload\r\n" +
+			"--b--\r\n")
+		handler(&ctx)
+
+		// A leaked slot would turn the second request into a 503.
+		if ctx.Response.StatusCode() != fasthttp.StatusInternalServerError {
+			t.Fatalf("request %d: unexpected status: got %d want %d", i, ctx.Response.StatusCode(), fasthttp.StatusInternalServerError)
+		}
+		var resp api.ErrorResponse
+		if err := sonic.Unmarshal(ctx.Response.Body(), &resp); err != nil {
+			t.Fatalf("decode error response: %v", err)
+		}
+		if resp.Status != api.StatusError || resp.Code != api.CodeInternal || resp.Error != "internal server error" {
+			t.Fatalf("unexpected error response: %+v", resp)
+		}
+		if !ctx.Response.ConnectionClose() {
+			t.Fatal("connection must be closed after a panic")
+		}
+	}
+
+	if inUse, _ := uploadHandler.uploadSlotUsage(); inUse != 0 {
+		t.Fatalf("upload slot leaked: got %d in use want 0", inUse)
+	}
+	if uploads := uploadHandler.uploads.snapshot(); len(uploads) != 0 {
+		t.Fatalf("in-flight upload leaked: %+v", uploads)
+	}
+	if got := reg.Counter("upload_server_panics_total", "", "route").Value("/upload"); got != 2 {
+		t.Fatalf("unexpected panic count: got %v want %v", got, 2)
+	}
+}
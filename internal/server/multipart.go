@@ -0,0 +1,569 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/server/format"
+	"client-server-fasthttp-test/internal/server/storage"
+
+	"github.com/bytedance/sonic"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	uploadsPath      = "/uploads"
+	uploadsPathSlash = uploadsPath + "/"
+
+	defaultMultipartTTL = 24 * time.Hour
+	// maxMultipartRequestSize bounds the JSON bodies of init and complete; a
+	// complete listing every part stays well below it.
+	maxMultipartRequestSize = 4 << 20
+)
+
+// multipartSession is an upload of one file in parts, S3-style: parts arrive
+// in any order, possibly concurrently, and are assembled on complete.
+type multipartSession struct {
+	id       string
+	name     string
+	size     int64
+	metadata map[string]string
+	// fileTTL is the time to live of the assembled file, see
+	// handlerConfig.uploadTTL.
+	fileTTL   time.Duration
+	createdAt time.Time
+
+	mu         sync.Mutex
+	parts      map[int]storage.Part
+	expiresAt  time.Time
+	completing bool
+}
+
+// multipartSessions tracks open multipart uploads. A session expires ttl after
+// its last activity; the janitor then removes it with its parts.
+type multipartSessions struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	sessions map[string]*multipartSession
+	now      func() time.Time
+}
+
+func newMultipartSessions(ttl time.Duration) *multipartSessions {
+	return &multipartSessions{
+		ttl:      ttl,
+		sessions: make(map[string]*multipartSession),
+		now:      time.Now,
+	}
+}
+
+func (m *multipartSessions) create(name string, size int64, metadata map[string]string, fileTTL time.Duration) (*multipartSession, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("generate upload id: %w", err)
+	}
+
+	now := m.now()
+	session := &multipartSession{
+		id:        hex.EncodeToString(raw),
+		name:      name,
+		size:      size,
+		metadata:  metadata,
+		fileTTL:   fileTTL,
+		createdAt: now,
+		parts:     make(map[int]storage.Part),
+		expiresAt: now.Add(m.ttl),
+	}
+
+	m.mu.Lock()
+	m.sessions[session.id] = session
+	m.mu.Unlock()
+
+	return session, nil
+}
+
+// get returns a live session and extends its lifetime.
+func (m *multipartSessions) get(id string) (*multipartSession, bool) {
+	m.mu.Lock()
+	session, ok := m.sessions[id]
+	m.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	now := m.now()
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if now.After(session.expiresAt) {
+		return nil, false
+	}
+	session.expiresAt = now.Add(m.ttl)
+
+	return session, true
+}
+
+func (m *multipartSessions) remove(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.sessions[id]
+	delete(m.sessions, id)
+
+	return ok
+}
+
+// removeExpired forgets expired sessions and returns them.
+func (m *multipartSessions) removeExpired() []*multipartSession {
+	now := m.now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var expired []*multipartSession
+	for id, session := range m.sessions {
+		session.mu.Lock()
+		if now.After(session.expiresAt) && !session.completing {
+			expired = append(expired, session)
+			delete(m.sessions, id)
+		}
+		session.mu.Unlock()
+	}
+
+	return expired
+}
+
+func (m *multipartSessions) has(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.sessions[id]
+	return ok
+}
+
+func (s *multipartSession) expiry() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.expiresAt
+}
+
+// handleMultipartInit starts a multipart upload. The whole file may exceed the
+// request body limit, which applies to each part instead.
+func (h *handlerConfig) handleMultipartInit(ctx *fasthttp.RequestCtx) {
+	if h.draining.Load() {
+		writeJSONErrorCode(ctx, fasthttp.StatusServiceUnavailable, api.CodeShuttingDown, "server is shutting down")
+		return
+	}
+
+	var init api.MultipartInit
+	if err := decodeJSONBody(ctx, &init); err != nil {
+		writeJSONError(ctx, fasthttp.StatusBadRequest, err.Error())
+		return
+	}
+	if err := storage.ValidateName(init.Name); err != nil {
+		writeJSONError(ctx, fasthttp.StatusBadRequest, err.Error())
+		return
+	}
+	if init.Size < 0 {
+		writeJSONError(ctx, fasthttp.StatusBadRequest, "size must not be negative")
+		return
+	}
+	if err := api.ValidateMetadata(init.Metadata); err != nil {
+		writeJSONErrorCode(ctx, fasthttp.StatusBadRequest, api.CodeInvalidMetadata, err.Error())
+		return
+	}
+	fileTTL, err := h.uploadTTL(init.TTL)
+	if err != nil {
+		writePreflightError(ctx, err)
+		return
+	}
+	if err := h.checkSpaceFor(init.Size); err != nil {
+		writePreflightError(ctx, err)
+		return
+	}
+
+	session, err := h.multipart.create(init.Name, init.Size, init.Metadata, fileTTL)
+	if err != nil {
+		writeJSONError(ctx, fasthttp.StatusInternalServerError, err.Error())
+		return
+	}
+	slog.Info("multipart upload started", "upload_id", session.id, "name", session.name, "size", session.size)
+	h.webhooks.Publish(multipartEvent(api.EventUploadStarted, session, ctx.RemoteAddr().String()))
+
+	writeJSON(ctx, fasthttp.StatusCreated, api.MultipartSession{
+		Status:    api.StatusOK,
+		UploadID:  session.id,
+		Name:      session.name,
+		ExpiresAt: session.expiry().UTC().Format(time.RFC3339),
+	})
+}
+
+// handleMultipart serves /uploads/{id} (DELETE aborts),
+// /uploads/{id}/parts/{n} (PUT) and /uploads/{id}/complete (POST).
+func (h *handlerConfig) handleMultipart(ctx *fasthttp.RequestCtx) {
+	segments := strings.Split(strings.TrimPrefix(string(ctx.Path()), uploadsPathSlash), "/")
+
+	session, ok := h.multipart.get(segments[0])
+	if !ok {
+		writeJSONError(ctx, fasthttp.StatusNotFound, "upload not found")
+		return
+	}
+
+	switch {
+	case len(segments) == 1 && ctx.IsDelete():
+		h.handleMultipartAbort(ctx, session)
+	case len(segments) == 3 && segments[1] == "parts" && ctx.IsPut():
+		number, err := strconv.Atoi(segments[2])
+		if err != nil || number < api.MinPartNumber || number > api.MaxPartNumber {
+			writeJSONError(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("part number must be between %d and %d", api.MinPartNumber, api.MaxPartNumber))
+			return
+		}
+		h.handlePutPart(ctx, session, number)
+	case len(segments) == 2 && segments[1] == "complete" && ctx.IsPost():
+		h.handleMultipartComplete(ctx, session)
+	default:
+		writeJSONError(ctx, fasthttp.StatusNotFound, "not found")
+	}
+}
+
+func (h *handlerConfig) handlePutPart(ctx *fasthttp.RequestCtx, session *multipartSession, number int) {
+	releaseUploadSlot, ok := h.tryAcquireUploadSlot()
+	if !ok {
+		ctx.SetConnectionClose()
+		writeJSONErrorCode(ctx, fasthttp.StatusServiceUnavailable, api.CodeTooManyUploads, "too many concurrent uploads")
+		return
+	}
+	defer releaseUploadSlot()
+
+	upload := h.uploads.begin(ctx.RemoteAddr().String(), ctx.Conn())
+	defer h.uploads.finish(upload)
+	ctx.SetUserValue(uploadIDUserValue, upload.id)
+	upload.setFilename(fmt.Sprintf("%s (part %d)", session.name, number))
+
+	bodyConsumed := false
+	defer func() {
+		if !bodyConsumed {
+			ctx.SetConnectionClose()
+		}
+	}()
+
+	if err := h.preflight(&ctx.Request.Header, false); err != nil {
+		writePreflightError(ctx, err)
+		return
+	}
+	expected := strings.TrimSpace(string(ctx.Request.Header.Peek(api.HeaderChecksumSHA256)))
+	if expected == "" {
+		writeJSONError(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("%s header is required", api.HeaderChecksumSHA256))
+		return
+	}
+
+	session.mu.Lock()
+	completing := session.completing
+	session.mu.Unlock()
+	if completing {
+		writeJSONErrorCode(ctx, fasthttp.StatusConflict, api.CodeConflict, "upload is being completed")
+		return
+	}
+
+	src := &readErrRecorder{r: upload.reader(requestBody(ctx), h.bandwidth)}
+	part, err := h.storage.PutPart(session.id, number, src, expected)
+	switch {
+	case errors.Is(err, storage.ErrChecksumMismatch):
+		bodyConsumed = true
+		writeJSON(ctx, fasthttp.StatusUnprocessableEntity, api.ErrorResponse{
+			Status:           api.StatusError,
+			Code:             api.CodeChecksumMismatch,
+			Error:            fmt.Sprintf("checksum mismatch in part %d", number),
+			ExpectedChecksum: expected,
+			ActualChecksum:   part.SHA256,
+		})
+		return
+	case err != nil && (src.err != nil || upload.cancelled()):
+		h.writeReadError(ctx, upload, fmt.Sprintf("read part %d: %v", number, src.err))
+		return
+	case err != nil:
+		writeJSONError(ctx, fasthttp.StatusInternalServerError, fmt.Sprintf("store part %d: %v", number, err))
+		return
+	}
+	bodyConsumed = true
+
+	session.mu.Lock()
+	session.parts[number] = part
+	session.mu.Unlock()
+
+	writeJSON(ctx, fasthttp.StatusOK, api.PartResult{
+		Status:     api.StatusOK,
+		PartNumber: part.Number,
+		Size:       part.Size,
+		SHA256:     part.SHA256,
+	})
+}
+
+func (h *handlerConfig) handleMultipartComplete(ctx *fasthttp.RequestCtx, session *multipartSession) {
+	var req api.MultipartComplete
+	if err := decodeJSONBody(ctx, &req); err != nil {
+		writeJSONError(ctx, fasthttp.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Parts) == 0 {
+		writeJSONError(ctx, fasthttp.StatusBadRequest, "parts are required")
+		return
+	}
+	if req.SHA256 == "" {
+		writeJSONError(ctx, fasthttp.StatusBadRequest, "sha256 is required")
+		return
+	}
+	// The condition is checked before the parts are assembled and again on
+	// commit. A failed one keeps the parts, so the client may retry.
+	condition, err := uploadCondition(&ctx.Request.Header)
+	if err != nil {
+		writePreflightError(ctx, err)
+		return
+	}
+	if err := condition.Check(h.storage, session.name); err != nil {
+		writeStorageError(ctx, err)
+		return
+	}
+
+	session.mu.Lock()
+	if session.completing {
+		session.mu.Unlock()
+		writeJSONErrorCode(ctx, fasthttp.StatusConflict, api.CodeConflict, "upload is being completed")
+		return
+	}
+	numbers := make([]int, 0, len(req.Parts))
+	digests := make([]string, 0, len(req.Parts))
+	var totalBytes int64
+	var problem *api.ErrorResponse
+	for i, listed := range req.Parts {
+		stored, ok := session.parts[listed.PartNumber]
+		switch {
+		case i > 0 && listed.PartNumber <= numbers[i-1]:
+			problem = &api.ErrorResponse{Code: api.CodeBadRequest, Error: "parts must be listed in ascending order"}
+		case !ok:
+			problem = &api.ErrorResponse{Code: api.CodeBadRequest, Error: fmt.Sprintf("part %d was not uploaded", listed.PartNumber)}
+		case stored.SHA256 != listed.SHA256:
+			problem = &api.ErrorResponse{
+				Code:             api.CodeChecksumMismatch,
+				Error:            fmt.Sprintf("checksum mismatch in part %d", listed.PartNumber),
+				ExpectedChecksum: listed.SHA256,
+				ActualChecksum:   stored.SHA256,
+			}
+		}
+		if problem != nil {
+			break
+		}
+		numbers = append(numbers, listed.PartNumber)
+		digests = append(digests, stored.SHA256)
+		totalBytes += stored.Size
+	}
+	if problem == nil {
+		session.completing = true
+	}
+	session.mu.Unlock()
+	if problem != nil {
+		writeMultipartProblem(ctx, *problem)
+		return
+	}
+
+	completed := false
+	defer func() {
+		if !completed {
+			session.mu.Lock()
+			session.completing = false
+			session.mu.Unlock()
+		}
+	}()
+
+	composite, err := api.CompositeSHA256(digests)
+	if err != nil {
+		writeJSONError(ctx, fasthttp.StatusInternalServerError, err.Error())
+		return
+	}
+	if req.CompositeSHA256 != "" && req.CompositeSHA256 != composite {
+		writeMultipartProblem(ctx, api.ErrorResponse{
+			Code:             api.CodeChecksumMismatch,
+			Error:            "composite checksum mismatch",
+			ExpectedChecksum: req.CompositeSHA256,
+			ActualChecksum:   composite,
+		})
+		return
+	}
+
+	staged, err := h.storage.AssembleParts(session.name, session.id, numbers)
+	if err != nil {
+		writeJSONError(ctx, fasthttp.StatusInternalServerError, fmt.Sprintf("assemble upload: %v", err))
+		return
+	}
+	defer func() {
+		if err := staged.Discard(); err != nil {
+			slog.Warn("discard staged upload", "error", err)
+		}
+	}()
+	if sha := staged.Object().SHA256; sha != req.SHA256 {
+		writeMultipartProblem(ctx, api.ErrorResponse{
+			Code:             api.CodeChecksumMismatch,
+			Error:            "checksum mismatch",
+			ExpectedChecksum: req.SHA256,
+			ActualChecksum:   sha,
+		})
+		return
+	}
+	if err := h.hooks.check(staged, session.metadata, ctx.RemoteAddr().String()); err != nil {
+		writePreflightError(ctx, err)
+		return
+	}
+	staged.SetMetadata(session.metadata)
+	staged.SetExpiresAt(expiresAt(session.fileTTL))
+	staged.SetCondition(condition)
+	stored, err := staged.Commit()
+	if errors.Is(err, storage.ErrPreconditionFailed) {
+		writeStorageError(ctx, err)
+		return
+	}
+	if err != nil {
+		writeJSONError(ctx, fasthttp.StatusInternalServerError, fmt.Sprintf("store uploaded file %q: %v", session.name, err))
+		return
+	}
+	completed = true
+
+	h.multipart.remove(session.id)
+	if err := h.storage.DeleteParts(session.id); err != nil {
+		slog.Warn("delete multipart parts", "upload_id", session.id, "error", err)
+	}
+
+	summary := uploadSummary{
+		files:           []api.UploadedFile{uploadedFile(session.name, stored)},
+		size:            totalBytes,
+		elapsed:         time.Since(session.createdAt),
+		sha256:          req.SHA256,
+		compositeSHA256: composite,
+	}
+
+	slog.Info("multipart upload complete",
+		"upload_id", session.id,
+		"name", session.name,
+		"parts", len(numbers),
+		"size", format.Bytes(totalBytes),
+		"duration", summary.elapsed.Round(time.Millisecond).String(),
+		"speed", format.BytesPerSecond(summary.throughput()),
+		"sha256", req.SHA256,
+		"composite_sha256", composite,
+	)
+	event := multipartEvent(api.EventUploadCompleted, session, ctx.RemoteAddr().String())
+	event.Files = summary.files
+	event.Size = totalBytes
+	event.SHA256 = req.SHA256
+	h.webhooks.Publish(event)
+
+	writeUploadResult(ctx, summary)
+}
+
+func (h *handlerConfig) handleMultipartAbort(ctx *fasthttp.RequestCtx, session *multipartSession) {
+	session.mu.Lock()
+	completing := session.completing
+	session.mu.Unlock()
+	if completing {
+		writeJSONErrorCode(ctx, fasthttp.StatusConflict, api.CodeConflict, "upload is being completed")
+		return
+	}
+
+	h.multipart.remove(session.id)
+	if err := h.storage.DeleteParts(session.id); err != nil {
+		writeJSONError(ctx, fasthttp.StatusInternalServerError, err.Error())
+		return
+	}
+	slog.Info("multipart upload aborted", "upload_id", session.id, "name", session.name)
+	event := multipartEvent(api.EventUploadFailed, session, ctx.RemoteAddr().String())
+	event.Code = api.CodeCancelled
+	event.Reason = "multipart upload aborted"
+	h.webhooks.Publish(event)
+
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// cleanupMultipart removes expired sessions and part directories left behind
+// by sessions this process does not know, e.g. from before a restart.
+func (h *handlerConfig) cleanupMultipart() {
+	for _, session := range h.multipart.removeExpired() {
+		if err := h.storage.DeleteParts(session.id); err != nil {
+			slog.Warn("delete expired multipart upload", "upload_id", session.id, "error", err)
+			continue
+		}
+		slog.Info("multipart upload expired", "upload_id", session.id)
+		event := multipartEvent(api.EventUploadFailed, session, "")
+		event.Code = api.CodeCancelled
+		event.Reason = "multipart upload expired"
+		h.webhooks.Publish(event)
+	}
+
+	dirs, err := h.storage.ListMultipart()
+	if err != nil {
+		slog.Warn("list multipart uploads", "error", err)
+		return
+	}
+	cutoff := h.multipart.now().Add(-h.multipart.ttl)
+	for _, dir := range dirs {
+		if h.multipart.has(dir.UploadID) || dir.ModTime.After(cutoff) {
+			continue
+		}
+		if err := h.storage.DeleteParts(dir.UploadID); err != nil {
+			slog.Warn("delete abandoned multipart upload", "upload_id", dir.UploadID, "error", err)
+			continue
+		}
+		slog.Info("abandoned multipart upload removed", "upload_id", dir.UploadID)
+	}
+}
+
+// runMultipartJanitor calls cleanupMultipart periodically until ctx is done.
+func (h *handlerConfig) runMultipartJanitor(ctx context.Context) {
+	interval := min(h.multipart.ttl/4, time.Minute)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	h.cleanupMultipart()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.cleanupMultipart()
+		}
+	}
+}
+
+func writeMultipartProblem(ctx *fasthttp.RequestCtx, problem api.ErrorResponse) {
+	status := fasthttp.StatusBadRequest
+	if problem.Code == api.CodeChecksumMismatch {
+		status = fasthttp.StatusUnprocessableEntity
+	}
+	problem.Status = api.StatusError
+
+	writeJSON(ctx, status, problem)
+}
+
+// decodeJSONBody reads a small JSON request body, which may arrive as a
+// stream.
+func decodeJSONBody(ctx *fasthttp.RequestCtx, v any) error {
+	body, err := io.ReadAll(io.LimitReader(requestBody(ctx), maxMultipartRequestSize+1))
+	if err != nil {
+		return fmt.Errorf("read request body: %w", err)
+	}
+	if len(body) > maxMultipartRequestSize {
+		return errors.New("request body too large")
+	}
+	if err := sonic.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("decode request body: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/client/uploader"
+
+	"github.com/bytedance/sonic"
+	"github.com/valyala/fasthttp"
+)
+
+func doMultipartRequest(h *handlerConfig, method, path, checksum string, body []byte) *fasthttp.RequestCtx {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(path)
+	if checksum != "" {
+		ctx.Request.Header.Set(api.HeaderChecksumSHA256, checksum)
+	}
+	ctx.Request.SetBody(body)
+	ctx.Request.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+testAuthToken)
+	h.handler(&ctx)
+
+	return &ctx
+}
+
+func startTestMultipart(t *testing.T, h *handlerConfig, name string) string {
+	t.Helper()
+
+	ctx := doMultipartRequest(h, fasthttp.MethodPost, uploadsPath, "", []byte(`{"name":"`+name+`"}`))
+	if ctx.Response.StatusCode() != fasthttp.StatusCreated {
+		t.Fatalf("unexpected init status: got %d want %d: %s", ctx.Response.StatusCode(), fasthttp.StatusCreated, ctx.Response.Body())
+	}
+	var session api.MultipartSession
+	if err := sonic.Unmarshal(ctx.Response.Body(), &session); err != nil {
+		t.Fatalf("decode session: %v", err)
+	}
+
+	return session.UploadID
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestMultipartUpload(t *testing.T) {
+	uploadHandler, client := newTestServer(t)
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 640)
+	localPath := filepath.Join(t.TempDir(), "big.bin")
+	if err := os.WriteFile(localPath, content, 0o600); err != nil {
+		t.Fatalf("write temp file: %v", err)
+	}
+
+	resp, err := client.UploadMultipartContext(context.Background(), uploader.MultipartUploadRequest{
+		URL:         "http://inmemory/uploads",
+		FilePath:    localPath,
+		PartSize:    1000,
+		Concurrency: 3,
+		Metadata:    map[string]string{"build-id": "42"},
+	})
+	if err != nil {
+		t.Fatalf("multipart upload: %v", err)
+	}
+	if resp.StatusCode != fasthttp.StatusCreated {
+		t.Fatalf("unexpected status: got %d want %d: %s", resp.StatusCode, fasthttp.StatusCreated, resp.Body)
+	}
+	if resp.Result == nil || resp.Result.SHA256 != sha256Hex(content) {
+		t.Fatalf("unexpected result: %+v", resp.Result)
+	}
+	if !strings.HasSuffix(resp.Result.CompositeSHA256, "-11") {
+		t.Fatalf("unexpected composite checksum: got %q want an 11 part suffix", resp.Result.CompositeSHA256)
+	}
+
+	reader, obj, err := uploadHandler.storage.Open("big.bin")
+	if err != nil {
+		t.Fatalf("open stored file: %v", err)
+	}
+	if obj.Metadata["build-id"] != "42" {
+		t.Fatalf("unexpected metadata: %v", obj.Metadata)
+	}
+	stored, err := io.ReadAll(reader)
+	_ = reader.Close()
+	if err != nil {
+		t.Fatalf("read stored file: %v", err)
+	}
+	if !bytes.Equal(stored, content) {
+		t.Fatal("stored content mismatch")
+	}
+
+	dirs, err := uploadHandler.storage.ListMultipart()
+	if err != nil {
+		t.Fatalf("list multipart uploads: %v", err)
+	}
+	if len(dirs) != 0 {
+		t.Fatalf("parts left behind after complete: %+v", dirs)
+	}
+}
+
+func TestMultipartRejectsBadParts(t *testing.T) {
+	uploadHandler, _ := newTestServer(t)
+	id := startTestMultipart(t, uploadHandler, "a.bin")
+	partPath := uploadsPath + "/" + id + "/parts/1"
+
+	ctx := doMultipartRequest(uploadHandler, fasthttp.MethodPut, partPath, "", []byte("part"))
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Fatalf("part without checksum: got %d want %d", ctx.Response.StatusCode(), fasthttp.StatusBadRequest)
+	}
+
+	ctx = doMultipartRequest(uploadHandler, fasthttp.MethodPut, partPath, sha256Hex([]byte("other")), []byte("part"))
+	if ctx.Response.StatusCode() != fasthttp.StatusUnprocessableEntity {
+		t.Fatalf("corrupt part: got %d want %d: %s", ctx.Response.StatusCode(), fasthttp.StatusUnprocessableEntity, ctx.Response.Body())
+	}
+	var problem api.ErrorResponse
+	if err := sonic.Unmarshal(ctx.Response.Body(), &problem); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if problem.Code != api.CodeChecksumMismatch || problem.ActualChecksum != sha256Hex([]byte("part")) {
+		t.Fatalf("unexpected error: %+v", problem)
+	}
+
+	ctx = doMultipartRequest(uploadHandler, fasthttp.MethodPost, uploadsPath+"/"+id+"/complete", "",
+		[]byte(`{"parts":[{"part_number":1,"sha256":"`+sha256Hex([]byte("part"))+`"}],"sha256":"`+sha256Hex([]byte("part"))+`"}`))
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Fatalf("complete with a rejected part: got %d want %d: %s", ctx.Response.StatusCode(), fasthttp.StatusBadRequest, ctx.Response.Body())
+	}
+
+	ctx = doMultipartRequest(uploadHandler, fasthttp.MethodPut, partPath, sha256Hex([]byte("part")), []byte("part"))
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("retried part: got %d want %d: %s", ctx.Response.StatusCode(), fasthttp.StatusOK, ctx.Response.Body())
+	}
+	ctx = doMultipartRequest(uploadHandler, fasthttp.MethodPost, uploadsPath+"/"+id+"/complete", "",
+		[]byte(`{"parts":[{"part_number":1,"sha256":"`+sha256Hex([]byte("part"))+`"}],"sha256":"`+sha256Hex([]byte("whole"))+`"}`))
+	if ctx.Response.StatusCode() != fasthttp.StatusUnprocessableEntity {
+		t.Fatalf("complete with a wrong file checksum: got %d want %d: %s", ctx.Response.StatusCode(), fasthttp.StatusUnprocessableEntity, ctx.Response.Body())
+	}
+	if _, err := uploadHandler.storage.Stat("a.bin"); err == nil {
+		t.Fatal("file with a wrong checksum was stored")
+	}
+}
+
+func TestMultipartAbortAndExpiry(t *testing.T) {
+	uploadHandler, _ := newTestServer(t)
+	body := []byte("part")
+
+	aborted := startTestMultipart(t, uploadHandler, "a.bin")
+	doMultipartRequest(uploadHandler, fasthttp.MethodPut, uploadsPath+"/"+aborted+"/parts/1", sha256Hex(body), body)
+	ctx := doMultipartRequest(uploadHandler, fasthttp.MethodDelete, uploadsPath+"/"+aborted, "", nil)
+	if ctx.Response.StatusCode() != fasthttp.StatusNoContent {
+		t.Fatalf("abort: got %d want %d: %s", ctx.Response.StatusCode(), fasthttp.StatusNoContent, ctx.Response.Body())
+	}
+	ctx = doMultipartRequest(uploadHandler, fasthttp.MethodPut, uploadsPath+"/"+aborted+"/parts/2", sha256Hex(body), body)
+	if ctx.Response.StatusCode() != fasthttp.StatusNotFound {
+		t.Fatalf("part after abort: got %d want %d", ctx.Response.StatusCode(), fasthttp.StatusNotFound)
+	}
+
+	expired := startTestMultipart(t, uploadHandler, "b.bin")
+	doMultipartRequest(uploadHandler, fasthttp.MethodPut, uploadsPath+"/"+expired+"/parts/1", sha256Hex(body), body)
+	now := time.Now().Add(defaultMultipartTTL + time.Minute)
+	uploadHandler.multipart.now = func() time.Time { return now }
+	uploadHandler.cleanupMultipart()
+
+	if uploadHandler.multipart.has(expired) {
+		t.Fatal("expired upload is still tracked")
+	}
+	dirs, err := uploadHandler.storage.ListMultipart()
+	if err != nil {
+		t.Fatalf("list multipart uploads: %v", err)
+	}
+	if len(dirs) != 0 {
+		t.Fatalf("parts left behind: %+v", dirs)
+	}
+}
+
+func TestUploadMultipartAbortsOnFailure(t *testing.T) {
+	uploadHandler, client := newTestServer(t)
+
+	localPath := filepath.Join(t.TempDir(), "big.bin")
+	if err := os.WriteFile(localPath, bytes.Repeat([]byte("x"), 3000), 0o600); err != nil {
+		t.Fatalf("write temp file: %v", err)
+	}
+
+	// With every upload slot taken, all parts are refused.
+	release, ok := uploadHandler.tryAcquireUploadSlot()
+	for ok {
+		defer release()
+		release, ok = uploadHandler.tryAcquireUploadSlot()
+	}
+
+	_, err := client.UploadMultipartContext(context.Background(), uploader.MultipartUploadRequest{
+		URL:      "http://inmemory/uploads",
+		FilePath: localPath,
+		PartSize: 1000,
+	})
+	if !errors.Is(err, uploader.ErrTooManyUploads) {
+		t.Fatalf("expected too many uploads, got %v", err)
+	}
+	dirs, err := uploadHandler.storage.ListMultipart()
+	if err != nil {
+		t.Fatalf("list multipart uploads: %v", err)
+	}
+	if len(dirs) != 0 || len(uploadHandler.multipart.sessions) != 0 {
+		t.Fatalf("failed upload was not aborted: dirs %+v sessions %d", dirs, len(uploadHandler.multipart.sessions))
+	}
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/server/format"
+
+	"github.com/valyala/fasthttp"
+)
+
+// PreflightCheck inspects the headers of an upload before its body is read,
+// e.g. to authenticate the client or enforce a quota. Returning a
+// *PreflightError selects the status code of the rejection; any other error
+// rejects with 403.
+type PreflightCheck func(header *fasthttp.RequestHeader) error
+
+// PreflightError rejects an upload with StatusCode and Message. Code is the
+// api error code sent to the client; when empty it follows from StatusCode.
+type PreflightError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *PreflightError) Error() string {
+	return e.Message
+}
+
+// preflightReason labels rejections in metrics without the variable detail.
+func preflightReason(err error) string {
+	var preflightErr *PreflightError
+	if !errors.As(err, &preflightErr) {
+		return "custom"
+	}
+	if code := preflightCode(err); code != "" {
+		return code
+	}
+
+	return strconv.Itoa(preflightErr.StatusCode)
+}
+
+func preflightStatus(err error) int {
+	var preflightErr *PreflightError
+	if errors.As(err, &preflightErr) {
+		return preflightErr.StatusCode
+	}
+
+	return fasthttp.StatusForbidden
+}
+
+func preflightCode(err error) string {
+	var preflightErr *PreflightError
+	if errors.As(err, &preflightErr) && preflightErr.Code != "" {
+		return preflightErr.Code
+	}
+
+	return api.CodeForStatus(preflightStatus(err))
+}
+
+func writePreflightError(ctx *fasthttp.RequestCtx, err error) {
+	writeJSONErrorCode(ctx, preflightStatus(err), preflightCode(err), err.Error())
+}
+
+// isUploadRequest tells whether header belongs to POST /upload or to a part
+// upload; the ContinueHandler sees every request of the server.
+func isUploadRequest(header *fasthttp.RequestHeader) bool {
+	if !header.IsPost() && !header.IsPut() {
+		return false
+	}
+
+	var uri fasthttp.URI
+	if err := uri.Parse(nil, header.RequestURI()); err != nil {
+		return false
+	}
+	path := string(uri.Path())
+
+	if header.IsPut() {
+		return strings.HasPrefix(path, uploadsPathSlash)
+	}
+
+	return path == uploadPath
+}
+
+// preflight runs every check that needs nothing but the request headers.
+// Slot availability and the request rate are only peeked at here; the
+// handler acquires the slot and takes the rate token once the body arrives.
+func (h *handlerConfig) preflight(header *fasthttp.RequestHeader, checkSlots bool) error {
+	if h.draining.Load() {
+		return &PreflightError{StatusCode: fasthttp.StatusServiceUnavailable, Code: api.CodeShuttingDown, Message: "server is shutting down"}
+	}
+	if checkSlots && !h.uploadSlots.available() {
+		return &PreflightError{StatusCode: fasthttp.StatusServiceUnavailable, Code: api.CodeTooManyUploads, Message: "too many concurrent uploads"}
+	}
+	if !h.requestRate.allow(!checkSlots) {
+		return &PreflightError{StatusCode: fasthttp.StatusTooManyRequests, Code: api.CodeTooManyUploads, Message: "upload rate limit exceeded"}
+	}
+
+	size, err := declaredUploadSize(header)
+	if err != nil {
+		return err
+	}
+	if size > 0 {
+		if h.maxRequestBodySize > 0 && size > h.maxRequestBodySize {
+			return &PreflightError{
+				StatusCode: fasthttp.StatusRequestEntityTooLarge,
+				Message:    fmt.Sprintf("upload of %s exceeds the limit of %s", format.Bytes(size), format.Bytes(h.maxRequestBodySize)),
+			}
+		}
+		if err := h.checkSpaceFor(size); err != nil {
+			return err
+		}
+	}
+
+	if _, err := h.uploadTTL(string(header.Peek(api.HeaderUploadTTL))); err != nil {
+		return err
+	}
+	if _, err := uploadCondition(header); err != nil {
+		return err
+	}
+	if _, err := h.extractPrefix(header); err != nil {
+		return err
+	}
+
+	for _, check := range h.preflightChecks {
+		if err := check(header); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *handlerConfig) checkSpaceFor(size int64) error {
+	if h.storage == nil {
+		return nil
+	}
+
+	// Failing to read free space is reported by /readyz; it must not block
+	// uploads on its own.
+	free, err := h.storage.FreeSpace()
+	if err != nil {
+		return nil
+	}
+	if uint64(size)+h.minFreeSpace.Load() > free {
+		return &PreflightError{
+			StatusCode: fasthttp.StatusInsufficientStorage,
+			Message:    fmt.Sprintf("not enough storage for %s", format.Bytes(size)),
+		}
+	}
+
+	return nil
+}
+
+// declaredUploadSize returns the size announced by the client, preferring the
+// payload size over Content-Length, which also counts multipart framing.
+// Zero means unknown.
+func declaredUploadSize(header *fasthttp.RequestHeader) (int64, error) {
+	if raw := header.Peek(api.HeaderUploadSize); len(raw) > 0 {
+		size, err := strconv.ParseInt(string(raw), 10, 64)
+		if err != nil || size < 0 {
+			return 0, &PreflightError{StatusCode: fasthttp.StatusBadRequest, Message: fmt.Sprintf("invalid %s header", api.HeaderUploadSize)}
+		}
+		return size, nil
+	}
+	// S3 clients announce the payload size of aws-chunked bodies here.
+	if raw := header.Peek(headerAmzDecodedContentLength); len(raw) > 0 {
+		size, err := strconv.ParseInt(string(raw), 10, 64)
+		if err != nil || size < 0 {
+			return 0, &PreflightError{StatusCode: fasthttp.StatusBadRequest, Message: fmt.Sprintf("invalid %s header", headerAmzDecodedContentLength)}
+		}
+		return size, nil
+	}
+	if contentLength := header.ContentLength(); contentLength > 0 {
+		return int64(contentLength), nil
+	}
+
+	return 0, nil
+}
+
+// continueHandler answers Expect: 100-continue. A rejected client receives
+// 417 without ever sending the body; fasthttp gives no way to attach the
+// reason, so it is logged and counted instead. Clients that want the status
+// and JSON error of the rejection send the upload without Expect.
+func (s *Server) continueHandler(header *fasthttp.RequestHeader) bool {
+	if !isUploadRequest(header) {
+		return true
+	}
+
+	err := s.uploadHandler.checkToken(header)
+	if err == nil {
+		_, err = s.uploadHandler.checkPresignedUpload(header)
+	}
+	if err == nil {
+		err = s.uploadHandler.preflight(header, true)
+	}
+	if err == nil {
+		return true
+	}
+
+	s.preflightRejections.Inc(preflightReason(err))
+	slog.Info("upload rejected before body",
+		"status", preflightStatus(err),
+		"error", err.Error(),
+		"declared_size", string(header.Peek(api.HeaderUploadSize)),
+	)
+
+	return false
+}
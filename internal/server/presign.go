@@ -0,0 +1,237 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/server/format"
+	"client-server-fasthttp-test/internal/server/presign"
+	"client-server-fasthttp-test/internal/server/storage"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	adminPresignPath = "/admin/presign"
+	// defaultPresignTTL applies to pre-signed URLs requested without a TTL.
+	defaultPresignTTL    = 15 * time.Minute
+	defaultPresignMaxTTL = 24 * time.Hour
+)
+
+var errPresignedSizeExceeded = errors.New("upload exceeds the size allowed by the pre-signed URL")
+
+// presigner issues and verifies pre-signed URLs. Upload URLs work once: the
+// grants already used are remembered until they expire. The record is kept
+// in memory, so a URL can be used once per server process.
+type presigner struct {
+	mu     sync.Mutex
+	secret []byte
+	// required rejects requests to the upload and file endpoints that are
+	// not made with a pre-signed URL.
+	required bool
+	maxTTL   time.Duration
+	used     map[presign.Grant]struct{}
+	now      func() time.Time
+}
+
+func newPresigner() *presigner {
+	return &presigner{
+		maxTTL: defaultPresignMaxTTL,
+		used:   make(map[presign.Grant]struct{}),
+		now:    time.Now,
+	}
+}
+
+// setSecret replaces the HMAC key, which invalidates every URL signed with
+// the previous one. An empty secret disables pre-signed URLs.
+func (p *presigner) setSecret(secret string) {
+	p.mu.Lock()
+	p.secret = []byte(secret)
+	p.mu.Unlock()
+}
+
+func (p *presigner) key() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.secret
+}
+
+// grant verifies the pre-signed URL a request was made with. Other requests
+// get a nil grant, or are rejected when pre-signed URLs are required.
+func (p *presigner) grant(header *fasthttp.RequestHeader) (*presign.Grant, error) {
+	var uri fasthttp.URI
+	if err := uri.Parse(nil, header.RequestURI()); err != nil {
+		return nil, &PreflightError{StatusCode: fasthttp.StatusBadRequest, Message: "invalid request URI"}
+	}
+	query, err := url.ParseQuery(string(uri.QueryString()))
+	switch {
+	case err != nil && (p.required || presign.IsPresigned(query)):
+		return nil, &PreflightError{StatusCode: fasthttp.StatusForbidden, Message: presign.ErrMalformed.Error()}
+	case err != nil || !presign.IsPresigned(query):
+		if p.required {
+			return nil, &PreflightError{StatusCode: fasthttp.StatusUnauthorized, Message: "a pre-signed URL is required"}
+		}
+		return nil, nil
+	}
+
+	secret := p.key()
+	if len(secret) == 0 {
+		return nil, &PreflightError{StatusCode: fasthttp.StatusForbidden, Message: "pre-signed URLs are disabled"}
+	}
+	grant, err := presign.Verify(secret, string(header.Method()), string(uri.Path()), query, p.now())
+	if err != nil {
+		return nil, &PreflightError{StatusCode: fasthttp.StatusForbidden, Message: err.Error()}
+	}
+
+	return &grant, nil
+}
+
+// isUsed reports whether the upload URL of grant has been used already.
+func (p *presigner) isUsed(grant presign.Grant) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, used := p.used[grant]
+	return used
+}
+
+// reserve marks the upload URL of grant as used. release undoes it for an
+// upload that failed, so that the URL can be retried.
+func (p *presigner) reserve(grant presign.Grant) (release func(), err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	for used := range p.used {
+		if !now.Before(used.ExpiresAt) {
+			delete(p.used, used)
+		}
+	}
+	if _, used := p.used[grant]; used {
+		return nil, &PreflightError{StatusCode: fasthttp.StatusForbidden, Message: "pre-signed URL has already been used"}
+	}
+	p.used[grant] = struct{}{}
+
+	return func() {
+		p.mu.Lock()
+		delete(p.used, grant)
+		p.mu.Unlock()
+	}, nil
+}
+
+// issue signs a URL for req, see api.PresignRequest. The TTL is capped at
+// maxTTL.
+func (p *presigner) issue(req api.PresignRequest) (presign.Grant, string, error) {
+	secret := p.key()
+	if len(secret) == 0 {
+		return presign.Grant{}, "", &PreflightError{StatusCode: fasthttp.StatusServiceUnavailable, Code: api.CodeUnavailable, Message: "pre-signed URLs are disabled"}
+	}
+	if err := storage.ValidateName(req.Name); err != nil {
+		return presign.Grant{}, "", &PreflightError{StatusCode: fasthttp.StatusBadRequest, Message: err.Error()}
+	}
+	if req.MaxSize < 0 {
+		return presign.Grant{}, "", &PreflightError{StatusCode: fasthttp.StatusBadRequest, Message: "max_size must not be negative"}
+	}
+
+	grant := presign.Grant{Method: strings.ToUpper(req.Method)}
+	switch grant.Method {
+	case fasthttp.MethodPost:
+		grant.Path = uploadPath
+		grant.Name = req.Name
+		grant.MaxSize = req.MaxSize
+	case fasthttp.MethodGet:
+		if req.MaxSize != 0 {
+			return presign.Grant{}, "", &PreflightError{StatusCode: fasthttp.StatusBadRequest, Message: "max_size only applies to uploads"}
+		}
+		grant.Path = filesPathSlash + req.Name
+	default:
+		return presign.Grant{}, "", &PreflightError{StatusCode: fasthttp.StatusBadRequest, Message: fmt.Sprintf("method %q cannot be pre-signed, expected POST or GET", req.Method)}
+	}
+
+	ttl := defaultPresignTTL
+	if req.TTL != "" {
+		parsed, err := time.ParseDuration(req.TTL)
+		if err != nil || parsed <= 0 {
+			return presign.Grant{}, "", &PreflightError{StatusCode: fasthttp.StatusBadRequest, Message: fmt.Sprintf("invalid ttl %q: expected a positive duration such as 15m", req.TTL)}
+		}
+		ttl = parsed
+	}
+	grant.ExpiresAt = p.now().Add(min(ttl, p.maxTTL)).Truncate(time.Second)
+
+	return grant, presign.URL(secret, grant), nil
+}
+
+// checkPresignedUpload verifies the pre-signed URL of an upload from its
+// headers: it must grant the request, be unused and allow the declared size.
+// Uploads without one get a nil grant.
+func (h *handlerConfig) checkPresignedUpload(header *fasthttp.RequestHeader) (*presign.Grant, error) {
+	grant, err := h.presign.grant(header)
+	if err != nil || grant == nil {
+		return nil, err
+	}
+	if h.presign.isUsed(*grant) {
+		return nil, &PreflightError{StatusCode: fasthttp.StatusForbidden, Message: "pre-signed URL has already been used"}
+	}
+	// Content-Length includes the multipart framing, so only the payload
+	// size is compared.
+	if grant.MaxSize > 0 && len(header.Peek(api.HeaderUploadSize)) > 0 {
+		size, err := declaredUploadSize(header)
+		if err != nil {
+			return nil, err
+		}
+		if size > grant.MaxSize {
+			return nil, &PreflightError{
+				StatusCode: fasthttp.StatusRequestEntityTooLarge,
+				Message:    fmt.Sprintf("upload of %s exceeds the %s allowed by the pre-signed URL", format.Bytes(size), format.Bytes(grant.MaxSize)),
+			}
+		}
+	}
+
+	return grant, nil
+}
+
+// presigned wraps the handlers of the file and multipart endpoints: a
+// request made with a pre-signed URL must be granted by it, and with
+// pre-signed URLs required every other request is rejected.
+func (h *handlerConfig) presigned(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if _, err := h.presign.grant(&ctx.Request.Header); err != nil {
+			writePreflightError(ctx, err)
+			return
+		}
+
+		next(ctx)
+	}
+}
+
+// maxSizeReader fails with errPresignedSizeExceeded once more than remaining
+// bytes have been read.
+type maxSizeReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (r *maxSizeReader) Read(p []byte) (int, error) {
+	if r.remaining < 0 {
+		return 0, errPresignedSizeExceeded
+	}
+	// One byte past the limit tells an oversized file from one that ends
+	// exactly at it.
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.r.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n, errPresignedSizeExceeded
+	}
+
+	return n, err
+}
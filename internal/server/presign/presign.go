@@ -0,0 +1,131 @@
+// Package presign signs and verifies the pre-signed URLs of the upload
+// server: an HMAC-SHA256 over the method, path, file name, size limit and
+// expiry a URL grants, carried in its query.
+package presign
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"client-server-fasthttp-test/internal/api"
+)
+
+const Algorithm = "UPLOAD-HMAC-SHA256"
+
+var (
+	ErrMalformed         = errors.New("malformed pre-signed URL")
+	ErrSignatureMismatch = errors.New("pre-signed URL signature mismatch")
+	ErrExpired           = errors.New("pre-signed URL expired")
+)
+
+// Grant is what a pre-signed URL allows: requests with Method to Path until
+// ExpiresAt. Name and MaxSize restrict uploads and are empty for downloads.
+type Grant struct {
+	Method    string
+	Path      string
+	Name      string
+	MaxSize   int64
+	ExpiresAt time.Time
+}
+
+// IsPresigned reports whether query belongs to a pre-signed URL.
+func IsPresigned(query url.Values) bool {
+	return query.Has(api.PresignSignatureParam)
+}
+
+// URL returns the path and query of the URL granting g, signed with secret.
+// ExpiresAt is truncated to the second.
+func URL(secret []byte, g Grant) string {
+	query := url.Values{}
+	query.Set(api.PresignExpiresParam, strconv.FormatInt(g.ExpiresAt.Unix(), 10))
+	if g.Name != "" {
+		query.Set(api.PresignNameParam, g.Name)
+	}
+	if g.MaxSize > 0 {
+		query.Set(api.PresignMaxSizeParam, strconv.FormatInt(g.MaxSize, 10))
+	}
+	query.Set(api.PresignSignatureParam, Signature(secret, g))
+
+	return (&url.URL{Path: g.Path, RawQuery: query.Encode()}).String()
+}
+
+// Signature is the hex HMAC-SHA256 of g.
+func Signature(secret []byte, g Grant) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(g.stringToSign()))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (g Grant) stringToSign() string {
+	return strings.Join([]string{
+		Algorithm,
+		g.Method,
+		g.Path,
+		g.Name,
+		strconv.FormatInt(g.MaxSize, 10),
+		strconv.FormatInt(g.ExpiresAt.Unix(), 10),
+	}, "\n")
+}
+
+// Verify checks a request with method to path made with a pre-signed URL,
+// whose query is query, and returns the grant. A GET grant also allows HEAD.
+// Query parameters the signature does not cover are rejected, as they could
+// change what the request does.
+func Verify(secret []byte, method, path string, query url.Values, now time.Time) (Grant, error) {
+	for key, values := range query {
+		switch key {
+		case api.PresignExpiresParam, api.PresignNameParam, api.PresignMaxSizeParam, api.PresignSignatureParam:
+		default:
+			return Grant{}, ErrMalformed
+		}
+		if len(values) != 1 {
+			return Grant{}, ErrMalformed
+		}
+	}
+
+	expires, err := strconv.ParseInt(query.Get(api.PresignExpiresParam), 10, 64)
+	if err != nil {
+		return Grant{}, ErrMalformed
+	}
+	var maxSize int64
+	if raw := query.Get(api.PresignMaxSizeParam); raw != "" {
+		maxSize, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || maxSize <= 0 {
+			return Grant{}, ErrMalformed
+		}
+	}
+	signature, err := hex.DecodeString(query.Get(api.PresignSignatureParam))
+	if err != nil || len(signature) != sha256.Size {
+		return Grant{}, ErrMalformed
+	}
+
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	g := Grant{
+		Method:    method,
+		Path:      path,
+		Name:      query.Get(api.PresignNameParam),
+		MaxSize:   maxSize,
+		ExpiresAt: time.Unix(expires, 0),
+	}
+	expected, _ := hex.DecodeString(Signature(secret, g))
+	if !hmac.Equal(signature, expected) {
+		return Grant{}, ErrSignatureMismatch
+	}
+	// Checked after the signature, so that the expiry of a forged URL is
+	// never reported.
+	if !now.Before(g.ExpiresAt) {
+		return Grant{}, ErrExpired
+	}
+
+	return g, nil
+}
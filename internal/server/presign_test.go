@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/client/uploader"
+	serverconfig "client-server-fasthttp-test/internal/server/config"
+	"client-server-fasthttp-test/internal/server/presign"
+
+	"github.com/bytedance/sonic"
+	"github.com/valyala/fasthttp"
+)
+
+var testPresignSecret = strings.Repeat("k", 32)
+
+func TestPresignVerify(t *testing.T) {
+	secret := []byte(testPresignSecret)
+	now := time.Unix(1_700_000_000, 0)
+	grant := presign.Grant{Method: fasthttp.MethodPost, Path: uploadPath, Name: "a b.bin", MaxSize: 10, ExpiresAt: now.Add(time.Minute)}
+
+	rawURL := presign.URL(secret, grant)
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("parse %q: %v", rawURL, err)
+	}
+	got, err := presign.Verify(secret, fasthttp.MethodPost, u.Path, u.Query(), now)
+	if err != nil || got != grant {
+		t.Fatalf("verify: got %+v %v want %+v", got, err, grant)
+	}
+
+	tamper := func(key, value string) url.Values {
+		query := u.Query()
+		query.Set(key, value)
+		return query
+	}
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		query  url.Values
+		now    time.Time
+		want   error
+	}{
+		{name: "other method", method: fasthttp.MethodPut, path: u.Path, query: u.Query(), now: now, want: presign.ErrSignatureMismatch},
+		{name: "other path", method: fasthttp.MethodPost, path: uploadsPath, query: u.Query(), now: now, want: presign.ErrSignatureMismatch},
+		{name: "other name", method: fasthttp.MethodPost, path: u.Path, query: tamper(api.PresignNameParam, "b.bin"), now: now, want: presign.ErrSignatureMismatch},
+		{name: "larger size", method: fasthttp.MethodPost, path: u.Path, query: tamper(api.PresignMaxSizeParam, "11"), now: now, want: presign.ErrSignatureMismatch},
+		{name: "later expiry", method: fasthttp.MethodPost, path: u.Path, query: tamper(api.PresignExpiresParam, "1800000000"), now: now, want: presign.ErrSignatureMismatch},
+		{name: "extra parameter", method: fasthttp.MethodPost, path: u.Path, query: tamper("versions", ""), now: now, want: presign.ErrMalformed},
+		{name: "bad signature", method: fasthttp.MethodPost, path: u.Path, query: tamper(api.PresignSignatureParam, "zz"), now: now, want: presign.ErrMalformed},
+		{name: "expired", method: fasthttp.MethodPost, path: u.Path, query: u.Query(), now: grant.ExpiresAt, want: presign.ErrExpired},
+	} {
+		if _, err := presign.Verify(secret, tc.method, tc.path, tc.query, tc.now); !errors.Is(err, tc.want) {
+			t.Fatalf("%s: got %v want %v", tc.name, err, tc.want)
+		}
+	}
+	if _, err := presign.Verify([]byte(strings.Repeat("x", 32)), fasthttp.MethodPost, u.Path, u.Query(), now); !errors.Is(err, presign.ErrSignatureMismatch) {
+		t.Fatalf("other secret: got %v want %v", err, presign.ErrSignatureMismatch)
+	}
+
+	download := presign.Grant{Method: fasthttp.MethodGet, Path: filesPathSlash + "a.bin", ExpiresAt: now.Add(time.Minute)}
+	u, _ = url.Parse(presign.URL(secret, download))
+	if _, err := presign.Verify(secret, fasthttp.MethodHead, u.Path, u.Query(), now); err != nil {
+		t.Fatalf("head with a download grant: %v", err)
+	}
+}
+
+func TestPresignedUpload(t *testing.T) {
+	uploadHandler, client := newTestServer(t)
+	uploadHandler.presign.setSecret(testPresignSecret)
+	ctx := context.Background()
+
+	issue := func(req api.PresignRequest) string {
+		t.Helper()
+		_, rawURL, err := uploadHandler.presign.issue(req)
+		if err != nil {
+			t.Fatalf("issue %+v: %v", req, err)
+		}
+		return "http://inmemory" + rawURL
+	}
+	writeFile := func(name, content string) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("write temp file: %v", err)
+		}
+		return path
+	}
+
+	uploadURL := issue(api.PresignRequest{Method: "post", Name: "builds/a.bin", MaxSize: 10})
+	presigned, err := uploader.ParsePresignedURL(uploadURL)
+	if err != nil || presigned.Name != "builds/a.bin" || presigned.MaxSize != 10 {
+		t.Fatalf("parse pre-signed URL: %+v %v", presigned, err)
+	}
+
+	if _, err := client.UploadPresignedContext(ctx, uploadURL, writeFile("big.bin", "0123456789x")); !errors.Is(err, uploader.ErrTooLarge) {
+		t.Fatalf("oversized file: got %v want %v", err, uploader.ErrTooLarge)
+	}
+	// Without a declared size the limit is enforced while streaming.
+	if _, err := client.UploadReaderContext(ctx, uploader.ReaderUploadRequest{URL: uploadURL, Reader: strings.NewReader("0123456789x"), FileName: "builds/a.bin"}); !errors.Is(err, uploader.ErrTooLarge) {
+		t.Fatalf("oversized stream: got %v want %v", err, uploader.ErrTooLarge)
+	}
+	if _, err := client.UploadFileContext(ctx, uploader.UploadRequest{URL: uploadURL, FilePath: writeFile("a.bin", "payload"), FileName: "other.bin"}); !errors.Is(err, uploader.ErrForbidden) {
+		t.Fatalf("other file name: got %v want %v", err, uploader.ErrForbidden)
+	}
+	tampered := strings.Replace(uploadURL, "a.bin", "b.bin", 1)
+	if _, err := client.UploadPresignedContext(ctx, tampered, writeFile("a.bin", "payload")); !errors.Is(err, uploader.ErrForbidden) {
+		t.Fatalf("tampered URL: got %v want %v", err, uploader.ErrForbidden)
+	}
+
+	// Failed attempts do not use up the URL.
+	if _, err := client.UploadPresignedContext(ctx, uploadURL, writeFile("a.bin", "payload")); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if _, err := client.UploadPresignedContext(ctx, uploadURL, writeFile("a.bin", "again")); !errors.Is(err, uploader.ErrForbidden) {
+		t.Fatalf("reused URL: got %v want %v", err, uploader.ErrForbidden)
+	}
+
+	downloadURL := issue(api.PresignRequest{Method: fasthttp.MethodGet, Name: "builds/a.bin"})
+	for range 2 {
+		var buf bytes.Buffer
+		if _, err := client.DownloadContext(ctx, downloadURL, &buf); err != nil || buf.String() != "payload" {
+			t.Fatalf("download: %q %v", buf.String(), err)
+		}
+	}
+	if _, err := client.StatContext(ctx, downloadURL); err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if _, err := client.ListVersionsContext(ctx, downloadURL); !errors.Is(err, uploader.ErrForbidden) {
+		t.Fatalf("download URL with extra parameters: got %v want %v", err, uploader.ErrForbidden)
+	}
+	if err := client.DeleteContext(ctx, downloadURL); !errors.Is(err, uploader.ErrForbidden) {
+		t.Fatalf("delete with a download URL: got %v want %v", err, uploader.ErrForbidden)
+	}
+
+	uploadHandler.presign.required = true
+	if _, err := client.ListContext(ctx, "http://inmemory/files"); !errors.Is(err, uploader.ErrUnauthorized) {
+		t.Fatalf("unsigned list: got %v want %v", err, uploader.ErrUnauthorized)
+	}
+	if _, err := client.UploadFileContext(ctx, uploader.UploadRequest{URL: "http://inmemory/upload", FilePath: writeFile("c.bin", "c")}); !errors.Is(err, uploader.ErrUnauthorized) {
+		t.Fatalf("unsigned upload: got %v want %v", err, uploader.ErrUnauthorized)
+	}
+	if _, err := client.StatContext(ctx, downloadURL); err != nil {
+		t.Fatalf("stat with pre-signed URLs required: %v", err)
+	}
+
+	uploadHandler.presign.now = func() time.Time { return time.Now().Add(time.Hour) }
+	if _, err := client.StatContext(ctx, downloadURL); !errors.Is(err, uploader.ErrForbidden) {
+		t.Fatalf("expired URL: got %v want %v", err, uploader.ErrForbidden)
+	}
+}
+
+func TestPresignedUploadExpectContinue(t *testing.T) {
+	s, httpClient := newTestEmbeddedServer(t)
+	s.uploadHandler.presign.setSecret(testPresignSecret)
+	client, err := uploader.New(httpClient, uploader.Config{
+		ChunkSize:       64,
+		FormFieldName:   "file",
+		RequestTimeout:  5 * time.Second,
+		ExpectContinue:  true,
+		ContinueTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+
+	_, rawURL, err := s.uploadHandler.presign.issue(api.PresignRequest{Method: fasthttp.MethodPost, Name: "a.bin", MaxSize: 4})
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	localPath := filepath.Join(t.TempDir(), "a.bin")
+	if err := os.WriteFile(localPath, []byte("payload"), 0o600); err != nil {
+		t.Fatalf("write temp file: %v", err)
+	}
+	upload := uploader.UploadRequest{URL: "http://inmemory" + rawURL, FilePath: localPath}
+	if _, err := client.UploadFileContext(context.Background(), upload); !errors.Is(err, uploader.ErrUploadRejected) {
+		t.Fatalf("oversized upload: got %v want %v", err, uploader.ErrUploadRejected)
+	}
+	if got := s.preflightRejections.Value(api.CodeTooLarge); got != 1 {
+		t.Fatalf("unexpected rejection count: got %v want 1", got)
+	}
+}
+
+func TestAdminPresign(t *testing.T) {
+	uploadHandler := newHandlerConfig("file", 1, nil, 0)
+	uploadHandler.presign.maxTTL = time.Hour
+	admin := newAdminHandler(newLiveConfig(serverconfig.AppConfig{AdminToken: testAdminToken}, uploadHandler), uploadHandler, nil)
+
+	presignRequest := func(body string) *fasthttp.RequestCtx {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+		ctx.Request.SetRequestURI(adminPresignPath)
+		ctx.Request.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+testAdminToken)
+		ctx.Request.SetBodyString(body)
+		admin.handler(&ctx)
+		return &ctx
+	}
+
+	if ctx := presignRequest(`{"method":"POST","name":"a.bin"}`); ctx.Response.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Fatalf("without a secret: got %d want %d", ctx.Response.StatusCode(), fasthttp.StatusServiceUnavailable)
+	}
+	uploadHandler.presign.setSecret(testPresignSecret)
+	for _, body := range []string{
+		`{"method":"PUT","name":"a.bin"}`,
+		`{"method":"POST","name":"../a.bin"}`,
+		`{"method":"GET","name":"a.bin","max_size":10}`,
+		`{"method":"POST","name":"a.bin","ttl":"soon"}`,
+		`{"method":"POST","name":"a.bin","max_size":-1}`,
+	} {
+		if ctx := presignRequest(body); ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+			t.Fatalf("%s: got %d want %d: %s", body, ctx.Response.StatusCode(), fasthttp.StatusBadRequest, ctx.Response.Body())
+		}
+	}
+
+	start := time.Now()
+	ctx := presignRequest(`{"method":"POST","name":"a.bin","max_size":10,"ttl":"72h"}`)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("presign: got %d want %d: %s", ctx.Response.StatusCode(), fasthttp.StatusOK, ctx.Response.Body())
+	}
+	var result api.PresignResult
+	if err := sonic.Unmarshal(ctx.Response.Body(), &result); err != nil {
+		t.Fatalf("decode result: %v", err)
+	}
+	if result.Method != fasthttp.MethodPost || !strings.HasPrefix(result.URL, uploadPath+"?") {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	expiresAt, err := time.Parse(time.RFC3339, result.ExpiresAt)
+	if err != nil || expiresAt.After(start.Add(time.Hour)) || expiresAt.Before(start.Add(time.Hour-time.Minute)) {
+		t.Fatalf("ttl was not capped: %s %v", result.ExpiresAt, err)
+	}
+}
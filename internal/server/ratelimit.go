@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket whose rate can be changed at runtime, like
+// uploadLimiter. A zero rate lets everything through.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func newRateLimiter(rate float64, burst int64) *rateLimiter {
+	l := &rateLimiter{now: time.Now}
+	l.setLimit(rate, burst)
+
+	return l
+}
+
+// setLimit changes the tokens added per second and the bucket size; a zero
+// burst makes the bucket hold one second's worth. The tokens saved up are
+// kept, but never above the new burst.
+func (l *rateLimiter) setLimit(rate float64, burst int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	wasUnlimited := l.rate <= 0
+	l.rate = rate
+	l.burst = float64(burst)
+	if l.burst <= 0 {
+		l.burst = math.Max(1, math.Ceil(rate))
+	}
+	if wasUnlimited || l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+func (l *rateLimiter) refill() {
+	now := l.now()
+	if l.rate > 0 && !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+}
+
+// allow reports whether a token is available and takes it when take is set.
+// Peeking lets Expect: 100-continue reject early without the token being
+// spent twice for the same request.
+func (l *rateLimiter) allow(take bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return true
+	}
+	l.refill()
+	if l.tokens < 1 {
+		return false
+	}
+	if take {
+		l.tokens--
+	}
+
+	return true
+}
+
+// wait takes n tokens, going into debt if needed, and sleeps until the debt
+// is paid off or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	l.refill()
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledReader reads no faster than its limiter allows, sharing the
+// limit with every other reader of the same limiter.
+type throttledReader struct {
+	r     io.Reader
+	limit *rateLimiter
+	ctx   context.Context
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if waitErr := t.limit.wait(t.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newRateLimiter(0, 0)
+	l.now = func() time.Time { return now }
+	if !l.allow(true) {
+		t.Fatal("unlimited limiter rejected a request")
+	}
+
+	l.setLimit(2, 2)
+	for i := range 2 {
+		if !l.allow(true) {
+			t.Fatalf("request %d within the burst was rejected", i+1)
+		}
+	}
+	if l.allow(false) || l.allow(true) {
+		t.Fatal("request above the burst was allowed")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if !l.allow(false) || !l.allow(true) || l.allow(true) {
+		t.Fatal("expected exactly one token after half a second at 2/s")
+	}
+
+	// Raising the limit at runtime does not hand out a fresh burst.
+	l.setLimit(10, 0)
+	if l.allow(true) {
+		t.Fatal("request was allowed without a saved token")
+	}
+	now = now.Add(time.Second)
+	for i := range 10 {
+		if !l.allow(true) {
+			t.Fatalf("request %d after the limit was raised was rejected", i+1)
+		}
+	}
+}
+
+func TestRateLimiterWaitIsCancelled(t *testing.T) {
+	l := newRateLimiter(1, 1)
+	if err := l.wait(context.Background(), 1); err != nil {
+		t.Fatalf("wait within the burst: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := l.wait(ctx, 1024); err == nil {
+		t.Fatal("expected the wait to be cancelled")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("cancelled wait took %s", elapsed)
+	}
+}
+
+func TestUploadRequestRateLimit(t *testing.T) {
+	s, client := newTestEmbeddedServer(t)
+	limited := s.live.snapshot()
+	limited.RateLimitRequests = 0.001
+	limited.RateLimitBurst = 1
+	s.ApplyConfig(limited, nil)
+
+	upload := func() *fasthttp.Response {
+		return doTestRequest(t, client, fasthttp.MethodPost, "/upload",
+			fasthttp.HeaderContentType, "multipart/form-data; boundary=b",
+		)
+	}
+	if resp := upload(); resp.StatusCode() == fasthttp.StatusTooManyRequests {
+		t.Fatalf("first upload was rate limited: %s", resp.Body())
+	}
+	resp := upload()
+	if resp.StatusCode() != fasthttp.StatusTooManyRequests {
+		t.Fatalf("unexpected status: got %d want %d: %s", resp.StatusCode(), fasthttp.StatusTooManyRequests, resp.Body())
+	}
+
+	// A reload lifts the limit without a restart.
+	limited.RateLimitRequests = 0
+	s.ApplyConfig(limited, nil)
+	if resp := upload(); resp.StatusCode() == fasthttp.StatusTooManyRequests {
+		t.Fatalf("upload was rate limited after the limit was lifted: %s", resp.Body())
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	serverconfig "client-server-fasthttp-test/internal/server/config"
+)
+
+// liveConfig holds the effective configuration of a running server and
+// applies the subset of changes that are safe without a restart.
+type liveConfig struct {
+	mu            sync.Mutex
+	current       serverconfig.AppConfig
+	lastReload    reloadReport
+	uploadHandler *handlerConfig
+	logLevel      *slog.LevelVar
+	// fixedAuth keeps the token set through WithAuth over AuthToken.
+	fixedAuth bool
+}
+
+type reloadReport struct {
+	At              string   `json:"at,omitempty"`
+	Applied         []string `json:"applied"`
+	RequiresRestart []string `json:"requires_restart"`
+	Error           string   `json:"error,omitempty"`
+}
+
+func newLiveConfig(cfg serverconfig.AppConfig, uploadHandler *handlerConfig) *liveConfig {
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(cfg.LogLevel)
+
+	return &liveConfig{
+		current:       cfg,
+		uploadHandler: uploadHandler,
+		logLevel:      logLevel,
+	}
+}
+
+func (l *liveConfig) snapshot() serverconfig.AppConfig {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.current
+}
+
+func (l *liveConfig) lastReloadReport() reloadReport {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.lastReload
+}
+
+// apply is the serverconfig.Watch callback. An invalid configuration is
+// rejected as a whole so the server keeps running with the previous one.
+func (l *liveConfig) apply(next serverconfig.AppConfig, loadErr error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	if loadErr != nil {
+		l.lastReload = reloadReport{At: now, Error: loadErr.Error()}
+		slog.Error("config reload rejected", "error", loadErr)
+		return
+	}
+
+	live, restart := l.current.Changes(next)
+	l.lastReload = reloadReport{At: now, Applied: live, RequiresRestart: restart}
+	if len(live) == 0 && len(restart) == 0 {
+		return
+	}
+
+	l.current = l.current.WithLive(next)
+	l.uploadHandler.uploadSlots.resize(l.current.MaxConcurrentUploads)
+	l.uploadHandler.minFreeSpace.Store(l.current.ReadyMinFreeSpace)
+	l.uploadHandler.presign.setSecret(l.current.PresignSecret)
+	if !l.fixedAuth {
+		l.uploadHandler.setAuthToken(l.current.AuthToken)
+	}
+	l.uploadHandler.webhooks.SetSecret(l.current.WebhookSecret)
+	l.uploadHandler.requestRate.setLimit(l.current.RateLimitRequests, int64(l.current.RateLimitBurst))
+	l.uploadHandler.bandwidth.setLimit(float64(l.current.RateLimitBandwidth), 0)
+	l.logLevel.Set(l.current.LogLevel)
+
+	if len(live) > 0 {
+		slog.Info("config reloaded", "applied", live)
+	}
+	if len(restart) > 0 {
+		slog.Warn("config changes require restart", "keys", restart)
+	}
+}
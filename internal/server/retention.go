@@ -0,0 +1,293 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"client-server-fasthttp-test/internal/api"
+	serverconfig "client-server-fasthttp-test/internal/server/config"
+	"client-server-fasthttp-test/internal/server/metrics"
+	"client-server-fasthttp-test/internal/server/storage"
+	"client-server-fasthttp-test/internal/server/webhook"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Reasons the retention janitor deletes a file for, used as metric labels.
+const (
+	retentionReasonTTL  = "ttl"
+	retentionReasonRule = "rule"
+	retentionReasonTemp = "temp"
+)
+
+// uploadTTL parses the time to live requested for an upload, see
+// api.HeaderUploadTTL, and shortens it to the configured maximum. Zero means
+// that the files only expire through retention rules.
+func (h *handlerConfig) uploadTTL(raw string) (time.Duration, error) {
+	if raw == "" {
+		return 0, nil
+	}
+
+	ttl, err := time.ParseDuration(strings.TrimSpace(raw))
+	if err != nil || ttl <= 0 {
+		return 0, &PreflightError{
+			StatusCode: fasthttp.StatusBadRequest,
+			Message:    fmt.Sprintf("invalid ttl %q: expected a positive duration such as 72h", raw),
+		}
+	}
+	if h.maxTTL > 0 && ttl > h.maxTTL {
+		ttl = h.maxTTL
+	}
+
+	return ttl, nil
+}
+
+// expiresAt returns the expiry of a file stored now with ttl.
+func expiresAt(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(ttl)
+}
+
+// downloadTracker counts the downloads in progress per object, so that the
+// retention janitor never deletes a file while it is being sent.
+type downloadTracker struct {
+	mu       sync.Mutex
+	active   map[string]int
+	deleting map[string]bool
+}
+
+func newDownloadTracker() *downloadTracker {
+	return &downloadTracker{
+		active:   make(map[string]int),
+		deleting: make(map[string]bool),
+	}
+}
+
+// begin registers a download of name and returns the function that ends it.
+// It fails while the janitor deletes name.
+func (t *downloadTracker) begin(name string) (func(), bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.deleting[name] {
+		return nil, false
+	}
+	t.active[name]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+
+			if t.active[name]--; t.active[name] <= 0 {
+				delete(t.active, name)
+			}
+		})
+	}, true
+}
+
+// beginDelete reserves name for deletion unless it is being downloaded.
+// endDelete must be called once the deletion is done.
+func (t *downloadTracker) beginDelete(name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.active[name] > 0 {
+		return false
+	}
+	t.deleting[name] = true
+
+	return true
+}
+
+func (t *downloadTracker) endDelete(name string) {
+	t.mu.Lock()
+	delete(t.deleting, name)
+	t.mu.Unlock()
+}
+
+// trackedBody ends a download once fasthttp closes the body after sending it.
+type trackedBody struct {
+	io.ReadCloser
+	done func()
+}
+
+func (b *trackedBody) Close() error {
+	defer b.done()
+
+	return b.ReadCloser.Close()
+}
+
+// retentionJanitor deletes files that expired, either through the TTL of
+// their upload or a retention rule, and temp files left over by interrupted
+// uploads.
+type retentionJanitor struct {
+	storage   storage.Backend
+	downloads *downloadTracker
+	webhooks  *webhook.Dispatcher
+	// rules are sorted by descending prefix length, so the first match is
+	// the longest.
+	rules    []serverconfig.RetentionRule
+	interval time.Duration
+	tempTTL  time.Duration
+	dryRun   bool
+	now      func() time.Time
+
+	deletedFiles   *metrics.Counter
+	reclaimedBytes *metrics.Counter
+}
+
+func newRetentionJanitor(h *handlerConfig, cfg serverconfig.AppConfig, reg *metrics.Registry) *retentionJanitor {
+	rules := append([]serverconfig.RetentionRule(nil), cfg.RetentionRules...)
+	sort.SliceStable(rules, func(i, j int) bool { return len(rules[i].Prefix) > len(rules[j].Prefix) })
+
+	return &retentionJanitor{
+		storage:   h.storage,
+		downloads: h.downloads,
+		webhooks:  h.webhooks,
+		rules:     rules,
+		interval:  cfg.RetentionInterval,
+		tempTTL:   cfg.RetentionTempTTL,
+		dryRun:    cfg.RetentionDryRun,
+		now:       time.Now,
+		deletedFiles: reg.Counter("upload_server_retention_deleted_files_total",
+			"Files deleted by the retention janitor, by reason; dry runs only count them.", "reason", "dry_run"),
+		reclaimedBytes: reg.Counter("upload_server_retention_reclaimed_bytes_total",
+			"Bytes freed by the retention janitor, by reason; dry runs only count them.", "reason", "dry_run"),
+	}
+}
+
+// run calls collect periodically until ctx is done.
+func (j *retentionJanitor) run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	j.collect()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			j.collect()
+		}
+	}
+}
+
+// collect makes one pass over the stored and the temp files.
+func (j *retentionJanitor) collect() {
+	now := j.now()
+
+	objects, err := j.storage.List("")
+	if err != nil {
+		slog.Warn("list objects for retention", "error", err)
+	}
+	for _, obj := range objects {
+		expiry, reason := j.expiry(obj)
+		if expiry.IsZero() || expiry.After(now) {
+			if obj.SHA256 != "" {
+				continue
+			}
+			// The listing did not include the sidecar with the upload TTL,
+			// see storage.Backend.
+			stat, err := j.storage.Stat(obj.Name)
+			if err != nil {
+				if !errors.Is(err, storage.ErrNotFound) {
+					slog.Warn("stat object for retention", "name", obj.Name, "error", err)
+				}
+				continue
+			}
+			if expiry, reason = j.expiry(stat); expiry.IsZero() || expiry.After(now) {
+				continue
+			}
+			obj = stat
+		}
+		j.deleteObject(obj, reason)
+	}
+
+	temps, err := j.storage.ListTemp()
+	if err != nil {
+		slog.Warn("list temp files", "error", err)
+	}
+	for _, temp := range temps {
+		if now.Sub(temp.ModTime) < j.tempTTL {
+			continue
+		}
+		j.deleteTemp(temp)
+	}
+}
+
+// expiry returns the earlier of the expiry set by the upload TTL and by the
+// retention rule matching obj, with the reason to report it under.
+func (j *retentionJanitor) expiry(obj storage.Object) (time.Time, string) {
+	expiry, reason := obj.ExpiresAt, retentionReasonTTL
+	for _, rule := range j.rules {
+		if !strings.HasPrefix(obj.Name, rule.Prefix) {
+			continue
+		}
+		if ruleExpiry := obj.ModTime.Add(rule.TTL); expiry.IsZero() || ruleExpiry.Before(expiry) {
+			expiry, reason = ruleExpiry, retentionReasonRule
+		}
+		break
+	}
+
+	return expiry, reason
+}
+
+func (j *retentionJanitor) deleteObject(obj storage.Object, reason string) {
+	if j.dryRun {
+		slog.Info("expired file would be deleted", "name", obj.Name, "reason", reason, "size", obj.Size)
+		j.record(reason, obj.Size)
+		return
+	}
+
+	if !j.downloads.beginDelete(obj.Name) {
+		slog.Debug("expired file is being downloaded, deletion postponed", "name", obj.Name)
+		return
+	}
+	defer j.downloads.endDelete(obj.Name)
+
+	if err := j.storage.Delete(obj.Name); err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			slog.Warn("delete expired file", "name", obj.Name, "error", err)
+		}
+		return
+	}
+	slog.Info("expired file deleted", "name", obj.Name, "reason", reason, "size", obj.Size)
+	j.record(reason, obj.Size)
+	j.webhooks.Publish(api.WebhookEvent{Type: api.EventFileExpired, Name: obj.Name, Size: obj.Size, SHA256: obj.SHA256, Reason: reason})
+}
+
+func (j *retentionJanitor) deleteTemp(temp storage.Object) {
+	if j.dryRun {
+		slog.Info("abandoned temp file would be deleted", "name", temp.Name, "size", temp.Size)
+		j.record(retentionReasonTemp, temp.Size)
+		return
+	}
+
+	if err := j.storage.DeleteTemp(temp.Name); err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			slog.Warn("delete abandoned temp file", "name", temp.Name, "error", err)
+		}
+		return
+	}
+	slog.Info("abandoned temp file deleted", "name", temp.Name, "size", temp.Size)
+	j.record(retentionReasonTemp, temp.Size)
+}
+
+func (j *retentionJanitor) record(reason string, size int64) {
+	dryRun := strconv.FormatBool(j.dryRun)
+	j.deletedFiles.Inc(reason, dryRun)
+	j.reclaimedBytes.Add(float64(size), reason, dryRun)
+}
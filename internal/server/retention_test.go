@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/client/uploader"
+	serverconfig "client-server-fasthttp-test/internal/server/config"
+	"client-server-fasthttp-test/internal/server/metrics"
+	"client-server-fasthttp-test/internal/server/storage"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestUploadTTL(t *testing.T) {
+	uploadHandler, client := newTestServer(t)
+	uploadHandler.maxTTL = time.Hour
+	ctx := context.Background()
+
+	localPath := filepath.Join(t.TempDir(), "a.bin")
+	if err := os.WriteFile(localPath, []byte("payload"), 0o600); err != nil {
+		t.Fatalf("write temp file: %v", err)
+	}
+	start := time.Now()
+	if _, err := client.UploadFileContext(ctx, uploader.UploadRequest{URL: "http://inmemory/upload", FilePath: localPath, TTL: 72 * time.Hour}); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	info, err := client.StatContext(ctx, "http://inmemory/files/a.bin")
+	if err != nil {
+		t.Fatalf("stat file: %v", err)
+	}
+	expiresAt, err := time.Parse(time.RFC3339, info.ExpiresAt)
+	if err != nil {
+		t.Fatalf("parse expiry %q: %v", info.ExpiresAt, err)
+	}
+	if want := start.Add(time.Hour); expiresAt.Before(want.Add(-time.Second)) || expiresAt.After(want.Add(time.Minute)) {
+		t.Fatalf("ttl was not capped: got %s want about %s", expiresAt, want)
+	}
+
+	if _, err := client.UploadFileContext(ctx, uploader.UploadRequest{URL: "http://inmemory/upload", FilePath: localPath, FileName: "b.bin"}); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if info, err := client.StatContext(ctx, "http://inmemory/files/b.bin"); err != nil || info.ExpiresAt != "" {
+		t.Fatalf("unexpected expiry without ttl: %+v %v", info, err)
+	}
+
+	for _, ttl := range []string{"soon", "-1h", "0s"} {
+		var reqCtx fasthttp.RequestCtx
+		reqCtx.Request.Header.SetMethod(fasthttp.MethodPost)
+		reqCtx.Request.SetRequestURI("/upload")
+		reqCtx.Request.Header.Set(api.HeaderUploadTTL, ttl)
+		reqCtx.Request.Header.SetContentType("multipart/form-data; boundary=b")
+		reqCtx.Request.SetBodyString("--b\r\nContent-Disposition: form-data; name=\"file\"; filename=\"c.bin\"\r\n\r\npayload\r\n--b--\r\n")
+		reqCtx.Request.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+testAuthToken)
+		uploadHandler.handler(&reqCtx)
+		if reqCtx.Response.StatusCode() != fasthttp.StatusBadRequest {
+			t.Fatalf("ttl %q: got %d want %d: %s", ttl, reqCtx.Response.StatusCode(), fasthttp.StatusBadRequest, reqCtx.Response.Body())
+		}
+	}
+
+	reqCtx := doMultipartRequest(uploadHandler, fasthttp.MethodPost, uploadsPath, "", []byte(`{"name":"c.bin","ttl":"soon"}`))
+	if reqCtx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Fatalf("multipart init: got %d want %d: %s", reqCtx.Response.StatusCode(), fasthttp.StatusBadRequest, reqCtx.Response.Body())
+	}
+}
+
+func storeTestObject(t *testing.T, store storage.Backend, name string, expiresAt time.Time) {
+	t.Helper()
+
+	staged, err := store.Stage(name, strings.NewReader("content"))
+	if err != nil {
+		t.Fatalf("stage %s: %v", name, err)
+	}
+	defer staged.Discard()
+	staged.SetExpiresAt(expiresAt)
+	if _, err := staged.Commit(); err != nil {
+		t.Fatalf("commit %s: %v", name, err)
+	}
+}
+
+func storedNames(t *testing.T, store storage.Backend) []string {
+	t.Helper()
+
+	objects, err := store.List("")
+	if err != nil {
+		t.Fatalf("list objects: %v", err)
+	}
+	var names []string
+	for _, obj := range objects {
+		names = append(names, obj.Name)
+	}
+
+	return names
+}
+
+func TestRetentionJanitor(t *testing.T) {
+	store, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("new storage: %v", err)
+	}
+	uploadHandler := newHandlerConfig("file", 4, store, 0)
+
+	storeTestObject(t, store, "ttl.bin", time.Now().Add(time.Hour))
+	storeTestObject(t, store, "busy.bin", time.Now().Add(time.Hour))
+	storeTestObject(t, store, "keep.bin", time.Time{})
+	storeTestObject(t, store, "tmp/rule.bin", time.Time{})
+	storeTestObject(t, store, "tmp/keep/long.bin", time.Time{})
+	abandoned := filepath.Join(store.Root(), ".tmp", "upload-123")
+	if err := os.WriteFile(abandoned, []byte("partial"), 0o600); err != nil {
+		t.Fatalf("write temp file: %v", err)
+	}
+	old := time.Now().Add(-25 * time.Hour)
+	if err := os.Chtimes(abandoned, old, old); err != nil {
+		t.Fatalf("age temp file: %v", err)
+	}
+
+	reg := metrics.NewRegistry()
+	janitor := newRetentionJanitor(uploadHandler, serverconfig.AppConfig{
+		RetentionRules: []serverconfig.RetentionRule{
+			{Prefix: "tmp/", TTL: time.Hour},
+			{Prefix: "tmp/keep/", TTL: 720 * time.Hour},
+		},
+		RetentionInterval: time.Minute,
+		RetentionTempTTL:  24 * time.Hour,
+		RetentionDryRun:   true,
+	}, reg)
+	now := time.Now().Add(2 * time.Hour)
+	janitor.now = func() time.Time { return now }
+
+	all := []string{"busy.bin", "keep.bin", "tmp/keep/long.bin", "tmp/rule.bin", "ttl.bin"}
+	janitor.collect()
+	if got := storedNames(t, store); !reflect.DeepEqual(got, all) {
+		t.Fatalf("dry run deleted files: got %v want %v", got, all)
+	}
+	if _, err := os.Stat(abandoned); err != nil {
+		t.Fatalf("dry run deleted the temp file: %v", err)
+	}
+	for _, reason := range []string{retentionReasonTTL, retentionReasonRule, retentionReasonTemp} {
+		want := 1.0
+		if reason == retentionReasonTTL {
+			want = 2
+		}
+		if got := janitor.deletedFiles.Value(reason, "true"); got != want {
+			t.Fatalf("dry run %s deletions: got %v want %v", reason, got, want)
+		}
+	}
+
+	done, ok := uploadHandler.downloads.begin("busy.bin")
+	if !ok {
+		t.Fatal("download was refused")
+	}
+	janitor.dryRun = false
+	janitor.collect()
+	if got, want := storedNames(t, store), []string{"busy.bin", "keep.bin", "tmp/keep/long.bin"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected files after collect: got %v want %v", got, want)
+	}
+	if _, err := os.Stat(abandoned); !os.IsNotExist(err) {
+		t.Fatalf("temp file was not deleted: %v", err)
+	}
+	if got := janitor.reclaimedBytes.Value(retentionReasonTemp, "false"); got != float64(len("partial")) {
+		t.Fatalf("unexpected reclaimed bytes: got %v want %d", got, len("partial"))
+	}
+
+	done()
+	janitor.collect()
+	if got, want := storedNames(t, store), []string{"keep.bin", "tmp/keep/long.bin"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("file was not deleted after its download: got %v want %v", got, want)
+	}
+	if got := janitor.deletedFiles.Value(retentionReasonTTL, "false"); got != 2 {
+		t.Fatalf("unexpected ttl deletions: got %v want 2", got)
+	}
+}
+
+func TestDownloadTracker(t *testing.T) {
+	tracker := newDownloadTracker()
+
+	done, ok := tracker.begin("a.bin")
+	if !ok {
+		t.Fatal("download was refused")
+	}
+	if tracker.beginDelete("a.bin") {
+		t.Fatal("deletion allowed during a download")
+	}
+	done()
+	done()
+	if !tracker.beginDelete("a.bin") {
+		t.Fatal("deletion refused after the download")
+	}
+	if _, ok := tracker.begin("a.bin"); ok {
+		t.Fatal("download allowed during the deletion")
+	}
+	tracker.endDelete("a.bin")
+	if _, ok := tracker.begin("a.bin"); !ok {
+		t.Fatal("download refused after the deletion")
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// routeUserValue holds the pattern of the matched route so that middleware
+// can label requests without using the raw, unbounded path.
+const routeUserValue = "server.route"
+
+// Router dispatches requests by method and path. Exact routes win over prefix
+// routes and among prefix routes the longest prefix wins. Routes and
+// middleware must be registered before Handler is called.
+type Router struct {
+	exact      map[string]map[string]fasthttp.RequestHandler
+	prefixes   []*prefixRoute
+	middleware []Middleware
+}
+
+type prefixRoute struct {
+	prefix  string
+	methods map[string]fasthttp.RequestHandler
+}
+
+func NewRouter() *Router {
+	return &Router{exact: make(map[string]map[string]fasthttp.RequestHandler)}
+}
+
+// Handle registers handler for method and the exact path.
+func (r *Router) Handle(method, path string, handler fasthttp.RequestHandler) {
+	methods, ok := r.exact[path]
+	if !ok {
+		methods = make(map[string]fasthttp.RequestHandler)
+		r.exact[path] = methods
+	}
+	methods[method] = handler
+}
+
+// HandlePrefix registers handler for method and every path starting with
+// prefix.
+func (r *Router) HandlePrefix(method, prefix string, handler fasthttp.RequestHandler) {
+	for _, route := range r.prefixes {
+		if route.prefix == prefix {
+			route.methods[method] = handler
+			return
+		}
+	}
+
+	r.prefixes = append(r.prefixes, &prefixRoute{
+		prefix:  prefix,
+		methods: map[string]fasthttp.RequestHandler{method: handler},
+	})
+	sort.SliceStable(r.prefixes, func(i, j int) bool {
+		return len(r.prefixes[i].prefix) > len(r.prefixes[j].prefix)
+	})
+}
+
+// Use appends middleware; the first one registered runs outermost.
+func (r *Router) Use(middleware ...Middleware) {
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// Handler returns the router wrapped in its middleware chain.
+func (r *Router) Handler() fasthttp.RequestHandler {
+	return Chain(r.dispatch, r.middleware...)
+}
+
+func (r *Router) dispatch(ctx *fasthttp.RequestCtx) {
+	path := string(ctx.Path())
+	method := string(ctx.Method())
+
+	pattern, methods := path, r.exact[path]
+	if methods == nil {
+		for _, route := range r.prefixes {
+			if strings.HasPrefix(path, route.prefix) {
+				pattern, methods = route.prefix+"*", route.methods
+				break
+			}
+		}
+	}
+	if methods == nil {
+		writeJSONError(ctx, fasthttp.StatusNotFound, "not found")
+		return
+	}
+
+	ctx.SetUserValue(routeUserValue, pattern)
+	handler, ok := methods[method]
+	if !ok && method == fasthttp.MethodHead {
+		handler, ok = methods[fasthttp.MethodGet]
+	}
+	if !ok {
+		allowed := make([]string, 0, len(methods))
+		for m := range methods {
+			allowed = append(allowed, m)
+		}
+		sort.Strings(allowed)
+		ctx.Response.Header.Set(fasthttp.HeaderAllow, strings.Join(allowed, ", "))
+		writeJSONError(ctx, fasthttp.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	handler(ctx)
+}
+
+// RouteName returns the pattern of the route that handled ctx, or an empty
+// string when no route matched.
+func RouteName(ctx *fasthttp.RequestCtx) string {
+	route, _ := ctx.UserValue(routeUserValue).(string)
+	return route
+}
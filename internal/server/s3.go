@@ -0,0 +1,1012 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/server/metrics"
+	"client-server-fasthttp-test/internal/server/storage"
+
+	"client-server-fasthttp-test/internal/server/sigv4"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	s3XMLNamespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3MaxKeys      = 1000
+	s3TimeFormat   = "2006-01-02T15:04:05.000Z"
+
+	headerAmzDecodedContentLength = "X-Amz-Decoded-Content-Length"
+	headerAmzRequestID            = "X-Amz-Request-Id"
+	headerAmzTrailer              = "X-Amz-Trailer"
+	headerAmzCopySource           = "X-Amz-Copy-Source"
+	headerContentMD5              = "Content-Md5"
+	amzChecksumPrefix             = "x-amz-checksum-"
+)
+
+// s3ChecksumAlgorithms are the x-amz-checksum-* algorithms that are verified.
+// Others, such as crc64nvme, are accepted without verification.
+var s3ChecksumAlgorithms = map[string]func() hash.Hash{
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+	"crc32c": func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// s3Handler serves a subset of the S3 API with path-style addressing:
+// objects of the single configured bucket are the files of the upload
+// storage, and multipart uploads share the sessions of /uploads.
+type s3Handler struct {
+	uploads  *handlerConfig
+	bucket   string
+	region   string
+	verifier *sigV4Verifier
+	created  time.Time
+	routes   fasthttp.RequestHandler
+}
+
+func newS3Handler(uploadHandler *handlerConfig, bucket, region string, credentials func() map[string]string, reg *metrics.Registry) *s3Handler {
+	s := &s3Handler{
+		uploads:  uploadHandler,
+		bucket:   bucket,
+		region:   region,
+		verifier: &sigV4Verifier{region: region, credentials: credentials, now: time.Now},
+		created:  time.Now(),
+	}
+
+	routes := NewRouter()
+	routes.Use(Metrics(reg), Logging(), Recovery(reg))
+	for _, method := range []string{fasthttp.MethodGet, fasthttp.MethodHead, fasthttp.MethodPut, fasthttp.MethodPost, fasthttp.MethodDelete} {
+		routes.HandlePrefix(method, "/", s.serve)
+	}
+	s.routes = routes.Handler()
+
+	return s
+}
+
+func (s *s3Handler) handler(ctx *fasthttp.RequestCtx) {
+	s.routes(ctx)
+}
+
+func (s *s3Handler) serve(ctx *fasthttp.RequestCtx) {
+	ctx.Response.Header.Set(headerAmzRequestID, strconv.FormatUint(ctx.ID(), 16))
+
+	auth, err := s.verifier.verify(&ctx.Request)
+	if err != nil {
+		s.writeError(ctx, err)
+		return
+	}
+
+	path, err := url.PathUnescape(string(ctx.Request.URI().PathOriginal()))
+	if err != nil {
+		s.writeError(ctx, s3Errorf(fasthttp.StatusBadRequest, "InvalidURI", "invalid request path"))
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	query := ctx.QueryArgs()
+	uploadID := string(query.Peek("uploadId"))
+
+	switch {
+	case bucket == "" && ctx.IsGet():
+		s.listBuckets(ctx, auth)
+	case bucket == "":
+		s.writeError(ctx, s3Errorf(fasthttp.StatusMethodNotAllowed, "MethodNotAllowed", "the specified method is not allowed against this resource"))
+	case bucket != s.bucket:
+		s.writeError(ctx, s3Errorf(fasthttp.StatusNotFound, "NoSuchBucket", "the specified bucket does not exist"))
+	case key == "" && ctx.IsHead():
+		ctx.SetStatusCode(fasthttp.StatusOK)
+	case key == "" && ctx.IsGet() && query.Has("location"):
+		s.getBucketLocation(ctx)
+	case key == "" && ctx.IsGet() && string(query.Peek("list-type")) == "2":
+		s.listObjectsV2(ctx)
+	case key == "" && ctx.IsGet():
+		s.writeError(ctx, s3Errorf(fasthttp.StatusNotImplemented, "NotImplemented", "only ListObjectsV2 (list-type=2) is supported"))
+	case key == "":
+		s.writeError(ctx, s3Errorf(fasthttp.StatusMethodNotAllowed, "MethodNotAllowed", "the specified method is not allowed against this resource"))
+	case ctx.IsPut() && len(ctx.Request.Header.Peek(headerAmzCopySource)) > 0:
+		s.writeError(ctx, s3Errorf(fasthttp.StatusNotImplemented, "NotImplemented", "CopyObject is not supported"))
+	case ctx.IsPut() && uploadID != "":
+		s.uploadPart(ctx, auth, key, uploadID)
+	case ctx.IsPut():
+		s.putObject(ctx, auth, key)
+	case (ctx.IsGet() || ctx.IsHead()) && uploadID != "":
+		s.writeError(ctx, s3Errorf(fasthttp.StatusNotImplemented, "NotImplemented", "ListParts is not supported"))
+	case ctx.IsGet() || ctx.IsHead():
+		s.getObject(ctx, key)
+	case ctx.IsDelete() && uploadID != "":
+		s.abortMultipartUpload(ctx, key, uploadID)
+	case ctx.IsDelete():
+		s.deleteObject(ctx, key)
+	case ctx.IsPost() && query.Has("uploads"):
+		s.createMultipartUpload(ctx, key)
+	case ctx.IsPost() && uploadID != "":
+		s.completeMultipartUpload(ctx, auth, key, uploadID)
+	default:
+		s.writeError(ctx, s3Errorf(fasthttp.StatusMethodNotAllowed, "MethodNotAllowed", "the specified method is not allowed against this resource"))
+	}
+}
+
+func (s *s3Handler) putObject(ctx *fasthttp.RequestCtx, auth *sigV4Auth, key string) {
+	var obj storage.Object
+	payload, ok := s.receive(ctx, auth, key, func(body io.Reader) error {
+		src := &readErrRecorder{r: s.uploads.content.reader(body, key, string(ctx.Request.Header.ContentType()))}
+		staged, err := s.uploads.storage.Stage(key, src)
+		if err != nil {
+			var policyErr *PreflightError
+			if errors.As(src.err, &policyErr) {
+				return s3PreflightError(policyErr)
+			}
+			return err
+		}
+		defer func() {
+			if err := staged.Discard(); err != nil {
+				slog.Warn("discard staged upload", "error", err)
+			}
+		}()
+		if hash := signedPayloadSHA256(auth); hash != "" && hash != staged.Object().SHA256 {
+			return s3Errorf(fasthttp.StatusBadRequest, "XAmzContentSHA256Mismatch", "the provided x-amz-content-sha256 header does not match what was computed")
+		}
+		if err := s.uploads.hooks.check(staged, nil, ctx.RemoteAddr().String()); err != nil {
+			return s3PreflightError(err)
+		}
+
+		obj, err = staged.Commit()
+		return err
+	})
+	if !ok {
+		return
+	}
+	slog.Info("s3 object stored", "key", key, "size", obj.Size, "sha256", obj.SHA256)
+	s.uploads.webhooks.Publish(api.WebhookEvent{
+		Type:   api.EventUploadCompleted,
+		Remote: ctx.RemoteAddr().String(),
+		Name:   key,
+		Files:  []api.UploadedFile{uploadedFile(key, obj)},
+		Size:   obj.Size,
+		SHA256: obj.SHA256,
+	})
+
+	payload.setChecksumHeader(ctx)
+	ctx.Response.Header.Set(fasthttp.HeaderETag, s3ETag(obj))
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+func (s *s3Handler) getObject(ctx *fasthttp.RequestCtx, key string) {
+	if storage.ValidateName(key) != nil {
+		s.writeError(ctx, s3Errorf(fasthttp.StatusNotFound, "NoSuchKey", "the specified key does not exist"))
+		return
+	}
+	obj, err := s.uploads.storage.Stat(key)
+	if err != nil {
+		s.writeStorageError(ctx, err)
+		return
+	}
+
+	start, end, partial, err := parseByteRange(string(ctx.Request.Header.Peek(fasthttp.HeaderRange)), obj.Size)
+	if err != nil {
+		s.writeError(ctx, err)
+		return
+	}
+	ctx.Response.Header.Set(fasthttp.HeaderETag, s3ETag(obj))
+	ctx.Response.Header.Set(fasthttp.HeaderLastModified, obj.ModTime.UTC().Format(http.TimeFormat))
+	ctx.Response.Header.Set(fasthttp.HeaderAcceptRanges, "bytes")
+	ctx.SetContentType("application/octet-stream")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	if partial {
+		ctx.Response.Header.Set(fasthttp.HeaderContentRange, fmt.Sprintf("bytes %d-%d/%d", start, end, obj.Size))
+		ctx.SetStatusCode(fasthttp.StatusPartialContent)
+	}
+	length := end - start + 1
+	if ctx.IsHead() {
+		ctx.Response.Header.SetContentLength(int(length))
+		return
+	}
+
+	// The object is being deleted by the retention janitor.
+	done, ok := s.uploads.downloads.begin(key)
+	if !ok {
+		ctx.Response.Reset()
+		s.writeError(ctx, s3Errorf(fasthttp.StatusNotFound, "NoSuchKey", "the specified key does not exist"))
+		return
+	}
+	body, _, err := s.uploads.storage.Open(key)
+	if err != nil {
+		done()
+		ctx.Response.Reset()
+		s.writeStorageError(ctx, err)
+		return
+	}
+	if start > 0 {
+		if err := skipBytes(body, start); err != nil {
+			_ = body.Close()
+			done()
+			ctx.Response.Reset()
+			s.writeError(ctx, err)
+			return
+		}
+	}
+	// fasthttp closes the body once it has been sent, which ends the
+	// download.
+	ctx.SetBodyStream(&trackedBody{ReadCloser: struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(body, length), body}, done: done}, int(length))
+}
+
+func (s *s3Handler) deleteObject(ctx *fasthttp.RequestCtx, key string) {
+	// Like S3, deleting a missing key succeeds.
+	if storage.ValidateName(key) == nil {
+		err := s.uploads.storage.Delete(key)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			s.writeStorageError(ctx, err)
+			return
+		}
+		if err == nil {
+			s.uploads.webhooks.Publish(api.WebhookEvent{Type: api.EventFileDeleted, Remote: ctx.RemoteAddr().String(), Name: key})
+		}
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+func (s *s3Handler) listBuckets(ctx *fasthttp.RequestCtx, auth *sigV4Auth) {
+	writeXML(ctx, fasthttp.StatusOK, s3ListAllMyBucketsResult{
+		Xmlns:   s3XMLNamespace,
+		Owner:   s3Owner{ID: auth.accessKey, DisplayName: auth.accessKey},
+		Buckets: []s3Bucket{{Name: s.bucket, CreationDate: s.created.UTC().Format(s3TimeFormat)}},
+	})
+}
+
+func (s *s3Handler) getBucketLocation(ctx *fasthttp.RequestCtx) {
+	// S3 reports the default region as an empty constraint.
+	location := s.region
+	if location == "us-east-1" {
+		location = ""
+	}
+
+	writeXML(ctx, fasthttp.StatusOK, s3LocationConstraint{Xmlns: s3XMLNamespace, Region: location})
+}
+
+func (s *s3Handler) listObjectsV2(ctx *fasthttp.RequestCtx) {
+	query := ctx.QueryArgs()
+	prefix := string(query.Peek("prefix"))
+	delimiter := string(query.Peek("delimiter"))
+	startAfter := string(query.Peek("start-after"))
+	token := string(query.Peek("continuation-token"))
+	encodeURL := string(query.Peek("encoding-type")) == "url"
+
+	maxKeys := s3MaxKeys
+	if raw := query.Peek("max-keys"); len(raw) > 0 {
+		n, err := strconv.Atoi(string(raw))
+		if err != nil || n < 0 {
+			s.writeError(ctx, s3Errorf(fasthttp.StatusBadRequest, "InvalidArgument", "invalid max-keys %q", raw))
+			return
+		}
+		maxKeys = min(n, s3MaxKeys)
+	}
+
+	marker := startAfter
+	if token != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			s.writeError(ctx, s3Errorf(fasthttp.StatusBadRequest, "InvalidArgument", "the continuation token provided is incorrect"))
+			return
+		}
+		marker = string(decoded)
+	}
+
+	objects, err := s.uploads.storage.List(prefix)
+	if err != nil {
+		s.writeStorageError(ctx, err)
+		return
+	}
+	// S3 lists in byte order, which differs from the directory walk order
+	// for names containing characters below '/'.
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+
+	encode := func(s string) string { return s }
+	if encodeURL {
+		encode = func(s string) string { return sigv4.URIEncode(s, false) }
+	}
+	result := s3ListBucketResult{
+		Xmlns:             s3XMLNamespace,
+		Name:              s.bucket,
+		Prefix:            encode(prefix),
+		Delimiter:         encode(delimiter),
+		MaxKeys:           maxKeys,
+		StartAfter:        encode(startAfter),
+		ContinuationToken: token,
+	}
+	if encodeURL {
+		result.EncodingType = "url"
+	}
+
+	var last string
+	seenPrefixes := make(map[string]bool)
+	for _, obj := range objects {
+		if obj.Name <= marker {
+			continue
+		}
+		entry := obj.Name
+		commonPrefix := false
+		if delimiter != "" {
+			if i := strings.Index(obj.Name[len(prefix):], delimiter); i >= 0 {
+				entry = obj.Name[:len(prefix)+i+len(delimiter)]
+				commonPrefix = true
+				if seenPrefixes[entry] || entry <= marker {
+					continue
+				}
+			}
+		}
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+
+		if commonPrefix {
+			seenPrefixes[entry] = true
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(entry)})
+		} else {
+			result.Contents = append(result.Contents, s3Object{
+				Key:          encode(obj.Name),
+				LastModified: obj.ModTime.UTC().Format(s3TimeFormat),
+				ETag:         s3ETag(obj),
+				Size:         obj.Size,
+				StorageClass: "STANDARD",
+			})
+		}
+		result.KeyCount++
+		last = entry
+	}
+	if result.IsTruncated {
+		result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+	}
+
+	writeXML(ctx, fasthttp.StatusOK, result)
+}
+
+func (s *s3Handler) createMultipartUpload(ctx *fasthttp.RequestCtx, key string) {
+	if s.uploads.draining.Load() {
+		s.writeError(ctx, s3Errorf(fasthttp.StatusServiceUnavailable, "ServiceUnavailable", "server is shutting down"))
+		return
+	}
+	if err := storage.ValidateName(key); err != nil {
+		s.writeError(ctx, s3Errorf(fasthttp.StatusBadRequest, "InvalidArgument", "%v", err))
+		return
+	}
+
+	session, err := s.uploads.multipart.create(key, 0, nil, 0)
+	if err != nil {
+		s.writeError(ctx, err)
+		return
+	}
+	slog.Info("multipart upload started", "upload_id", session.id, "name", session.name, "api", "s3")
+	s.uploads.webhooks.Publish(multipartEvent(api.EventUploadStarted, session, ctx.RemoteAddr().String()))
+
+	writeXML(ctx, fasthttp.StatusOK, s3InitiateMultipartUploadResult{
+		Xmlns:    s3XMLNamespace,
+		Bucket:   s.bucket,
+		Key:      key,
+		UploadID: session.id,
+	})
+}
+
+func (s *s3Handler) uploadPart(ctx *fasthttp.RequestCtx, auth *sigV4Auth, key, uploadID string) {
+	number, err := strconv.Atoi(string(ctx.QueryArgs().Peek("partNumber")))
+	if err != nil || number < api.MinPartNumber || number > api.MaxPartNumber {
+		s.writeError(ctx, s3Errorf(fasthttp.StatusBadRequest, "InvalidArgument", "part number must be an integer between %d and %d", api.MinPartNumber, api.MaxPartNumber))
+		return
+	}
+	session, ok := s.session(ctx, key, uploadID)
+	if !ok {
+		return
+	}
+
+	var part storage.Part
+	payload, ok := s.receive(ctx, auth, fmt.Sprintf("%s (part %d)", key, number), func(body io.Reader) error {
+		session.mu.Lock()
+		completing := session.completing
+		session.mu.Unlock()
+		if completing {
+			return s3Errorf(fasthttp.StatusConflict, "OperationAborted", "the upload is being completed")
+		}
+
+		part, err = s.uploads.storage.PutPart(session.id, number, body, signedPayloadSHA256(auth))
+		if errors.Is(err, storage.ErrChecksumMismatch) {
+			return s3Errorf(fasthttp.StatusBadRequest, "XAmzContentSHA256Mismatch", "the provided x-amz-content-sha256 header does not match what was computed")
+		}
+		return err
+	})
+	if !ok {
+		return
+	}
+
+	session.mu.Lock()
+	session.parts[number] = part
+	session.mu.Unlock()
+
+	payload.setChecksumHeader(ctx)
+	ctx.Response.Header.Set(fasthttp.HeaderETag, strconv.Quote(part.MD5))
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+func (s *s3Handler) completeMultipartUpload(ctx *fasthttp.RequestCtx, auth *sigV4Auth, key, uploadID string) {
+	session, ok := s.session(ctx, key, uploadID)
+	if !ok {
+		return
+	}
+	body, err := readS3Body(ctx, auth)
+	if err != nil {
+		s.writeError(ctx, err)
+		return
+	}
+	var req s3CompleteMultipartUpload
+	if err := xml.Unmarshal(body, &req); err != nil || len(req.Parts) == 0 {
+		s.writeError(ctx, s3Errorf(fasthttp.StatusBadRequest, "MalformedXML", "the XML you provided was not well-formed or did not validate against our published schema"))
+		return
+	}
+
+	session.mu.Lock()
+	if session.completing {
+		session.mu.Unlock()
+		s.writeError(ctx, s3Errorf(fasthttp.StatusConflict, "OperationAborted", "the upload is being completed"))
+		return
+	}
+	numbers := make([]int, 0, len(req.Parts))
+	var problem *s3Error
+	for i, listed := range req.Parts {
+		stored, ok := session.parts[listed.PartNumber]
+		switch {
+		case i > 0 && listed.PartNumber <= numbers[i-1]:
+			problem = s3Errorf(fasthttp.StatusBadRequest, "InvalidPartOrder", "the list of parts was not in ascending order")
+		case !ok || strings.Trim(listed.ETag, `"`) != stored.MD5:
+			problem = s3Errorf(fasthttp.StatusBadRequest, "InvalidPart", "part %d could not be found or its entity tag does not match", listed.PartNumber)
+		}
+		if problem != nil {
+			break
+		}
+		numbers = append(numbers, listed.PartNumber)
+	}
+	if problem == nil {
+		session.completing = true
+	}
+	session.mu.Unlock()
+	if problem != nil {
+		s.writeError(ctx, problem)
+		return
+	}
+
+	completed := false
+	defer func() {
+		if !completed {
+			session.mu.Lock()
+			session.completing = false
+			session.mu.Unlock()
+		}
+	}()
+
+	staged, err := s.uploads.storage.AssembleParts(session.name, session.id, numbers)
+	if err != nil {
+		s.writeError(ctx, fmt.Errorf("assemble upload: %w", err))
+		return
+	}
+	defer func() {
+		if err := staged.Discard(); err != nil {
+			slog.Warn("discard staged upload", "error", err)
+		}
+	}()
+	if err := s.uploads.hooks.check(staged, session.metadata, ctx.RemoteAddr().String()); err != nil {
+		s.writeError(ctx, s3PreflightError(err))
+		return
+	}
+	obj, err := staged.Commit()
+	if err != nil {
+		s.writeError(ctx, fmt.Errorf("store uploaded file %q: %w", session.name, err))
+		return
+	}
+	completed = true
+
+	s.uploads.multipart.remove(session.id)
+	if err := s.uploads.storage.DeleteParts(session.id); err != nil {
+		slog.Warn("delete multipart parts", "upload_id", session.id, "error", err)
+	}
+	slog.Info("multipart upload complete", "upload_id", session.id, "name", session.name, "parts", len(numbers), "sha256", obj.SHA256, "api", "s3")
+	event := multipartEvent(api.EventUploadCompleted, session, ctx.RemoteAddr().String())
+	event.Files = []api.UploadedFile{uploadedFile(key, obj)}
+	event.Size = obj.Size
+	event.SHA256 = obj.SHA256
+	s.uploads.webhooks.Publish(event)
+
+	writeXML(ctx, fasthttp.StatusOK, s3CompleteMultipartUploadResult{
+		Xmlns:    s3XMLNamespace,
+		Location: fmt.Sprintf("http://%s/%s/%s", ctx.Host(), s.bucket, sigv4.URIEncode(key, false)),
+		Bucket:   s.bucket,
+		Key:      key,
+		ETag:     s3ETag(obj),
+	})
+}
+
+func (s *s3Handler) abortMultipartUpload(ctx *fasthttp.RequestCtx, key, uploadID string) {
+	session, ok := s.session(ctx, key, uploadID)
+	if !ok {
+		return
+	}
+	session.mu.Lock()
+	completing := session.completing
+	session.mu.Unlock()
+	if completing {
+		s.writeError(ctx, s3Errorf(fasthttp.StatusConflict, "OperationAborted", "the upload is being completed"))
+		return
+	}
+
+	s.uploads.multipart.remove(session.id)
+	if err := s.uploads.storage.DeleteParts(session.id); err != nil {
+		s.writeError(ctx, err)
+		return
+	}
+	slog.Info("multipart upload aborted", "upload_id", session.id, "name", session.name, "api", "s3")
+	event := multipartEvent(api.EventUploadFailed, session, ctx.RemoteAddr().String())
+	event.Code = api.CodeCancelled
+	event.Reason = "multipart upload aborted"
+	s.uploads.webhooks.Publish(event)
+
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// session looks up a multipart upload of key and answers NoSuchUpload when
+// there is none.
+func (s *s3Handler) session(ctx *fasthttp.RequestCtx, key, uploadID string) (*multipartSession, bool) {
+	session, ok := s.uploads.multipart.get(uploadID)
+	if !ok || session.name != key {
+		s.writeError(ctx, s3Errorf(fasthttp.StatusNotFound, "NoSuchUpload", "the specified multipart upload does not exist"))
+		return nil, false
+	}
+
+	return session, true
+}
+
+// receive runs store on the verified body of an object or part upload. Like
+// /upload it holds an upload slot, is tracked for the admin API and passes
+// the preflight checks first. Failures are answered before it returns false.
+func (s *s3Handler) receive(ctx *fasthttp.RequestCtx, auth *sigV4Auth, label string, store func(body io.Reader) error) (*s3Payload, bool) {
+	releaseUploadSlot, ok := s.uploads.tryAcquireUploadSlot()
+	if !ok {
+		ctx.SetConnectionClose()
+		s.writeError(ctx, s3Errorf(fasthttp.StatusServiceUnavailable, "SlowDown", "too many concurrent uploads"))
+		return nil, false
+	}
+	defer releaseUploadSlot()
+
+	upload := s.uploads.uploads.begin(ctx.RemoteAddr().String(), ctx.Conn())
+	defer s.uploads.uploads.finish(upload)
+	ctx.SetUserValue(uploadIDUserValue, upload.id)
+	upload.setFilename(label)
+
+	if err := s.uploads.preflight(&ctx.Request.Header, false); err != nil {
+		ctx.SetConnectionClose()
+		s.writeError(ctx, s3PreflightError(err))
+		return nil, false
+	}
+	src := &readErrRecorder{r: upload.reader(requestBody(ctx), s.uploads.bandwidth)}
+	payload, err := newS3Payload(&ctx.Request.Header, auth, src)
+	if err != nil {
+		ctx.SetConnectionClose()
+		s.writeError(ctx, err)
+		return nil, false
+	}
+
+	err = store(payload)
+	var s3Err *s3Error
+	switch {
+	case err == nil:
+		return payload, true
+	case errors.As(err, &s3Err):
+		// The body may have been rejected half way.
+		ctx.SetConnectionClose()
+		s.writeError(ctx, s3Err)
+	case upload.cancelled():
+		ctx.SetConnectionClose()
+		slog.Warn("upload cancelled", "id", upload.id, "remote", upload.remoteAddr, "file", label, "received", upload.received.Load())
+		s.writeError(ctx, s3Errorf(fasthttp.StatusConflict, "OperationAborted", "%v", errUploadCancelled))
+	case src.err != nil:
+		ctx.SetConnectionClose()
+		s.writeError(ctx, s3Errorf(fasthttp.StatusBadRequest, "IncompleteBody", "read request body: %v", src.err))
+	case errors.Is(err, storage.ErrInvalidName):
+		s.writeError(ctx, s3Errorf(fasthttp.StatusBadRequest, "InvalidArgument", "%v", err))
+	default:
+		s.writeError(ctx, err)
+	}
+
+	return nil, false
+}
+
+func (s *s3Handler) writeStorageError(ctx *fasthttp.RequestCtx, err error) {
+	if errors.Is(err, storage.ErrNotFound) {
+		s.writeError(ctx, s3Errorf(fasthttp.StatusNotFound, "NoSuchKey", "the specified key does not exist"))
+		return
+	}
+
+	s.writeError(ctx, err)
+}
+
+// writeError answers with the S3 XML error for err; anything but an *s3Error
+// is an InternalError.
+func (s *s3Handler) writeError(ctx *fasthttp.RequestCtx, err error) {
+	var s3Err *s3Error
+	if !errors.As(err, &s3Err) {
+		slog.Error("s3 request failed", "method", string(ctx.Method()), "path", string(ctx.Path()), "error", err)
+		s3Err = s3Errorf(fasthttp.StatusInternalServerError, "InternalError", "we encountered an internal error, please try again")
+	}
+
+	writeXML(ctx, s3Err.StatusCode, s3ErrorResponse{
+		Code:      s3Err.Code,
+		Message:   s3Err.Message,
+		Resource:  string(ctx.Path()),
+		RequestID: string(ctx.Response.Header.Peek(headerAmzRequestID)),
+	})
+}
+
+// s3PreflightError maps a preflight rejection to the closest S3 error.
+func s3PreflightError(err error) *s3Error {
+	status := preflightStatus(err)
+	code := "AccessDenied"
+	switch preflightCode(err) {
+	case api.CodeTooManyUploads:
+		code = "SlowDown"
+	case api.CodeShuttingDown, api.CodeUnavailable:
+		code = "ServiceUnavailable"
+	case api.CodeTooLarge:
+		code = "EntityTooLarge"
+	case api.CodeInsufficientStorage:
+		code = "InsufficientStorage"
+	case api.CodeBadRequest, api.CodeUnsupportedMediaType:
+		code = "InvalidArgument"
+	}
+
+	return s3Errorf(status, code, "%s", err.Error())
+}
+
+// s3ContinueHandler answers Expect: 100-continue on the S3 listener, where
+// every PUT is an object or part upload.
+func (s *Server) s3ContinueHandler(header *fasthttp.RequestHeader) bool {
+	if !header.IsPut() {
+		return true
+	}
+
+	err := s.uploadHandler.preflight(header, true)
+	if err == nil {
+		return true
+	}
+
+	s.preflightRejections.Inc(preflightReason(err))
+	slog.Info("s3 upload rejected before body", "status", preflightStatus(err), "error", err.Error())
+
+	return false
+}
+
+// s3Payload is the body of an object or part upload, decoded from
+// aws-chunked when needed. At the end of the body it checks the declared
+// size, Content-MD5 and x-amz-checksum-* value and reports a mismatch as an
+// *s3Error instead of io.EOF, so that storage never commits it.
+type s3Payload struct {
+	r       io.Reader
+	chunked *awsChunkedReader
+	n       int64
+	// size is the declared decoded length, or -1.
+	size int64
+
+	md5         hash.Hash
+	expectedMD5 string
+
+	checksum         hash.Hash
+	checksumName     string
+	expectedChecksum string
+	actualChecksum   string
+}
+
+func newS3Payload(header *fasthttp.RequestHeader, auth *sigV4Auth, body io.Reader) (*s3Payload, error) {
+	if err := checkPayloadHash(auth.payloadHash); err != nil {
+		return nil, err
+	}
+
+	p := &s3Payload{r: body, size: -1}
+	if isAWSChunked(auth.payloadHash) {
+		chunkAuth := auth
+		if auth.payloadHash == streamingUnsignedPayloadTrailer {
+			chunkAuth = nil
+		}
+		p.chunked = newAWSChunkedReader(body, chunkAuth, auth.payloadHash == streamingSignedPayloadTrailer)
+		p.r = p.chunked
+	}
+	if raw := header.Peek(headerAmzDecodedContentLength); len(raw) > 0 {
+		size, err := strconv.ParseInt(string(raw), 10, 64)
+		if err != nil || size < 0 {
+			return nil, s3Errorf(fasthttp.StatusBadRequest, "InvalidArgument", "invalid %s header", headerAmzDecodedContentLength)
+		}
+		p.size = size
+	}
+	if raw := header.Peek(headerContentMD5); len(raw) > 0 {
+		p.md5 = md5.New()
+		p.expectedMD5 = string(raw)
+	}
+
+	for algorithm, newHash := range s3ChecksumAlgorithms {
+		if value := header.Peek(amzChecksumPrefix + algorithm); len(value) > 0 {
+			p.checksum, p.checksumName, p.expectedChecksum = newHash(), amzChecksumPrefix+algorithm, string(value)
+			return p, nil
+		}
+	}
+	if trailer := strings.ToLower(strings.TrimSpace(string(header.Peek(headerAmzTrailer)))); trailer != "" {
+		if p.chunked == nil {
+			return nil, s3Errorf(fasthttp.StatusBadRequest, "InvalidRequest", "%s requires an aws-chunked body", headerAmzTrailer)
+		}
+		if newHash, ok := s3ChecksumAlgorithms[strings.TrimPrefix(trailer, amzChecksumPrefix)]; ok {
+			p.checksum, p.checksumName = newHash(), trailer
+		}
+	}
+
+	return p, nil
+}
+
+func (p *s3Payload) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if p.md5 != nil {
+		p.md5.Write(b[:n])
+	}
+	if p.checksum != nil {
+		p.checksum.Write(b[:n])
+	}
+	if err == io.EOF {
+		if verifyErr := p.verify(); verifyErr != nil {
+			return n, verifyErr
+		}
+	}
+
+	return n, err
+}
+
+func (p *s3Payload) verify() error {
+	if p.size >= 0 && p.n != p.size {
+		return s3Errorf(fasthttp.StatusBadRequest, "IncompleteBody", "received %d bytes, %s declared %d", p.n, headerAmzDecodedContentLength, p.size)
+	}
+	if p.md5 != nil && base64.StdEncoding.EncodeToString(p.md5.Sum(nil)) != p.expectedMD5 {
+		return s3Errorf(fasthttp.StatusBadRequest, "BadDigest", "the Content-MD5 you specified did not match what we received")
+	}
+	if p.checksum == nil {
+		return nil
+	}
+
+	expected := p.expectedChecksum
+	if expected == "" && p.chunked != nil {
+		expected = p.chunked.Trailers()[p.checksumName]
+	}
+	if expected == "" {
+		return s3Errorf(fasthttp.StatusBadRequest, "InvalidRequest", "the %s trailer is missing", p.checksumName)
+	}
+	p.actualChecksum = base64.StdEncoding.EncodeToString(p.checksum.Sum(nil))
+	if p.actualChecksum != expected {
+		return s3Errorf(fasthttp.StatusBadRequest, "BadDigest", "the %s you specified did not match the calculated checksum", p.checksumName)
+	}
+
+	return nil
+}
+
+func (p *s3Payload) setChecksumHeader(ctx *fasthttp.RequestCtx) {
+	if p.actualChecksum != "" {
+		ctx.Response.Header.Set(p.checksumName, p.actualChecksum)
+	}
+}
+
+// signedPayloadSHA256 returns the body checksum the request was signed with,
+// or "" when the body is unsigned or signed chunk by chunk.
+func signedPayloadSHA256(auth *sigV4Auth) string {
+	if auth.payloadHash == sigv4.UnsignedPayload || isAWSChunked(auth.payloadHash) {
+		return ""
+	}
+
+	return auth.payloadHash
+}
+
+// readS3Body reads the small XML body of a bucket or multipart request and
+// checks it against the signed payload hash.
+func readS3Body(ctx *fasthttp.RequestCtx, auth *sigV4Auth) ([]byte, error) {
+	if err := checkPayloadHash(auth.payloadHash); err != nil {
+		return nil, err
+	}
+	if isAWSChunked(auth.payloadHash) {
+		return nil, s3Errorf(fasthttp.StatusBadRequest, "InvalidRequest", "aws-chunked encoding is only supported for uploads")
+	}
+
+	body, err := io.ReadAll(io.LimitReader(requestBody(ctx), maxMultipartRequestSize+1))
+	if err != nil {
+		return nil, s3Errorf(fasthttp.StatusBadRequest, "IncompleteBody", "read request body: %v", err)
+	}
+	if len(body) > maxMultipartRequestSize {
+		return nil, s3Errorf(fasthttp.StatusBadRequest, "MaxMessageLengthExceeded", "your request was too big")
+	}
+	if expected := signedPayloadSHA256(auth); expected != "" && expected != sigv4.HexSHA256(string(body)) {
+		return nil, s3Errorf(fasthttp.StatusBadRequest, "XAmzContentSHA256Mismatch", "the provided x-amz-content-sha256 header does not match what was computed")
+	}
+
+	return body, nil
+}
+
+// parseByteRange parses a single-range Range header for an object of size
+// bytes. Like S3, a header it does not understand selects the whole object.
+func parseByteRange(header string, size int64) (start, end int64, partial bool, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, size - 1, false, nil
+	}
+	rawStart, rawEnd, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, size - 1, false, nil
+	}
+
+	invalid := s3Errorf(fasthttp.StatusRequestedRangeNotSatisfiable, "InvalidRange", "the requested range is not satisfiable")
+	if rawStart == "" {
+		suffix, parseErr := strconv.ParseInt(rawEnd, 10, 64)
+		if parseErr != nil || suffix <= 0 || size == 0 {
+			return 0, 0, false, invalid
+		}
+		return max(size-suffix, 0), size - 1, true, nil
+	}
+
+	start, parseErr := strconv.ParseInt(rawStart, 10, 64)
+	if parseErr != nil || start < 0 || start >= size {
+		return 0, 0, false, invalid
+	}
+	end = size - 1
+	if rawEnd != "" {
+		end, parseErr = strconv.ParseInt(rawEnd, 10, 64)
+		if parseErr != nil || end < start {
+			return 0, 0, false, invalid
+		}
+		end = min(end, size-1)
+	}
+
+	return start, end, true, nil
+}
+
+func skipBytes(r io.Reader, n int64) error {
+	if seeker, ok := r.(io.Seeker); ok {
+		if _, err := seeker.Seek(n, io.SeekStart); err != nil {
+			return fmt.Errorf("seek object: %w", err)
+		}
+		return nil
+	}
+	if _, err := io.CopyN(io.Discard, r, n); err != nil {
+		return fmt.Errorf("skip object bytes: %w", err)
+	}
+
+	return nil
+}
+
+// s3ETag is the quoted MD5 of obj, falling back to its SHA-256 for objects
+// stored before MD5 was recorded.
+func s3ETag(obj storage.Object) string {
+	if obj.MD5 != "" {
+		return strconv.Quote(obj.MD5)
+	}
+
+	return strconv.Quote(obj.SHA256)
+}
+
+func writeXML(ctx *fasthttp.RequestCtx, statusCode int, payload any) {
+	body, err := xml.Marshal(payload)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetContentType("application/xml")
+		ctx.SetBodyString(xml.Header + "<Error><Code>InternalError</Code><Message>internal server error</Message></Error>")
+		return
+	}
+
+	ctx.SetStatusCode(statusCode)
+	ctx.SetContentType("application/xml")
+	ctx.SetBodyString(xml.Header)
+	ctx.Response.AppendBody(body)
+}
+
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource,omitempty"`
+	RequestID string   `xml:"RequestId"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3LocationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Region  string   `xml:",chardata"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	KeyCount              int              `xml:"KeyCount"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	Parts []s3CompletedPart `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/server/metrics"
+	"client-server-fasthttp-test/internal/server/sigv4"
+
+	"github.com/valyala/fasthttp"
+)
+
+func newTestS3Handler(t *testing.T) (*s3Handler, *handlerConfig) {
+	t.Helper()
+
+	uploadHandler, _ := newTestServer(t)
+	credentials := func() map[string]string { return map[string]string{testAccessKey: testSecretKey} }
+
+	return newS3Handler(uploadHandler, "uploads", "us-east-1", credentials, metrics.NewRegistry()), uploadHandler
+}
+
+// doS3Request signs the request like an SDK with a single-payload body and
+// runs it through the handler.
+func doS3Request(s *s3Handler, method, uri string, body []byte, headers ...string) *fasthttp.RequestCtx {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(uri)
+	ctx.Request.Header.SetHost("localhost:9000")
+	for i := 0; i+1 < len(headers); i += 2 {
+		ctx.Request.Header.Set(headers[i], headers[i+1])
+	}
+	ctx.Request.SetBody(body)
+	signTestS3Request(&ctx.Request, sigv4.HexSHA256(string(body)))
+	s.handler(&ctx)
+
+	return &ctx
+}
+
+func signTestS3Request(req *fasthttp.Request, payloadHash string) {
+	sigv4.Sign(req, testAccessKey, testSecretKey, "us-east-1", payloadHash, time.Now())
+}
+
+func s3ErrorCode(t *testing.T, ctx *fasthttp.RequestCtx) string {
+	t.Helper()
+
+	var problem s3ErrorResponse
+	if err := xml.Unmarshal(ctx.Response.Body(), &problem); err != nil {
+		t.Fatalf("decode s3 error %q: %v", ctx.Response.Body(), err)
+	}
+
+	return problem.Code
+}
+
+func TestS3ObjectLifecycle(t *testing.T) {
+	s, uploadHandler := newTestS3Handler(t)
+	content := []byte("hello, s3")
+	md5Sum := md5.Sum(content)
+
+	ctx := doS3Request(s, fasthttp.MethodPut, "/uploads/dir/a.txt", content,
+		headerContentMD5, base64.StdEncoding.EncodeToString(md5Sum[:]))
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("put object: got %d want %d: %s", ctx.Response.StatusCode(), fasthttp.StatusOK, ctx.Response.Body())
+	}
+	wantETag := `"` + hex.EncodeToString(md5Sum[:]) + `"`
+	if got := string(ctx.Response.Header.Peek(fasthttp.HeaderETag)); got != wantETag {
+		t.Fatalf("unexpected etag: got %s want %s", got, wantETag)
+	}
+	if _, err := uploadHandler.storage.Stat("dir/a.txt"); err != nil {
+		t.Fatalf("stat stored object: %v", err)
+	}
+
+	ctx = doS3Request(s, fasthttp.MethodGet, "/uploads/dir/a.txt", nil)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK || !bytes.Equal(ctx.Response.Body(), content) {
+		t.Fatalf("get object: got %d %q", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	ctx = doS3Request(s, fasthttp.MethodGet, "/uploads/dir/a.txt", nil, fasthttp.HeaderRange, "bytes=7-")
+	if ctx.Response.StatusCode() != fasthttp.StatusPartialContent || string(ctx.Response.Body()) != "s3" {
+		t.Fatalf("ranged get: got %d %q", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if got := string(ctx.Response.Header.Peek(fasthttp.HeaderContentRange)); got != "bytes 7-8/9" {
+		t.Fatalf("unexpected content range: got %q want %q", got, "bytes 7-8/9")
+	}
+
+	ctx = doS3Request(s, fasthttp.MethodHead, "/uploads/dir/a.txt", nil)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK || ctx.Response.Header.ContentLength() != len(content) {
+		t.Fatalf("head object: got %d with length %d", ctx.Response.StatusCode(), ctx.Response.Header.ContentLength())
+	}
+
+	ctx = doS3Request(s, fasthttp.MethodDelete, "/uploads/dir/a.txt", nil)
+	if ctx.Response.StatusCode() != fasthttp.StatusNoContent {
+		t.Fatalf("delete object: got %d want %d", ctx.Response.StatusCode(), fasthttp.StatusNoContent)
+	}
+	ctx = doS3Request(s, fasthttp.MethodGet, "/uploads/dir/a.txt", nil)
+	if ctx.Response.StatusCode() != fasthttp.StatusNotFound || s3ErrorCode(t, ctx) != "NoSuchKey" {
+		t.Fatalf("get deleted object: got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+}
+
+func TestS3RejectsBadRequests(t *testing.T) {
+	s, uploadHandler := newTestS3Handler(t)
+
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod(fasthttp.MethodPut)
+	ctx.Request.SetRequestURI("/uploads/a.txt")
+	ctx.Request.Header.SetHost("localhost:9000")
+	ctx.Request.SetBodyString("tampered")
+	signTestS3Request(&ctx.Request, sigv4.HexSHA256("original"))
+	s.handler(&ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest || s3ErrorCode(t, &ctx) != "XAmzContentSHA256Mismatch" {
+		t.Fatalf("tampered body: got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if _, err := uploadHandler.storage.Stat("a.txt"); err == nil {
+		t.Fatal("tampered body was stored")
+	}
+
+	ctx.Request.Header.Set(fasthttp.HeaderAuthorization, strings.Replace(string(ctx.Request.Header.Peek(fasthttp.HeaderAuthorization)), "Signature=", "Signature=0", 1))
+	ctx.Response.Reset()
+	s.handler(&ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusForbidden || s3ErrorCode(t, &ctx) != "SignatureDoesNotMatch" {
+		t.Fatalf("bad signature: got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	wrongMD5 := doS3Request(s, fasthttp.MethodPut, "/uploads/a.txt", []byte("data"), headerContentMD5, "AAAAAAAAAAAAAAAAAAAAAA==")
+	if wrongMD5.Response.StatusCode() != fasthttp.StatusBadRequest || s3ErrorCode(t, wrongMD5) != "BadDigest" {
+		t.Fatalf("wrong content-md5: got %d %s", wrongMD5.Response.StatusCode(), wrongMD5.Response.Body())
+	}
+
+	otherBucket := doS3Request(s, fasthttp.MethodGet, "/other/a.txt", nil)
+	if otherBucket.Response.StatusCode() != fasthttp.StatusNotFound || s3ErrorCode(t, otherBucket) != "NoSuchBucket" {
+		t.Fatalf("unknown bucket: got %d %s", otherBucket.Response.StatusCode(), otherBucket.Response.Body())
+	}
+}
+
+func TestS3StreamingUpload(t *testing.T) {
+	s, uploadHandler := newTestS3Handler(t)
+
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod(fasthttp.MethodPut)
+	ctx.Request.SetRequestURI("/uploads/stream.txt")
+	ctx.Request.Header.SetHost("localhost:9000")
+	ctx.Request.Header.Set(headerAmzDecodedContentLength, "5")
+	ctx.Request.Header.Set(headerAmzTrailer, "x-amz-checksum-crc32")
+	ctx.Request.SetBodyString("5\r\nhello\r\n0\r\nx-amz-checksum-crc32:NhCmhg==\r\n\r\n")
+	signTestS3Request(&ctx.Request, streamingUnsignedPayloadTrailer)
+	s.handler(&ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("streaming put: got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if got := string(ctx.Response.Header.Peek("x-amz-checksum-crc32")); got != "NhCmhg==" {
+		t.Fatalf("unexpected checksum header: got %q want %q", got, "NhCmhg==")
+	}
+	obj, err := uploadHandler.storage.Stat("stream.txt")
+	if err != nil || obj.Size != 5 {
+		t.Fatalf("stat stored object: %+v %v", obj, err)
+	}
+
+	ctx.Request.SetRequestURI("/uploads/corrupt.txt")
+	ctx.Request.SetBodyString("5\r\nhellO\r\n0\r\nx-amz-checksum-crc32:NhCmhg==\r\n\r\n")
+	signTestS3Request(&ctx.Request, streamingUnsignedPayloadTrailer)
+	ctx.Response.Reset()
+	s.handler(&ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest || s3ErrorCode(t, &ctx) != "BadDigest" {
+		t.Fatalf("corrupt streaming put: got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if _, err := uploadHandler.storage.Stat("corrupt.txt"); err == nil {
+		t.Fatal("corrupt body was stored")
+	}
+}
+
+func TestS3ListObjectsV2(t *testing.T) {
+	s, _ := newTestS3Handler(t)
+	for _, key := range []string{"a.txt", "dir/b.txt", "dir/c.txt", "e.txt"} {
+		if ctx := doS3Request(s, fasthttp.MethodPut, "/uploads/"+key, []byte(key)); ctx.Response.StatusCode() != fasthttp.StatusOK {
+			t.Fatalf("put %s: got %d %s", key, ctx.Response.StatusCode(), ctx.Response.Body())
+		}
+	}
+
+	list := func(query string) s3ListBucketResult {
+		t.Helper()
+		ctx := doS3Request(s, fasthttp.MethodGet, "/uploads?list-type=2&"+query, nil)
+		if ctx.Response.StatusCode() != fasthttp.StatusOK {
+			t.Fatalf("list %q: got %d %s", query, ctx.Response.StatusCode(), ctx.Response.Body())
+		}
+		var result s3ListBucketResult
+		if err := xml.Unmarshal(ctx.Response.Body(), &result); err != nil {
+			t.Fatalf("decode list: %v", err)
+		}
+		return result
+	}
+
+	result := list("delimiter=/")
+	if len(result.Contents) != 2 || result.Contents[0].Key != "a.txt" || result.Contents[1].Key != "e.txt" {
+		t.Fatalf("unexpected contents: %+v", result.Contents)
+	}
+	if len(result.CommonPrefixes) != 1 || result.CommonPrefixes[0].Prefix != "dir/" {
+		t.Fatalf("unexpected common prefixes: %+v", result.CommonPrefixes)
+	}
+
+	var keys []string
+	token := ""
+	for {
+		page := list("max-keys=3&continuation-token=" + token)
+		for _, obj := range page.Contents {
+			keys = append(keys, obj.Key)
+		}
+		if !page.IsTruncated {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+	if strings.Join(keys, ",") != "a.txt,dir/b.txt,dir/c.txt,e.txt" {
+		t.Fatalf("unexpected paged keys: %v", keys)
+	}
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	s, uploadHandler := newTestS3Handler(t)
+
+	ctx := doS3Request(s, fasthttp.MethodPost, "/uploads/big.bin?uploads", nil)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("create multipart upload: got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var initiated s3InitiateMultipartUploadResult
+	if err := xml.Unmarshal(ctx.Response.Body(), &initiated); err != nil {
+		t.Fatalf("decode initiate result: %v", err)
+	}
+
+	parts := [][]byte{bytes.Repeat([]byte("a"), 100), bytes.Repeat([]byte("b"), 50)}
+	var complete strings.Builder
+	complete.WriteString("<CompleteMultipartUpload>")
+	for i, part := range parts {
+		ctx = doS3Request(s, fasthttp.MethodPut, fmt.Sprintf("/uploads/big.bin?partNumber=%d&uploadId=%s", i+1, initiated.UploadID), part)
+		if ctx.Response.StatusCode() != fasthttp.StatusOK {
+			t.Fatalf("upload part %d: got %d %s", i+1, ctx.Response.StatusCode(), ctx.Response.Body())
+		}
+		fmt.Fprintf(&complete, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, ctx.Response.Header.Peek(fasthttp.HeaderETag))
+	}
+	complete.WriteString("</CompleteMultipartUpload>")
+
+	reversed := "<CompleteMultipartUpload><Part><PartNumber>2</PartNumber><ETag>x</ETag></Part><Part><PartNumber>1</PartNumber><ETag>x</ETag></Part></CompleteMultipartUpload>"
+	ctx = doS3Request(s, fasthttp.MethodPost, "/uploads/big.bin?uploadId="+initiated.UploadID, []byte(reversed))
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest || s3ErrorCode(t, ctx) != "InvalidPart" {
+		t.Fatalf("complete with wrong etags: got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	ctx = doS3Request(s, fasthttp.MethodPost, "/uploads/big.bin?uploadId="+initiated.UploadID, []byte(complete.String()))
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("complete multipart upload: got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	obj, err := uploadHandler.storage.Stat("big.bin")
+	if err != nil || obj.Size != 150 {
+		t.Fatalf("stat assembled object: %+v %v", obj, err)
+	}
+	if uploadHandler.multipart.has(initiated.UploadID) {
+		t.Fatal("completed upload is still tracked")
+	}
+
+	ctx = doS3Request(s, fasthttp.MethodDelete, "/uploads/big.bin?uploadId="+initiated.UploadID, nil)
+	if ctx.Response.StatusCode() != fasthttp.StatusNotFound || s3ErrorCode(t, ctx) != "NoSuchUpload" {
+		t.Fatalf("abort completed upload: got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+}
+
+func TestS3ContinueRejection(t *testing.T) {
+	_, uploadHandler := newTestS3Handler(t)
+	uploadHandler.maxRequestBodySize = 1024
+	s := &Server{
+		uploadHandler:       uploadHandler,
+		preflightRejections: metrics.NewRegistry().Counter("rejections_total", "Rejections.", "reason"),
+	}
+
+	var header fasthttp.RequestHeader
+	header.SetMethod(fasthttp.MethodPut)
+	header.SetRequestURI("/uploads/a.bin")
+	header.SetContentLength(4096)
+	if s.s3ContinueHandler(&header) {
+		t.Fatal("oversized upload was allowed to send its body")
+	}
+	if got := s.preflightRejections.Value(api.CodeTooLarge); got != 1 {
+		t.Fatalf("unexpected rejection count: got %v want 1", got)
+	}
+}
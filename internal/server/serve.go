@@ -1,46 +1,73 @@
 package server
 
 import (
+	"context"
 	"fmt"
-	"log"
-	"net/http"
-	_ "net/http/pprof"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 
 	serverconfig "client-server-fasthttp-test/internal/server/config"
-
-	"github.com/valyala/fasthttp"
 )
 
+// Serve loads the configuration from the environment and .env.server, runs
+// the server with hot reload enabled and shuts it down on SIGINT or SIGTERM.
 func Serve() error {
-	cfg := serverconfig.Cfg
-
-	uploadHandler := newHandlerConfig(cfg.FileField, cfg.MaxConcurrentUploads)
-
-	if cfg.PprofEnabled {
-		go runPprofServer(cfg.PprofAddr)
+	var opts serverconfig.Options
+	cfg, err := serverconfig.Load(opts)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
 	}
 
-	server := &fasthttp.Server{
-		Name:               cfg.Name,
-		Handler:            uploadHandler.handler,
-		StreamRequestBody:  cfg.StreamRequestBody,
-		MaxRequestBodySize: cfg.MaxRequestBodySize,
-		ReadTimeout:        cfg.ReadTimeout,
-		WriteTimeout:       cfg.WriteTimeout,
-		IdleTimeout:        cfg.IdleTimeout,
+	s, err := New(cfg)
+	if err != nil {
+		return err
 	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: s.live.logLevel})))
+
+	signalCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		if err := serverconfig.Watch(signalCtx, opts, s.ApplyConfig); err != nil {
+			slog.Warn("config hot reload disabled", "error", err)
+		}
+	}()
 
-	log.Printf("server is listening on %s", cfg.Addr)
-	if err := server.ListenAndServe(cfg.Addr); err != nil {
-		return fmt.Errorf("listen and serve: %w", err)
+	return run(signalCtx, s)
+}
+
+// ServeWithConfig runs the server with cfg until ctx is done and then shuts it
+// down gracefully. It is meant for programs embedding the server: the default
+// slog logger is left alone and the config is not reloaded from disk.
+func ServeWithConfig(ctx context.Context, cfg serverconfig.AppConfig) error {
+	s, err := New(cfg)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return run(ctx, s)
 }
 
-func runPprofServer(addr string) {
-	log.Printf("pprof is listening on %s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatalf("pprof listen and serve: %v", err)
+func run(ctx context.Context, s *Server) error {
+	serveErrCh := make(chan error, 1)
+	go func() {
+		serveErrCh <- s.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErrCh:
+		// One listener failed; close the others without draining.
+		closedCtx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_ = s.Shutdown(closedCtx)
+		return err
+	case <-ctx.Done():
 	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownDrainDelay+s.cfg.ShutdownTimeout)
+	defer cancel()
+
+	return s.Shutdown(shutdownCtx)
 }
@@ -0,0 +1,390 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+	"time"
+
+	serverconfig "client-server-fasthttp-test/internal/server/config"
+	"client-server-fasthttp-test/internal/server/metrics"
+	"client-server-fasthttp-test/internal/server/storage"
+
+	"github.com/valyala/fasthttp"
+)
+
+const corsMaxAge = 10 * time.Minute
+
+// Server is the upload server. It runs standalone through ListenAndServe or
+// is mounted into another fasthttp application through Handler.
+type Server struct {
+	cfg           serverconfig.AppConfig
+	uploadHandler *handlerConfig
+	live          *liveConfig
+	metrics       *metrics.Registry
+	router        *Router
+	retention     *retentionJanitor
+
+	preflightRejections *metrics.Counter
+
+	handlerOnce sync.Once
+	handler     fasthttp.RequestHandler
+
+	httpServer  *fasthttp.Server
+	adminServer *fasthttp.Server
+	s3Server    *fasthttp.Server
+	pprofServer *http.Server
+
+	// janitorCtx bounds the multipart cleanup, the retention janitor and
+	// the webhook deliveries started by Start.
+	janitorCtx  context.Context
+	stopJanitor context.CancelFunc
+	startOnce   sync.Once
+}
+
+type Option func(*options)
+
+type options struct {
+	storage         storage.Backend
+	metrics         *metrics.Registry
+	middleware      []Middleware
+	preflightChecks []PreflightCheck
+	uploadHooks     []UploadHook
+	authToken       string
+}
+
+// WithStorage replaces the storage configured by the UPLOAD_SERVER_STORAGE_*
+// keys.
+func WithStorage(store storage.Backend) Option {
+	return func(o *options) { o.storage = store }
+}
+
+// WithMetrics records metrics into reg instead of a private registry, e.g. to
+// expose them next to the embedding application's own.
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(o *options) { o.metrics = reg }
+}
+
+// WithMiddleware appends middleware to the chain, after the built-in
+// metrics, logging, recovery and CORS layers.
+func WithMiddleware(middleware ...Middleware) Option {
+	return func(o *options) { o.middleware = append(o.middleware, middleware...) }
+}
+
+// WithAuth requires token as a bearer token on the upload and file
+// endpoints, in place of UPLOAD_SERVER_AUTH_TOKEN, which a reload then no
+// longer changes. The health endpoints stay open, and requests made with a
+// pre-signed URL are authorized by its signature.
+func WithAuth(token string) Option {
+	return func(o *options) { o.authToken = token }
+}
+
+// WithPreflightCheck adds checks that run on the headers of every upload
+// before its body is read, both for Expect: 100-continue and plain requests.
+func WithPreflightCheck(checks ...PreflightCheck) Option {
+	return func(o *options) { o.preflightChecks = append(o.preflightChecks, checks...) }
+}
+
+// WithUploadHook adds hooks that inspect every uploaded file before it is
+// committed, after the command of UPLOAD_SERVER_HOOK_COMMAND.
+func WithUploadHook(hooks ...UploadHook) Option {
+	return func(o *options) { o.uploadHooks = append(o.uploadHooks, hooks...) }
+}
+
+// New builds a server from cfg without starting any listener.
+func New(cfg serverconfig.AppConfig, opts ...Option) (*Server, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.storage == nil {
+		store, err := openStorage(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("open storage: %w", err)
+		}
+		o.storage = store
+	}
+	if o.metrics == nil {
+		o.metrics = metrics.NewRegistry()
+	}
+
+	uploadHandler := newHandlerConfig(cfg.FileField, cfg.MaxConcurrentUploads, o.storage, cfg.ReadyMinFreeSpace)
+	uploadHandler.maxRequestBodySize = int64(cfg.MaxRequestBodySize)
+	uploadHandler.preflightChecks = o.preflightChecks
+	uploadHandler.multipart.ttl = cfg.MultipartTTL
+	uploadHandler.maxTTL = cfg.RetentionMaxTTL
+	uploadHandler.presign.setSecret(cfg.PresignSecret)
+	uploadHandler.presign.required = cfg.PresignRequired
+	uploadHandler.presign.maxTTL = cfg.PresignMaxTTL
+	uploadHandler.setAuthToken(cfg.AuthToken)
+	if o.authToken != "" {
+		uploadHandler.setAuthToken(o.authToken)
+	}
+	webhooks, err := newWebhookDispatcher(cfg, o.metrics)
+	if err != nil {
+		return nil, fmt.Errorf("open webhook outbox: %w", err)
+	}
+	uploadHandler.webhooks = webhooks
+	uploadHandler.hooks, err = newUploadHooks(cfg, o.uploadHooks, o.storage, o.metrics)
+	if err != nil {
+		return nil, fmt.Errorf("upload hooks: %w", err)
+	}
+	uploadHandler.content = newContentPolicy(cfg, o.metrics)
+	uploadHandler.extract = newExtractLimits(cfg)
+	uploadHandler.requestRate.setLimit(cfg.RateLimitRequests, int64(cfg.RateLimitBurst))
+	uploadHandler.bandwidth.setLimit(float64(cfg.RateLimitBandwidth), 0)
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	s := &Server{
+		cfg:           cfg,
+		uploadHandler: uploadHandler,
+		live:          newLiveConfig(cfg, uploadHandler),
+		metrics:       o.metrics,
+		router:        NewRouter(),
+		retention:     newRetentionJanitor(uploadHandler, cfg, o.metrics),
+		preflightRejections: o.metrics.Counter("upload_server_preflight_rejections_total",
+			"Uploads rejected from their headers before the body was read, by reason.", "reason"),
+		janitorCtx:  janitorCtx,
+		stopJanitor: stopJanitor,
+	}
+
+	s.live.fixedAuth = o.authToken != ""
+
+	s.router.Use(Metrics(s.metrics), Logging(), Recovery(s.metrics))
+	if len(cfg.CORSAllowedOrigins) > 0 {
+		s.router.Use(CORS(CORSConfig{AllowedOrigins: cfg.CORSAllowedOrigins, MaxAge: corsMaxAge}))
+	}
+	s.router.Use(o.middleware...)
+	uploadHandler.register(s.router)
+	s.router.Handle(fasthttp.MethodGet, "/metrics", s.handleMetrics)
+
+	s.httpServer = &fasthttp.Server{
+		Name: cfg.Name,
+		// Resolved on first request so that routes added through Router
+		// after New are served as well.
+		Handler:                      func(ctx *fasthttp.RequestCtx) { s.Handler()(ctx) },
+		StreamRequestBody:            cfg.StreamRequestBody,
+		DisablePreParseMultipartForm: true,
+		ContinueHandler:              s.continueHandler,
+		MaxRequestBodySize:           cfg.MaxRequestBodySize,
+		ReadTimeout:                  cfg.ReadTimeout,
+		WriteTimeout:                 cfg.WriteTimeout,
+		IdleTimeout:                  cfg.IdleTimeout,
+	}
+	if cfg.AdminEnabled {
+		s.adminServer = &fasthttp.Server{
+			Name:    cfg.Name,
+			Handler: newAdminHandler(s.live, uploadHandler, s.metrics).handler,
+		}
+	}
+	if cfg.S3Enabled {
+		credentials := func() map[string]string { return s.live.snapshot().S3Credentials }
+		s.s3Server = &fasthttp.Server{
+			Name:                         cfg.Name,
+			Handler:                      newS3Handler(uploadHandler, cfg.S3Bucket, cfg.S3Region, credentials, s.metrics).handler,
+			StreamRequestBody:            true,
+			DisablePreParseMultipartForm: true,
+			ContinueHandler:              s.s3ContinueHandler,
+			MaxRequestBodySize:           cfg.MaxRequestBodySize,
+			ReadTimeout:                  cfg.ReadTimeout,
+			WriteTimeout:                 cfg.WriteTimeout,
+			IdleTimeout:                  cfg.IdleTimeout,
+		}
+	}
+	if cfg.PprofEnabled {
+		s.pprofServer = &http.Server{Addr: cfg.PprofAddr, Handler: pprofMux()}
+	}
+
+	return s, nil
+}
+
+// openStorage opens the S3 bucket when configured and the storage directory
+// otherwise, which only keeps uploads with StoragePersist.
+func openStorage(cfg serverconfig.AppConfig) (storage.Backend, error) {
+	if !cfg.StorageS3Enabled {
+		if !cfg.StoragePersist {
+			return storage.NewDiscard(cfg.StorageDir)
+		}
+		return storage.NewLocal(cfg.StorageDir)
+	}
+
+	return storage.NewS3(storage.S3Config{
+		Endpoint:  cfg.StorageS3Endpoint,
+		Bucket:    cfg.StorageS3Bucket,
+		Region:    cfg.StorageS3Region,
+		AccessKey: cfg.StorageS3AccessKey,
+		SecretKey: cfg.StorageS3SecretKey,
+		Prefix:    cfg.StorageS3Prefix,
+		PartSize:  cfg.StorageS3PartSize,
+	})
+}
+
+// Router gives access to the route table so that embedders can add their own
+// endpoints. Routes must be added before the server starts serving.
+func (s *Server) Router() *Router {
+	return s.router
+}
+
+// Handler returns the full middleware chain and routes. The upload endpoint
+// needs the request body as a stream, so a host fasthttp.Server should run
+// with StreamRequestBody and DisablePreParseMultipartForm. The host must
+// also call Start for the background work that Serve would run.
+func (s *Server) Handler() fasthttp.RequestHandler {
+	s.handlerOnce.Do(func() {
+		s.handler = s.router.Handler()
+	})
+
+	return s.handler
+}
+
+// Metrics returns the registry the server records into.
+func (s *Server) Metrics() *metrics.Registry {
+	return s.metrics
+}
+
+// ApplyConfig applies the live-reloadable part of next, see
+// serverconfig.Watch.
+func (s *Server) ApplyConfig(next serverconfig.AppConfig, loadErr error) {
+	s.live.apply(next, loadErr)
+}
+
+// ListenAndServe serves the upload API on the configured address together
+// with the admin API, the S3 API and pprof when enabled. It returns when any
+// listener fails or after Shutdown.
+func (s *Server) ListenAndServe() error {
+	ln, err := net.Listen("tcp4", s.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+
+	return s.Serve(ln)
+}
+
+// Start runs the background work of the server until ctx is done or Shutdown
+// is called: the cleanup of expired multipart uploads and expired files and
+// the webhook deliveries. It returns at once; only the first call starts
+// anything. Serve calls it, but a program that mounts Handler in its own
+// fasthttp.Server must call it itself, or stale uploads are never cleaned up
+// and webhook events pile up in the outbox undelivered.
+func (s *Server) Start(ctx context.Context) {
+	s.startOnce.Do(func() {
+		workCtx, stop := context.WithCancel(s.janitorCtx)
+		context.AfterFunc(ctx, stop)
+
+		go s.uploadHandler.runMultipartJanitor(workCtx)
+		go s.retention.run(workCtx)
+		if s.uploadHandler.webhooks != nil {
+			go s.uploadHandler.webhooks.Run(workCtx)
+		}
+	})
+}
+
+// Serve is ListenAndServe with a caller-provided listener for the upload API.
+// It also runs the background work of Start until Shutdown.
+func (s *Server) Serve(ln net.Listener) error {
+	s.Start(context.Background())
+
+	errCh := make(chan error, 4)
+	if s.pprofServer != nil {
+		go func() {
+			slog.Info("pprof is listening", "addr", s.pprofServer.Addr)
+			if err := s.pprofServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errCh <- fmt.Errorf("pprof listen and serve: %w", err)
+			}
+		}()
+	}
+	if s.adminServer != nil {
+		go func() {
+			slog.Info("admin api is listening", "addr", s.cfg.AdminAddr)
+			if err := s.adminServer.ListenAndServe(s.cfg.AdminAddr); err != nil {
+				errCh <- fmt.Errorf("admin listen and serve: %w", err)
+			}
+		}()
+	}
+	if s.s3Server != nil {
+		go func() {
+			slog.Info("s3 api is listening", "addr", s.cfg.S3Addr, "bucket", s.cfg.S3Bucket)
+			if err := s.s3Server.ListenAndServe(s.cfg.S3Addr); err != nil {
+				errCh <- fmt.Errorf("s3 listen and serve: %w", err)
+			}
+		}()
+	}
+	go func() {
+		slog.Info("server is listening", "addr", ln.Addr().String())
+		if err := s.httpServer.Serve(ln); err != nil {
+			errCh <- fmt.Errorf("listen and serve: %w", err)
+			return
+		}
+		errCh <- nil
+	}()
+
+	return <-errCh
+}
+
+// Shutdown flips readiness to draining and keeps serving for the configured
+// drain delay so that load balancers stop routing new uploads, then waits
+// until ctx is done for in-flight requests to finish.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.uploadHandler.draining.Store(true)
+	s.stopJanitor()
+	slog.Info("shutdown requested", "drain_delay", s.cfg.ShutdownDrainDelay.String())
+
+	drain := time.NewTimer(s.cfg.ShutdownDrainDelay)
+	select {
+	case <-drain.C:
+	case <-ctx.Done():
+		drain.Stop()
+	}
+
+	var errs []error
+	if err := s.httpServer.ShutdownWithContext(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("shutdown: %w", err))
+	}
+	if s.adminServer != nil {
+		if err := s.adminServer.ShutdownWithContext(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("shutdown admin api: %w", err))
+		}
+	}
+	if s.s3Server != nil {
+		if err := s.s3Server.ShutdownWithContext(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("shutdown s3 api: %w", err))
+		}
+	}
+	if s.pprofServer != nil {
+		if err := s.pprofServer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("shutdown pprof: %w", err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	slog.Info("server stopped")
+
+	return nil
+}
+
+func (s *Server) handleMetrics(ctx *fasthttp.RequestCtx) {
+	ctx.SetContentType("text/plain; version=0.0.4; charset=utf-8")
+	if err := s.metrics.WriteText(ctx); err != nil {
+		writeJSONError(ctx, fasthttp.StatusInternalServerError, fmt.Sprintf("write metrics: %v", err))
+	}
+}
+
+func pprofMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return mux
+}
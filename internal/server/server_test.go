@@ -0,0 +1,362 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/client/uploader"
+	serverconfig "client-server-fasthttp-test/internal/server/config"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func newTestEmbeddedServer(t *testing.T, opts ...Option) (*Server, *fasthttp.Client) {
+	t.Helper()
+
+	cfg, err := serverconfig.Load(serverconfig.Options{})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	cfg.StorageDir = t.TempDir()
+	cfg.StoragePersist = true
+	cfg.CORSAllowedOrigins = []string{"https://app.example"}
+
+	s, err := New(cfg, opts...)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+
+	ln := fasthttputil.NewInmemoryListener()
+	go func() {
+		_ = s.httpServer.Serve(ln)
+	}()
+	t.Cleanup(func() {
+		_ = s.httpServer.Shutdown()
+		_ = ln.Close()
+	})
+
+	return s, &fasthttp.Client{
+		Dial: func(_ string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}
+}
+
+func doTestRequest(t *testing.T, client *fasthttp.Client, method, path string, headers ...string) *fasthttp.Response {
+	t.Helper()
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.Header.SetMethod(method)
+	req.SetRequestURI("http://inmemory" + path)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	resp := fasthttp.AcquireResponse()
+	t.Cleanup(func() { fasthttp.ReleaseResponse(resp) })
+	if err := client.Do(req, resp); err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+
+	return resp
+}
+
+func TestServerCustomRoutesAndMiddleware(t *testing.T) {
+	var seen []string
+	tag := func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+			seen = append(seen, RouteName(ctx)+"|"+string(ctx.Path()))
+			next(ctx)
+		}
+	}
+	s, client := newTestEmbeddedServer(t, WithMiddleware(tag))
+	s.Router().Handle(fasthttp.MethodGet, "/custom", func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("custom")
+	})
+
+	resp := doTestRequest(t, client, fasthttp.MethodGet, "/custom")
+	if resp.StatusCode() != fasthttp.StatusOK || string(resp.Body()) != "custom" {
+		t.Fatalf("unexpected custom route response: %d %q", resp.StatusCode(), resp.Body())
+	}
+	if len(seen) != 1 || seen[0] != "|/custom" {
+		t.Fatalf("middleware did not run before routing: %v", seen)
+	}
+
+	resp = doTestRequest(t, client, fasthttp.MethodPut, "/upload")
+	if resp.StatusCode() != fasthttp.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status: got %d want %d", resp.StatusCode(), fasthttp.StatusMethodNotAllowed)
+	}
+	if allow := string(resp.Header.Peek(fasthttp.HeaderAllow)); allow != fasthttp.MethodPost {
+		t.Fatalf("unexpected Allow header: got %q want %q", allow, fasthttp.MethodPost)
+	}
+
+	resp = doTestRequest(t, client, fasthttp.MethodGet, "/metrics")
+	body := string(resp.Body())
+	for _, want := range []string{
+		`upload_server_http_requests_total{route="/custom",method="GET",code="200"} 1`,
+		`upload_server_http_requests_total{route="/upload",method="PUT",code="405"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("metrics missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestServerCORS(t *testing.T) {
+	s, client := newTestEmbeddedServer(t)
+
+	resp := doTestRequest(t, client, fasthttp.MethodOptions, "/upload",
+		fasthttp.HeaderOrigin, "https://app.example",
+		fasthttp.HeaderAccessControlRequestMethod, fasthttp.MethodPost,
+	)
+	if resp.StatusCode() != fasthttp.StatusNoContent {
+		t.Fatalf("unexpected preflight status: got %d want %d", resp.StatusCode(), fasthttp.StatusNoContent)
+	}
+	if origin := string(resp.Header.Peek(fasthttp.HeaderAccessControlAllowOrigin)); origin != "https://app.example" {
+		t.Fatalf("unexpected allowed origin: got %q", origin)
+	}
+
+	staged, err := s.uploadHandler.storage.Stage("a.bin", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatalf("stage: %v", err)
+	}
+	staged.SetMetadata(map[string]string{"build-id": "42"})
+	if _, err := staged.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	s.uploadHandler.setAuthToken(testAuthToken)
+	resp = doTestRequest(t, client, fasthttp.MethodHead, "/files/a.bin",
+		fasthttp.HeaderOrigin, "https://app.example",
+		fasthttp.HeaderAuthorization, "Bearer "+testAuthToken,
+	)
+	want := api.HeaderChecksumSHA256 + ", " + api.HeaderVersionID + ", " + fasthttp.HeaderETag + ", " + api.HeaderMetadataPrefix + "Build-Id"
+	if exposed := string(resp.Header.Peek(fasthttp.HeaderAccessControlExposeHeaders)); exposed != want {
+		t.Fatalf("unexpected exposed headers: got %q want %q", exposed, want)
+	}
+
+	resp = doTestRequest(t, client, fasthttp.MethodGet, "/healthz", fasthttp.HeaderOrigin, "https://evil.example")
+	if origin := resp.Header.Peek(fasthttp.HeaderAccessControlAllowOrigin); len(origin) != 0 {
+		t.Fatalf("unexpected CORS header for foreign origin: %q", origin)
+	}
+}
+
+func TestUploadExpectContinue(t *testing.T) {
+	s, httpClient := newTestEmbeddedServer(t)
+	client, err := uploader.New(httpClient, uploader.Config{
+		ChunkSize:       64,
+		FormFieldName:   "file",
+		RequestTimeout:  5 * time.Second,
+		ExpectContinue:  true,
+		ContinueTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+
+	localPath := filepath.Join(t.TempDir(), "payload.bin")
+	if err := os.WriteFile(localPath, bytes.Repeat([]byte("expect"), 1024), 0o600); err != nil {
+		t.Fatalf("write temp file: %v", err)
+	}
+	upload := func() (*uploader.UploadResponse, error) {
+		return client.UploadFileContext(context.Background(), uploader.UploadRequest{URL: "http://inmemory/upload", FilePath: localPath})
+	}
+
+	resp, err := upload()
+	if err != nil {
+		t.Fatalf("upload file: %v", err)
+	}
+	if resp.StatusCode != fasthttp.StatusCreated {
+		t.Fatalf("unexpected status: got %d want %d: %s", resp.StatusCode, fasthttp.StatusCreated, resp.Body)
+	}
+
+	s.uploadHandler.uploadSlots.resize(1)
+	if !s.uploadHandler.uploadSlots.tryAcquire() {
+		t.Fatal("acquire upload slot")
+	}
+	defer s.uploadHandler.uploadSlots.release()
+
+	var httpErr *uploader.HTTPError
+	if _, err := upload(); !errors.Is(err, uploader.ErrUploadRejected) || !errors.As(err, &httpErr) || httpErr.StatusCode != fasthttp.StatusExpectationFailed {
+		t.Fatalf("expected a 417 rejection, got %v", err)
+	}
+	if got := s.preflightRejections.Value(api.CodeTooManyUploads); got != 1 {
+		t.Fatalf("unexpected rejection count: got %v want %v", got, 1)
+	}
+}
+
+func TestUploadExpectContinueRejections(t *testing.T) {
+	s, httpClient := newTestEmbeddedServer(t)
+	localPath := filepath.Join(t.TempDir(), "payload.bin")
+	if err := os.WriteFile(localPath, bytes.Repeat([]byte("expect"), 1024), 0o600); err != nil {
+		t.Fatalf("write temp file: %v", err)
+	}
+	upload := func(token string) error {
+		client, err := uploader.New(httpClient, uploader.Config{
+			ChunkSize:       64,
+			FormFieldName:   "file",
+			RequestTimeout:  5 * time.Second,
+			ExpectContinue:  true,
+			ContinueTimeout: 5 * time.Second,
+			AuthToken:       token,
+		})
+		if err != nil {
+			t.Fatalf("new client: %v", err)
+		}
+		_, err = client.UploadFileContext(context.Background(), uploader.UploadRequest{URL: "http://inmemory/upload", FilePath: localPath})
+		return err
+	}
+
+	// The reason of a 417 is only in the server's log and metrics.
+	s.uploadHandler.setAuthToken(testAuthToken)
+	if err := upload("wrong-token"); !errors.Is(err, uploader.ErrUploadRejected) {
+		t.Fatalf("wrong token: got %v want %v", err, uploader.ErrUploadRejected)
+	}
+	if got := s.preflightRejections.Value(api.CodeUnauthorized); got != 1 {
+		t.Fatalf("unexpected unauthorized count: got %v want 1", got)
+	}
+
+	s.uploadHandler.maxRequestBodySize = 1024
+	if err := upload(testAuthToken); !errors.Is(err, uploader.ErrUploadRejected) {
+		t.Fatalf("oversized upload: got %v want %v", err, uploader.ErrUploadRejected)
+	}
+	if got := s.preflightRejections.Value(api.CodeTooLarge); got != 1 {
+		t.Fatalf("unexpected too_large count: got %v want 1", got)
+	}
+}
+
+func TestUploadRejectsDeclaredSizeBeforeBody(t *testing.T) {
+	s, client := newTestEmbeddedServer(t)
+	s.uploadHandler.maxRequestBodySize = 1024
+
+	resp := doTestRequest(t, client, fasthttp.MethodPost, "/upload",
+		fasthttp.HeaderContentType, "multipart/form-data; boundary=b",
+		api.HeaderUploadSize, "4096",
+	)
+	if resp.StatusCode() != fasthttp.StatusRequestEntityTooLarge {
+		t.Fatalf("unexpected status: got %d want %d: %s", resp.StatusCode(), fasthttp.StatusRequestEntityTooLarge, resp.Body())
+	}
+}
+
+func TestServerWithAuth(t *testing.T) {
+	s, client := newTestEmbeddedServer(t, WithAuth("secret-token"))
+
+	resp := doTestRequest(t, client, fasthttp.MethodPost, "/upload",
+		fasthttp.HeaderContentType, "multipart/form-data; boundary=b",
+	)
+	if resp.StatusCode() != fasthttp.StatusUnauthorized {
+		t.Fatalf("unexpected status: got %d want %d: %s", resp.StatusCode(), fasthttp.StatusUnauthorized, resp.Body())
+	}
+	if got := string(resp.Header.Peek(fasthttp.HeaderWWWAuthenticate)); got != `Bearer realm="upload"` {
+		t.Fatalf("unexpected WWW-Authenticate header: %q", got)
+	}
+
+	resp = doTestRequest(t, client, fasthttp.MethodPost, "/upload",
+		fasthttp.HeaderContentType, "multipart/form-data; boundary=b",
+		fasthttp.HeaderAuthorization, "Bearer secret-token",
+	)
+	if resp.StatusCode() != fasthttp.StatusBadRequest {
+		t.Fatalf("unexpected status with token: got %d want %d: %s", resp.StatusCode(), fasthttp.StatusBadRequest, resp.Body())
+	}
+
+	for _, path := range []string{"/healthz", "/livez"} {
+		if resp := doTestRequest(t, client, fasthttp.MethodGet, path); resp.StatusCode() != fasthttp.StatusOK {
+			t.Fatalf("%s: unexpected status: got %d want %d", path, resp.StatusCode(), fasthttp.StatusOK)
+		}
+	}
+
+	// A reload does not replace the token given to New.
+	next := s.live.snapshot()
+	next.AuthToken = "from-config"
+	s.ApplyConfig(next, nil)
+	resp = doTestRequest(t, client, fasthttp.MethodGet, "/files",
+		fasthttp.HeaderAuthorization, "Bearer secret-token",
+	)
+	if resp.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("unexpected status after reload: got %d want %d: %s", resp.StatusCode(), fasthttp.StatusOK, resp.Body())
+	}
+}
+
+func TestServerAuthTokenReload(t *testing.T) {
+	s, client := newTestEmbeddedServer(t)
+	// Uploads are open without a token, the file endpoints are closed.
+	resp := doTestRequest(t, client, fasthttp.MethodPost, "/upload", fasthttp.HeaderContentType, "multipart/form-data; boundary=b")
+	if resp.StatusCode() != fasthttp.StatusBadRequest {
+		t.Fatalf("unexpected upload status without a token: got %d want %d: %s", resp.StatusCode(), fasthttp.StatusBadRequest, resp.Body())
+	}
+	for _, method := range []string{fasthttp.MethodGet, fasthttp.MethodDelete} {
+		if resp := doTestRequest(t, client, method, "/files/a.bin"); resp.StatusCode() != fasthttp.StatusUnauthorized {
+			t.Fatalf("%s /files/a.bin without a token: got %d want %d", method, resp.StatusCode(), fasthttp.StatusUnauthorized)
+		}
+	}
+
+	next := s.live.snapshot()
+	next.AuthToken = "rotated"
+	s.ApplyConfig(next, nil)
+	if resp := doTestRequest(t, client, fasthttp.MethodGet, "/files"); resp.StatusCode() != fasthttp.StatusUnauthorized {
+		t.Fatalf("unexpected status after the token was set: got %d want %d", resp.StatusCode(), fasthttp.StatusUnauthorized)
+	}
+	resp = doTestRequest(t, client, fasthttp.MethodGet, "/files", fasthttp.HeaderAuthorization, "Bearer rotated")
+	if resp.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("unexpected status with the token: got %d want %d: %s", resp.StatusCode(), fasthttp.StatusOK, resp.Body())
+	}
+}
+
+func TestServerStartRunsBackgroundWork(t *testing.T) {
+	delivered := make(chan struct{}, 4)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered <- struct{}{}
+	}))
+	t.Cleanup(receiver.Close)
+
+	cfg, err := serverconfig.Load(serverconfig.Options{})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	cfg.StorageDir = t.TempDir()
+	cfg.WebhookURLs = []string{receiver.URL}
+	cfg.WebhookOutboxDir = t.TempDir()
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+
+	// The host application owns the fasthttp.Server, so Serve never runs.
+	host := &fasthttp.Server{
+		Handler:                      s.Handler(),
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+	}
+	ln := fasthttputil.NewInmemoryListener()
+	go func() {
+		_ = host.Serve(ln)
+	}()
+	t.Cleanup(func() {
+		_ = host.Shutdown()
+		_ = ln.Close()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s.Start(ctx)
+	s.Start(ctx)
+
+	client := &fasthttp.Client{Dial: func(_ string) (net.Conn, error) { return ln.Dial() }}
+	doTestRequest(t, client, fasthttp.MethodPost, "/upload", fasthttp.HeaderContentType, "multipart/form-data; boundary=b")
+
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook event was not delivered after Start")
+	}
+}
@@ -0,0 +1,405 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"client-server-fasthttp-test/internal/server/sigv4"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	maxSigV4ClockSkew = 15 * time.Minute
+
+	streamingSignedPayload          = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingSignedPayloadTrailer   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsignedPayloadTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+
+	// maxChunkLineSize bounds a chunk header or trailer line of an
+	// aws-chunked body.
+	maxChunkLineSize = 4096
+)
+
+// sigV4Auth is the verified signature of a request. The streaming payload
+// formats sign every chunk, chained to the signature of the request.
+type sigV4Auth struct {
+	accessKey   string
+	amzDate     string
+	scope       string
+	signingKey  []byte
+	signature   string
+	payloadHash string
+}
+
+// sigV4Verifier checks AWS Signature Version 4 Authorization headers against
+// locally configured keys.
+type sigV4Verifier struct {
+	region string
+	// credentials maps access key ids to secret keys. It is called per
+	// request so that keys can be rotated at runtime.
+	credentials func() map[string]string
+	now         func() time.Time
+}
+
+func (v *sigV4Verifier) verify(req *fasthttp.Request) (*sigV4Auth, error) {
+	authorization := string(req.Header.Peek(fasthttp.HeaderAuthorization))
+	if authorization == "" {
+		return nil, s3Errorf(fasthttp.StatusForbidden, "AccessDenied", "anonymous access is not allowed")
+	}
+	algorithm, fields, _ := strings.Cut(authorization, " ")
+	if algorithm != sigv4.Algorithm {
+		return nil, s3Errorf(fasthttp.StatusBadRequest, "AuthorizationHeaderMalformed", "unsupported authorization algorithm %q", algorithm)
+	}
+
+	var credential, signedHeaders, signature string
+	for _, field := range strings.Split(fields, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch key {
+		case "Credential":
+			credential = value
+		case "SignedHeaders":
+			signedHeaders = value
+		case "Signature":
+			signature = value
+		}
+	}
+	if credential == "" || signedHeaders == "" || signature == "" {
+		return nil, s3Errorf(fasthttp.StatusBadRequest, "AuthorizationHeaderMalformed", "authorization header requires Credential, SignedHeaders and Signature")
+	}
+
+	// Credential is <access key>/<date>/<region>/<service>/aws4_request.
+	accessKey, scope, _ := strings.Cut(credential, "/")
+	scopeParts := strings.Split(scope, "/")
+	if len(scopeParts) != 4 || scopeParts[2] != sigv4.Service || scopeParts[3] != sigv4.Terminator {
+		return nil, s3Errorf(fasthttp.StatusBadRequest, "AuthorizationHeaderMalformed", "invalid credential scope %q", scope)
+	}
+	if scopeParts[1] != v.region {
+		return nil, s3Errorf(fasthttp.StatusBadRequest, "AuthorizationHeaderMalformed", "region %q is wrong; expecting %q", scopeParts[1], v.region)
+	}
+	secret, ok := v.credentials()[accessKey]
+	if !ok {
+		return nil, s3Errorf(fasthttp.StatusForbidden, "InvalidAccessKeyId", "the access key id %q does not exist", accessKey)
+	}
+
+	amzDate, err := requestAmzDate(&req.Header)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(amzDate, scopeParts[0]) {
+		return nil, s3Errorf(fasthttp.StatusBadRequest, "AuthorizationHeaderMalformed", "credential date %q does not match request date %q", scopeParts[0], amzDate)
+	}
+	signedAt, _ := time.Parse(sigv4.DateFormat, amzDate)
+	if skew := v.now().Sub(signedAt); skew > maxSigV4ClockSkew || skew < -maxSigV4ClockSkew {
+		return nil, s3Errorf(fasthttp.StatusForbidden, "RequestTimeTooSkewed", "the difference between the request time and the server's time is too large")
+	}
+
+	payloadHash := string(req.Header.Peek(sigv4.HeaderContentSHA256))
+	if payloadHash == "" {
+		return nil, s3Errorf(fasthttp.StatusBadRequest, "InvalidRequest", "missing required header %s", sigv4.HeaderContentSHA256)
+	}
+	headers := strings.Split(signedHeaders, ";")
+	if !slices.Contains(headers, "host") {
+		return nil, s3Errorf(fasthttp.StatusBadRequest, "AuthorizationHeaderMalformed", "the host header must be signed")
+	}
+
+	auth := &sigV4Auth{
+		accessKey:   accessKey,
+		amzDate:     amzDate,
+		scope:       scope,
+		signingKey:  sigv4.SigningKey(secret, scopeParts[0], scopeParts[1]),
+		payloadHash: payloadHash,
+	}
+	canonical := sigv4.CanonicalRequest(req, headers, payloadHash)
+	stringToSign := strings.Join([]string{sigv4.Algorithm, amzDate, scope, sigv4.HexSHA256(canonical)}, "\n")
+	auth.signature = hex.EncodeToString(sigv4.HMACSHA256(auth.signingKey, stringToSign))
+	if !hmac.Equal([]byte(auth.signature), []byte(signature)) {
+		return nil, s3Errorf(fasthttp.StatusForbidden, "SignatureDoesNotMatch", "the request signature we calculated does not match the signature you provided")
+	}
+
+	return auth, nil
+}
+
+// requestAmzDate returns the signing time in the SigV4 basic format, from
+// X-Amz-Date or else from Date.
+func requestAmzDate(header *fasthttp.RequestHeader) (string, error) {
+	if raw := string(header.Peek(sigv4.HeaderDate)); raw != "" {
+		if _, err := time.Parse(sigv4.DateFormat, raw); err != nil {
+			return "", s3Errorf(fasthttp.StatusBadRequest, "AccessDenied", "invalid %s header %q", sigv4.HeaderDate, raw)
+		}
+		return raw, nil
+	}
+	if raw := string(header.Peek(fasthttp.HeaderDate)); raw != "" {
+		t, err := http.ParseTime(raw)
+		if err != nil {
+			return "", s3Errorf(fasthttp.StatusBadRequest, "AccessDenied", "invalid Date header %q", raw)
+		}
+		return t.UTC().Format(sigv4.DateFormat), nil
+	}
+
+	return "", s3Errorf(fasthttp.StatusForbidden, "AccessDenied", "the request must contain a valid %s or Date header", sigv4.HeaderDate)
+}
+
+// awsChunkedReader decodes an aws-chunked body: chunks framed as
+// "<hex size>[;chunk-signature=<sig>]\r\n<data>\r\n", a final zero-size
+// chunk and optional trailer lines. With auth set, every chunk signature is
+// verified, chained from the signature of the request, before the next chunk
+// is read; data of a chunk with a bad signature surfaces as a read error, so
+// it is never committed.
+type awsChunkedReader struct {
+	r    *bufio.Reader
+	auth *sigV4Auth
+	// signedTrailer requires an x-amz-trailer-signature after the trailers.
+	signedTrailer bool
+
+	prevSignature  string
+	chunkSignature string
+	chunkHash      hashWriter
+	remaining      int64
+	inChunk        bool
+	trailers       map[string]string
+	err            error
+}
+
+type hashWriter interface {
+	io.Writer
+	Sum(b []byte) []byte
+	Reset()
+}
+
+func newAWSChunkedReader(r io.Reader, auth *sigV4Auth, signedTrailer bool) *awsChunkedReader {
+	c := &awsChunkedReader{
+		r:             bufio.NewReaderSize(r, 64<<10),
+		auth:          auth,
+		signedTrailer: signedTrailer,
+		chunkHash:     sha256.New(),
+		trailers:      make(map[string]string),
+	}
+	if auth != nil {
+		c.prevSignature = auth.signature
+	}
+
+	return c
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	for c.remaining == 0 {
+		if err := c.advance(); err != nil {
+			c.err = err
+			return 0, err
+		}
+	}
+
+	n, err := c.r.Read(p[:min(int64(len(p)), c.remaining)])
+	c.remaining -= int64(n)
+	c.chunkHash.Write(p[:n])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		c.err = err
+	}
+
+	return n, err
+}
+
+// Trailers returns the trailer headers, keyed by lowercase name, once the
+// body has been read to EOF.
+func (c *awsChunkedReader) Trailers() map[string]string {
+	return c.trailers
+}
+
+// advance finishes the current chunk and reads the next chunk header. It
+// returns io.EOF after the final chunk and the trailers.
+func (c *awsChunkedReader) advance() error {
+	if c.inChunk {
+		if err := c.expectCRLF(); err != nil {
+			return err
+		}
+		if err := c.verifyChunk(); err != nil {
+			return err
+		}
+		c.inChunk = false
+	}
+
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	rawSize, extension, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(rawSize), 16, 64)
+	if err != nil || size < 0 {
+		return s3Errorf(fasthttp.StatusBadRequest, "IncompleteBody", "invalid aws-chunked chunk header %q", line)
+	}
+	c.chunkSignature = strings.TrimPrefix(strings.TrimSpace(extension), "chunk-signature=")
+	if c.auth != nil && c.chunkSignature == "" {
+		return s3Errorf(fasthttp.StatusForbidden, "SignatureDoesNotMatch", "missing chunk signature")
+	}
+	c.chunkHash.Reset()
+
+	if size > 0 {
+		c.remaining = size
+		c.inChunk = true
+		return nil
+	}
+
+	if err := c.verifyChunk(); err != nil {
+		return err
+	}
+	if err := c.readTrailers(); err != nil {
+		return err
+	}
+
+	return io.EOF
+}
+
+func (c *awsChunkedReader) verifyChunk() error {
+	if c.auth == nil {
+		return nil
+	}
+
+	stringToSign := strings.Join([]string{
+		sigv4.Algorithm + "-PAYLOAD",
+		c.auth.amzDate,
+		c.auth.scope,
+		c.prevSignature,
+		sigv4.EmptySHA256,
+		hex.EncodeToString(c.chunkHash.Sum(nil)),
+	}, "\n")
+	expected := hex.EncodeToString(sigv4.HMACSHA256(c.auth.signingKey, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(c.chunkSignature)) {
+		return s3Errorf(fasthttp.StatusForbidden, "SignatureDoesNotMatch", "chunk signature does not match")
+	}
+	c.prevSignature = expected
+
+	return nil
+}
+
+func (c *awsChunkedReader) readTrailers() error {
+	var signed strings.Builder
+	var trailerSignature string
+	for {
+		// The final CRLF is optional for bodies without trailers.
+		line, err := c.readLine()
+		eof := errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !eof {
+			return err
+		}
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return s3Errorf(fasthttp.StatusBadRequest, "IncompleteBody", "invalid aws-chunked trailer %q", line)
+		}
+		name, value = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+		if name == "x-amz-trailer-signature" {
+			trailerSignature = value
+			continue
+		}
+		c.trailers[name] = value
+		signed.WriteString(name + ":" + value + "\n")
+		if eof {
+			break
+		}
+	}
+
+	if c.auth == nil || !c.signedTrailer {
+		return nil
+	}
+	stringToSign := strings.Join([]string{
+		sigv4.Algorithm + "-TRAILER",
+		c.auth.amzDate,
+		c.auth.scope,
+		c.prevSignature,
+		sigv4.HexSHA256(signed.String()),
+	}, "\n")
+	expected := hex.EncodeToString(sigv4.HMACSHA256(c.auth.signingKey, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(trailerSignature)) {
+		return s3Errorf(fasthttp.StatusForbidden, "SignatureDoesNotMatch", "trailer signature does not match")
+	}
+
+	return nil
+}
+
+func (c *awsChunkedReader) expectCRLF() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	if line != "" {
+		return s3Errorf(fasthttp.StatusBadRequest, "IncompleteBody", "aws-chunked chunk is longer than its declared size")
+	}
+
+	return nil
+}
+
+// readLine reads a CRLF-terminated line without the terminator. A body that
+// ends early yields io.ErrUnexpectedEOF.
+func (c *awsChunkedReader) readLine() (string, error) {
+	var line []byte
+	for {
+		fragment, isPrefix, err := c.r.ReadLine()
+		line = append(line, fragment...)
+		if len(line) > maxChunkLineSize {
+			return "", s3Errorf(fasthttp.StatusBadRequest, "IncompleteBody", "aws-chunked line too long")
+		}
+		if err == io.EOF {
+			return string(line), io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", err
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// isAWSChunked tells whether payloadHash announces an aws-chunked body.
+func isAWSChunked(payloadHash string) bool {
+	return strings.HasPrefix(payloadHash, "STREAMING-")
+}
+
+func checkPayloadHash(payloadHash string) error {
+	switch payloadHash {
+	case sigv4.UnsignedPayload, streamingSignedPayload, streamingSignedPayloadTrailer, streamingUnsignedPayloadTrailer:
+		return nil
+	}
+	if len(payloadHash) != sha256.Size*2 {
+		return s3Errorf(fasthttp.StatusBadRequest, "InvalidArgument", "unsupported %s value %q", sigv4.HeaderContentSHA256, payloadHash)
+	}
+	if _, err := hex.DecodeString(payloadHash); err != nil {
+		return s3Errorf(fasthttp.StatusBadRequest, "InvalidArgument", "invalid %s value %q", sigv4.HeaderContentSHA256, payloadHash)
+	}
+
+	return nil
+}
+
+// s3Error is an error answered with the S3 XML error body.
+type s3Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func s3Errorf(status int, code, format string, args ...any) *s3Error {
+	return &s3Error{StatusCode: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,186 @@
+// Package sigv4 implements the parts of AWS Signature Version 4 for S3 that
+// are shared by the S3 API of the server, which verifies signatures, and the
+// S3 storage backend, which signs its requests.
+package sigv4
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	Algorithm  = "AWS4-HMAC-SHA256"
+	Service    = "s3"
+	Terminator = "aws4_request"
+	DateFormat = "20060102T150405Z"
+
+	HeaderDate          = "X-Amz-Date"
+	HeaderContentSHA256 = "X-Amz-Content-Sha256"
+
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+	EmptySHA256     = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// signedHeaders are the headers Sign always covers. Together with the payload hash
+// they pin the method, path, query, host and body of a request.
+var signedHeaders = []string{"host", "x-amz-content-sha256", "x-amz-date"}
+
+// Sign adds X-Amz-Date, X-Amz-Content-Sha256 and an Authorization header to
+// req, signing any other X-Amz-* headers it already has. The request URI,
+// including the host, must be set beforehand.
+func Sign(req *fasthttp.Request, accessKey, secretKey, region, payloadHash string, now time.Time) {
+	if len(req.Header.Host()) == 0 {
+		req.Header.SetHostBytes(req.URI().Host())
+	}
+	amzDate := now.UTC().Format(DateFormat)
+	req.Header.Set(HeaderDate, amzDate)
+	req.Header.Set(HeaderContentSHA256, payloadHash)
+
+	headers := headersToSign(req)
+	scope := Scope(amzDate[:8], region)
+	stringToSign := StringToSign(amzDate, scope, CanonicalRequest(req, headers, payloadHash))
+	signature := hex.EncodeToString(HMACSHA256(SigningKey(secretKey, amzDate[:8], region), stringToSign))
+	req.Header.Set(fasthttp.HeaderAuthorization, fmt.Sprintf("%s Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		Algorithm, accessKey, scope, strings.Join(headers, ";"), signature))
+}
+
+// headersToSign returns signedHeaders plus the other x-amz-* headers of req,
+// such as x-amz-copy-source, which S3 requires to be signed as well.
+func headersToSign(req *fasthttp.Request) []string {
+	headers := append([]string(nil), signedHeaders...)
+	for key := range req.Header.All() {
+		name := strings.ToLower(string(key))
+		if strings.HasPrefix(name, "x-amz-") && !slices.Contains(headers, name) {
+			headers = append(headers, name)
+		}
+	}
+	sort.Strings(headers)
+
+	return headers
+}
+
+// Scope is the credential scope of a signature made on date (YYYYMMDD).
+func Scope(date, region string) string {
+	return strings.Join([]string{date, region, Service, Terminator}, "/")
+}
+
+func StringToSign(amzDate, scope, canonicalRequest string) string {
+	return strings.Join([]string{Algorithm, amzDate, scope, HexSHA256(canonicalRequest)}, "\n")
+}
+
+func CanonicalRequest(req *fasthttp.Request, signedHeaders []string, payloadHash string) string {
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		values := make([]string, 0, 1)
+		for _, value := range req.Header.PeekAll(name) {
+			values = append(values, strings.Join(strings.Fields(string(value)), " "))
+		}
+		headers.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+
+	return strings.Join([]string{
+		string(req.Header.Method()),
+		canonicalURI(req.URI().PathOriginal()),
+		canonicalQuery(string(req.URI().QueryString())),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+// canonicalURI encodes the path once, as S3 signs it, whatever escaping the
+// client used on the wire.
+func canonicalURI(rawPath []byte) string {
+	path := string(rawPath)
+	if decoded, err := url.PathUnescape(path); err == nil {
+		path = decoded
+	}
+	if path == "" {
+		return "/"
+	}
+
+	return URIEncode(path, false)
+}
+
+func canonicalQuery(rawQuery string) string {
+	type param struct{ key, value string }
+	var params []param
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, "=")
+		if decoded, err := url.PathUnescape(key); err == nil {
+			key = decoded
+		}
+		if decoded, err := url.PathUnescape(value); err == nil {
+			value = decoded
+		}
+		params = append(params, param{key: URIEncode(key, true), value: URIEncode(value, true)})
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i].key != params[j].key {
+			return params[i].key < params[j].key
+		}
+		return params[i].value < params[j].value
+	})
+
+	pairs := make([]string, len(params))
+	for i, p := range params {
+		pairs[i] = p.key + "=" + p.value
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// URIEncode percent-encodes everything but the unreserved characters and,
+// unless encodeSlash is set, the slash.
+func URIEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&0x0f])
+		}
+	}
+
+	return b.String()
+}
+
+func SigningKey(secret, date, region string) []byte {
+	key := HMACSHA256([]byte("AWS4"+secret), date)
+	key = HMACSHA256(key, region)
+	key = HMACSHA256(key, Service)
+
+	return HMACSHA256(key, Terminator)
+}
+
+func HMACSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+func HexSHA256(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
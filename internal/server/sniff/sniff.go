@@ -0,0 +1,213 @@
+// Package sniff identifies the media type of a file from its first bytes and
+// matches media types against the patterns of the server's content policy.
+package sniff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Len is how many leading bytes Detect looks at.
+const Len = 512
+
+// Unknown is the media type of content Detect does not recognize.
+const Unknown = "application/octet-stream"
+
+// signatures cover formats http.DetectContentType does not know, mostly
+// executables and archives. They are tried first.
+var signatures = []struct {
+	mediaType string
+	match     func(data []byte) bool
+}{
+	{"application/x-elf", prefix("\x7fELF")},
+	{"application/vnd.microsoft.portable-executable", isPE},
+	{"application/x-mach-binary", prefix("\xfe\xed\xfa\xce", "\xfe\xed\xfa\xcf", "\xce\xfa\xed\xfe", "\xcf\xfa\xed\xfe")},
+	{"application/x-7z-compressed", prefix("7z\xbc\xaf\x27\x1c")},
+	{"application/x-xz", prefix("\xfd7zXZ\x00")},
+	{"application/zstd", prefix("\x28\xb5\x2f\xfd")},
+	{"application/x-bzip2", func(data []byte) bool {
+		return len(data) >= 4 && string(data[:3]) == "BZh" && '1' <= data[3] && data[3] <= '9'
+	}},
+	{"application/x-tar", func(data []byte) bool {
+		return len(data) >= 262 && string(data[257:262]) == "ustar"
+	}},
+	{"application/vnd.sqlite3", prefix("SQLite format 3\x00")},
+}
+
+// aliases maps the names http.DetectContentType, mime.TypeByExtension and
+// clients use for the same format to one of them. AWS SDKs label untyped
+// objects binary/octet-stream.
+var aliases = map[string]string{
+	"binary/octet-stream":          Unknown,
+	"application/x-gzip":           "application/gzip",
+	"application/x-zip-compressed": "application/zip",
+	"application/x-rar-compressed": "application/vnd.rar",
+	"application/x-pdf":            "application/pdf",
+	"application/javascript":       "text/javascript",
+	"application/x-javascript":     "text/javascript",
+	"text/xml":                     "application/xml",
+	"image/jpg":                    "image/jpeg",
+	"image/x-icon":                 "image/vnd.microsoft.icon",
+	"audio/wave":                   "audio/wav",
+	"audio/x-wav":                  "audio/wav",
+}
+
+// Detect returns the media type of the content starting with data, without
+// parameters. Only the first Len bytes are looked at.
+func Detect(data []byte) string {
+	if len(data) > Len {
+		data = data[:Len]
+	}
+	if len(data) == 0 {
+		return Unknown
+	}
+	for _, sig := range signatures {
+		if sig.match(data) {
+			return sig.mediaType
+		}
+	}
+
+	mediaType := Normalize(http.DetectContentType(data))
+	if mediaType == "text/plain" && bytes.HasPrefix(data, []byte("#!")) {
+		return "text/x-shellscript"
+	}
+
+	return mediaType
+}
+
+// ByExtension returns the media type registered for the extension of name,
+// or "" for an unknown one.
+func ByExtension(name string) string {
+	dot := strings.LastIndexByte(name, '.')
+	if dot < 0 || strings.ContainsRune(name[dot:], '/') {
+		return ""
+	}
+
+	return Normalize(mime.TypeByExtension(strings.ToLower(name[dot:])))
+}
+
+// Normalize drops the parameters of mediaType, lowercases it and maps
+// aliases to one name.
+func Normalize(mediaType string) string {
+	mediaType, _, _ = strings.Cut(mediaType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if alias, ok := aliases[mediaType]; ok {
+		return alias
+	}
+
+	return mediaType
+}
+
+// Compatible tells whether content detected as detected may be what a client
+// declared as declared. Content Detect does not recognize contradicts
+// nothing, and neither does a declaration of "" or Unknown.
+func Compatible(detected, declared string) bool {
+	declared = Normalize(declared)
+	switch {
+	case declared == "" || declared == Unknown || detected == Unknown || detected == declared:
+		return true
+	case detected == "application/xml":
+		return strings.HasSuffix(declared, "+xml")
+	case strings.HasPrefix(detected, "text/"):
+		return textual(declared)
+	case detected == "application/zip":
+		return zipBased(declared)
+	}
+
+	return false
+}
+
+// Refine returns the first of declared that names the detected content more
+// precisely, e.g. application/json for text/plain, or detected itself. The
+// declarations of formats Detect recognizes on its own never win, so that a
+// client cannot relabel them.
+func Refine(detected string, declared ...string) string {
+	if detected != "text/plain" && detected != "application/xml" && detected != "application/zip" {
+		return detected
+	}
+	for _, mediaType := range declared {
+		mediaType = Normalize(mediaType)
+		if mediaType != "" && mediaType != Unknown && Compatible(detected, mediaType) {
+			return mediaType
+		}
+	}
+
+	return detected
+}
+
+// Match tells whether mediaType matches pattern: "*/*", "type/*" or a media
+// type.
+func Match(pattern, mediaType string) bool {
+	pattern = Normalize(pattern)
+	if pattern == "*/*" {
+		return true
+	}
+	if typ, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(mediaType, typ+"/")
+	}
+
+	return pattern == Normalize(mediaType)
+}
+
+// ValidPattern tells whether pattern can be passed to Match.
+func ValidPattern(pattern string) bool {
+	if strings.Contains(pattern, ";") {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(pattern)
+	if err != nil {
+		return false
+	}
+	typ, subtype, ok := strings.Cut(mediaType, "/")
+
+	return ok && typ != "" && subtype != "" && (typ != "*" || subtype == "*")
+}
+
+// textual tells whether mediaType is a text format.
+func textual(mediaType string) bool {
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/x-ndjson", "application/yaml", "application/x-yaml",
+		"application/toml", "application/sql", "application/x-sh", "application/x-httpd-php":
+		return true
+	}
+
+	return false
+}
+
+// zipBased tells whether mediaType is a format stored as a zip archive, like
+// office documents and Java archives.
+func zipBased(mediaType string) bool {
+	return strings.HasSuffix(mediaType, "+zip") || strings.HasPrefix(mediaType, "application/vnd.") ||
+		mediaType == "application/java-archive"
+}
+
+func prefix(magics ...string) func(data []byte) bool {
+	return func(data []byte) bool {
+		for _, magic := range magics {
+			if bytes.HasPrefix(data, []byte(magic)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// isPE recognizes Windows executables by the DOS header and, when it lies
+// within data, the PE signature it points to.
+func isPE(data []byte) bool {
+	if len(data) < 0x40 || string(data[:2]) != "MZ" {
+		return false
+	}
+	offset := binary.LittleEndian.Uint32(data[0x3c:])
+	if uint64(offset)+4 <= uint64(len(data)) {
+		return string(data[offset:offset+4]) == "PE\x00\x00"
+	}
+
+	return !strings.HasPrefix(http.DetectContentType(data), "text/")
+}
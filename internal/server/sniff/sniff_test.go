@@ -0,0 +1,122 @@
+package sniff
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func peImage(offset uint32) []byte {
+	data := make([]byte, 256)
+	copy(data, "MZ")
+	binary.LittleEndian.PutUint32(data[0x3c:], offset)
+	copy(data[offset:], "PE\x00\x00")
+
+	return data
+}
+
+func TestDetect(t *testing.T) {
+	tar := make([]byte, 512)
+	copy(tar[257:], "ustar\x0000")
+
+	tests := []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{name: "empty", in: nil, want: Unknown},
+		{name: "png", in: []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), want: "image/png"},
+		{name: "pdf", in: []byte("%PDF-1.7\n"), want: "application/pdf"},
+		{name: "gzip", in: []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00"), want: "application/gzip"},
+		{name: "zip", in: []byte("PK\x03\x04\x14\x00"), want: "application/zip"},
+		{name: "elf", in: []byte("\x7fELF\x02\x01\x01"), want: "application/x-elf"},
+		{name: "pe", in: peImage(0x80), want: "application/vnd.microsoft.portable-executable"},
+		{name: "text-starting-with-mz", in: []byte(strings.Repeat("MZ is a text file ", 8)), want: "text/plain"},
+		{name: "xz", in: []byte("\xfd7zXZ\x00\x00"), want: "application/x-xz"},
+		{name: "bzip2", in: []byte("BZh91AY&SY"), want: "application/x-bzip2"},
+		{name: "tar", in: tar, want: "application/x-tar"},
+		{name: "script", in: []byte("#!/bin/sh\necho hi\n"), want: "text/x-shellscript"},
+		{name: "text", in: []byte("hello world"), want: "text/plain"},
+		{name: "xml", in: []byte("<?xml version=\"1.0\"?><a/>"), want: "application/xml"},
+		{name: "binary", in: []byte{0x00, 0x01, 0x02, 0xff}, want: Unknown},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Detect(tc.in); got != tc.want {
+				t.Fatalf("unexpected media type: got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCompatible(t *testing.T) {
+	tests := []struct {
+		detected string
+		declared string
+		want     bool
+	}{
+		{detected: "image/png", declared: "image/png", want: true},
+		{detected: "image/png", declared: "", want: true},
+		{detected: "image/png", declared: Unknown, want: true},
+		{detected: "image/png", declared: "binary/octet-stream", want: true},
+		{detected: "image/png", declared: "image/jpeg", want: false},
+		{detected: "application/gzip", declared: "application/x-gzip", want: true},
+		{detected: "text/plain", declared: "application/json; charset=utf-8", want: true},
+		{detected: "text/plain", declared: "image/png", want: false},
+		{detected: "application/xml", declared: "image/svg+xml", want: true},
+		{detected: "application/zip", declared: "application/vnd.openxmlformats-officedocument.wordprocessingml.document", want: true},
+		{detected: "application/zip", declared: "application/pdf", want: false},
+		{detected: "application/x-elf", declared: "application/pdf", want: false},
+		{detected: Unknown, declared: "image/png", want: true},
+	}
+
+	for _, tc := range tests {
+		if got := Compatible(tc.detected, tc.declared); got != tc.want {
+			t.Fatalf("Compatible(%q, %q): got %v want %v", tc.detected, tc.declared, got, tc.want)
+		}
+	}
+}
+
+func TestRefine(t *testing.T) {
+	if got := Refine("text/plain", "", Unknown, "application/json"); got != "application/json" {
+		t.Fatalf("unexpected refined type: got %q want %q", got, "application/json")
+	}
+	if got := Refine("text/plain", "image/png"); got != "text/plain" {
+		t.Fatalf("incompatible declaration was used: got %q want %q", got, "text/plain")
+	}
+	if got := Refine(Unknown, "image/png"); got != Unknown {
+		t.Fatalf("unknown content was relabeled: got %q want %q", got, Unknown)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern   string
+		mediaType string
+		want      bool
+	}{
+		{pattern: "*/*", mediaType: "image/png", want: true},
+		{pattern: "image/*", mediaType: "image/png", want: true},
+		{pattern: "image/*", mediaType: "imagex/png", want: false},
+		{pattern: "Application/X-GZIP", mediaType: "application/gzip", want: true},
+		{pattern: "application/pdf", mediaType: "application/zip", want: false},
+	}
+
+	for _, tc := range tests {
+		if got := Match(tc.pattern, tc.mediaType); got != tc.want {
+			t.Fatalf("Match(%q, %q): got %v want %v", tc.pattern, tc.mediaType, got, tc.want)
+		}
+	}
+
+	for _, pattern := range []string{"image/*", "*/*", "application/pdf"} {
+		if !ValidPattern(pattern) {
+			t.Fatalf("pattern %q is valid", pattern)
+		}
+	}
+	for _, pattern := range []string{"", "image", "*/png", "image/", "text/plain; charset=utf-8"} {
+		if ValidPattern(pattern) {
+			t.Fatalf("pattern %q is not valid", pattern)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin
+
+package storage
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func freeSpace(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, fmt.Errorf("statfs %q: %w", dir, err)
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
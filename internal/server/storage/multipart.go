@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const partsDirName = ".parts"
+
+var (
+	// ErrInvalidUploadID is returned for multipart upload ids that are not
+	// plain lowercase hex, which keeps them from addressing anything outside
+	// the parts directory.
+	ErrInvalidUploadID  = errors.New("invalid upload id")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// Part is one stored part of a multipart upload.
+type Part struct {
+	Number int
+	Size   int64
+	SHA256 string
+	MD5    string
+}
+
+// MultipartDir is the on-disk state of a multipart upload, used to clean up
+// uploads that were abandoned, e.g. across a restart.
+type MultipartDir struct {
+	UploadID string
+	ModTime  time.Time
+}
+
+// PutPart stores part number of uploadID, replacing an earlier attempt of the
+// same part. The part only becomes visible once it has been written in full
+// and, when expectedSHA256 is set, verified; on a mismatch the error wraps
+// ErrChecksumMismatch and the returned Part carries the actual checksum.
+func (l *Local) PutPart(uploadID string, number int, r io.Reader, expectedSHA256 string) (Part, error) {
+	dir, err := l.partsPath(uploadID)
+	if err != nil {
+		return Part{}, err
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return Part{}, fmt.Errorf("create parts dir: %w", err)
+	}
+
+	tempFile, err := os.CreateTemp(dir, "part-*.tmp")
+	if err != nil {
+		return Part{}, fmt.Errorf("create part file: %w", err)
+	}
+
+	hasher, md5Hasher := sha256.New(), md5.New()
+	n, copyErr := io.Copy(io.MultiWriter(tempFile, hasher, md5Hasher), r)
+	closeErr := tempFile.Close()
+	if copyErr != nil {
+		_ = os.Remove(tempFile.Name())
+		return Part{}, fmt.Errorf("write part %d: %w", number, copyErr)
+	}
+	if closeErr != nil {
+		_ = os.Remove(tempFile.Name())
+		return Part{}, fmt.Errorf("close part %d: %w", number, closeErr)
+	}
+	part := Part{
+		Number: number,
+		Size:   n,
+		SHA256: hex.EncodeToString(hasher.Sum(nil)),
+		MD5:    hex.EncodeToString(md5Hasher.Sum(nil)),
+	}
+	if expectedSHA256 != "" && part.SHA256 != expectedSHA256 {
+		_ = os.Remove(tempFile.Name())
+		return part, fmt.Errorf("%w: part %d", ErrChecksumMismatch, number)
+	}
+	if err := os.Rename(tempFile.Name(), filepath.Join(dir, partFileName(number))); err != nil {
+		_ = os.Remove(tempFile.Name())
+		return Part{}, fmt.Errorf("store part %d: %w", number, err)
+	}
+
+	return part, nil
+}
+
+// AssembleParts concatenates the given parts of uploadID, in order, into a
+// staged object named name. The parts are left in place; DeleteParts removes
+// them once the object is committed or the upload is given up.
+func (l *Local) AssembleParts(name, uploadID string, numbers []int) (*Staged, error) {
+	dir, err := l.partsPath(uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	readers := make([]io.Reader, 0, len(numbers))
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			_ = file.Close()
+		}
+	}()
+	for _, number := range numbers {
+		file, err := os.Open(filepath.Join(dir, partFileName(number)))
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: part %d of upload %s", ErrNotFound, number, uploadID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("open part %d: %w", number, err)
+		}
+		files = append(files, file)
+		readers = append(readers, file)
+	}
+
+	return l.Stage(name, io.MultiReader(readers...))
+}
+
+// DeleteParts removes every part of uploadID. Deleting an unknown upload is
+// not an error.
+func (l *Local) DeleteParts(uploadID string) error {
+	dir, err := l.partsPath(uploadID)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("delete parts of upload %s: %w", uploadID, err)
+	}
+
+	return nil
+}
+
+// ListMultipart returns the uploads that have parts on disk. ModTime is the
+// last time a part was added.
+func (l *Local) ListMultipart() ([]MultipartDir, error) {
+	entries, err := os.ReadDir(filepath.Join(l.root, partsDirName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("list multipart uploads: %w", err)
+	}
+
+	dirs := make([]MultipartDir, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() || ValidateUploadID(entry.Name()) != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		dirs = append(dirs, MultipartDir{UploadID: entry.Name(), ModTime: info.ModTime()})
+	}
+
+	return dirs, nil
+}
+
+// ValidateUploadID accepts the lowercase hex ids generated for multipart
+// uploads.
+func ValidateUploadID(uploadID string) error {
+	if uploadID == "" || len(uploadID) > 64 {
+		return fmt.Errorf("%w: %q", ErrInvalidUploadID, uploadID)
+	}
+	for _, c := range uploadID {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return fmt.Errorf("%w: %q", ErrInvalidUploadID, uploadID)
+		}
+	}
+
+	return nil
+}
+
+func (l *Local) partsPath(uploadID string) (string, error) {
+	if err := ValidateUploadID(uploadID); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(l.root, partsDirName, uploadID), nil
+}
+
+func partFileName(number int) string {
+	return strconv.Itoa(number) + ".part"
+}
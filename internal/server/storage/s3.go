@@ -0,0 +1,973 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"client-server-fasthttp-test/internal/server/sigv4"
+
+	"github.com/bytedance/sonic"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// MinS3PartSize is the smallest part S3 accepts but for the last one.
+	MinS3PartSize     = 5 << 20
+	DefaultS3PartSize = 8 << 20
+
+	s3ClientTimeout = time.Minute
+	s3MaxErrorBody  = 64 << 10
+	// s3MaxCopySize is the largest object CopyObject accepts; larger ones
+	// are copied through the server.
+	s3MaxCopySize = 5 << 30
+
+	headerAmzCopySource = "X-Amz-Copy-Source"
+)
+
+// S3Config configures an S3 backend. Buckets are addressed path-style, so
+// any S3-compatible service works.
+type S3Config struct {
+	// Endpoint is the base URL of the S3 API, e.g.
+	// https://s3.eu-west-1.amazonaws.com.
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	// Prefix is prepended to every key so that a bucket can be shared.
+	Prefix string
+	// PartSize is the size of the parts objects are uploaded in and so the
+	// memory held per upload. Zero means DefaultS3PartSize.
+	PartSize int64
+	// Client sends the requests. It should stream response bodies; nil
+	// means a client with StreamResponseBody and one minute timeouts.
+	Client *fasthttp.Client
+}
+
+// S3 stores objects in an S3 bucket. Uploads are streamed in parts through
+// S3 multipart uploads, which stay invisible until Commit completes them.
+// Checksums are kept in hidden sidecar objects, like the metadata files of
+// Local.
+type S3 struct {
+	client    *fasthttp.Client
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	prefix    string
+	partSize  int64
+	// commitMu serializes the commits of this process, which check their
+	// Condition and archive the current version. Other writers to the
+	// bucket are not covered.
+	commitMu sync.Mutex
+}
+
+var _ Backend = (*S3)(nil)
+
+func NewS3(cfg S3Config) (*S3, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" || cfg.Region == "" || cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, errors.New("s3 storage requires a bucket, region and access keys")
+	}
+	if cfg.PartSize < 0 {
+		return nil, fmt.Errorf("invalid s3 part size %d", cfg.PartSize)
+	}
+
+	client := cfg.Client
+	if client == nil {
+		client = &fasthttp.Client{
+			StreamResponseBody: true,
+			ReadTimeout:        s3ClientTimeout,
+			WriteTimeout:       s3ClientTimeout,
+		}
+	}
+	partSize := cfg.PartSize
+	if partSize == 0 {
+		partSize = DefaultS3PartSize
+	}
+
+	return &S3{
+		client:    client,
+		endpoint:  strings.TrimSuffix(endpoint.String(), "/"),
+		bucket:    cfg.Bucket,
+		region:    cfg.Region,
+		accessKey: cfg.AccessKey,
+		secretKey: cfg.SecretKey,
+		prefix:    cfg.Prefix,
+		partSize:  partSize,
+	}, nil
+}
+
+func (s *S3) Stage(name string, r io.Reader) (*Staged, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+
+	upload, err := s.upload(s.key(name), r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Staged{
+		object: Object{Name: name, Size: upload.size, SHA256: upload.sha256, MD5: upload.md5},
+		commit: func(obj Object, condition Condition) (Object, error) {
+			s.commitMu.Lock()
+			defer s.commitMu.Unlock()
+
+			if err := condition.Check(s, name); err != nil {
+				return Object{}, err
+			}
+			current, err := s.Stat(name)
+			exists := err == nil
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return Object{}, err
+			}
+			if exists {
+				if err := s.archive(current); err != nil {
+					return Object{}, err
+				}
+			}
+			// rollback puts back the sidecar of the current version, whose
+			// archived copy is then redundant.
+			rollback := func() {
+				if !exists {
+					_ = s.deleteKey(s.metaKey(name))
+					return
+				}
+				_ = s.writeMeta(s.metaKey(name), newObjectMeta(current))
+				_ = s.deleteKey(s.versionKey(name, current.VersionID))
+				_ = s.deleteKey(s.versionKey(name, current.VersionID) + ".json")
+			}
+
+			obj.VersionID = newVersionID()
+			if err := s.writeMeta(s.metaKey(name), newObjectMeta(obj)); err != nil {
+				rollback()
+				return Object{}, err
+			}
+			if err := upload.complete(); err != nil {
+				rollback()
+				return Object{}, fmt.Errorf("commit object %q: %w", name, err)
+			}
+
+			obj.ModTime = time.Now()
+			return obj, nil
+		},
+		discard: upload.abort,
+	}, nil
+}
+
+func (s *S3) Stat(name string) (Object, error) {
+	if err := ValidateName(name); err != nil {
+		return Object{}, err
+	}
+
+	obj, err := s.stat(s.key(name), s.metaKey(name), name, NullVersionID)
+	if errors.Is(err, ErrNotFound) {
+		return Object{}, fmt.Errorf("%w: %q", ErrNotFound, name)
+	}
+	if err != nil {
+		return Object{}, fmt.Errorf("stat object %q: %w", name, err)
+	}
+
+	return obj, nil
+}
+
+func (s *S3) Open(name string) (io.ReadCloser, Object, error) {
+	obj, err := s.Stat(name)
+	if err != nil {
+		return nil, Object{}, err
+	}
+
+	body, err := s.get(s.key(name))
+	if errors.Is(err, ErrNotFound) {
+		return nil, Object{}, fmt.Errorf("%w: %q", ErrNotFound, name)
+	}
+	if err != nil {
+		return nil, Object{}, fmt.Errorf("open object %q: %w", name, err)
+	}
+
+	return body, obj, nil
+}
+
+func (s *S3) Delete(name string) error {
+	// S3 deletes missing keys without complaint.
+	if _, err := s.Stat(name); err != nil {
+		return err
+	}
+
+	if err := s.deleteKey(s.key(name)); err != nil {
+		return fmt.Errorf("delete object %q: %w", name, err)
+	}
+	if err := s.deleteKey(s.metaKey(name)); err != nil {
+		return fmt.Errorf("delete object metadata %q: %w", name, err)
+	}
+	entries, err := s.list(s.key(versionsDir(name) + "/"))
+	if err != nil {
+		return fmt.Errorf("delete versions of %q: %w", name, err)
+	}
+	for _, entry := range entries {
+		if err := s.deleteKey(entry.Key); err != nil {
+			return fmt.Errorf("delete versions of %q: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// List leaves SHA256 and Metadata empty, as S3 listings carry no metadata;
+// Stat has them.
+// MD5 is set for objects that were uploaded in a single part.
+func (s *S3) List(prefix string) ([]Object, error) {
+	entries, err := s.list(s.key(prefix))
+	if err != nil {
+		return nil, fmt.Errorf("list objects: %w", err)
+	}
+
+	var objects []Object
+	for _, entry := range entries {
+		name := strings.TrimPrefix(entry.Key, s.prefix)
+		// Skips the metadata, parts and probe objects.
+		if ValidateName(name) != nil {
+			continue
+		}
+		modTime, _ := time.Parse(time.RFC3339, entry.LastModified)
+		objects = append(objects, Object{Name: name, Size: entry.Size, MD5: md5FromETag(entry.ETag), ModTime: modTime})
+	}
+
+	return objects, nil
+}
+
+// CheckWritable puts and deletes a probe object.
+func (s *S3) CheckWritable() error {
+	var id [8]byte
+	_, _ = rand.Read(id[:])
+	key := s.key(tempDirName + "/probe-" + hex.EncodeToString(id[:]))
+
+	if err := s.put(key, nil); err != nil {
+		return fmt.Errorf("put probe object: %w", err)
+	}
+	if err := s.deleteKey(key); err != nil {
+		return fmt.Errorf("delete probe object: %w", err)
+	}
+
+	return nil
+}
+
+func (s *S3) FreeSpace() (uint64, error) {
+	return 0, fmt.Errorf("free space of s3 storage: %w", ErrUnsupported)
+}
+
+func (s *S3) PutPart(uploadID string, number int, r io.Reader, expectedSHA256 string) (Part, error) {
+	if err := ValidateUploadID(uploadID); err != nil {
+		return Part{}, err
+	}
+
+	upload, err := s.upload(s.partKey(uploadID, number), r)
+	if err != nil {
+		return Part{}, fmt.Errorf("write part %d: %w", number, err)
+	}
+	part := Part{Number: number, Size: upload.size, SHA256: upload.sha256, MD5: upload.md5}
+	if expectedSHA256 != "" && part.SHA256 != expectedSHA256 {
+		_ = upload.abort()
+		return part, fmt.Errorf("%w: part %d", ErrChecksumMismatch, number)
+	}
+	if err := upload.complete(); err != nil {
+		_ = upload.abort()
+		return Part{}, fmt.Errorf("store part %d: %w", number, err)
+	}
+
+	return part, nil
+}
+
+func (s *S3) AssembleParts(name, uploadID string, numbers []int) (*Staged, error) {
+	if err := ValidateUploadID(uploadID); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, len(numbers))
+	for i, number := range numbers {
+		keys[i] = s.partKey(uploadID, number)
+		resp, err := s.do(fasthttp.MethodHead, keys[i], "", nil)
+		if err != nil {
+			return nil, fmt.Errorf("stat part %d: %w", number, err)
+		}
+		status := resp.StatusCode()
+		fasthttp.ReleaseResponse(resp)
+		if status == fasthttp.StatusNotFound {
+			return nil, fmt.Errorf("%w: part %d of upload %s", ErrNotFound, number, uploadID)
+		}
+		if status != fasthttp.StatusOK {
+			return nil, fmt.Errorf("stat part %d: unexpected status %d", number, status)
+		}
+	}
+
+	parts := &s3PartsReader{s3: s, keys: keys}
+	defer parts.Close()
+
+	return s.Stage(name, parts)
+}
+
+func (s *S3) DeleteParts(uploadID string) error {
+	if err := ValidateUploadID(uploadID); err != nil {
+		return err
+	}
+
+	entries, err := s.list(s.key(partsDirName + "/" + uploadID + "/"))
+	if err != nil {
+		return fmt.Errorf("delete parts of upload %s: %w", uploadID, err)
+	}
+	for _, entry := range entries {
+		if err := s.deleteKey(entry.Key); err != nil {
+			return fmt.Errorf("delete parts of upload %s: %w", uploadID, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *S3) ListMultipart() ([]MultipartDir, error) {
+	prefix := s.key(partsDirName + "/")
+	entries, err := s.list(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("list multipart uploads: %w", err)
+	}
+
+	var dirs []MultipartDir
+	index := make(map[string]int)
+	for _, entry := range entries {
+		uploadID, _, _ := strings.Cut(strings.TrimPrefix(entry.Key, prefix), "/")
+		if ValidateUploadID(uploadID) != nil {
+			continue
+		}
+		modTime, _ := time.Parse(time.RFC3339, entry.LastModified)
+		i, ok := index[uploadID]
+		if !ok {
+			index[uploadID] = len(dirs)
+			dirs = append(dirs, MultipartDir{UploadID: uploadID, ModTime: modTime})
+			continue
+		}
+		if modTime.After(dirs[i].ModTime) {
+			dirs[i].ModTime = modTime
+		}
+	}
+
+	return dirs, nil
+}
+
+// ListTemp returns nothing: objects are staged as native S3 multipart
+// uploads, and those left over by interrupted uploads are best removed by a
+// lifecycle rule on the bucket (AbortIncompleteMultipartUpload).
+func (s *S3) ListTemp() ([]Object, error) {
+	return nil, nil
+}
+
+// CreateTemp uses the system temp dir, as S3 has no local temp area.
+func (s *S3) CreateTemp(pattern string) (*os.File, error) {
+	return os.CreateTemp("", pattern)
+}
+
+func (s *S3) DeleteTemp(name string) error {
+	return fmt.Errorf("delete temp object %q: %w", name, ErrUnsupported)
+}
+
+// ListVersions lists the prior versions under the versions prefix of name,
+// which takes a request per version for its sidecar.
+func (s *S3) ListVersions(name string) ([]Object, error) {
+	current, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := s.key(versionsDir(name) + "/")
+	entries, err := s.list(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("list versions of %q: %w", name, err)
+	}
+	var versions []Object
+	for _, entry := range entries {
+		versionID := strings.TrimPrefix(entry.Key, prefix)
+		if ValidateVersionID(versionID) != nil {
+			continue
+		}
+		version, err := s.statVersion(name, versionID)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	sortVersions(versions)
+
+	return append([]Object{current}, versions...), nil
+}
+
+func (s *S3) StatVersion(name, versionID string) (Object, error) {
+	if err := ValidateVersionID(versionID); err != nil {
+		return Object{}, err
+	}
+	current, err := s.Stat(name)
+	if err != nil {
+		return Object{}, err
+	}
+	if current.VersionID == versionID {
+		return current, nil
+	}
+
+	return s.statVersion(name, versionID)
+}
+
+func (s *S3) OpenVersion(name, versionID string) (io.ReadCloser, Object, error) {
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+
+	obj, err := s.StatVersion(name, versionID)
+	if err != nil {
+		return nil, Object{}, err
+	}
+
+	key := s.versionKey(name, versionID)
+	if current, err := s.Stat(name); err == nil && current.VersionID == versionID {
+		key = s.key(name)
+	}
+	body, err := s.get(key)
+	if errors.Is(err, ErrNotFound) {
+		return nil, Object{}, fmt.Errorf("%w: %q version %s", ErrNotFound, name, versionID)
+	}
+	if err != nil {
+		return nil, Object{}, fmt.Errorf("open object %q version %s: %w", name, versionID, err)
+	}
+
+	return body, obj, nil
+}
+
+func (s *S3) statVersion(name, versionID string) (Object, error) {
+	key := s.versionKey(name, versionID)
+	obj, err := s.stat(key, key+".json", name, versionID)
+	if errors.Is(err, ErrNotFound) {
+		return Object{}, fmt.Errorf("%w: %q version %s", ErrNotFound, name, versionID)
+	}
+	if err != nil {
+		return Object{}, fmt.Errorf("stat object %q version %s: %w", name, versionID, err)
+	}
+
+	return obj, nil
+}
+
+// archive copies the current version of an object to its versions prefix
+// before Commit replaces it. The caller holds commitMu.
+func (s *S3) archive(current Object) error {
+	key := s.versionKey(current.Name, current.VersionID)
+	if err := s.copyKey(s.key(current.Name), key, current.Size); err != nil {
+		return fmt.Errorf("keep version %s of %q: %w", current.VersionID, current.Name, err)
+	}
+	if err := s.writeMeta(key+".json", versionMeta(current)); err != nil {
+		_ = s.deleteKey(key)
+		return err
+	}
+
+	return nil
+}
+
+// copyKey copies src to dst, within the bucket when CopyObject allows it.
+func (s *S3) copyKey(src, dst string, size int64) error {
+	if size > s3MaxCopySize {
+		body, err := s.get(src)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		upload, err := s.upload(dst, body)
+		if err != nil {
+			return err
+		}
+		if err := upload.complete(); err != nil {
+			_ = upload.abort()
+			return err
+		}
+		return nil
+	}
+
+	resp, err := s.do(fasthttp.MethodPut, dst, "", nil, headerAmzCopySource, "/"+s.bucket+"/"+sigv4.URIEncode(src, false))
+	if err != nil {
+		return err
+	}
+	defer fasthttp.ReleaseResponse(resp)
+	// Like completions, copies may fail with 200 and an error body.
+	if resp.StatusCode() != fasthttp.StatusOK || bytes.Contains(resp.Body(), []byte("<Error>")) {
+		return s3ResponseErr(resp)
+	}
+
+	return nil
+}
+
+func (s *S3) key(name string) string {
+	return s.prefix + name
+}
+
+func (s *S3) metaKey(name string) string {
+	return s.key(metaDirName + "/" + name + ".json")
+}
+
+func (s *S3) partKey(uploadID string, number int) string {
+	return s.key(partsDirName + "/" + uploadID + "/" + partFileName(number))
+}
+
+func (s *S3) versionKey(name, versionID string) string {
+	return s.key(versionsDir(name) + "/" + versionID)
+}
+
+// stat heads key and reads its sidecar at metaKey; versionID is used when the
+// sidecar has none. A missing key is ErrNotFound.
+func (s *S3) stat(key, metaKey, name, versionID string) (Object, error) {
+	resp, err := s.do(fasthttp.MethodHead, key, "", nil)
+	if err != nil {
+		return Object{}, err
+	}
+	defer fasthttp.ReleaseResponse(resp)
+	if resp.StatusCode() == fasthttp.StatusNotFound {
+		return Object{}, ErrNotFound
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return Object{}, s3ResponseErr(resp)
+	}
+
+	meta, err := s.readMeta(metaKey)
+	if err != nil {
+		return Object{}, err
+	}
+	modTime, _ := http.ParseTime(string(resp.Header.Peek(fasthttp.HeaderLastModified)))
+	obj := meta.object(name, versionID, int64(resp.Header.ContentLength()), modTime)
+	if obj.MD5 == "" {
+		obj.MD5 = md5FromETag(string(resp.Header.Peek(fasthttp.HeaderETag)))
+	}
+
+	return obj, nil
+}
+
+// readMeta returns the sidecar at key, or an empty one when there is none.
+func (s *S3) readMeta(key string) (objectMeta, error) {
+	body, err := s.get(key)
+	if errors.Is(err, ErrNotFound) {
+		return objectMeta{}, nil
+	}
+	if err != nil {
+		return objectMeta{}, fmt.Errorf("read object metadata %q: %w", key, err)
+	}
+	defer body.Close()
+
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return objectMeta{}, fmt.Errorf("read object metadata %q: %w", key, err)
+	}
+	var meta objectMeta
+	if err := sonic.Unmarshal(raw, &meta); err != nil {
+		return objectMeta{}, fmt.Errorf("decode object metadata %q: %w", key, err)
+	}
+
+	return meta, nil
+}
+
+func (s *S3) writeMeta(key string, meta objectMeta) error {
+	raw, err := sonic.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("encode object metadata %q: %w", key, err)
+	}
+	if err := s.put(key, raw); err != nil {
+		return fmt.Errorf("write object metadata %q: %w", key, err)
+	}
+
+	return nil
+}
+
+// s3Upload is an object written to S3 but not visible yet: either a body
+// small enough for one part, put on complete, or a multipart upload whose
+// parts have been sent.
+type s3Upload struct {
+	s3     *S3
+	key    string
+	size   int64
+	sha256 string
+	md5    string
+
+	small    []byte
+	uploadID string
+	etags    []string
+	done     bool
+}
+
+// upload reads r in parts of partSize, hashing it, and sends every full part
+// as soon as it has been read, so at most one part is held in memory.
+func (s *S3) upload(key string, r io.Reader) (*s3Upload, error) {
+	u := &s3Upload{s3: s, key: key}
+	hasher, md5Hasher := sha256.New(), md5.New()
+	buf := make([]byte, s.partSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		last := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !last {
+			_ = u.abort()
+			return nil, fmt.Errorf("read upload: %w", err)
+		}
+		hasher.Write(buf[:n])
+		md5Hasher.Write(buf[:n])
+		u.size += int64(n)
+
+		if last && u.uploadID == "" {
+			u.small = buf[:n]
+			break
+		}
+		if u.uploadID == "" {
+			if err := u.create(); err != nil {
+				return nil, err
+			}
+		}
+		if n > 0 {
+			if err := u.putPart(buf[:n]); err != nil {
+				_ = u.abort()
+				return nil, err
+			}
+		}
+		if last {
+			break
+		}
+	}
+
+	u.sha256 = hex.EncodeToString(hasher.Sum(nil))
+	u.md5 = hex.EncodeToString(md5Hasher.Sum(nil))
+	return u, nil
+}
+
+func (u *s3Upload) create() error {
+	resp, err := u.s3.do(fasthttp.MethodPost, u.key, "uploads=", nil)
+	if err != nil {
+		return fmt.Errorf("create multipart upload: %w", err)
+	}
+	defer fasthttp.ReleaseResponse(resp)
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return fmt.Errorf("create multipart upload: %w", s3ResponseErr(resp))
+	}
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp.Body(), &result); err != nil || result.UploadID == "" {
+		return fmt.Errorf("create multipart upload: invalid response %q", resp.Body())
+	}
+	u.uploadID = result.UploadID
+
+	return nil
+}
+
+func (u *s3Upload) putPart(data []byte) error {
+	number := len(u.etags) + 1
+	query := "partNumber=" + strconv.Itoa(number) + "&uploadId=" + sigv4.URIEncode(u.uploadID, true)
+	resp, err := u.s3.do(fasthttp.MethodPut, u.key, query, data)
+	if err != nil {
+		return fmt.Errorf("upload part %d: %w", number, err)
+	}
+	defer fasthttp.ReleaseResponse(resp)
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return fmt.Errorf("upload part %d: %w", number, s3ResponseErr(resp))
+	}
+	u.etags = append(u.etags, string(resp.Header.Peek(fasthttp.HeaderETag)))
+
+	return nil
+}
+
+// complete makes the object visible.
+func (u *s3Upload) complete() error {
+	if u.uploadID == "" {
+		if err := u.s3.put(u.key, u.small); err != nil {
+			return err
+		}
+		u.done = true
+		return nil
+	}
+
+	var body bytes.Buffer
+	body.WriteString("<CompleteMultipartUpload>")
+	for i, etag := range u.etags {
+		body.WriteString("<Part><PartNumber>" + strconv.Itoa(i+1) + "</PartNumber><ETag>")
+		_ = xml.EscapeText(&body, []byte(etag))
+		body.WriteString("</ETag></Part>")
+	}
+	body.WriteString("</CompleteMultipartUpload>")
+
+	resp, err := u.s3.do(fasthttp.MethodPost, u.key, "uploadId="+sigv4.URIEncode(u.uploadID, true), body.Bytes())
+	if err != nil {
+		return fmt.Errorf("complete multipart upload: %w", err)
+	}
+	defer fasthttp.ReleaseResponse(resp)
+	// S3 may report a failed completion with 200 and an error body.
+	if resp.StatusCode() != fasthttp.StatusOK || bytes.Contains(resp.Body(), []byte("<Error>")) {
+		return fmt.Errorf("complete multipart upload: %w", s3ResponseErr(resp))
+	}
+	u.done = true
+
+	return nil
+}
+
+// abort gives up an upload that has not been completed.
+func (u *s3Upload) abort() error {
+	if u.done || u.uploadID == "" {
+		return nil
+	}
+
+	resp, err := u.s3.do(fasthttp.MethodDelete, u.key, "uploadId="+sigv4.URIEncode(u.uploadID, true), nil)
+	if err != nil {
+		return fmt.Errorf("abort multipart upload: %w", err)
+	}
+	defer fasthttp.ReleaseResponse(resp)
+	if resp.StatusCode() != fasthttp.StatusNoContent && resp.StatusCode() != fasthttp.StatusNotFound {
+		return fmt.Errorf("abort multipart upload: %w", s3ResponseErr(resp))
+	}
+	u.done = true
+
+	return nil
+}
+
+// s3PartsReader reads the given objects one after another, opening each
+// only when the previous one is done.
+type s3PartsReader struct {
+	s3      *S3
+	keys    []string
+	current io.ReadCloser
+}
+
+func (p *s3PartsReader) Read(b []byte) (int, error) {
+	for {
+		if p.current == nil {
+			if len(p.keys) == 0 {
+				return 0, io.EOF
+			}
+			body, err := p.s3.get(p.keys[0])
+			if err != nil {
+				return 0, fmt.Errorf("open part: %w", err)
+			}
+			p.current, p.keys = body, p.keys[1:]
+		}
+
+		n, err := p.current.Read(b)
+		if errors.Is(err, io.EOF) {
+			_ = p.current.Close()
+			p.current = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (p *s3PartsReader) Close() error {
+	if p.current == nil {
+		return nil
+	}
+
+	err := p.current.Close()
+	p.current = nil
+	return err
+}
+
+type s3ListEntry struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+}
+
+// list returns every key under prefix, following continuation tokens.
+func (s *S3) list(prefix string) ([]s3ListEntry, error) {
+	var entries []s3ListEntry
+	token := ""
+	for {
+		query := "list-type=2&prefix=" + sigv4.URIEncode(prefix, true)
+		if token != "" {
+			query += "&continuation-token=" + sigv4.URIEncode(token, true)
+		}
+		resp, err := s.do(fasthttp.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode() != fasthttp.StatusOK {
+			err := s3ResponseErr(resp)
+			fasthttp.ReleaseResponse(resp)
+			return nil, err
+		}
+
+		var page struct {
+			Contents              []s3ListEntry `xml:"Contents"`
+			IsTruncated           bool          `xml:"IsTruncated"`
+			NextContinuationToken string        `xml:"NextContinuationToken"`
+		}
+		err = xml.Unmarshal(resp.Body(), &page)
+		fasthttp.ReleaseResponse(resp)
+		if err != nil {
+			return nil, fmt.Errorf("decode object listing: %w", err)
+		}
+		entries = append(entries, page.Contents...)
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return entries, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *S3) put(key string, data []byte) error {
+	resp, err := s.do(fasthttp.MethodPut, key, "", data)
+	if err != nil {
+		return err
+	}
+	defer fasthttp.ReleaseResponse(resp)
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return s3ResponseErr(resp)
+	}
+
+	return nil
+}
+
+// get opens key for reading; a missing key is ErrNotFound.
+func (s *S3) get(key string) (io.ReadCloser, error) {
+	resp, err := s.do(fasthttp.MethodGet, key, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() == fasthttp.StatusNotFound {
+		fasthttp.ReleaseResponse(resp)
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		err := s3ResponseErr(resp)
+		fasthttp.ReleaseResponse(resp)
+		return nil, err
+	}
+
+	body := resp.BodyStream()
+	if body == nil {
+		body = bytes.NewReader(resp.Body())
+	}
+	return &s3Body{Reader: body, resp: resp}, nil
+}
+
+func (s *S3) deleteKey(key string) error {
+	resp, err := s.do(fasthttp.MethodDelete, key, "", nil)
+	if err != nil {
+		return err
+	}
+	defer fasthttp.ReleaseResponse(resp)
+	if resp.StatusCode() != fasthttp.StatusNoContent && resp.StatusCode() != fasthttp.StatusOK {
+		return s3ResponseErr(resp)
+	}
+
+	return nil
+}
+
+// do sends a signed request for key, or for the bucket when key is empty.
+// headers are name/value pairs, set before signing. The caller releases the
+// response.
+func (s *S3) do(method, key, query string, body []byte, headers ...string) (*fasthttp.Response, error) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	uri := s.endpoint + "/" + s.bucket
+	if key != "" {
+		uri += "/" + sigv4.URIEncode(key, false)
+	}
+	if query != "" {
+		uri += "?" + query
+	}
+	req.URI().DisablePathNormalizing = true
+	req.SetRequestURI(uri)
+	req.Header.SetMethod(method)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	payloadHash := sigv4.EmptySHA256
+	if body != nil {
+		req.SetBodyRaw(body)
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	sigv4.Sign(req, s.accessKey, s.secretKey, s.region, payloadHash, time.Now())
+
+	resp := fasthttp.AcquireResponse()
+	if err := s.client.Do(req, resp); err != nil {
+		fasthttp.ReleaseResponse(resp)
+		return nil, fmt.Errorf("%s %s: %w", method, key, err)
+	}
+
+	return resp, nil
+}
+
+// s3Body releases the streamed response once the object has been read.
+type s3Body struct {
+	io.Reader
+	resp *fasthttp.Response
+}
+
+func (b *s3Body) Close() error {
+	err := b.resp.CloseBodyStream()
+	fasthttp.ReleaseResponse(b.resp)
+	return err
+}
+
+// S3Error is an error response of the S3 API.
+type S3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: unexpected status %d", e.StatusCode)
+	}
+
+	return fmt.Sprintf("s3: %s: %s", e.Code, e.Message)
+}
+
+func s3ResponseErr(resp *fasthttp.Response) error {
+	s3Err := &S3Error{StatusCode: resp.StatusCode()}
+	body := resp.Body()
+	if len(body) > s3MaxErrorBody {
+		body = body[:s3MaxErrorBody]
+	}
+	_ = xml.Unmarshal(body, s3Err)
+
+	return s3Err
+}
+
+// md5FromETag returns the MD5 an ETag carries, which is the case for
+// objects uploaded in a single part.
+func md5FromETag(etag string) string {
+	etag = strings.Trim(etag, `"`)
+	if len(etag) != md5.Size*2 {
+		return ""
+	}
+	if _, err := hex.DecodeString(etag); err != nil {
+		return ""
+	}
+
+	return etag
+}
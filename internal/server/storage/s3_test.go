@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"client-server-fasthttp-test/internal/server/storage/s3fake"
+)
+
+const testPartSize = 1024
+
+func newTestS3(t *testing.T) (*S3, *s3fake.Server) {
+	t.Helper()
+
+	fake := s3fake.New("uploads")
+	t.Cleanup(fake.Close)
+	store, err := NewS3(S3Config{
+		Endpoint:  fake.URL(),
+		Bucket:    "uploads",
+		Region:    "us-east-1",
+		AccessKey: "AKIDEXAMPLE",
+		SecretKey: "secret",
+		Prefix:    "server/",
+		PartSize:  testPartSize,
+		Client:    fake.Client(),
+	})
+	if err != nil {
+		t.Fatalf("new s3 storage: %v", err)
+	}
+
+	return store, fake
+}
+
+func hexSHA256(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func readObject(t *testing.T, store Backend, name string) []byte {
+	t.Helper()
+
+	body, _, err := store.Open(name)
+	if err != nil {
+		t.Fatalf("open %s: %v", name, err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+
+	return data
+}
+
+func TestS3StageAndCommit(t *testing.T) {
+	store, fake := newTestS3(t)
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"small.txt", []byte("hello")},
+		{"dir/large.bin", bytes.Repeat([]byte("0123456789"), 350)},
+	} {
+		staged, err := store.Stage(tc.name, bytes.NewReader(tc.data))
+		if err != nil {
+			t.Fatalf("stage %s: %v", tc.name, err)
+		}
+		if _, err := store.Stat(tc.name); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("staged %s is visible: %v", tc.name, err)
+		}
+		staged.SetMetadata(map[string]string{"source": tc.name})
+		staged.SetExpiresAt(expiresAt)
+		obj, err := staged.Commit()
+		if err != nil {
+			t.Fatalf("commit %s: %v", tc.name, err)
+		}
+		if err := staged.Discard(); err != nil {
+			t.Fatalf("discard committed %s: %v", tc.name, err)
+		}
+
+		stat, err := store.Stat(tc.name)
+		if err != nil {
+			t.Fatalf("stat %s: %v", tc.name, err)
+		}
+		if stat.Size != int64(len(tc.data)) || stat.SHA256 != hexSHA256(tc.data) || stat.MD5 != obj.MD5 || stat.Metadata["source"] != tc.name || !stat.ExpiresAt.Equal(expiresAt) {
+			t.Fatalf("unexpected stat of %s: got %+v want size %d sha256 %s", tc.name, stat, len(tc.data), hexSHA256(tc.data))
+		}
+		if got := readObject(t, store, tc.name); !bytes.Equal(got, tc.data) {
+			t.Fatalf("content mismatch for %s", tc.name)
+		}
+	}
+	if fake.Uploads() != 0 {
+		t.Fatalf("multipart uploads left open: %d", fake.Uploads())
+	}
+
+	objects, err := store.List("")
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	var names []string
+	for _, obj := range objects {
+		names = append(names, obj.Name)
+	}
+	if !slices.Equal(names, []string{"dir/large.bin", "small.txt"}) {
+		t.Fatalf("unexpected listing: %v", names)
+	}
+
+	if err := store.Delete("small.txt"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := store.Delete("small.txt"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("delete missing object: got %v want %v", err, ErrNotFound)
+	}
+	for _, key := range fake.Keys("uploads") {
+		if strings.Contains(key, "small.txt") {
+			t.Fatalf("key left behind after delete: %s", key)
+		}
+	}
+}
+
+func TestS3DiscardAbortsUpload(t *testing.T) {
+	store, fake := newTestS3(t)
+
+	staged, err := store.Stage("large.bin", bytes.NewReader(make([]byte, 3*testPartSize)))
+	if err != nil {
+		t.Fatalf("stage: %v", err)
+	}
+	if fake.Uploads() != 1 {
+		t.Fatalf("unexpected open uploads: got %d want 1", fake.Uploads())
+	}
+	if err := staged.Discard(); err != nil {
+		t.Fatalf("discard: %v", err)
+	}
+	if fake.Uploads() != 0 || len(fake.Keys("uploads")) != 0 {
+		t.Fatalf("discarded upload left state: uploads %d keys %v", fake.Uploads(), fake.Keys("uploads"))
+	}
+
+	failing := io.MultiReader(bytes.NewReader(make([]byte, 2*testPartSize+10)), errReader{errors.New("connection reset")})
+	if _, err := store.Stage("broken.bin", failing); err == nil || !strings.Contains(err.Error(), "connection reset") {
+		t.Fatalf("expected read error, got %v", err)
+	}
+	if fake.Uploads() != 0 {
+		t.Fatalf("failed upload was not aborted: %d open", fake.Uploads())
+	}
+}
+
+func TestS3Parts(t *testing.T) {
+	store, fake := newTestS3(t)
+	const uploadID = "0123abcd"
+	first, second := bytes.Repeat([]byte("a"), testPartSize+1), []byte("tail")
+
+	part, err := store.PutPart(uploadID, 1, bytes.NewReader(first), hexSHA256([]byte("other")))
+	if !errors.Is(err, ErrChecksumMismatch) || part.SHA256 != hexSHA256(first) {
+		t.Fatalf("corrupt part: got %+v %v", part, err)
+	}
+	if fake.Uploads() != 0 || len(fake.Keys("uploads")) != 0 {
+		t.Fatalf("rejected part was stored: uploads %d keys %v", fake.Uploads(), fake.Keys("uploads"))
+	}
+
+	if _, err := store.PutPart(uploadID, 1, bytes.NewReader(first), hexSHA256(first)); err != nil {
+		t.Fatalf("put part 1: %v", err)
+	}
+	if _, err := store.PutPart(uploadID, 2, bytes.NewReader(second), ""); err != nil {
+		t.Fatalf("put part 2: %v", err)
+	}
+	dirs, err := store.ListMultipart()
+	if err != nil || len(dirs) != 1 || dirs[0].UploadID != uploadID {
+		t.Fatalf("unexpected multipart listing: %+v %v", dirs, err)
+	}
+	if objects, err := store.List(""); err != nil || len(objects) != 0 {
+		t.Fatalf("parts are listed as objects: %+v %v", objects, err)
+	}
+
+	if _, err := store.AssembleParts("whole.bin", uploadID, []int{1, 3}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("assemble missing part: got %v want %v", err, ErrNotFound)
+	}
+	staged, err := store.AssembleParts("whole.bin", uploadID, []int{1, 2})
+	if err != nil {
+		t.Fatalf("assemble parts: %v", err)
+	}
+	defer staged.Discard()
+	if _, err := staged.Commit(); err != nil {
+		t.Fatalf("commit assembled object: %v", err)
+	}
+	if got := readObject(t, store, "whole.bin"); !bytes.Equal(got, append(first, second...)) {
+		t.Fatal("assembled content mismatch")
+	}
+
+	if err := store.DeleteParts(uploadID); err != nil {
+		t.Fatalf("delete parts: %v", err)
+	}
+	if dirs, err := store.ListMultipart(); err != nil || len(dirs) != 0 {
+		t.Fatalf("parts left behind: %+v %v", dirs, err)
+	}
+}
+
+func TestS3CheckWritable(t *testing.T) {
+	store, fake := newTestS3(t)
+
+	if err := store.CheckWritable(); err != nil {
+		t.Fatalf("check writable: %v", err)
+	}
+	if keys := fake.Keys("uploads"); len(keys) != 0 {
+		t.Fatalf("probe left behind: %v", keys)
+	}
+	if _, err := store.FreeSpace(); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("free space: got %v want %v", err, ErrUnsupported)
+	}
+
+	missing, err := NewS3(S3Config{Endpoint: fake.URL(), Bucket: "missing", Region: "us-east-1", AccessKey: "a", SecretKey: "b", Client: fake.Client()})
+	if err != nil {
+		t.Fatalf("new s3 storage: %v", err)
+	}
+	var s3Err *S3Error
+	if err := missing.CheckWritable(); !errors.As(err, &s3Err) || s3Err.Code != "NoSuchBucket" {
+		t.Fatalf("missing bucket: got %v want NoSuchBucket", err)
+	}
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
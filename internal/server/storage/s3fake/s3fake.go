@@ -0,0 +1,371 @@
+// Package s3fake is an in-memory stand-in for the part of the S3 API that the
+// S3 storage backend uses. It is served over an in-process listener, so tests
+// need no network access. Signatures are not verified, but every request must
+// carry one and signed payload hashes must match the body.
+package s3fake
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+const (
+	maxKeys          = 1000
+	headerCopySource = "X-Amz-Copy-Source"
+)
+
+type object struct {
+	data    []byte
+	etag    string
+	modTime time.Time
+}
+
+type upload struct {
+	bucket string
+	key    string
+	parts  map[int]*object
+}
+
+// Server holds the buckets it was created with.
+type Server struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]*object
+	uploads map[string]*upload
+
+	ln     *fasthttputil.InmemoryListener
+	server *fasthttp.Server
+}
+
+// New starts a fake with the given, empty buckets.
+func New(buckets ...string) *Server {
+	s := &Server{
+		buckets: make(map[string]map[string]*object, len(buckets)),
+		uploads: make(map[string]*upload),
+		ln:      fasthttputil.NewInmemoryListener(),
+	}
+	for _, bucket := range buckets {
+		s.buckets[bucket] = make(map[string]*object)
+	}
+	s.server = &fasthttp.Server{Handler: s.handle}
+	go func() {
+		_ = s.server.Serve(s.ln)
+	}()
+
+	return s
+}
+
+// URL is the endpoint to configure the S3 client with.
+func (s *Server) URL() string {
+	return "http://s3fake"
+}
+
+// Client returns a client that dials the fake whatever the request host.
+func (s *Server) Client() *fasthttp.Client {
+	return &fasthttp.Client{
+		StreamResponseBody: true,
+		Dial: func(string) (net.Conn, error) {
+			return s.ln.Dial()
+		},
+	}
+}
+
+func (s *Server) Close() {
+	_ = s.server.Shutdown()
+	_ = s.ln.Close()
+}
+
+// Keys returns the keys stored in bucket, sorted.
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Uploads returns the number of multipart uploads neither completed nor
+// aborted.
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.uploads)
+}
+
+func (s *Server) handle(ctx *fasthttp.RequestCtx) {
+	if !strings.HasPrefix(string(ctx.Request.Header.Peek(fasthttp.HeaderAuthorization)), "AWS4-HMAC-SHA256 Credential=") {
+		writeError(ctx, fasthttp.StatusForbidden, "AccessDenied", "missing signature")
+		return
+	}
+	if hash := string(ctx.Request.Header.Peek("X-Amz-Content-Sha256")); len(hash) == sha256.Size*2 {
+		sum := sha256.Sum256(ctx.PostBody())
+		if hash != hex.EncodeToString(sum[:]) {
+			writeError(ctx, fasthttp.StatusBadRequest, "XAmzContentSHA256Mismatch", "payload hash does not match the body")
+			return
+		}
+	}
+
+	path, err := url.PathUnescape(string(ctx.Request.URI().PathOriginal()))
+	if err != nil {
+		writeError(ctx, fasthttp.StatusBadRequest, "InvalidURI", "invalid path")
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	query := ctx.QueryArgs()
+	uploadID := string(query.Peek("uploadId"))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	objects, ok := s.buckets[bucket]
+	switch {
+	case !ok:
+		writeError(ctx, fasthttp.StatusNotFound, "NoSuchBucket", "the specified bucket does not exist")
+	case key == "" && ctx.IsGet() && string(query.Peek("list-type")) == "2":
+		s.list(ctx, objects)
+	case key == "":
+		writeError(ctx, fasthttp.StatusNotImplemented, "NotImplemented", "not supported by the fake")
+	case ctx.IsPost() && query.Has("uploads"):
+		s.createUpload(ctx, bucket, key)
+	case ctx.IsPut() && uploadID != "":
+		s.uploadPart(ctx, bucket, key, uploadID)
+	case ctx.IsPost() && uploadID != "":
+		s.completeUpload(ctx, objects, bucket, key, uploadID)
+	case ctx.IsDelete() && uploadID != "":
+		if _, ok := s.upload(ctx, bucket, key, uploadID); ok {
+			delete(s.uploads, uploadID)
+			ctx.SetStatusCode(fasthttp.StatusNoContent)
+		}
+	case ctx.IsPut() && len(ctx.Request.Header.Peek(headerCopySource)) > 0:
+		s.copyObject(ctx, objects, key)
+	case ctx.IsPut():
+		objects[key] = newObject(ctx.PostBody())
+		ctx.Response.Header.Set(fasthttp.HeaderETag, objects[key].etag)
+		ctx.SetStatusCode(fasthttp.StatusOK)
+	case ctx.IsGet() || ctx.IsHead():
+		obj, ok := objects[key]
+		if !ok {
+			writeError(ctx, fasthttp.StatusNotFound, "NoSuchKey", "the specified key does not exist")
+			return
+		}
+		ctx.Response.Header.Set(fasthttp.HeaderETag, obj.etag)
+		ctx.Response.Header.Set(fasthttp.HeaderLastModified, obj.modTime.UTC().Format(http.TimeFormat))
+		ctx.SetStatusCode(fasthttp.StatusOK)
+		if ctx.IsHead() {
+			ctx.Response.Header.SetContentLength(len(obj.data))
+			return
+		}
+		ctx.SetBody(obj.data)
+	case ctx.IsDelete():
+		delete(objects, key)
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+	default:
+		writeError(ctx, fasthttp.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed")
+	}
+}
+
+func (s *Server) list(ctx *fasthttp.RequestCtx, objects map[string]*object) {
+	prefix := string(ctx.QueryArgs().Peek("prefix"))
+	after := string(ctx.QueryArgs().Peek("continuation-token"))
+	limit := maxKeys
+	if raw := ctx.QueryArgs().Peek("max-keys"); len(raw) > 0 {
+		limit, _ = strconv.Atoi(string(raw))
+	}
+
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type entry struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int    `xml:"Size"`
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Prefix                string   `xml:"Prefix"`
+		KeyCount              int      `xml:"KeyCount"`
+		IsTruncated           bool     `xml:"IsTruncated"`
+		NextContinuationToken string   `xml:"NextContinuationToken,omitempty"`
+		Contents              []entry  `xml:"Contents"`
+	}{Prefix: prefix}
+	for _, key := range keys {
+		if result.KeyCount == limit {
+			result.IsTruncated = true
+			result.NextContinuationToken = result.Contents[len(result.Contents)-1].Key
+			break
+		}
+		obj := objects[key]
+		result.Contents = append(result.Contents, entry{
+			Key:          key,
+			LastModified: obj.modTime.UTC().Format(time.RFC3339),
+			ETag:         obj.etag,
+			Size:         len(obj.data),
+		})
+		result.KeyCount++
+	}
+
+	writeXML(ctx, fasthttp.StatusOK, result)
+}
+
+func (s *Server) createUpload(ctx *fasthttp.RequestCtx, bucket, key string) {
+	var id [16]byte
+	_, _ = rand.Read(id[:])
+	uploadID := hex.EncodeToString(id[:])
+	s.uploads[uploadID] = &upload{bucket: bucket, key: key, parts: make(map[int]*object)}
+
+	writeXML(ctx, fasthttp.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadID string   `xml:"UploadId"`
+	}{Bucket: bucket, Key: key, UploadID: uploadID})
+}
+
+func (s *Server) uploadPart(ctx *fasthttp.RequestCtx, bucket, key, uploadID string) {
+	up, ok := s.upload(ctx, bucket, key, uploadID)
+	if !ok {
+		return
+	}
+	number, err := strconv.Atoi(string(ctx.QueryArgs().Peek("partNumber")))
+	if err != nil || number < 1 || number > 10000 {
+		writeError(ctx, fasthttp.StatusBadRequest, "InvalidArgument", "invalid part number")
+		return
+	}
+
+	part := newObject(ctx.PostBody())
+	up.parts[number] = part
+	ctx.Response.Header.Set(fasthttp.HeaderETag, part.etag)
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+func (s *Server) completeUpload(ctx *fasthttp.RequestCtx, objects map[string]*object, bucket, key, uploadID string) {
+	up, ok := s.upload(ctx, bucket, key, uploadID)
+	if !ok {
+		return
+	}
+	var req struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(ctx.PostBody(), &req); err != nil || len(req.Parts) == 0 {
+		writeError(ctx, fasthttp.StatusBadRequest, "MalformedXML", "invalid complete request")
+		return
+	}
+
+	var data []byte
+	etags := md5.New()
+	for i, listed := range req.Parts {
+		part, ok := up.parts[listed.PartNumber]
+		if !ok || part.etag != listed.ETag || (i > 0 && listed.PartNumber <= req.Parts[i-1].PartNumber) {
+			writeError(ctx, fasthttp.StatusBadRequest, "InvalidPart", "part is missing, out of order or has another etag")
+			return
+		}
+		data = append(data, part.data...)
+		raw, _ := hex.DecodeString(strings.Trim(part.etag, `"`))
+		etags.Write(raw)
+	}
+	delete(s.uploads, uploadID)
+	objects[key] = &object{
+		data:    data,
+		etag:    fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(etags.Sum(nil)), len(req.Parts)),
+		modTime: time.Now(),
+	}
+
+	writeXML(ctx, fasthttp.StatusOK, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string   `xml:"Bucket"`
+		Key     string   `xml:"Key"`
+		ETag    string   `xml:"ETag"`
+	}{Bucket: bucket, Key: key, ETag: objects[key].etag})
+}
+
+// copyObject copies an object of the same or another bucket, given as
+// "bucket/key" with an optional leading slash.
+func (s *Server) copyObject(ctx *fasthttp.RequestCtx, objects map[string]*object, key string) {
+	source, err := url.PathUnescape(string(ctx.Request.Header.Peek(headerCopySource)))
+	if err != nil {
+		writeError(ctx, fasthttp.StatusBadRequest, "InvalidArgument", "invalid copy source")
+		return
+	}
+	srcBucket, srcKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	src, ok := s.buckets[srcBucket][srcKey]
+	if !ok {
+		writeError(ctx, fasthttp.StatusNotFound, "NoSuchKey", "the copy source does not exist")
+		return
+	}
+
+	objects[key] = &object{data: src.data, etag: src.etag, modTime: time.Now()}
+	writeXML(ctx, fasthttp.StatusOK, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string   `xml:"ETag"`
+		LastModified string   `xml:"LastModified"`
+	}{ETag: src.etag, LastModified: objects[key].modTime.UTC().Format(time.RFC3339)})
+}
+
+func (s *Server) upload(ctx *fasthttp.RequestCtx, bucket, key, uploadID string) (*upload, bool) {
+	up, ok := s.uploads[uploadID]
+	if !ok || up.bucket != bucket || up.key != key {
+		writeError(ctx, fasthttp.StatusNotFound, "NoSuchUpload", "the specified multipart upload does not exist")
+		return nil, false
+	}
+
+	return up, true
+}
+
+func newObject(data []byte) *object {
+	sum := md5.Sum(data)
+	return &object{
+		data:    append([]byte(nil), data...),
+		etag:    `"` + hex.EncodeToString(sum[:]) + `"`,
+		modTime: time.Now(),
+	}
+}
+
+func writeError(ctx *fasthttp.RequestCtx, status int, code, message string) {
+	writeXML(ctx, status, struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: message})
+}
+
+func writeXML(ctx *fasthttp.RequestCtx, status int, payload any) {
+	body, err := xml.Marshal(payload)
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+
+	ctx.SetStatusCode(status)
+	ctx.SetContentType("application/xml")
+	ctx.SetBodyString(xml.Header)
+	ctx.Response.AppendBody(body)
+}
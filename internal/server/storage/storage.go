@@ -0,0 +1,562 @@
+package storage
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+const (
+	tempDirName = ".tmp"
+	metaDirName = ".meta"
+)
+
+var (
+	ErrInvalidName = errors.New("invalid object name")
+	ErrNotFound    = errors.New("object not found")
+	ErrUnsupported = errors.New("not supported")
+)
+
+type Object struct {
+	Name   string
+	Size   int64
+	SHA256 string
+	// MD5 is kept for S3 clients, which expect it as the ETag. It is empty
+	// for objects stored before it was recorded.
+	MD5     string
+	ModTime time.Time
+	// Metadata holds the key/value pairs the client attached to the upload.
+	Metadata map[string]string
+	// ExpiresAt is when the retention janitor may delete the object; zero
+	// means never.
+	ExpiresAt time.Time
+	// VersionID identifies the version, which a new Commit of the same name
+	// keeps as a prior version; see ListVersions.
+	VersionID string
+}
+
+// objectMeta is persisted next to every committed object so that stat and
+// listing do not have to rehash file contents.
+type objectMeta struct {
+	SHA256    string            `json:"sha256"`
+	MD5       string            `json:"md5,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	ExpiresAt string            `json:"expires_at,omitempty"`
+	VersionID string            `json:"version_id,omitempty"`
+	// Modified is only set for prior versions, see versionMeta.
+	Modified string `json:"modified,omitempty"`
+}
+
+func newObjectMeta(obj Object) objectMeta {
+	meta := objectMeta{SHA256: obj.SHA256, MD5: obj.MD5, Metadata: obj.Metadata, VersionID: obj.VersionID}
+	if !obj.ExpiresAt.IsZero() {
+		meta.ExpiresAt = obj.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+
+	return meta
+}
+
+// object returns the Object the sidecar describes. versionID is used when the
+// sidecar has none, e.g. when it is missing.
+func (m objectMeta) object(name, versionID string, size int64, modTime time.Time) Object {
+	obj := Object{
+		Name:      name,
+		Size:      size,
+		SHA256:    m.SHA256,
+		MD5:       m.MD5,
+		ModTime:   modTime,
+		Metadata:  m.Metadata,
+		ExpiresAt: m.expiresAt(),
+		VersionID: m.VersionID,
+	}
+	if obj.VersionID == "" {
+		obj.VersionID = versionID
+	}
+	if modified, err := time.Parse(time.RFC3339Nano, m.Modified); err == nil {
+		obj.ModTime = modified
+	}
+
+	return obj
+}
+
+// expiresAt returns the zero time for objects without an expiry, and for
+// a sidecar that cannot be parsed, so that such objects are kept.
+func (m objectMeta) expiresAt() time.Time {
+	t, _ := time.Parse(time.RFC3339, m.ExpiresAt)
+	return t
+}
+
+// Backend is where uploaded objects are kept. Names are validated with
+// ValidateName by every backend.
+type Backend interface {
+	// Stage streams r to the backend while hashing it. The object is not
+	// visible under name until the returned Staged is committed.
+	Stage(name string, r io.Reader) (*Staged, error)
+	// Stat returns the object metadata without opening its contents.
+	Stat(name string) (Object, error)
+	// Open returns the object contents; the caller must close the reader.
+	Open(name string) (io.ReadCloser, Object, error)
+	// Delete removes the object with all its versions.
+	Delete(name string) error
+	// List returns all objects whose name starts with prefix, sorted by
+	// name. Backends that cannot list checksums cheaply leave SHA256 and
+	// Metadata empty; Stat returns them.
+	List(prefix string) ([]Object, error)
+	CheckWritable() error
+	// FreeSpace returns ErrUnsupported for backends without a meaningful
+	// capacity.
+	FreeSpace() (uint64, error)
+
+	PutPart(uploadID string, number int, r io.Reader, expectedSHA256 string) (Part, error)
+	AssembleParts(name, uploadID string, numbers []int) (*Staged, error)
+	DeleteParts(uploadID string) error
+	ListMultipart() ([]MultipartDir, error)
+
+	// ListTemp returns the files uploads are staged in before Commit, named
+	// relative to the temp area. Files that are no longer written to are
+	// left over from interrupted uploads.
+	ListTemp() ([]Object, error)
+	DeleteTemp(name string) error
+	// CreateTemp creates a scratch file in the temp area that no object is
+	// staged in, e.g. to buffer an archive before extracting it. The caller
+	// closes and removes it.
+	CreateTemp(pattern string) (*os.File, error)
+
+	// ListVersions returns the current version of name followed by the
+	// versions it replaced, newest first.
+	ListVersions(name string) ([]Object, error)
+	// StatVersion and OpenVersion are Stat and Open for any version listed
+	// by ListVersions, current or not.
+	StatVersion(name, versionID string) (Object, error)
+	OpenVersion(name, versionID string) (io.ReadCloser, Object, error)
+}
+
+// Local stores objects as plain files under a root directory. Uploads are
+// staged in a hidden temp directory and only become visible on Commit.
+// Replaced versions are kept in a hidden versions directory.
+type Local struct {
+	root    string
+	tempDir string
+	metaDir string
+	// discard drops staged objects on Commit instead of keeping them, see
+	// NewDiscard.
+	discard bool
+	// commitMu serializes commits, which check their Condition and archive
+	// the current version before replacing it.
+	commitMu sync.Mutex
+}
+
+var _ Backend = (*Local)(nil)
+
+// Staged is an uploaded object that is not visible yet. It must be
+// discarded once done with, also after Commit.
+type Staged struct {
+	object Object
+	// path is the local file with the contents, see Path.
+	path      string
+	condition Condition
+	commit    func(Object, Condition) (Object, error)
+	discard   func() error
+}
+
+func NewLocal(root string) (*Local, error) {
+	tempDir := filepath.Join(root, tempDirName)
+	metaDir := filepath.Join(root, metaDirName)
+	for _, dir := range []string{tempDir, metaDir} {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return nil, fmt.Errorf("create storage dir %q: %w", dir, err)
+		}
+	}
+
+	return &Local{
+		root:    root,
+		tempDir: tempDir,
+		metaDir: metaDir,
+	}, nil
+}
+
+// NewDiscard is NewLocal for a server that does not keep uploads: objects are
+// still staged and hashed under root, but Commit removes them, so nothing is
+// ever listed or opened.
+func NewDiscard(root string) (*Local, error) {
+	l, err := NewLocal(root)
+	if err != nil {
+		return nil, err
+	}
+	l.discard = true
+
+	return l, nil
+}
+
+func (l *Local) Root() string {
+	return l.root
+}
+
+// Stage streams r into a temp file while hashing it. The object is not
+// visible under name until the returned Staged is committed.
+func (l *Local) Stage(name string, r io.Reader) (*Staged, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+
+	tempFile, err := os.CreateTemp(l.tempDir, "upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+
+	hasher, md5Hasher := sha256.New(), md5.New()
+	n, copyErr := io.Copy(io.MultiWriter(tempFile, hasher, md5Hasher), r)
+	closeErr := tempFile.Close()
+	if copyErr != nil {
+		_ = os.Remove(tempFile.Name())
+		return nil, fmt.Errorf("write temp file: %w", copyErr)
+	}
+	if closeErr != nil {
+		_ = os.Remove(tempFile.Name())
+		return nil, fmt.Errorf("close temp file: %w", closeErr)
+	}
+
+	tempPath := tempFile.Name()
+	return &Staged{
+		object: Object{
+			Name:   name,
+			Size:   n,
+			SHA256: hex.EncodeToString(hasher.Sum(nil)),
+			MD5:    hex.EncodeToString(md5Hasher.Sum(nil)),
+		},
+		path: tempPath,
+		commit: func(obj Object, condition Condition) (Object, error) {
+			if l.discard {
+				if err := os.Remove(tempPath); err != nil && !os.IsNotExist(err) {
+					return Object{}, fmt.Errorf("discard object %q: %w", obj.Name, err)
+				}
+				obj.ModTime = time.Now()
+				return obj, nil
+			}
+
+			l.commitMu.Lock()
+			defer l.commitMu.Unlock()
+
+			if err := condition.Check(l, obj.Name); err != nil {
+				return Object{}, err
+			}
+			current, err := l.Stat(obj.Name)
+			switch {
+			case err == nil:
+				if err := l.archive(current); err != nil {
+					return Object{}, err
+				}
+			case !errors.Is(err, ErrNotFound):
+				return Object{}, err
+			}
+
+			target := l.path(obj.Name)
+			if err := os.MkdirAll(filepath.Dir(target), 0o750); err != nil {
+				return Object{}, fmt.Errorf("create object dir: %w", err)
+			}
+			obj.VersionID = newVersionID()
+			if err := l.writeMeta(obj.Name, newObjectMeta(obj)); err != nil {
+				return Object{}, err
+			}
+			if err := os.Rename(tempPath, target); err != nil {
+				return Object{}, fmt.Errorf("commit object %q: %w", obj.Name, err)
+			}
+
+			obj.ModTime = time.Now()
+			return obj, nil
+		},
+		discard: func() error {
+			if err := os.Remove(tempPath); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("discard staged object %q: %w", name, err)
+			}
+			return nil
+		},
+	}, nil
+}
+
+func (s *Staged) Object() Object {
+	return s.object
+}
+
+// Path returns the local file holding the staged contents until Commit or
+// Discard, or "" for backends that stage elsewhere. Moving the file away
+// leaves nothing to commit; Discard still succeeds.
+func (s *Staged) Path() string {
+	return s.path
+}
+
+// SetMetadata sets the metadata stored with the object on Commit.
+func (s *Staged) SetMetadata(metadata map[string]string) {
+	s.object.Metadata = metadata
+}
+
+// SetExpiresAt sets when the object expires, see Object.ExpiresAt.
+func (s *Staged) SetExpiresAt(t time.Time) {
+	s.object.ExpiresAt = t
+}
+
+// SetCondition sets the condition Commit checks against the current version.
+func (s *Staged) SetCondition(condition Condition) {
+	s.condition = condition
+}
+
+// Commit makes the object visible under its name. A version it replaces is
+// kept, see Backend.ListVersions.
+func (s *Staged) Commit() (Object, error) {
+	obj, err := s.commit(s.object, s.condition)
+	if err != nil {
+		return Object{}, err
+	}
+
+	s.object = obj
+	return obj, nil
+}
+
+func (s *Staged) Discard() error {
+	return s.discard()
+}
+
+// Stat returns the object metadata without opening its contents.
+func (l *Local) Stat(name string) (Object, error) {
+	if err := ValidateName(name); err != nil {
+		return Object{}, err
+	}
+
+	info, err := os.Stat(l.path(name))
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return Object{}, fmt.Errorf("%w: %q", ErrNotFound, name)
+	}
+	if err != nil {
+		return Object{}, fmt.Errorf("stat object %q: %w", name, err)
+	}
+
+	return l.object(name, info), nil
+}
+
+// Open returns the object contents; the caller must close the reader.
+func (l *Local) Open(name string) (io.ReadCloser, Object, error) {
+	obj, err := l.Stat(name)
+	if err != nil {
+		return nil, Object{}, err
+	}
+
+	file, err := os.Open(l.path(name))
+	if os.IsNotExist(err) {
+		return nil, Object{}, fmt.Errorf("%w: %q", ErrNotFound, name)
+	}
+	if err != nil {
+		return nil, Object{}, fmt.Errorf("open object %q: %w", name, err)
+	}
+
+	return file, obj, nil
+}
+
+func (l *Local) Delete(name string) error {
+	if err := ValidateName(name); err != nil {
+		return err
+	}
+
+	if err := os.Remove(l.path(name)); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %q", ErrNotFound, name)
+		}
+		return fmt.Errorf("delete object %q: %w", name, err)
+	}
+	if err := os.Remove(l.metaPath(name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("delete object metadata %q: %w", name, err)
+	}
+	if err := os.RemoveAll(filepath.Join(l.root, filepath.FromSlash(versionsDir(name)))); err != nil {
+		return fmt.Errorf("delete versions of %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// List returns all objects whose name starts with prefix, sorted by name.
+func (l *Local) List(prefix string) ([]Object, error) {
+	var objects []Object
+	err := filepath.WalkDir(l.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == l.root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, l.object(name, info))
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list objects: %w", err)
+	}
+
+	return objects, nil
+}
+
+// CheckWritable creates and removes a probe file in the temp directory.
+func (l *Local) CheckWritable() error {
+	probe, err := os.CreateTemp(l.tempDir, "probe-*")
+	if err != nil {
+		return fmt.Errorf("create probe file: %w", err)
+	}
+	name := probe.Name()
+	if err := probe.Close(); err != nil {
+		_ = os.Remove(name)
+		return fmt.Errorf("close probe file: %w", err)
+	}
+	if err := os.Remove(name); err != nil {
+		return fmt.Errorf("remove probe file: %w", err)
+	}
+
+	return nil
+}
+
+// FreeSpace reports the number of bytes available to unprivileged users on
+// the filesystem holding the storage root.
+func (l *Local) FreeSpace() (uint64, error) {
+	return freeSpace(l.root)
+}
+
+func (l *Local) CreateTemp(pattern string) (*os.File, error) {
+	return os.CreateTemp(l.tempDir, pattern)
+}
+
+// ListTemp returns the files in the temp directory, including staged
+// uploads that are still being written.
+func (l *Local) ListTemp() ([]Object, error) {
+	entries, err := os.ReadDir(l.tempDir)
+	if err != nil {
+		return nil, fmt.Errorf("list temp files: %w", err)
+	}
+
+	files := make([]Object, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, Object{Name: entry.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+
+	return files, nil
+}
+
+// DeleteTemp removes a file returned by ListTemp.
+func (l *Local) DeleteTemp(name string) error {
+	if name == "" || filepath.Base(name) != name || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+
+	if err := os.Remove(filepath.Join(l.tempDir, name)); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %q", ErrNotFound, name)
+		}
+		return fmt.Errorf("delete temp file %q: %w", name, err)
+	}
+
+	return nil
+}
+
+func (l *Local) path(name string) string {
+	return filepath.Join(l.root, filepath.FromSlash(name))
+}
+
+func (l *Local) metaPath(name string) string {
+	return filepath.Join(l.metaDir, filepath.FromSlash(name)+".json")
+}
+
+func (l *Local) object(name string, info fs.FileInfo) Object {
+	meta, err := l.readMeta(name)
+	if err != nil {
+		meta = objectMeta{}
+	}
+
+	return meta.object(name, NullVersionID, info.Size(), info.ModTime())
+}
+
+func (l *Local) readMeta(name string) (objectMeta, error) {
+	raw, err := os.ReadFile(l.metaPath(name))
+	if err != nil {
+		return objectMeta{}, err
+	}
+
+	var meta objectMeta
+	if err := sonic.Unmarshal(raw, &meta); err != nil {
+		return objectMeta{}, fmt.Errorf("decode object metadata %q: %w", name, err)
+	}
+
+	return meta, nil
+}
+
+func (l *Local) writeMeta(name string, meta objectMeta) error {
+	raw, err := sonic.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("encode object metadata %q: %w", name, err)
+	}
+
+	metaPath := l.metaPath(name)
+	if err := os.MkdirAll(filepath.Dir(metaPath), 0o750); err != nil {
+		return fmt.Errorf("create metadata dir: %w", err)
+	}
+	if err := os.WriteFile(metaPath, raw, 0o640); err != nil {
+		return fmt.Errorf("write object metadata %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// ValidateName accepts slash-separated relative names without dot segments,
+// so an object can never escape the storage root or shadow internal files.
+func ValidateName(name string) error {
+	if name == "" || strings.ContainsRune(name, '\\') || strings.ContainsRune(name, 0) {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	if path.IsAbs(name) || path.Clean(name) != name {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return fmt.Errorf("%w: %q", ErrInvalidName, name)
+		}
+	}
+
+	return nil
+}
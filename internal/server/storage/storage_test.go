@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiscardKeepsNothing(t *testing.T) {
+	store, err := NewDiscard(t.TempDir())
+	if err != nil {
+		t.Fatalf("new storage: %v", err)
+	}
+
+	obj, err := commitObject(t, store, "a.txt", "payload", Condition{})
+	if err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if obj.Size != int64(len("payload")) || obj.SHA256 == "" {
+		t.Fatalf("unexpected object: %+v", obj)
+	}
+	if _, err := store.Stat("a.txt"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("stat: got %v want %v", err, ErrNotFound)
+	}
+	if objects, err := store.List(""); err != nil || len(objects) != 0 {
+		t.Fatalf("list: got %v, %v want none", objects, err)
+	}
+	if temp, err := store.ListTemp(); err != nil || len(temp) != 0 {
+		t.Fatalf("temp files: got %v, %v want none", temp, err)
+	}
+	if _, err := os.Stat(store.path("a.txt")); !os.IsNotExist(err) {
+		t.Fatalf("object file exists: %v", err)
+	}
+	if err := store.CheckWritable(); err != nil {
+		t.Fatalf("check writable: %v", err)
+	}
+}
+
+func TestCreateTempUsesTempArea(t *testing.T) {
+	store, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("new storage: %v", err)
+	}
+
+	tmp, err := store.CreateTemp("archive-*.zip")
+	if err != nil {
+		t.Fatalf("create temp: %v", err)
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	temp, err := store.ListTemp()
+	if err != nil || len(temp) != 1 || filepath.Join(store.tempDir, temp[0].Name) != tmp.Name() {
+		t.Fatalf("temp files: got %+v, %v want %s", temp, err, tmp.Name())
+	}
+}
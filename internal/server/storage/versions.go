@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+const versionsDirName = ".versions"
+
+// NullVersionID is the version of objects stored before versioning, which
+// have no id of their own.
+const NullVersionID = "null"
+
+var (
+	// ErrInvalidVersionID is returned for version ids that are neither
+	// NullVersionID nor plain lowercase hex.
+	ErrInvalidVersionID = errors.New("invalid version id")
+	// ErrPreconditionFailed is returned by Commit when the Condition of the
+	// staged object does not hold.
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
+// Condition makes Commit fail with ErrPreconditionFailed unless the current
+// version of the object is the expected one, which prevents lost updates.
+type Condition struct {
+	// IfNoneMatch requires that the object does not exist yet.
+	IfNoneMatch bool
+	// IfMatch requires the current version to have this id; "*" only
+	// requires the object to exist.
+	IfMatch string
+}
+
+// Check compares the condition against the current version of name in store.
+func (c Condition) Check(store Backend, name string) error {
+	if !c.IfNoneMatch && c.IfMatch == "" {
+		return nil
+	}
+
+	current, err := store.Stat(name)
+	exists := err == nil
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	switch {
+	case c.IfNoneMatch && exists:
+		return fmt.Errorf("%w: %q already exists", ErrPreconditionFailed, name)
+	case c.IfMatch != "" && !exists:
+		return fmt.Errorf("%w: %q does not exist", ErrPreconditionFailed, name)
+	case c.IfMatch != "" && c.IfMatch != "*" && c.IfMatch != current.VersionID:
+		return fmt.Errorf("%w: current version of %q is %s", ErrPreconditionFailed, name, current.VersionID)
+	}
+
+	return nil
+}
+
+// newVersionID returns an id that sorts after the ids generated before it:
+// the commit time in nanoseconds followed by random bits.
+func newVersionID() string {
+	var id [12]byte
+	binary.BigEndian.PutUint64(id[:8], uint64(time.Now().UnixNano()))
+	_, _ = rand.Read(id[8:])
+
+	return hex.EncodeToString(id[:])
+}
+
+// ValidateVersionID accepts NullVersionID and the lowercase hex ids
+// generated on Commit.
+func ValidateVersionID(versionID string) error {
+	if versionID == NullVersionID {
+		return nil
+	}
+	if versionID == "" || len(versionID) > 64 {
+		return fmt.Errorf("%w: %q", ErrInvalidVersionID, versionID)
+	}
+	for _, c := range versionID {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return fmt.Errorf("%w: %q", ErrInvalidVersionID, versionID)
+		}
+	}
+
+	return nil
+}
+
+// versionsDir is where the prior versions of name are kept. Hashing the name
+// keeps the layout flat and free of the name's own directories.
+func versionsDir(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return versionsDirName + "/" + hex.EncodeToString(sum[:])
+}
+
+// sortVersions orders prior versions newest first; NullVersionID, which
+// predates versioning, is always the oldest.
+func sortVersions(versions []Object) {
+	sort.Slice(versions, func(i, j int) bool {
+		if versions[i].VersionID == NullVersionID || versions[j].VersionID == NullVersionID {
+			return versions[j].VersionID == NullVersionID && versions[i].VersionID != NullVersionID
+		}
+		return versions[i].VersionID > versions[j].VersionID
+	})
+}
+
+// versionMeta is the sidecar of a prior version. It records the commit time
+// of the version, which the copy kept in the versions area does not have.
+func versionMeta(obj Object) objectMeta {
+	meta := newObjectMeta(obj)
+	meta.Modified = obj.ModTime.UTC().Format(time.RFC3339Nano)
+
+	return meta
+}
+
+// ListVersions returns the current version of name followed by its prior
+// versions, newest first.
+func (l *Local) ListVersions(name string) ([]Object, error) {
+	current, err := l.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(l.root, filepath.FromSlash(versionsDir(name)))
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []Object{current}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("list versions of %q: %w", name, err)
+	}
+
+	var versions []Object
+	for _, entry := range entries {
+		versionID, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || ValidateVersionID(versionID) != nil {
+			continue
+		}
+		version, err := l.statVersion(name, versionID)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	sortVersions(versions)
+
+	return append([]Object{current}, versions...), nil
+}
+
+// StatVersion is Stat for any version returned by ListVersions.
+func (l *Local) StatVersion(name, versionID string) (Object, error) {
+	if err := ValidateVersionID(versionID); err != nil {
+		return Object{}, err
+	}
+	current, err := l.Stat(name)
+	if err != nil {
+		return Object{}, err
+	}
+	if current.VersionID == versionID {
+		return current, nil
+	}
+
+	return l.statVersion(name, versionID)
+}
+
+// OpenVersion is Open for any version returned by ListVersions.
+func (l *Local) OpenVersion(name, versionID string) (io.ReadCloser, Object, error) {
+	// Holding commitMu keeps the current version from being replaced between
+	// the stat and the open; the open file survives a later replacement.
+	l.commitMu.Lock()
+	defer l.commitMu.Unlock()
+
+	obj, err := l.StatVersion(name, versionID)
+	if err != nil {
+		return nil, Object{}, err
+	}
+
+	path := l.versionPath(name, versionID)
+	if current, err := l.Stat(name); err == nil && current.VersionID == versionID {
+		path = l.path(name)
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, Object{}, fmt.Errorf("%w: %q version %s", ErrNotFound, name, versionID)
+	}
+	if err != nil {
+		return nil, Object{}, fmt.Errorf("open object %q version %s: %w", name, versionID, err)
+	}
+
+	return file, obj, nil
+}
+
+func (l *Local) statVersion(name, versionID string) (Object, error) {
+	path := l.versionPath(name, versionID)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return Object{}, fmt.Errorf("%w: %q version %s", ErrNotFound, name, versionID)
+	}
+	if err != nil {
+		return Object{}, fmt.Errorf("stat object %q version %s: %w", name, versionID, err)
+	}
+
+	raw, err := os.ReadFile(path + ".json")
+	if err != nil && !os.IsNotExist(err) {
+		return Object{}, fmt.Errorf("read object metadata %q version %s: %w", name, versionID, err)
+	}
+	var meta objectMeta
+	if len(raw) > 0 {
+		if err := sonic.Unmarshal(raw, &meta); err != nil {
+			return Object{}, fmt.Errorf("decode object metadata %q version %s: %w", name, versionID, err)
+		}
+	}
+
+	return meta.object(name, versionID, info.Size(), info.ModTime()), nil
+}
+
+// archive keeps the current version of an object before Commit replaces it.
+// The file is hard-linked rather than copied, as Commit renames the new file
+// over it. The caller holds commitMu.
+func (l *Local) archive(current Object) error {
+	path := l.versionPath(current.Name, current.VersionID)
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return fmt.Errorf("create versions dir: %w", err)
+	}
+
+	raw, err := sonic.Marshal(versionMeta(current))
+	if err != nil {
+		return fmt.Errorf("encode version metadata %q: %w", current.Name, err)
+	}
+	// A leftover of an interrupted commit would make the link fail.
+	_ = os.Remove(path)
+	if err := os.Link(l.path(current.Name), path); err != nil {
+		return fmt.Errorf("keep version %s of %q: %w", current.VersionID, current.Name, err)
+	}
+	if err := os.WriteFile(path+".json", raw, 0o640); err != nil {
+		_ = os.Remove(path)
+		return fmt.Errorf("write version metadata %q: %w", current.Name, err)
+	}
+
+	return nil
+}
+
+func (l *Local) versionPath(name, versionID string) string {
+	return filepath.Join(l.root, filepath.FromSlash(versionsDir(name)), versionID)
+}
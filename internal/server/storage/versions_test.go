@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func commitObject(t *testing.T, store Backend, name, content string, condition Condition) (Object, error) {
+	t.Helper()
+
+	staged, err := store.Stage(name, strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("stage %s: %v", name, err)
+	}
+	defer staged.Discard()
+	staged.SetMetadata(map[string]string{"content": content})
+	staged.SetCondition(condition)
+
+	return staged.Commit()
+}
+
+func testVersions(t *testing.T, store Backend) {
+	first, err := commitObject(t, store, "dir/a.txt", "first", Condition{IfNoneMatch: true})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := ValidateVersionID(first.VersionID); err != nil || first.VersionID == NullVersionID {
+		t.Fatalf("unexpected version id %q: %v", first.VersionID, err)
+	}
+	if _, err := commitObject(t, store, "dir/a.txt", "again", Condition{IfNoneMatch: true}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("create existing: got %v want %v", err, ErrPreconditionFailed)
+	}
+	second, err := commitObject(t, store, "dir/a.txt", "second", Condition{IfMatch: first.VersionID})
+	if err != nil {
+		t.Fatalf("replace first version: %v", err)
+	}
+	if _, err := commitObject(t, store, "dir/a.txt", "lost", Condition{IfMatch: first.VersionID}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("replace stale version: got %v want %v", err, ErrPreconditionFailed)
+	}
+	if _, err := commitObject(t, store, "missing.txt", "x", Condition{IfMatch: "*"}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("replace missing object: got %v want %v", err, ErrPreconditionFailed)
+	}
+	third, err := commitObject(t, store, "dir/a.txt", "third", Condition{})
+	if err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+
+	versions, err := store.ListVersions("dir/a.txt")
+	if err != nil {
+		t.Fatalf("list versions: %v", err)
+	}
+	want := []Object{third, second, first}
+	if len(versions) != len(want) {
+		t.Fatalf("unexpected versions: %+v", versions)
+	}
+	for i, version := range versions {
+		if version.VersionID != want[i].VersionID || version.SHA256 != want[i].SHA256 || version.Metadata["content"] != want[i].Metadata["content"] {
+			t.Fatalf("unexpected version %d: got %+v want %+v", i, version, want[i])
+		}
+	}
+	if objects, err := store.List(""); err != nil || len(objects) != 1 {
+		t.Fatalf("prior versions are listed: %+v %v", objects, err)
+	}
+
+	for _, version := range want {
+		body, obj, err := store.OpenVersion("dir/a.txt", version.VersionID)
+		if err != nil {
+			t.Fatalf("open version %s: %v", version.VersionID, err)
+		}
+		data, err := io.ReadAll(body)
+		_ = body.Close()
+		if err != nil || string(data) != version.Metadata["content"] || obj.VersionID != version.VersionID {
+			t.Fatalf("unexpected content of version %s: %q %v", version.VersionID, data, err)
+		}
+	}
+	if _, err := store.StatVersion("dir/a.txt", "00ff"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("stat unknown version: got %v want %v", err, ErrNotFound)
+	}
+	if _, err := store.StatVersion("dir/a.txt", "../a.txt"); !errors.Is(err, ErrInvalidVersionID) {
+		t.Fatalf("stat invalid version: got %v want %v", err, ErrInvalidVersionID)
+	}
+
+	if err := store.Delete("dir/a.txt"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := store.ListVersions("dir/a.txt"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("versions after delete: got %v want %v", err, ErrNotFound)
+	}
+	if _, err := commitObject(t, store, "dir/a.txt", "new", Condition{}); err != nil {
+		t.Fatalf("recreate: %v", err)
+	}
+	if versions, err := store.ListVersions("dir/a.txt"); err != nil || len(versions) != 1 {
+		t.Fatalf("deleted versions came back: %+v %v", versions, err)
+	}
+}
+
+func TestLocalVersions(t *testing.T) {
+	store, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("new storage: %v", err)
+	}
+	testVersions(t, store)
+}
+
+func TestS3Versions(t *testing.T) {
+	store, fake := newTestS3(t)
+	testVersions(t, store)
+
+	if err := store.Delete("dir/a.txt"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if keys := fake.Keys("uploads"); len(keys) != 0 {
+		t.Fatalf("keys left behind after delete: %v", keys)
+	}
+}
+
+func TestLocalVersionsOfUnversionedObject(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewLocal(root)
+	if err != nil {
+		t.Fatalf("new storage: %v", err)
+	}
+	// Stored before versioning: a file without a sidecar.
+	if err := os.WriteFile(filepath.Join(root, "old.txt"), []byte("old"), 0o600); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if _, err := commitObject(t, store, "old.txt", "new", Condition{IfMatch: NullVersionID}); err != nil {
+		t.Fatalf("replace unversioned object: %v", err)
+	}
+
+	versions, err := store.ListVersions("old.txt")
+	if err != nil || len(versions) != 2 || versions[1].VersionID != NullVersionID {
+		t.Fatalf("unexpected versions: %+v %v", versions, err)
+	}
+	body, _, err := store.OpenVersion("old.txt", NullVersionID)
+	if err != nil {
+		t.Fatalf("open null version: %v", err)
+	}
+	defer body.Close()
+	if data, err := io.ReadAll(body); err != nil || string(data) != "old" {
+		t.Fatalf("unexpected content of the null version: %q %v", data, err)
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/client/uploader"
+	"client-server-fasthttp-test/internal/server/metrics"
+	"client-server-fasthttp-test/internal/server/storage"
+	"client-server-fasthttp-test/internal/server/storage/s3fake"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func TestUploadToS3Storage(t *testing.T) {
+	fake := s3fake.New("uploads")
+	t.Cleanup(fake.Close)
+	store, err := storage.NewS3(storage.S3Config{
+		Endpoint:  fake.URL(),
+		Bucket:    "uploads",
+		Region:    "us-east-1",
+		AccessKey: "AKIDEXAMPLE",
+		SecretKey: "secret",
+		Prefix:    "files/",
+		PartSize:  1024,
+		Client:    fake.Client(),
+	})
+	if err != nil {
+		t.Fatalf("new s3 storage: %v", err)
+	}
+	_, httpClient := newTestEmbeddedServer(t, WithStorage(store), WithAuth(testAuthToken))
+	client, err := uploader.New(httpClient, uploader.Config{ChunkSize: 64, FormFieldName: "file", RequestTimeout: 5 * time.Second, AuthToken: testAuthToken})
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+
+	content := bytes.Repeat([]byte("streamed to s3 "), 300)
+	sum := sha256.Sum256(content)
+	localPath := filepath.Join(t.TempDir(), "report.bin")
+	if err := os.WriteFile(localPath, content, 0o600); err != nil {
+		t.Fatalf("write temp file: %v", err)
+	}
+
+	resp, err := client.UploadFileContext(context.Background(), uploader.UploadRequest{
+		URL:      "http://inmemory/upload",
+		FilePath: localPath,
+		Metadata: map[string]string{"env": "prod"},
+	})
+	if err != nil {
+		t.Fatalf("upload file: %v", err)
+	}
+	if resp.StatusCode != fasthttp.StatusCreated {
+		t.Fatalf("unexpected upload status: got %d want %d: %s", resp.StatusCode, fasthttp.StatusCreated, resp.Body)
+	}
+	if keys := fake.Keys("uploads"); !slices.Equal(keys, []string{"files/.meta/report.bin.json", "files/report.bin"}) {
+		t.Fatalf("unexpected bucket keys: %v", keys)
+	}
+	if fake.Uploads() != 0 {
+		t.Fatalf("multipart uploads left open: %d", fake.Uploads())
+	}
+
+	download := doTestRequest(t, httpClient, fasthttp.MethodGet, "/files/report.bin", fasthttp.HeaderAuthorization, "Bearer "+testAuthToken)
+	defer fasthttp.ReleaseResponse(download)
+	if download.StatusCode() != fasthttp.StatusOK || !bytes.Equal(download.Body(), content) {
+		t.Fatalf("download: got %d with %d bytes", download.StatusCode(), len(download.Body()))
+	}
+	if got := string(download.Header.Peek(api.HeaderChecksumSHA256)); got != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected checksum header: got %q want %q", got, hex.EncodeToString(sum[:]))
+	}
+
+	// S3 listings carry no metadata, so label filters stat every object.
+	files, err := client.ListContext(context.Background(), "http://inmemory/files?label=env=prod")
+	if err != nil || len(files) != 1 || files[0].Metadata["env"] != "prod" || files[0].SHA256 == "" {
+		t.Fatalf("list by label: %+v %v", files, err)
+	}
+}
+
+// TestS3StorageSignatures runs the S3 storage against the S3 API of the
+// server, which verifies every signature.
+func TestS3StorageSignatures(t *testing.T) {
+	uploadHandler, _ := newTestServer(t)
+	credentials := func() map[string]string { return map[string]string{testAccessKey: testSecretKey} }
+	s3API := newS3Handler(uploadHandler, "uploads", "us-east-1", credentials, metrics.NewRegistry())
+
+	server := &fasthttp.Server{Handler: s3API.handler, StreamRequestBody: true, DisablePreParseMultipartForm: true}
+	ln := fasthttputil.NewInmemoryListener()
+	go func() {
+		_ = server.Serve(ln)
+	}()
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+		_ = ln.Close()
+	})
+
+	store, err := storage.NewS3(storage.S3Config{
+		Endpoint:  "http://localhost:9000",
+		Bucket:    "uploads",
+		Region:    "us-east-1",
+		AccessKey: testAccessKey,
+		SecretKey: testSecretKey,
+		PartSize:  1024,
+		Client: &fasthttp.Client{
+			StreamResponseBody: true,
+			Dial:               func(string) (net.Conn, error) { return ln.Dial() },
+		},
+	})
+	if err != nil {
+		t.Fatalf("new s3 storage: %v", err)
+	}
+
+	content := []byte("signed content")
+	staged, err := uploadHandler.storage.Stage("dir/a b.txt", bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("stage: %v", err)
+	}
+	if _, err := staged.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	obj, err := store.Stat("dir/a b.txt")
+	if err != nil || obj.Size != int64(len(content)) {
+		t.Fatalf("stat over s3 api: %+v %v", obj, err)
+	}
+	body, _, err := store.Open("dir/a b.txt")
+	if err != nil {
+		t.Fatalf("open over s3 api: %v", err)
+	}
+	got, err := io.ReadAll(body)
+	_ = body.Close()
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("read over s3 api: %q %v", got, err)
+	}
+	objects, err := store.List("dir/")
+	if err != nil || len(objects) != 1 || objects[0].Name != "dir/a b.txt" {
+		t.Fatalf("list over s3 api: %+v %v", objects, err)
+	}
+
+	// Parts are signed with their payload hash. Commit would write the
+	// checksum sidecar, a hidden key the S3 API refuses.
+	staged, err = store.Stage("big.bin", bytes.NewReader(bytes.Repeat([]byte("x"), 2500)))
+	if err != nil {
+		t.Fatalf("stage over s3 api: %v", err)
+	}
+	if err := staged.Discard(); err != nil {
+		t.Fatalf("discard over s3 api: %v", err)
+	}
+	if len(uploadHandler.multipart.sessions) != 0 {
+		t.Fatalf("aborted upload is still tracked: %d", len(uploadHandler.multipart.sessions))
+	}
+}
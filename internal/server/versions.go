@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/server/storage"
+
+	"github.com/valyala/fasthttp"
+)
+
+// uploadCondition reads the If-Match and If-None-Match headers of a write.
+// If-None-Match only supports "*", which creates a file but never replaces
+// it; If-Match takes one version, as an ETag or a bare id, or "*" for any.
+func uploadCondition(header *fasthttp.RequestHeader) (storage.Condition, error) {
+	ifMatch := strings.TrimSpace(string(header.Peek(fasthttp.HeaderIfMatch)))
+	ifNoneMatch := strings.TrimSpace(string(header.Peek(fasthttp.HeaderIfNoneMatch)))
+
+	var condition storage.Condition
+	switch {
+	case ifMatch != "" && ifNoneMatch != "":
+		return condition, &PreflightError{StatusCode: fasthttp.StatusBadRequest, Message: "If-Match and If-None-Match cannot be combined"}
+	case ifNoneMatch != "":
+		if ifNoneMatch != "*" {
+			return condition, &PreflightError{StatusCode: fasthttp.StatusBadRequest, Message: `If-None-Match only supports "*"`}
+		}
+		condition.IfNoneMatch = true
+	case ifMatch == "*":
+		condition.IfMatch = ifMatch
+	case ifMatch != "":
+		versionID := api.ParseETag(ifMatch)
+		if strings.Contains(ifMatch, ",") || storage.ValidateVersionID(versionID) != nil {
+			return condition, &PreflightError{
+				StatusCode: fasthttp.StatusBadRequest,
+				Message:    fmt.Sprintf("invalid If-Match %q: expected a single version id", ifMatch),
+			}
+		}
+		condition.IfMatch = versionID
+	}
+
+	return condition, nil
+}
+
+func (h *handlerConfig) handleListVersions(ctx *fasthttp.RequestCtx, name string) {
+	objects, err := h.storage.ListVersions(name)
+	if err != nil {
+		writeStorageError(ctx, err)
+		return
+	}
+
+	versions := make([]api.FileInfo, 0, len(objects))
+	for _, obj := range objects {
+		versions = append(versions, newFileInfo(obj))
+	}
+
+	writeJSON(ctx, fasthttp.StatusOK, api.FileVersionList{Status: api.StatusOK, Name: name, Versions: versions})
+}
+
+// handleRestoreFile makes a prior version current again by committing a copy
+// of it, so the version it replaces is kept like on any other upload.
+func (h *handlerConfig) handleRestoreFile(ctx *fasthttp.RequestCtx, name string) {
+	versionID := string(ctx.QueryArgs().Peek(api.RestoreQueryParam))
+	if versionID == "" {
+		writeJSONError(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("missing %s query parameter", api.RestoreQueryParam))
+		return
+	}
+	condition, err := uploadCondition(&ctx.Request.Header)
+	if err != nil {
+		writePreflightError(ctx, err)
+		return
+	}
+	if h.draining.Load() {
+		writeJSONErrorCode(ctx, fasthttp.StatusServiceUnavailable, api.CodeShuttingDown, "server is shutting down")
+		return
+	}
+
+	body, version, err := h.storage.OpenVersion(name, versionID)
+	if err != nil {
+		writeStorageError(ctx, err)
+		return
+	}
+	staged, err := h.storage.Stage(name, body)
+	_ = body.Close()
+	if err != nil {
+		writeStorageError(ctx, err)
+		return
+	}
+	defer func() {
+		if err := staged.Discard(); err != nil {
+			slog.Warn("discard restored version", "error", err)
+		}
+	}()
+	if version.SHA256 != "" && staged.Object().SHA256 != version.SHA256 {
+		writeStorageError(ctx, fmt.Errorf("%w: version %s of %q", storage.ErrChecksumMismatch, versionID, name))
+		return
+	}
+
+	staged.SetMetadata(version.Metadata)
+	staged.SetExpiresAt(version.ExpiresAt)
+	staged.SetCondition(condition)
+	stored, err := staged.Commit()
+	if err != nil {
+		writeStorageError(ctx, err)
+		return
+	}
+	slog.Info("file version restored", "name", name, "restored_version", versionID, "version", stored.VersionID)
+
+	setObjectHeaders(ctx, stored)
+	writeJSON(ctx, fasthttp.StatusOK, api.RestoreResult{Status: api.StatusOK, File: newFileInfo(stored)})
+}
+
+// checkConditions checks the condition of every staged file before any of
+// them is committed, so that a failed condition leaves none stored. Commit
+// checks again, atomically with the replacement.
+func (h *handlerConfig) checkConditions(files []*storage.Staged, condition storage.Condition) error {
+	for _, staged := range files {
+		if err := condition.Check(h.storage, staged.Object().Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
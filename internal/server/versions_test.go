@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/client/uploader"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestFileVersions(t *testing.T) {
+	_, client := newTestServer(t)
+	ctx := context.Background()
+	fileURL := "http://inmemory/files/a.bin"
+
+	localPath := filepath.Join(t.TempDir(), "a.bin")
+	upload := func(content string, condition uploader.Condition) error {
+		t.Helper()
+		if err := os.WriteFile(localPath, []byte(content), 0o600); err != nil {
+			t.Fatalf("write temp file: %v", err)
+		}
+		_, err := client.UploadFileContext(ctx, uploader.UploadRequest{URL: "http://inmemory/upload", FilePath: localPath, Condition: condition})
+		return err
+	}
+
+	if err := upload("first", uploader.Condition{IfNoneMatch: true}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	first, err := client.StatContext(ctx, fileURL)
+	if err != nil || first.VersionID == "" {
+		t.Fatalf("stat: %+v %v", first, err)
+	}
+	if err := upload("again", uploader.Condition{IfNoneMatch: true}); !errors.Is(err, uploader.ErrPreconditionFailed) {
+		t.Fatalf("create existing: got %v want %v", err, uploader.ErrPreconditionFailed)
+	}
+	if err := upload("second", uploader.Condition{IfMatch: first.VersionID}); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	if err := upload("lost", uploader.Condition{IfMatch: first.VersionID}); !errors.Is(err, uploader.ErrPreconditionFailed) {
+		t.Fatalf("replace stale version: got %v want %v", err, uploader.ErrPreconditionFailed)
+	}
+
+	versions, err := client.ListVersionsContext(ctx, fileURL)
+	if err != nil {
+		t.Fatalf("list versions: %v", err)
+	}
+	if len(versions) != 2 || versions[1].VersionID != first.VersionID || versions[0].SHA256 != sha256Hex([]byte("second")) {
+		t.Fatalf("unexpected versions: %+v", versions)
+	}
+
+	var buf bytes.Buffer
+	if _, err := client.DownloadContext(ctx, uploader.VersionURL(fileURL, first.VersionID), &buf); err != nil || buf.String() != "first" {
+		t.Fatalf("download first version: %q %v", buf.String(), err)
+	}
+
+	if _, err := client.RestoreContext(ctx, fileURL, first.VersionID, uploader.Condition{IfMatch: first.VersionID}); !errors.Is(err, uploader.ErrPreconditionFailed) {
+		t.Fatalf("restore over a stale version: got %v want %v", err, uploader.ErrPreconditionFailed)
+	}
+	restored, err := client.RestoreContext(ctx, fileURL, first.VersionID, uploader.Condition{IfMatch: versions[0].VersionID})
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if restored.VersionID == first.VersionID || restored.SHA256 != first.SHA256 {
+		t.Fatalf("unexpected restored file: %+v", restored)
+	}
+	buf.Reset()
+	if _, err := client.DownloadContext(ctx, fileURL, &buf); err != nil || buf.String() != "first" {
+		t.Fatalf("download restored file: %q %v", buf.String(), err)
+	}
+	if versions, err = client.ListVersionsContext(ctx, fileURL); err != nil || len(versions) != 3 {
+		t.Fatalf("restore did not keep the replaced version: %+v %v", versions, err)
+	}
+
+	if _, err := client.RestoreContext(ctx, fileURL, "00ff", uploader.Condition{}); !errors.Is(err, uploader.ErrNotFound) {
+		t.Fatalf("restore unknown version: got %v want %v", err, uploader.ErrNotFound)
+	}
+	if err := client.DeleteContext(ctx, fileURL); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := client.ListVersionsContext(ctx, fileURL); !errors.Is(err, uploader.ErrNotFound) {
+		t.Fatalf("versions after delete: got %v want %v", err, uploader.ErrNotFound)
+	}
+}
+
+func TestUploadCondition(t *testing.T) {
+	for _, tc := range []struct {
+		ifMatch, ifNoneMatch string
+		valid                bool
+	}{
+		{valid: true},
+		{ifNoneMatch: "*", valid: true},
+		{ifMatch: "*", valid: true},
+		{ifMatch: `"18dfbcb0eede1d2a74ee4c9a"`, valid: true},
+		{ifMatch: `W/"null"`, valid: true},
+		{ifNoneMatch: `"18dfbcb0eede1d2a74ee4c9a"`},
+		{ifMatch: `"a", "b"`},
+		{ifMatch: `"../x"`},
+		{ifMatch: "*", ifNoneMatch: "*"},
+	} {
+		var header fasthttp.RequestHeader
+		if tc.ifMatch != "" {
+			header.Set(fasthttp.HeaderIfMatch, tc.ifMatch)
+		}
+		if tc.ifNoneMatch != "" {
+			header.Set(fasthttp.HeaderIfNoneMatch, tc.ifNoneMatch)
+		}
+		if _, err := uploadCondition(&header); (err == nil) != tc.valid {
+			t.Fatalf("if-match %q if-none-match %q: got %v want valid %v", tc.ifMatch, tc.ifNoneMatch, err, tc.valid)
+		}
+	}
+}
+
+func TestMultipartCompleteCondition(t *testing.T) {
+	uploadHandler, client := newTestServer(t)
+	ctx := context.Background()
+
+	localPath := filepath.Join(t.TempDir(), "big.bin")
+	if err := os.WriteFile(localPath, bytes.Repeat([]byte("x"), 3000), 0o600); err != nil {
+		t.Fatalf("write temp file: %v", err)
+	}
+	request := uploader.MultipartUploadRequest{URL: "http://inmemory/uploads", FilePath: localPath, PartSize: 1024, Condition: uploader.Condition{IfNoneMatch: true}}
+	if _, err := client.UploadMultipartContext(ctx, request); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := client.UploadMultipartContext(ctx, request); !errors.Is(err, uploader.ErrPreconditionFailed) {
+		t.Fatalf("create existing: got %v want %v", err, uploader.ErrPreconditionFailed)
+	}
+	if len(uploadHandler.multipart.sessions) != 0 {
+		t.Fatalf("failed upload was not aborted: %d sessions left", len(uploadHandler.multipart.sessions))
+	}
+	if versions, err := uploadHandler.storage.ListVersions("big.bin"); err != nil || len(versions) != 1 {
+		t.Fatalf("unexpected versions: %+v %v", versions, err)
+	}
+	if code := api.CodeForStatus(fasthttp.StatusPreconditionFailed); code != api.CodePreconditionFailed {
+		t.Fatalf("unexpected code for 412: %q", code)
+	}
+}
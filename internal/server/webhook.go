@@ -0,0 +1,74 @@
+package server
+
+import (
+	"strconv"
+
+	"client-server-fasthttp-test/internal/api"
+	serverconfig "client-server-fasthttp-test/internal/server/config"
+	"client-server-fasthttp-test/internal/server/metrics"
+	"client-server-fasthttp-test/internal/server/webhook"
+
+	"github.com/bytedance/sonic"
+	"github.com/valyala/fasthttp"
+)
+
+const adminWebhooksPath = "/admin/webhooks"
+
+type webhooksResponse struct {
+	Pending    int                `json:"pending"`
+	Deliveries []webhook.Delivery `json:"deliveries"`
+}
+
+// newWebhookDispatcher returns the dispatcher of the configured webhooks, or
+// nil when there are none.
+func newWebhookDispatcher(cfg serverconfig.AppConfig, reg *metrics.Registry) (*webhook.Dispatcher, error) {
+	if len(cfg.WebhookURLs) == 0 {
+		return nil, nil
+	}
+
+	return webhook.New(webhook.Config{
+		Endpoints:   cfg.WebhookURLs,
+		Secret:      cfg.WebhookSecret,
+		OutboxDir:   cfg.WebhookOutboxDir,
+		MaxAttempts: cfg.WebhookMaxAttempts,
+		Timeout:     cfg.WebhookTimeout,
+		Backoff:     cfg.WebhookBackoff,
+		MaxBackoff:  cfg.WebhookMaxBackoff,
+	}, reg)
+}
+
+// uploadEvent returns an event of the POST /upload with the in-flight id.
+func uploadEvent(eventType string, id uint64, remote string) api.WebhookEvent {
+	return api.WebhookEvent{
+		Type:     eventType,
+		UploadID: strconv.FormatUint(id, 10),
+		Remote:   remote,
+	}
+}
+
+// multipartEvent returns an event of a multipart upload through either API.
+func multipartEvent(eventType string, session *multipartSession, remote string) api.WebhookEvent {
+	return api.WebhookEvent{
+		Type:     eventType,
+		UploadID: session.id,
+		Remote:   remote,
+		Name:     session.name,
+		Size:     session.size,
+	}
+}
+
+// failedUploadEvent returns the upload.failed event of an upload answered
+// with the error response in ctx.
+func failedUploadEvent(ctx *fasthttp.RequestCtx, event api.WebhookEvent) api.WebhookEvent {
+	event.Type = api.EventUploadFailed
+	var resp api.ErrorResponse
+	if err := sonic.Unmarshal(ctx.Response.Body(), &resp); err == nil {
+		event.Code = resp.Code
+		event.Reason = resp.Error
+	}
+	if event.Code == "" {
+		event.Code = api.CodeForStatus(ctx.Response.StatusCode())
+	}
+
+	return event
+}
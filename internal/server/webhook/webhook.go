@@ -0,0 +1,570 @@
+// Package webhook delivers the lifecycle events of the upload server to
+// configured HTTP endpoints. Every event is first written to an on-disk
+// outbox, so deliveries survive restarts, and retried with exponential
+// backoff until the endpoint accepts it or the attempts run out.
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	mrand "math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/server/metrics"
+
+	"github.com/bytedance/sonic"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	pendingDir = "pending"
+	failedDir  = "failed"
+	// LogFile is the delivery log in the outbox directory, one JSON
+	// Delivery per line. It is rotated to LogFile+".1" at maxLogSize.
+	LogFile    = "deliveries.log"
+	maxLogSize = 10 << 20
+	// recentDeliveries is how many deliveries Recent returns.
+	recentDeliveries = 100
+)
+
+// Results of a delivery attempt.
+const (
+	ResultDelivered = "delivered"
+	ResultRetry     = "retry"
+	ResultFailed    = "failed"
+)
+
+// Config configures a Dispatcher.
+type Config struct {
+	// Endpoints receive every event.
+	Endpoints []string
+	// Secret signs the requests, see api.HeaderWebhookSignature. Without
+	// one they are sent unsigned.
+	Secret string
+	// OutboxDir keeps the pending and the failed deliveries and the
+	// delivery log.
+	OutboxDir string
+	// MaxAttempts is how often a delivery is tried before it is moved to
+	// the failed directory of the outbox.
+	MaxAttempts int
+	// Timeout limits one attempt.
+	Timeout time.Duration
+	// Backoff is the wait after the first failed attempt. It doubles with
+	// every further one, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Client sends the requests; nil uses a default fasthttp.Client.
+	Client *fasthttp.Client
+}
+
+// Delivery is one attempt to deliver an event to an endpoint.
+type Delivery struct {
+	ID         string `json:"id"`
+	EventID    string `json:"event_id"`
+	Event      string `json:"event"`
+	Endpoint   string `json:"endpoint"`
+	Attempt    int    `json:"attempt"`
+	Result     string `json:"result"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Duration   string `json:"duration"`
+	At         string `json:"at"`
+}
+
+// entry is a pending delivery as stored in the outbox.
+type entry struct {
+	ID       string `json:"id"`
+	EventID  string `json:"event_id"`
+	Event    string `json:"event"`
+	Endpoint string `json:"endpoint"`
+	// Body is kept verbatim, so that every attempt sends, and signs, the
+	// same bytes.
+	Body        string    `json:"body"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+// queue holds the pending deliveries to one endpoint.
+type queue struct {
+	endpoint string
+	mu       sync.Mutex
+	entries  map[string]*entry
+	// wake is signalled when an entry is added.
+	wake chan struct{}
+}
+
+func (q *queue) add(e *entry) {
+	q.mu.Lock()
+	q.entries[e.ID] = e
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *queue) remove(id string) {
+	q.mu.Lock()
+	delete(q.entries, id)
+	q.mu.Unlock()
+}
+
+func (q *queue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.entries)
+}
+
+// next returns the entry due first if it is due at now, or how long to wait
+// for it.
+func (q *queue) next(now time.Time) (*entry, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var first *entry
+	for _, e := range q.entries {
+		if first == nil || e.NextAttempt.Before(first.NextAttempt) {
+			first = e
+		}
+	}
+	switch {
+	case first == nil:
+		return nil, time.Hour
+	case first.NextAttempt.After(now):
+		return nil, first.NextAttempt.Sub(now)
+	}
+
+	return first, 0
+}
+
+// Dispatcher publishes events to the configured endpoints. A nil
+// *Dispatcher discards them.
+type Dispatcher struct {
+	cfg    Config
+	client *fasthttp.Client
+	queues []*queue
+	now    func() time.Time
+
+	mu     sync.Mutex
+	secret []byte
+	// recent are the last deliveries, oldest first.
+	recent []Delivery
+
+	deliveries *metrics.Counter
+}
+
+// New returns a Dispatcher for cfg and loads the deliveries left pending in
+// its outbox. Deliveries to endpoints no longer configured are moved to the
+// failed directory.
+func New(cfg Config, reg *metrics.Registry) (*Dispatcher, error) {
+	switch {
+	case len(cfg.Endpoints) == 0:
+		return nil, errors.New("no webhook endpoints configured")
+	case cfg.OutboxDir == "":
+		return nil, errors.New("webhook outbox directory is not set")
+	case cfg.MaxAttempts < 1:
+		return nil, errors.New("webhook max attempts must be positive")
+	case cfg.Timeout <= 0 || cfg.Backoff <= 0 || cfg.MaxBackoff <= 0:
+		return nil, errors.New("webhook timeout and backoff must be positive")
+	}
+	for _, dir := range []string{pendingDir, failedDir} {
+		if err := os.MkdirAll(filepath.Join(cfg.OutboxDir, dir), 0o755); err != nil {
+			return nil, fmt.Errorf("create webhook outbox: %w", err)
+		}
+	}
+
+	d := &Dispatcher{
+		cfg:    cfg,
+		client: cfg.Client,
+		now:    time.Now,
+		secret: []byte(cfg.Secret),
+		deliveries: reg.Counter("upload_server_webhook_deliveries_total",
+			"Webhook delivery attempts by result.", "result"),
+	}
+	if d.client == nil {
+		d.client = &fasthttp.Client{}
+	}
+	byEndpoint := make(map[string]*queue, len(cfg.Endpoints))
+	for _, endpoint := range cfg.Endpoints {
+		if byEndpoint[endpoint] != nil {
+			continue
+		}
+		q := &queue{endpoint: endpoint, entries: make(map[string]*entry), wake: make(chan struct{}, 1)}
+		byEndpoint[endpoint] = q
+		d.queues = append(d.queues, q)
+	}
+
+	if err := d.load(byEndpoint); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *Dispatcher) load(byEndpoint map[string]*queue) error {
+	dir := filepath.Join(d.cfg.OutboxDir, pendingDir)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("read webhook outbox: %w", err)
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+		if !strings.HasSuffix(file.Name(), ".json") {
+			// A temp file of a write that was interrupted.
+			_ = os.Remove(path)
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read webhook delivery: %w", err)
+		}
+		var e entry
+		if err := sonic.Unmarshal(data, &e); err != nil {
+			slog.Warn("skip malformed webhook delivery", "path", path, "error", err)
+			continue
+		}
+		q := byEndpoint[e.Endpoint]
+		if q == nil {
+			slog.Warn("webhook endpoint no longer configured", "endpoint", e.Endpoint, "delivery", e.ID)
+			d.fail(&e)
+			continue
+		}
+		q.entries[e.ID] = &e
+	}
+
+	return nil
+}
+
+// SetSecret replaces the key requests are signed with.
+func (d *Dispatcher) SetSecret(secret string) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	d.secret = []byte(secret)
+	d.mu.Unlock()
+}
+
+func (d *Dispatcher) key() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.secret
+}
+
+// Publish queues event for every endpoint. ID and Time are filled in when
+// empty. The deliveries are on disk when Publish returns.
+func (d *Dispatcher) Publish(event api.WebhookEvent) {
+	if d == nil {
+		return
+	}
+
+	if event.ID == "" {
+		raw := make([]byte, 16)
+		if _, err := rand.Read(raw); err != nil {
+			slog.Error("generate webhook event id", "error", err)
+			return
+		}
+		event.ID = hex.EncodeToString(raw)
+	}
+	now := d.now()
+	if event.Time == "" {
+		event.Time = now.UTC().Format(time.RFC3339Nano)
+	}
+	body, err := sonic.Marshal(event)
+	if err != nil {
+		slog.Error("encode webhook event", "event", event.Type, "error", err)
+		return
+	}
+
+	for i, q := range d.queues {
+		e := &entry{
+			ID:          event.ID + "-" + strconv.Itoa(i),
+			EventID:     event.ID,
+			Event:       event.Type,
+			Endpoint:    q.endpoint,
+			Body:        string(body),
+			NextAttempt: now,
+		}
+		if err := d.store(e); err != nil {
+			slog.Error("store webhook delivery", "event", event.Type, "endpoint", q.endpoint, "error", err)
+			continue
+		}
+		q.add(e)
+	}
+}
+
+// Pending returns the number of deliveries not yet made.
+func (d *Dispatcher) Pending() int {
+	if d == nil {
+		return 0
+	}
+
+	pending := 0
+	for _, q := range d.queues {
+		pending += q.len()
+	}
+
+	return pending
+}
+
+// Recent returns the last delivery attempts, newest first.
+func (d *Dispatcher) Recent() []Delivery {
+	if d == nil {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	recent := make([]Delivery, len(d.recent))
+	for i, delivery := range d.recent {
+		recent[len(recent)-1-i] = delivery
+	}
+
+	return recent
+}
+
+// Run delivers the queued events until ctx is done, one endpoint at a time
+// per goroutine.
+func (d *Dispatcher) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, q := range d.queues {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.run(ctx, q)
+		}()
+	}
+	wg.Wait()
+}
+
+func (d *Dispatcher) run(ctx context.Context, q *queue) {
+	for ctx.Err() == nil {
+		e, wait := q.next(d.now())
+		if e != nil {
+			d.attempt(q, e)
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+		case <-q.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// attempt sends e once and retries, removes or fails it depending on the
+// outcome.
+func (d *Dispatcher) attempt(q *queue, e *entry) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	start := d.now()
+	timestamp := strconv.FormatInt(start.Unix(), 10)
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.SetRequestURI(e.Endpoint)
+	req.Header.SetContentType("application/json")
+	req.Header.Set(api.HeaderWebhookID, e.EventID)
+	req.Header.Set(api.HeaderWebhookEvent, e.Event)
+	req.Header.Set(api.HeaderWebhookTimestamp, timestamp)
+	if secret := d.key(); len(secret) > 0 {
+		req.Header.Set(api.HeaderWebhookSignature, Sign(secret, timestamp, []byte(e.Body)))
+	}
+	req.SetBodyString(e.Body)
+
+	err := d.client.DoTimeout(req, resp, d.cfg.Timeout)
+	e.Attempts++
+	delivery := Delivery{
+		ID:       e.ID,
+		EventID:  e.EventID,
+		Event:    e.Event,
+		Endpoint: e.Endpoint,
+		Attempt:  e.Attempts,
+		Duration: time.Since(start).Round(time.Millisecond).String(),
+		At:       start.UTC().Format(time.RFC3339),
+	}
+	if err == nil {
+		delivery.StatusCode = resp.StatusCode()
+		if delivery.StatusCode < 200 || delivery.StatusCode > 299 {
+			err = fmt.Errorf("endpoint answered with status %d", delivery.StatusCode)
+		}
+	}
+
+	switch {
+	case err == nil:
+		delivery.Result = ResultDelivered
+		if err := os.Remove(d.pendingPath(e.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("remove delivered webhook", "delivery", e.ID, "error", err)
+		}
+	case e.Attempts >= d.cfg.MaxAttempts:
+		delivery.Result = ResultFailed
+		d.fail(e)
+	default:
+		delivery.Result = ResultRetry
+		q.mu.Lock()
+		e.NextAttempt = d.now().Add(d.backoff(e.Attempts))
+		q.mu.Unlock()
+		if err := d.store(e); err != nil {
+			slog.Warn("store webhook delivery", "delivery", e.ID, "error", err)
+		}
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	d.record(delivery)
+	// Removed last, so that a delivery is pending until it is logged.
+	if delivery.Result != ResultRetry {
+		q.remove(e.ID)
+	}
+}
+
+// backoff returns the wait after the given number of failed attempts, with
+// up to a tenth of jitter so that retries of many deliveries spread out.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	wait := d.cfg.MaxBackoff
+	if attempts <= 30 {
+		if doubled := d.cfg.Backoff << (attempts - 1); doubled > 0 && doubled < wait {
+			wait = doubled
+		}
+	}
+
+	return wait + mrand.N(wait/10+1)
+}
+
+func (d *Dispatcher) pendingPath(id string) string {
+	return filepath.Join(d.cfg.OutboxDir, pendingDir, id+".json")
+}
+
+// store writes e to the pending directory, replacing it atomically.
+func (d *Dispatcher) store(e *entry) error {
+	data, err := sonic.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encode webhook delivery: %w", err)
+	}
+
+	path := d.pendingPath(e.ID)
+	tmp, err := os.CreateTemp(filepath.Dir(path), e.ID+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create webhook delivery: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write webhook delivery: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync webhook delivery: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close webhook delivery: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("commit webhook delivery: %w", err)
+	}
+
+	return nil
+}
+
+// fail moves e to the failed directory, where it stays for inspection.
+func (d *Dispatcher) fail(e *entry) {
+	path := d.pendingPath(e.ID)
+	failed := filepath.Join(d.cfg.OutboxDir, failedDir, e.ID+".json")
+	err := d.store(e)
+	if err == nil {
+		err = os.Rename(path, failed)
+	}
+	if err != nil {
+		slog.Warn("move failed webhook delivery", "delivery", e.ID, "error", err)
+	}
+}
+
+// record adds delivery to the delivery log.
+func (d *Dispatcher) record(delivery Delivery) {
+	d.deliveries.Inc(delivery.Result)
+	attrs := []any{
+		"delivery", delivery.ID,
+		"event", delivery.Event,
+		"endpoint", delivery.Endpoint,
+		"attempt", delivery.Attempt,
+	}
+	switch delivery.Result {
+	case ResultDelivered:
+		slog.Info("webhook delivered", attrs...)
+	case ResultRetry:
+		slog.Warn("webhook delivery failed, will retry", append(attrs, "error", delivery.Error)...)
+	default:
+		slog.Error("webhook delivery failed", append(attrs, "error", delivery.Error)...)
+	}
+
+	line, err := sonic.Marshal(delivery)
+	if err != nil {
+		slog.Warn("encode webhook delivery log", "error", err)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.recent = append(d.recent, delivery)
+	if len(d.recent) > recentDeliveries {
+		d.recent = append(d.recent[:0], d.recent[len(d.recent)-recentDeliveries:]...)
+	}
+	if err := d.appendLog(append(line, '\n')); err != nil {
+		slog.Warn("write webhook delivery log", "error", err)
+	}
+}
+
+// appendLog appends line to the delivery log. d.mu must be held.
+func (d *Dispatcher) appendLog(line []byte) error {
+	path := filepath.Join(d.cfg.OutboxDir, LogFile)
+	if info, err := os.Stat(path); err == nil && info.Size()+int64(len(line)) > maxLogSize {
+		if err := os.Rename(path, path+".1"); err != nil {
+			return fmt.Errorf("rotate: %w", err)
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// Sign returns the signature of a request with timestamp and body, see
+// api.HeaderWebhookSignature.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,226 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/server/metrics"
+
+	"github.com/bytedance/sonic"
+)
+
+const testSecret = "webhook-secret"
+
+// receiver is a webhook endpoint that answers the first failures requests
+// with 500 and records every request it accepts.
+type receiver struct {
+	t        *testing.T
+	mu       sync.Mutex
+	failures int
+	attempts int
+	events   []api.WebhookEvent
+	received chan struct{}
+}
+
+func newReceiver(t *testing.T, failures int) (*receiver, string) {
+	r := &receiver{t: t, failures: failures, received: make(chan struct{}, 16)}
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	return r, server.URL + "/hook"
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		r.t.Errorf("read webhook body: %v", err)
+		return
+	}
+	timestamp := req.Header.Get(api.HeaderWebhookTimestamp)
+	if got, want := req.Header.Get(api.HeaderWebhookSignature), Sign([]byte(testSecret), timestamp, body); got != want {
+		r.t.Errorf("unexpected signature: got %q want %q", got, want)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.attempts++
+	if r.attempts <= r.failures {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var event api.WebhookEvent
+	if err := sonic.Unmarshal(body, &event); err != nil {
+		r.t.Errorf("decode webhook event: %v", err)
+	}
+	if got := req.Header.Get(api.HeaderWebhookID); got != event.ID {
+		r.t.Errorf("unexpected event id header: got %q want %q", got, event.ID)
+	}
+	if got := req.Header.Get(api.HeaderWebhookEvent); got != event.Type {
+		r.t.Errorf("unexpected event header: got %q want %q", got, event.Type)
+	}
+	r.events = append(r.events, event)
+	w.WriteHeader(http.StatusNoContent)
+	r.received <- struct{}{}
+}
+
+func (r *receiver) wait(t *testing.T) {
+	t.Helper()
+
+	select {
+	case <-r.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+}
+
+func testConfig(dir string, endpoints ...string) Config {
+	return Config{
+		Endpoints:   endpoints,
+		Secret:      testSecret,
+		OutboxDir:   dir,
+		MaxAttempts: 3,
+		Timeout:     time.Second,
+		Backoff:     10 * time.Millisecond,
+		MaxBackoff:  50 * time.Millisecond,
+	}
+}
+
+func runDispatcher(t *testing.T, d *Dispatcher) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func pendingFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatalf("list outbox: %v", err)
+	}
+
+	return names
+}
+
+func TestDispatcherRetriesUntilDelivered(t *testing.T) {
+	recv, endpoint := newReceiver(t, 2)
+	dir := t.TempDir()
+	reg := metrics.NewRegistry()
+	d, err := New(testConfig(dir, endpoint), reg)
+	if err != nil {
+		t.Fatalf("new dispatcher: %v", err)
+	}
+	runDispatcher(t, d)
+
+	d.Publish(api.WebhookEvent{Type: api.EventUploadCompleted, Name: "a.bin", Size: 3, SHA256: "abc"})
+	recv.wait(t)
+
+	recv.mu.Lock()
+	event := recv.events[0]
+	recv.mu.Unlock()
+	if event.ID == "" || event.Time == "" || event.Name != "a.bin" || event.SHA256 != "abc" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for d.Pending() > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if files := pendingFiles(t, filepath.Join(dir, pendingDir)); len(files) != 0 {
+		t.Fatalf("delivered event left in the outbox: %v", files)
+	}
+	recent := d.Recent()
+	if len(recent) != 3 || recent[0].Result != ResultDelivered || recent[0].Attempt != 3 || recent[1].Result != ResultRetry {
+		t.Fatalf("unexpected deliveries: %+v", recent)
+	}
+	if got := reg.Counter("upload_server_webhook_deliveries_total", "", "result").Value(ResultRetry); got != 2 {
+		t.Fatalf("unexpected retry count: got %v want %v", got, 2)
+	}
+	log, err := os.ReadFile(filepath.Join(dir, LogFile))
+	if err != nil {
+		t.Fatalf("read delivery log: %v", err)
+	}
+	if lines := strings.Count(string(log), "\n"); lines != 3 {
+		t.Fatalf("unexpected delivery log lines: got %v want %v", lines, 3)
+	}
+}
+
+func TestDispatcherKeepsOutboxAcrossRestarts(t *testing.T) {
+	recv, endpoint := newReceiver(t, 0)
+	dir := t.TempDir()
+
+	// Published but never run, as if the server stopped right away.
+	stopped, err := New(testConfig(dir, endpoint), metrics.NewRegistry())
+	if err != nil {
+		t.Fatalf("new dispatcher: %v", err)
+	}
+	stopped.Publish(api.WebhookEvent{ID: "evt-1", Type: api.EventFileDeleted, Name: "a.bin"})
+	if files := pendingFiles(t, filepath.Join(dir, pendingDir)); len(files) != 1 {
+		t.Fatalf("unexpected outbox: %v", files)
+	}
+
+	d, err := New(testConfig(dir, endpoint), metrics.NewRegistry())
+	if err != nil {
+		t.Fatalf("new dispatcher: %v", err)
+	}
+	if d.Pending() != 1 {
+		t.Fatalf("unexpected pending deliveries: got %v want %v", d.Pending(), 1)
+	}
+	runDispatcher(t, d)
+	recv.wait(t)
+
+	recv.mu.Lock()
+	defer recv.mu.Unlock()
+	if len(recv.events) != 1 || recv.events[0].ID != "evt-1" || recv.events[0].Type != api.EventFileDeleted {
+		t.Fatalf("unexpected events: %+v", recv.events)
+	}
+}
+
+func TestDispatcherGivesUpAfterMaxAttempts(t *testing.T) {
+	recv, endpoint := newReceiver(t, 100)
+	dir := t.TempDir()
+	d, err := New(testConfig(dir, endpoint), metrics.NewRegistry())
+	if err != nil {
+		t.Fatalf("new dispatcher: %v", err)
+	}
+	runDispatcher(t, d)
+
+	d.Publish(api.WebhookEvent{Type: api.EventUploadFailed, Code: api.CodeCancelled})
+	deadline := time.Now().Add(5 * time.Second)
+	for d.Pending() > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if files := pendingFiles(t, filepath.Join(dir, failedDir)); len(files) != 1 {
+		t.Fatalf("unexpected failed deliveries: %v", files)
+	}
+	if files := pendingFiles(t, filepath.Join(dir, pendingDir)); len(files) != 0 {
+		t.Fatalf("failed delivery left pending: %v", files)
+	}
+	recv.mu.Lock()
+	attempts := recv.attempts
+	recv.mu.Unlock()
+	if attempts != 3 {
+		t.Fatalf("unexpected attempts: got %v want %v", attempts, 3)
+	}
+	if recent := d.Recent(); len(recent) != 3 || recent[0].Result != ResultFailed || recent[0].StatusCode != http.StatusInternalServerError {
+		t.Fatalf("unexpected deliveries: %+v", recent)
+	}
+}
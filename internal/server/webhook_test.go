@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"client-server-fasthttp-test/internal/api"
+	"client-server-fasthttp-test/internal/server/metrics"
+	"client-server-fasthttp-test/internal/server/webhook"
+
+	"github.com/bytedance/sonic"
+	"github.com/valyala/fasthttp"
+)
+
+func TestUploadWebhooks(t *testing.T) {
+	events := make(chan api.WebhookEvent, 16)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var event api.WebhookEvent
+		if err := sonic.Unmarshal(body, &event); err != nil {
+			t.Errorf("decode webhook event: %v", err)
+		}
+		events <- event
+	}))
+	t.Cleanup(receiver.Close)
+
+	uploadHandler, _ := newTestServer(t)
+	dispatcher, err := webhook.New(webhook.Config{
+		Endpoints:   []string{receiver.URL},
+		OutboxDir:   t.TempDir(),
+		MaxAttempts: 3,
+		Timeout:     time.Second,
+		Backoff:     10 * time.Millisecond,
+		MaxBackoff:  10 * time.Millisecond,
+	}, metrics.NewRegistry())
+	if err != nil {
+		t.Fatalf("new dispatcher: %v", err)
+	}
+	uploadHandler.webhooks = dispatcher
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go dispatcher.Run(ctx)
+
+	upload := func(checksum string) *fasthttp.RequestCtx {
+		var ctx fasthttp.RequestCtx
+		body := "--b\r\n" +
+			"Content-Disposition: form-data; name=\"file\"; filename=\"a.bin\"\r\n\r\n" +
+			"payload\r\n"
+		if checksum != "" {
+			body += "--b\r\n" +
+				"Content-Disposition: form-data; name=\"" + api.ChecksumFieldSHA256 + "\"\r\n\r\n" +
+				checksum + "\r\n"
+		}
+		body += "--b--\r\n"
+		ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+		ctx.Request.SetRequestURI("/upload")
+		ctx.Request.Header.SetContentType("multipart/form-data; boundary=b")
+		ctx.Request.SetBodyString(body)
+		ctx.Request.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+testAuthToken)
+		uploadHandler.handler(&ctx)
+		return &ctx
+	}
+	if resp := upload("deadbeef"); resp.Response.StatusCode() != fasthttp.StatusUnprocessableEntity {
+		t.Fatalf("unexpected status: got %d want %d", resp.Response.StatusCode(), fasthttp.StatusUnprocessableEntity)
+	}
+	if resp := upload(""); resp.Response.StatusCode() != fasthttp.StatusCreated {
+		t.Fatalf("unexpected status: got %d want %d: %s", resp.Response.StatusCode(), fasthttp.StatusCreated, resp.Response.Body())
+	}
+	var del fasthttp.RequestCtx
+	del.Request.Header.SetMethod(fasthttp.MethodDelete)
+	del.Request.SetRequestURI("/files/a.bin")
+	del.Request.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+testAuthToken)
+	uploadHandler.handler(&del)
+	if del.Response.StatusCode() != fasthttp.StatusNoContent {
+		t.Fatalf("unexpected delete status: got %d want %d", del.Response.StatusCode(), fasthttp.StatusNoContent)
+	}
+
+	byType := make(map[string][]api.WebhookEvent)
+	for range 5 {
+		select {
+		case event := <-events:
+			byType[event.Type] = append(byType[event.Type], event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("missing webhook events, got %+v", byType)
+		}
+	}
+
+	if len(byType[api.EventUploadStarted]) != 2 {
+		t.Fatalf("unexpected started events: %+v", byType[api.EventUploadStarted])
+	}
+	failed := byType[api.EventUploadFailed]
+	if len(failed) != 1 || failed[0].Code != api.CodeChecksumMismatch || failed[0].Reason != "checksum mismatch" {
+		t.Fatalf("unexpected failed events: %+v", failed)
+	}
+	completed := byType[api.EventUploadCompleted]
+	if len(completed) != 1 || len(completed[0].Files) != 1 || completed[0].Files[0].Name != "a.bin" ||
+		completed[0].Size != int64(len("payload")) || completed[0].SHA256 != sha256Hex([]byte("payload")) {
+		t.Fatalf("unexpected completed events: %+v", completed)
+	}
+	if completed[0].UploadID == failed[0].UploadID {
+		t.Fatalf("uploads share the id %q", completed[0].UploadID)
+	}
+	if deleted := byType[api.EventFileDeleted]; len(deleted) != 1 || deleted[0].Name != "a.bin" {
+		t.Fatalf("unexpected deleted events: %+v", deleted)
+	}
+}